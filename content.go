@@ -0,0 +1,59 @@
+package tally
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gyokuro/tally/proto"
+	"io"
+)
+
+// Blob of content opened for reading, e.g. a photo.  Reads can seek, to serve ranges.
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+
+	Mime() string
+	Size() int64
+}
+
+// Store of content blobs by the hex SHA-256 of their data, so that identical blobs are stored
+// once.  Events keep only a reference to the content stored out of line.
+type ContentStore interface {
+
+	// Stores the data, unless already stored.  Returns its hash.
+	Put(mime string, data []byte) (string, error)
+
+	// Opens the blob of the hash.  Returns ErrorNotFound if not stored, and ErrorBadParam if the
+	// hash is not a hex SHA-256.  The blob must be closed.
+	Open(hash string) (Blob, error)
+
+	// Performs any necessary clean up
+	Close()
+}
+
+// Returns the hex SHA-256 of the data, by which it is stored.
+func ContentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns true if the hash is a hex SHA-256 in lower case, as returned by ContentHash.
+func ValidContentHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the size of the content in bytes, whether inline or stored out of line.
+func ContentSize(content *Tally.Content) int64 {
+	if content.Hash != nil {
+		return content.GetSize()
+	}
+	return int64(len(content.Data))
+}
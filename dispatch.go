@@ -0,0 +1,135 @@
+package tally
+
+import (
+	"time"
+)
+
+// States of a rider's pickup request.  A pending pickup is matched to a cab and an offer is
+// sent to the cab.  If the cab declines or does not reply in time, the pickup goes back to
+// pending and the cab is excluded from further matching for this pickup.
+type PickupState string
+
+const (
+	PickupPending   PickupState = "pending"   // waiting to be matched to a cab
+	PickupOffered   PickupState = "offered"   // offer sent to a cab, waiting for the reply
+	PickupAssigned  PickupState = "assigned"  // cab accepted the offer
+	PickupCancelled PickupState = "cancelled" // cancelled by the rider
+	PickupExpired   PickupState = "expired"   // no cab accepted within the request timeout
+)
+
+// States of an offer sent to a cab.
+type OfferState string
+
+const (
+	OfferPending   OfferState = "offered"
+	OfferAccepted  OfferState = "accepted"
+	OfferDeclined  OfferState = "declined"
+	OfferTimedOut  OfferState = "timedout"
+	OfferCancelled OfferState = "cancelled"
+)
+
+// Strategy for matching pending pickups to available cabs.
+type MatchStrategy int
+
+const (
+	// Repeatedly assigns the closest pair of pickup and cab.
+	MatchGreedy MatchStrategy = iota
+
+	// Minimizes the total pickup distance of all requests in the window (Hungarian algorithm).
+	MatchOptimal
+)
+
+// A rider's request to be picked up at a location.
+type Pickup struct {
+	Id       Id          `json:"id"`
+	Rider    string      `json:"rider"`
+	Location Location    `json:"location"`
+	State    PickupState `json:"state"`
+	Cab      Id          `json:"cab,omitempty"`   // cab offered or assigned
+	Offer    Id          `json:"offer,omitempty"` // current offer
+	Declined []Id        `json:"declined,omitempty"`
+	Created  time.Time   `json:"created"`
+}
+
+// An offer of a pickup to a cab.  The cab must accept or decline before the offer expires.
+type Offer struct {
+	Id       Id         `json:"id"`
+	Pickup   Id         `json:"pickup"`
+	Cab      Id         `json:"cab"`
+	Location Location   `json:"location"` // pickup location
+	Distance float64    `json:"distance"` // meters from the cab to the pickup location
+	State    OfferState `json:"state"`
+	Created  time.Time  `json:"created"`
+	Expires  time.Time  `json:"expires"`
+}
+
+// Settings for the dispatch service.
+type DispatchConfig struct {
+	Strategy MatchStrategy
+
+	// Search radius in meters for candidate cabs, and the max number of candidates per pickup.
+	Radius     float64
+	Candidates int
+
+	// Pending pickups are collected for this long and matched together.
+	Window time.Duration
+
+	// How long a cab has to reply to an offer.
+	OfferTimeout time.Duration
+
+	// How long a pickup can stay unassigned before it expires.
+	RequestTimeout time.Duration
+
+	// How long assigned, cancelled and expired pickups and their offers are kept after they
+	// are closed, so riders and cabs can see the outcome.
+	Retention time.Duration
+}
+
+// Sanitizes the dispatch config, filling in defaults for values not set.
+func SanitizeDispatch(c *DispatchConfig) *DispatchConfig {
+	if c.Radius == 0 {
+		c.Radius = 2000.
+	}
+	if c.Candidates == 0 {
+		c.Candidates = 8
+	}
+	if c.Window == 0 {
+		c.Window = 2 * time.Second
+	}
+	if c.OfferTimeout == 0 {
+		c.OfferTimeout = 15 * time.Second
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = 5 * time.Minute
+	}
+	if c.Retention == 0 {
+		c.Retention = c.RequestTimeout
+	}
+	return c
+}
+
+// Service interface for matching riders to cabs.  Invalid state transitions, e.g. accepting
+// an offer that has timed out, return ErrorInvalidState.
+type DispatchService interface {
+
+	// Submits a pickup request.  Returns the pickup with the id assigned.
+	Request(pickup Pickup) (Pickup, error)
+
+	// Loads a pickup by id.  If not found, ErrorNotFound is returned.
+	Pickup(id Id) (Pickup, error)
+
+	// Cancels a pickup.  An assigned cab is made available again.
+	Cancel(id Id) (Pickup, error)
+
+	// Lists the offers waiting for the cab's reply.
+	Offers(cab Id) ([]Offer, error)
+
+	// Accepts an offer.  The pickup is assigned to the cab.
+	Accept(offer Id) (Offer, error)
+
+	// Declines an offer.  The pickup is matched again to other cabs.
+	Decline(offer Id) (Offer, error)
+
+	// Performs any necessary clean up
+	Close()
+}
@@ -0,0 +1,76 @@
+package tally
+
+import (
+	"github.com/gyokuro/tally/geo"
+)
+
+// Tariff for computing the fare of a ride.  The metered fare is the base fare plus the distance
+// and time rates.  Time spent moving slower than the waiting speed is charged at the waiting
+// rate instead of the per minute rate.  Surcharges apply by the local time of the pick up, and
+// a zone rate replaces the metered fare for rides between its zones, e.g. to the airport.
+type Tariff struct {
+	Currency string `json:"currency"`
+
+	BaseFare    float64      `json:"baseFare"`
+	MinimumFare float64      `json:"minimumFare"`
+	PerDistance float64      `json:"perDistance"` // per unit of distance
+	Unit        DistanceUnit `json:"unit"`
+	Model       geo.Model    `json:"model"` // of the earth for metering the track
+	PerMinute   float64      `json:"perMinute"`
+
+	// Speed in units of distance per hour, below which the time is charged as waiting.
+	WaitingSpeed     float64 `json:"waitingSpeed"`
+	WaitingPerMinute float64 `json:"waitingPerMinute"`
+
+	// IANA time zone for the time of day surcharges, e.g. America/New_York.  Defaults to UTC.
+	TimeZone   string      `json:"timeZone"`
+	Surcharges []Surcharge `json:"surcharges"`
+	Zones      []ZoneRate  `json:"zones"`
+}
+
+// Surcharge for rides picked up between the local times of day, in HH:MM.  The time range may
+// wrap around midnight, e.g. 20:00 to 06:00.  Either multiplies the fare before surcharges or
+// adds a flat amount.
+type Surcharge struct {
+	Name       string  `json:"name"`
+	From       string  `json:"from"`
+	To         string  `json:"to"`
+	Multiplier float64 `json:"multiplier"`
+	Flat       float64 `json:"flat"`
+}
+
+// Flat rate for rides picked up within the pickup polygon and dropped off within the dropoff
+// polygon.  An empty polygon matches anywhere.
+type ZoneRate struct {
+	Name    string     `json:"name"`
+	Pickup  []Location `json:"pickup"`
+	Dropoff []Location `json:"dropoff"`
+	Fare    float64    `json:"fare"`
+}
+
+// A line of a receipt, e.g. 3.2 km at 1.50 per km.
+type FareItem struct {
+	Name     string  `json:"name"`
+	Quantity float64 `json:"quantity,omitempty"`
+	Rate     float64 `json:"rate,omitempty"`
+	Amount   float64 `json:"amount"`
+}
+
+// Itemized fare of a ride.  Distance is in the tariff's unit, and times are in minutes.
+type Receipt struct {
+	Ride     Id         `json:"ride"`
+	Currency string     `json:"currency"`
+	Distance float64    `json:"distance"`
+	Minutes  float64    `json:"minutes"`
+	Waiting  float64    `json:"waiting"`
+	Items    []FareItem `json:"items"`
+	Total    float64    `json:"total"`
+}
+
+// Computes the fares of rides.
+type FareCalculator interface {
+
+	// Computes the fare of a completed ride from its track.  If the ride is not completed,
+	// ErrorInvalidState is returned.
+	Fare(ride Ride) (Receipt, error)
+}
@@ -0,0 +1,53 @@
+package geo
+
+import (
+	"math"
+)
+
+// Returns the angle normalized to [0, 360).
+func normalizeBearing(deg float64) float64 {
+	return math.Mod(math.Mod(deg, 360.)+360., 360.)
+}
+
+// Returns the longitude normalized to [-180, 180].
+func normalizeLongitude(lon float64) float64 {
+	return math.Remainder(lon, 360.)
+}
+
+// Returns the initial bearing in degrees clockwise from north, in [0, 360), of the great circle
+// from the first point to the second.  The bearing changes along the way, except on meridians
+// and the equator.
+func Bearing(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, phi2 := lat1*toRadians, lat2*toRadians
+	dlon := (lon2 - lon1) * toRadians
+	y := math.Sin(dlon) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dlon)
+	return normalizeBearing(math.Atan2(y, x) / toRadians)
+}
+
+// Returns the bearing of the great circle on arrival at the second point.
+func FinalBearing(lat1, lon1, lat2, lon2 float64) float64 {
+	return normalizeBearing(Bearing(lat2, lon2, lat1, lon1) + 180.)
+}
+
+// Returns the point reached by following the great circle from the start for the distance in
+// meters, on the initial bearing.
+func Destination(lat, lon, bearing, distance float64) (float64, float64) {
+	phi1, lambda1 := lat*toRadians, lon*toRadians
+	theta, delta := bearing*toRadians, distance/EarthRadius
+	sinPhi2 := math.Sin(phi1)*math.Cos(delta) + math.Cos(phi1)*math.Sin(delta)*math.Cos(theta)
+	phi2 := math.Asin(sinPhi2)
+	lambda2 := lambda1 + math.Atan2(math.Sin(theta)*math.Sin(delta)*math.Cos(phi1),
+		math.Cos(delta)-math.Sin(phi1)*sinPhi2)
+	return phi2 / toRadians, normalizeLongitude(lambda2 / toRadians)
+}
+
+// Returns the point halfway along the great circle between two points.
+func Midpoint(lat1, lon1, lat2, lon2 float64) (float64, float64) {
+	phi1, phi2 := lat1*toRadians, lat2*toRadians
+	dlon := (lon2 - lon1) * toRadians
+	bx, by := math.Cos(phi2)*math.Cos(dlon), math.Cos(phi2)*math.Sin(dlon)
+	phi := math.Atan2(math.Sin(phi1)+math.Sin(phi2), math.Hypot(math.Cos(phi1)+bx, by))
+	lambda := lon1*toRadians + math.Atan2(by, math.Cos(phi1)+bx)
+	return phi / toRadians, normalizeLongitude(lambda / toRadians)
+}
@@ -0,0 +1,120 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func near(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestBearing(test *testing.T) {
+	for _, c := range []struct {
+		lat1, lon1, lat2, lon2 float64
+		initial, final         float64
+	}{
+		{0, 0, 1, 0, 0, 0},
+		{0, 0, 0, 1, 90, 90},
+		{0, 0, -1, 0, 180, 180},
+		{0, 1, 0, 0, 270, 270},
+		{0, 179.5, 0, -179.5, 90, 90}, // east, across the antimeridian
+		// Great circle from Baghdad to Osaka heads north of east and arrives south of east
+		{35, 45, 35, 135, 60.16, 119.84},
+	} {
+		if b := Bearing(c.lat1, c.lon1, c.lat2, c.lon2); !near(b, c.initial, 0.01) {
+			test.Error("Expecting initial bearing", c.initial, "got", b, c)
+		}
+		if b := FinalBearing(c.lat1, c.lon1, c.lat2, c.lon2); !near(b, c.final, 0.01) {
+			test.Error("Expecting final bearing", c.final, "got", b, c)
+		}
+	}
+}
+
+func TestDestination(test *testing.T) {
+	// A degree of the great circle along the equator and the meridian
+	degree := EarthRadius * toRadians
+	if lat, lon := Destination(0, 0, 90, degree); !near(lat, 0, 1e-9) || !near(lon, 1, 1e-9) {
+		test.Error("Expecting (0, 1)", lat, lon)
+	}
+	if lat, lon := Destination(0, 179.5, 90, degree); !near(lat, 0, 1e-9) || !near(lon, -179.5, 1e-9) {
+		test.Error("Expecting to cross the antimeridian", lat, lon)
+	}
+	if lat, _ := Destination(89.5, 0, 0, degree); !near(lat, 89.5, 1e-9) {
+		test.Error("Expecting to go over the pole", lat)
+	}
+
+	// Going back the reverse of the final bearing returns to the start
+	lat1, lon1 := 40.7128, -74.0060
+	lat2, lon2 := Destination(lat1, lon1, 51.3, 5570e3)
+	if d := Haversine(lat1, lon1, lat2, lon2); !near(d, 5570e3, 1e-3) {
+		test.Error("Expecting the distance traveled", d)
+	}
+	back := normalizeBearing(FinalBearing(lat1, lon1, lat2, lon2) + 180.)
+	if lat, lon := Destination(lat2, lon2, back, 5570e3); !near(lat, lat1, 1e-9) || !near(lon, lon1, 1e-9) {
+		test.Error("Expecting to return to the start", lat, lon)
+	}
+}
+
+func TestMidpoint(test *testing.T) {
+	if lat, lon := Midpoint(0, 0, 0, 90); !near(lat, 0, 1e-9) || !near(lon, 45, 1e-9) {
+		test.Error("Expecting (0, 45)", lat, lon)
+	}
+	if lat, lon := Midpoint(10, 170, 10, -170); !near(lon, 180, 1e-9) && !near(lon, -180, 1e-9) || lat <= 10 {
+		test.Error("Expecting on the antimeridian, north of the parallel", lat, lon)
+	}
+	lat, lon := Midpoint(51.5074, -0.1278, 40.7128, -74.0060)
+	if d1, d2 := Haversine(51.5074, -0.1278, lat, lon), Haversine(lat, lon, 40.7128, -74.0060); !near(d1, d2, 1e-3) {
+		test.Error("Expecting halfway", d1, d2)
+	}
+}
+
+func TestBoundingBox(test *testing.T) {
+	degree := EarthRadius * toRadians
+	b := BoundingBox(0, 0, degree)
+	if !near(b.South, -1, 1e-9) || !near(b.North, 1, 1e-9) || !near(b.West, -1, 1e-9) || !near(b.East, 1, 1e-9) {
+		test.Error("Expecting a degree around", b)
+	}
+
+	// Circles at random places are within their boxes
+	for _, c := range [][2]float64{{60, 10}, {-45, 179.9}, {89, -120}, {-33.9, 151.2}} {
+		b := BoundingBox(c[0], c[1], 200e3)
+		for bearing := 0.; bearing < 360.; bearing += 5. {
+			lat, lon := Destination(c[0], c[1], bearing, 199.999e3)
+			if !b.Contains(lat, lon) {
+				test.Error("Expecting", lat, lon, "within", b)
+			}
+		}
+	}
+
+	b = BoundingBox(-45, 179.9, 200e3)
+	if !b.CrossesAntimeridian() || !b.Contains(-45, -179) || b.Contains(-45, 0) {
+		test.Error("Expecting a box across the antimeridian", b)
+	}
+	b = BoundingBox(89, -120, 200e3)
+	if b.North != 90 || b.West != -180 || b.East != 180 || !b.Contains(89.5, 60) {
+		test.Error("Expecting a box over the pole", b)
+	}
+	if b := BoundingBox(0, 0, 30000e3); b != World {
+		test.Error("Expecting the world", b)
+	}
+}
+
+func TestBoxIntersects(test *testing.T) {
+	fiji := Box{South: -21, West: 177, North: -12, East: -178}
+	for _, c := range []struct {
+		box      Box
+		expected bool
+	}{
+		{Box{South: -20, West: -179, North: -15, East: -175}, true},
+		{Box{South: -20, West: 170, North: -15, East: 178}, true},
+		{Box{South: -20, West: 0, North: -15, East: 10}, false},
+		{Box{South: -10, West: 178, North: 0, East: 179}, false},
+		{Box{South: -20, West: 175, North: -15, East: -175}, true},
+		{World, true},
+	} {
+		if fiji.Intersects(c.box) != c.expected || c.box.Intersects(fiji) != c.expected {
+			test.Error("Expecting intersection", c.expected, c.box)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package geo
+
+import (
+	"math"
+)
+
+// Latitude and longitude bounds in degrees.  A box crossing the antimeridian has its west bound
+// greater than its east bound, e.g. 170 to -170 for the 20 degrees around it.
+type Box struct {
+	South float64 `json:"south"`
+	West  float64 `json:"west"`
+	North float64 `json:"north"`
+	East  float64 `json:"east"`
+}
+
+// The box of all the earth
+var World = Box{South: -90., West: -180., North: 90., East: 180.}
+
+// Returns true if the box crosses the antimeridian.
+func (b Box) CrossesAntimeridian() bool {
+	return b.West > b.East
+}
+
+// Returns the longitude ranges of the box, two if it crosses the antimeridian.
+func (b Box) longitudes() [][2]float64 {
+	if b.CrossesAntimeridian() {
+		return [][2]float64{{b.West, 180.}, {-180., b.East}}
+	}
+	return [][2]float64{{b.West, b.East}}
+}
+
+// Returns true if the point is within the box, including its edges.
+func (b Box) Contains(lat, lon float64) bool {
+	if lat < b.South || lat > b.North {
+		return false
+	}
+	for _, r := range b.longitudes() {
+		if lon >= r[0] && lon <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the boxes overlap, including touching at the edges.
+func (b Box) Intersects(other Box) bool {
+	if b.South > other.North || b.North < other.South {
+		return false
+	}
+	for _, r := range b.longitudes() {
+		for _, o := range other.longitudes() {
+			if r[0] <= o[1] && o[0] <= r[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the smallest box enclosing the circle of the radius in meters around the center on the
+// sphere.  If the circle covers a pole, the box spans all longitudes from the latitude of its far
+// edge to the pole.  If it crosses the antimeridian, so does the box.
+//
+// See J. P. Matuschek, Finding points within a distance of a latitude/longitude using bounding
+// coordinates, http://janmatuschek.de/LatitudeLongitudeBoundingCoordinates
+func BoundingBox(lat, lon, radius float64) Box {
+	r := radius / EarthRadius
+	south, north := lat-r/toRadians, lat+r/toRadians
+	if south <= -90. || north >= 90. {
+		return Box{South: math.Max(south, -90.), West: -180., North: math.Min(north, 90.), East: 180.}
+	}
+
+	dlon := math.Asin(math.Sin(r)/math.Cos(lat*toRadians)) / toRadians
+	west, east := lon-dlon, lon+dlon
+	if dlon >= 180. || math.IsNaN(dlon) {
+		west, east = -180., 180.
+	}
+	if west < -180. {
+		west += 360.
+	}
+	if east > 180. {
+		east -= 360.
+	}
+	return Box{South: south, West: west, North: north, East: east}
+}
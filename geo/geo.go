@@ -0,0 +1,132 @@
+// Package geo computes distances on the earth by a choice of models: a sphere of the mean earth
+// radius, the WGS84 ellipsoid, or a flat equirectangular approximation for short ranges.  All
+// angles are in degrees and all distances in meters.
+package geo
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+const (
+	toRadians = math.Pi / 180.
+
+	// Mean radius of the earth (IUGG), the radius of the sphere of the same mean as the WGS84
+	// ellipsoid's axes.
+	EarthRadius = 6371008.8
+
+	// Semi-major axis and flattening of the WGS84 ellipsoid
+	WGS84A = 6378137.
+	WGS84F = 1 / 298.257223563
+)
+
+// Model of the earth for computing distances
+type Model int
+
+const (
+	// The model left unset, e.g. by a query to take that of the service it is sent to.  Measures
+	// as the spherical model.
+	DefaultModel Model = iota
+
+	// Great circle distance on a sphere by the Haversine formula.  Off by up to 0.6% from the
+	// ellipsoid.
+	Spherical
+
+	// Geodesic distance on the WGS84 ellipsoid by Vincenty's formulae, accurate to a millimeter.
+	// About ten times slower than the spherical model.
+	Ellipsoidal
+
+	// Pythagoras on an equirectangular projection at the mean latitude.  Fastest, and within
+	// 0.1% of the spherical model up to about 100 km away from the poles and the antimeridian.
+	Equirectangular
+)
+
+var modelNames = []string{"default", "spherical", "ellipsoidal", "equirectangular"}
+
+var ErrUnknownModel = errors.New("Unknown distance model")
+
+// Parses the name of a model, or the default model if empty.  Also accepts the formula names
+// haversine and vincenty, and wgs84.
+func ParseModel(s string) (Model, error) {
+	switch name := strings.ToLower(strings.TrimSpace(s)); name {
+	case "":
+		return DefaultModel, nil
+	case "haversine":
+		return Spherical, nil
+	case "vincenty", "wgs84":
+		return Ellipsoidal, nil
+	default:
+		for i, n := range modelNames {
+			if n == name {
+				return Model(i), nil
+			}
+		}
+	}
+	return DefaultModel, ErrUnknownModel
+}
+
+func (m Model) String() string {
+	if m >= 0 && int(m) < len(modelNames) {
+		return modelNames[m]
+	}
+	return "unknown"
+}
+
+// Implements encoding.TextMarshaler, so models are named in json configs.
+func (m Model) MarshalText() ([]byte, error) {
+	if m < 0 || int(m) >= len(modelNames) {
+		return nil, ErrUnknownModel
+	}
+	return []byte(m.String()), nil
+}
+
+// Implements encoding.TextUnmarshaler
+func (m *Model) UnmarshalText(text []byte) (err error) {
+	*m, err = ParseModel(string(text))
+	return
+}
+
+// Returns the distance in meters between two points by the model.
+func (m Model) Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	switch m {
+	case Ellipsoidal:
+		return Vincenty(lat1, lon1, lat2, lon2)
+	case Equirectangular:
+		return EquirectangularDistance(lat1, lon1, lat2, lon2)
+	}
+	return Haversine(lat1, lon1, lat2, lon2)
+}
+
+// Returns the great circle distance within which lie all the points within the distance by the
+// model, e.g. to search a spherical index for them.  The sphere of the mean radius is longer than
+// the ellipsoid by at most its ratio to the least radius of curvature, at the equator along the
+// meridian.  On the equirectangular projection, the haversine of the central angle is at most that
+// of the projected distance at any latitude, as the product of the cosines of the latitudes is at
+// most the square of the cosine of their mean.
+func (m Model) SphericalBound(distance float64) float64 {
+	switch m {
+	case Ellipsoidal:
+		return distance * EarthRadius / (WGS84A * (1 - WGS84F*(2-WGS84F)))
+	case Equirectangular:
+		return 2 * EarthRadius * math.Asin(math.Min(distance/EarthRadius/2, 1))
+	}
+	return distance
+}
+
+// Returns the great circle distance in meters on the sphere of the mean earth radius.
+func Haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	dlat, dlon := (lat2-lat1)*toRadians, (lon2-lon1)*toRadians
+	a := math.Pow(math.Sin(dlat/2), 2) +
+		math.Cos(lat1*toRadians)*math.Cos(lat2*toRadians)*math.Pow(math.Sin(dlon/2), 2)
+	return 2 * EarthRadius * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Returns the distance in meters on the equirectangular projection at the mean latitude.  The
+// difference in longitude is taken the short way around, across the antimeridian if need be.
+func EquirectangularDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	dlon := math.Remainder(lon2-lon1, 360.)
+	x := dlon * toRadians * math.Cos((lat1+lat2)/2*toRadians)
+	y := (lat2 - lat1) * toRadians
+	return EarthRadius * math.Hypot(x, y)
+}
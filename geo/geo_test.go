@@ -0,0 +1,124 @@
+package geo
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// Degrees from degrees, minutes and seconds
+func dms(d, m, s float64) float64 {
+	if d < 0 {
+		return d - m/60 - s/3600
+	}
+	return d + m/60 + s/3600
+}
+
+// Published reference distances on WGS84, to the millimeter
+var references = []struct {
+	name                   string
+	lat1, lon1, lat2, lon2 float64
+	meters                 float64
+}{
+	// Geoscience Australia's worked example of Vincenty's formulae
+	{"Flinders Peak to Buninyong", dms(-37, 57, 3.72030), dms(144, 25, 29.52440),
+		dms(-37, 39, 10.15610), dms(143, 55, 35.38390), 54972.271},
+	// A degree of the equator, a * pi / 180
+	{"Equator degree", 0, 0, 0, 1, 111319.491},
+	// The quarter meridian
+	{"Equator to pole", 0, 0, 90, 0, 10001965.729},
+	// A degree of the meridian at the equator
+	{"Meridian degree", 0, 0, 1, 0, 110574.389},
+}
+
+func TestVincenty(test *testing.T) {
+	for _, r := range references {
+		if d := Vincenty(r.lat1, r.lon1, r.lat2, r.lon2); math.Abs(d-r.meters) > 0.001 {
+			test.Error(r.name, "expecting", r.meters, "got", d)
+		}
+		if d := Vincenty(r.lat2, r.lon2, r.lat1, r.lon1); math.Abs(d-r.meters) > 0.001 {
+			test.Error(r.name, "reversed, expecting", r.meters, "got", d)
+		}
+	}
+	if d := Vincenty(10, 20, 10, 20); d != 0 {
+		test.Error("Expecting 0", d)
+	}
+	// Across the antimeridian, the short way
+	if d := Vincenty(0, 179.5, 0, -179.5); math.Abs(d-111319.491) > 0.001 {
+		test.Error("Expecting a degree of the equator", d)
+	}
+	// Nearly antipodal points, where the iteration does not converge
+	if d := Vincenty(0, 0, 0.5, 179.7); math.Abs(d/Haversine(0, 0, 0.5, 179.7)-1) > 0.005 {
+		test.Error("Expecting about the spherical distance", d)
+	}
+}
+
+func TestModels(test *testing.T) {
+	for _, r := range references {
+		d := Haversine(r.lat1, r.lon1, r.lat2, r.lon2)
+		if math.Abs(d/r.meters-1) > 0.006 {
+			test.Error(r.name, "spherical distance off by more than 0.6%", d)
+		}
+		if d := Spherical.Distance(r.lat1, r.lon1, r.lat2, r.lon2); d != Haversine(r.lat1, r.lon1, r.lat2, r.lon2) {
+			test.Error(r.name, "expecting haversine", d)
+		}
+		if d := Ellipsoidal.Distance(r.lat1, r.lon1, r.lat2, r.lon2); math.Abs(d-r.meters) > 0.001 {
+			test.Error(r.name, "expecting vincenty", d)
+		}
+	}
+	// City scale, within 0.1% of the sphere, including across the antimeridian
+	for _, p := range [][4]float64{{40.7128, -74.0060, 40.7306, -73.9352}, {-16.5, 179.9, -16.6, -179.8}} {
+		e, h := EquirectangularDistance(p[0], p[1], p[2], p[3]), Haversine(p[0], p[1], p[2], p[3])
+		if math.Abs(e/h-1) > 0.001 {
+			test.Error("Expecting equirectangular close to haversine", e, h)
+		}
+	}
+}
+
+func TestSphericalBound(test *testing.T) {
+	if b := Ellipsoidal.SphericalBound(1000.); b < 1005. || b > 1006. {
+		test.Error("Expecting the ellipsoid widened by about 0.56%", b)
+	}
+	if b := Spherical.SphericalBound(1000.); b != 1000. {
+		test.Error("Expecting the distance itself", b)
+	}
+	// Points at the distance in all directions, at all latitudes up to the poles and across the
+	// antimeridian, are within the bound of their model
+	for _, distance := range []float64{100., 1e4, 1e6} {
+		for lat := -89.9; lat < 90.; lat += 5. {
+			for bearing := 0.; bearing < 360.; bearing += 7.5 {
+				lat2, lon2 := Destination(lat, 179.99, bearing, distance)
+				for _, m := range []Model{Ellipsoidal, Equirectangular} {
+					d := m.Distance(lat, 179.99, lat2, lon2)
+					if h := Haversine(lat, 179.99, lat2, lon2); h > m.SphericalBound(d)*(1+1e-12) {
+						test.Error("Expecting", m, "within its bound at", lat, bearing, d, h)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestParseModel(test *testing.T) {
+	for s, expected := range map[string]Model{
+		"": DefaultModel, "default": DefaultModel, "spherical": Spherical, "haversine": Spherical, "Ellipsoidal": Ellipsoidal, "wgs84": Ellipsoidal,
+		"vincenty": Ellipsoidal, "equirectangular": Equirectangular,
+	} {
+		if m, err := ParseModel(s); err != nil || m != expected {
+			test.Error("Expecting", expected, "for", s, "got", m, err)
+		}
+	}
+	if _, err := ParseModel("flat"); err != ErrUnknownModel {
+		test.Error("Expecting error", err)
+	}
+
+	config := struct {
+		Model Model `json:"model"`
+	}{}
+	if err := json.Unmarshal([]byte(`{"model":"ellipsoidal"}`), &config); err != nil || config.Model != Ellipsoidal {
+		test.Error("Expecting ellipsoidal", config, err)
+	}
+	if buff, err := json.Marshal(config); err != nil || string(buff) != `{"model":"ellipsoidal"}` {
+		test.Error("Expecting the model named", string(buff), err)
+	}
+}
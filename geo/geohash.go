@@ -0,0 +1,73 @@
+package geo
+
+import (
+	"errors"
+	"strings"
+)
+
+// Alphabet of the geohash digits, 5 bits each
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Longest geohash, of cells a few centimeters wide
+const MaxGeohashPrecision = 12
+
+var ErrBadGeohash = errors.New("Bad geohash")
+
+// Returns the geohash of the point with the number of digits, from 1 to MaxGeohashPrecision.
+// Bits alternate between longitude and latitude, halving their ranges, so points sharing a prefix
+// are in the same cell.
+func Geohash(lat, lon float64, precision int) string {
+	if precision < 1 {
+		precision = 1
+	} else if precision > MaxGeohashPrecision {
+		precision = MaxGeohashPrecision
+	}
+	lats, lons := [2]float64{-90., 90.}, [2]float64{-180., 180.}
+	hash := make([]byte, precision)
+	for i := range hash {
+		digit := 0
+		for bit := 0; bit < 5; bit++ {
+			r, v := &lons, lon
+			if (i*5+bit)%2 == 1 {
+				r, v = &lats, lat
+			}
+			mid := (r[0] + r[1]) / 2
+			digit <<= 1
+			if v >= mid {
+				digit |= 1
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+		}
+		hash[i] = geohashBase32[digit]
+	}
+	return string(hash)
+}
+
+// Returns the box of the cell of the geohash, or ErrBadGeohash.
+func GeohashBox(hash string) (Box, error) {
+	if len(hash) == 0 || len(hash) > MaxGeohashPrecision {
+		return Box{}, ErrBadGeohash
+	}
+	lats, lons := [2]float64{-90., 90.}, [2]float64{-180., 180.}
+	for i, c := range strings.ToLower(hash) {
+		digit := strings.IndexRune(geohashBase32, c)
+		if digit < 0 {
+			return Box{}, ErrBadGeohash
+		}
+		for bit := 0; bit < 5; bit++ {
+			r := &lons
+			if (i*5+bit)%2 == 1 {
+				r = &lats
+			}
+			mid := (r[0] + r[1]) / 2
+			if digit&(16>>uint(bit)) != 0 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+		}
+	}
+	return Box{South: lats[0], West: lons[0], North: lats[1], East: lons[1]}, nil
+}
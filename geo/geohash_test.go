@@ -0,0 +1,33 @@
+package geo
+
+import (
+	"testing"
+)
+
+func TestGeohash(test *testing.T) {
+	for _, c := range []struct {
+		lat, lon float64
+		hash     string
+	}{
+		{57.64911, 10.40744, "u4pruydqqvj"},
+		{37.7749, -122.4194, "9q8yy"},
+		{-90., -180., "000"},
+		{0., 0., "s0000"},
+	} {
+		if hash := Geohash(c.lat, c.lon, len(c.hash)); hash != c.hash {
+			test.Error("Expecting", c.hash, "for", c.lat, c.lon, "got", hash)
+		}
+		b, err := GeohashBox(c.hash)
+		if err != nil || !b.Contains(c.lat, c.lon) {
+			test.Error("Expecting the box of", c.hash, "to contain", c.lat, c.lon, b, err)
+		}
+	}
+	if b, _ := GeohashBox("s"); b != (Box{South: 0, West: 0, North: 45, East: 45}) {
+		test.Error("Expecting the first cell north east of 0, 0", b)
+	}
+	for _, hash := range []string{"", "a", "9q8yy9q8yy9q8"} {
+		if _, err := GeohashBox(hash); err != ErrBadGeohash {
+			test.Error("Expecting ErrBadGeohash for", hash, err)
+		}
+	}
+}
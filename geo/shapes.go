@@ -0,0 +1,144 @@
+package geo
+
+import (
+	"math"
+)
+
+// Position as in GeoJSON: longitude, then latitude
+type Position [2]float64
+
+// Closed ring of positions.  Repeating the first position at the end, as GeoJSON does, is optional.
+type Ring []Position
+
+// Polygon of an outer ring and any number of holes, as in GeoJSON
+type Polygon []Ring
+
+// Polygons, as in GeoJSON
+type MultiPolygon []Polygon
+
+// Route of positions joined by great circle segments, as in GeoJSON
+type LineString []Position
+
+// Returns true if the point is inside the ring, by the even-odd rule (ray casting).  Edges are
+// straight in latitude and longitude, which is accurate enough for city-sized rings.  Rings must
+// not cross the antimeridian; split them into a multipolygon instead.
+func (r Ring) Contains(lat, lon float64) bool {
+	inside := false
+	n := len(r)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		a, b := r[i], r[j]
+		if (a[1] > lat) != (b[1] > lat) {
+			x := (b[0]-a[0])*(lat-a[1])/(b[1]-a[1]) + a[0]
+			if lon < x {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// Returns the box of the ring's positions.
+func (r Ring) Bounds() Box {
+	if len(r) == 0 {
+		return Box{South: 90., West: 180., North: -90., East: -180.}
+	}
+	b := Box{South: r[0][1], West: r[0][0], North: r[0][1], East: r[0][0]}
+	for _, p := range r[1:] {
+		b.South, b.West = math.Min(b.South, p[1]), math.Min(b.West, p[0])
+		b.North, b.East = math.Max(b.North, p[1]), math.Max(b.East, p[0])
+	}
+	return b
+}
+
+// Returns true if the point is inside the outer ring and not inside any of the holes.
+func (p Polygon) Contains(lat, lon float64) bool {
+	if len(p) == 0 || !p[0].Contains(lat, lon) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if hole.Contains(lat, lon) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the point is inside any of the polygons.
+func (m MultiPolygon) Contains(lat, lon float64) bool {
+	for _, p := range m {
+		if p.Contains(lat, lon) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the boxes of the polygons, one each.  The polygons may be far apart, e.g. on either
+// side of the antimeridian, so they are not merged into one box.
+func (m MultiPolygon) Bounds() []Box {
+	boxes := make([]Box, 0, len(m))
+	for _, p := range m {
+		if len(p) > 0 {
+			boxes = append(boxes, p[0].Bounds())
+		}
+	}
+	return boxes
+}
+
+// Returns the distance in meters on the sphere from the point to the nearest point of the route.
+func (l LineString) Distance(lat, lon float64) float64 {
+	if len(l) == 0 {
+		return math.Inf(1)
+	}
+	d := Haversine(l[0][1], l[0][0], lat, lon)
+	for i := 1; i < len(l); i++ {
+		d = math.Min(d, segmentDistance(l[i-1], l[i], lat, lon))
+	}
+	return d
+}
+
+// Returns the boxes enclosing the points within the distance in meters of the route, one for each
+// segment.
+func (l LineString) Bounds(distance float64) []Box {
+	boxes := make([]Box, 0, len(l))
+	for i := range l {
+		if i > 0 || len(l) == 1 {
+			boxes = append(boxes, segmentCircle(l, i, distance))
+		}
+	}
+	return boxes
+}
+
+// Returns the box of the circle around the segment ending at position i: centered at its
+// midpoint, of radius half its length plus the distance.
+func segmentCircle(l LineString, i int, distance float64) Box {
+	if i == 0 {
+		return BoundingBox(l[0][1], l[0][0], distance)
+	}
+	lat, lon, r := SegmentCircle(l[i-1], l[i], distance)
+	return BoundingBox(lat, lon, r)
+}
+
+// Returns the center and radius in meters of a circle enclosing all the points within the distance
+// of the segment.
+func SegmentCircle(a, b Position, distance float64) (lat, lon, radius float64) {
+	lat, lon = Midpoint(a[1], a[0], b[1], b[0])
+	return lat, lon, Haversine(a[1], a[0], b[1], b[0])/2 + distance
+}
+
+// Returns the distance in meters from the point to the great circle segment, by the cross track
+// distance if the point is abeam the segment, or else the distance to the nearer end.
+func segmentDistance(a, b Position, lat, lon float64) float64 {
+	d13 := Haversine(a[1], a[0], lat, lon) / EarthRadius
+	theta13 := Bearing(a[1], a[0], lat, lon) * toRadians
+	theta12 := Bearing(a[1], a[0], b[1], b[0]) * toRadians
+	if math.Cos(theta13-theta12) < 0 {
+		return d13 * EarthRadius // behind the start
+	}
+	crossTrack := math.Asin(math.Sin(d13) * math.Sin(theta13-theta12))
+	alongTrack := math.Acos(math.Max(-1, math.Min(1, math.Cos(d13)/math.Cos(crossTrack))))
+	if alongTrack > Haversine(a[1], a[0], b[1], b[0])/EarthRadius {
+		return Haversine(b[1], b[0], lat, lon) // past the end
+	}
+	return math.Abs(crossTrack) * EarthRadius
+}
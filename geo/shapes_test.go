@@ -0,0 +1,77 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+// Square of 2 degrees around (0, 0) with a square hole of 1 degree
+var donut = Polygon{
+	Ring{{-1, -1}, {1, -1}, {1, 1}, {-1, 1}, {-1, -1}},
+	Ring{{-0.5, -0.5}, {0.5, -0.5}, {0.5, 0.5}, {-0.5, 0.5}},
+}
+
+func TestPolygonContains(test *testing.T) {
+	for _, c := range []struct {
+		lat, lon float64
+		expected bool
+	}{
+		{0, 0, false}, // in the hole
+		{0.75, 0, true},
+		{0, -0.75, true},
+		{1.5, 0, false},
+		{0, 179, false},
+	} {
+		if donut.Contains(c.lat, c.lon) != c.expected {
+			test.Error("Expecting", c.expected, "for", c.lat, c.lon)
+		}
+	}
+
+	// Islands on either side of the antimeridian
+	islands := MultiPolygon{
+		Polygon{Ring{{179, -17}, {180, -17}, {180, -16}, {179, -16}}},
+		Polygon{Ring{{-180, -17}, {-179, -17}, {-179, -16}, {-180, -16}}},
+	}
+	if !islands.Contains(-16.5, 179.5) || !islands.Contains(-16.5, -179.5) || islands.Contains(-16.5, 0) {
+		test.Error("Expecting the points on the islands only")
+	}
+	if b := islands.Bounds(); len(b) != 2 || b[0] != (Box{South: -17, West: 179, North: -16, East: 180}) {
+		test.Error("Expecting the box of each island", b)
+	}
+	if (MultiPolygon{}).Contains(0, 0) || (Polygon{}).Contains(0, 0) {
+		test.Error("Expecting empty polygons to contain nothing")
+	}
+}
+
+func TestLineDistance(test *testing.T) {
+	degree := EarthRadius * toRadians
+	route := LineString{{0, 0}, {2, 0}, {2, 2}}
+	for _, c := range []struct {
+		lat, lon, expected float64
+	}{
+		{0, 1, 0},                // on the first segment
+		{0.01, 1, 0.01 * degree}, // abeam the first segment
+		{0, -1, degree},          // behind the start
+		{1, 3, degree},           // abeam the second segment
+		{3, 2, degree},           // past the end
+	} {
+		if d := route.Distance(c.lat, c.lon); math.Abs(d-c.expected) > 0.001*degree {
+			test.Error("Expecting", c.expected, "for", c.lat, c.lon, "got", d)
+		}
+	}
+	if d := (LineString{{0, 0}}).Distance(0, 1); math.Abs(d-degree) > 1e-6 {
+		test.Error("Expecting the distance to a single point", d)
+	}
+
+	// Points within the corridor are within its boxes
+	boxes := route.Bounds(1000)
+	for _, p := range [][2]float64{{0.008, 1}, {-0.008, 0}, {1, 2.008}, {2.008, 2}} {
+		inside := false
+		for _, b := range boxes {
+			inside = inside || b.Contains(p[0], p[1])
+		}
+		if !inside {
+			test.Error("Expecting", p, "within the boxes", boxes)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package geo
+
+import (
+	"errors"
+	"math"
+)
+
+// Latitude at which web mercator tiles end, where the map is square
+const MaxMercatorLatitude = 85.0511287798066
+
+// Deepest zoom of the tiles served
+const MaxZoom = 24
+
+var ErrBadTile = errors.New("Bad tile coordinates")
+
+// Slippy map tile of web mercator, as in the /{z}/{x}/{y} urls of map servers: 2^z tiles across,
+// from longitude -180 at x = 0, and from the north at y = 0.
+type Tile struct {
+	Z, X, Y int
+}
+
+// Returns ErrBadTile unless the zoom is from 0 to MaxZoom and the tile is within the map.
+func (t Tile) Validate() error {
+	if t.Z < 0 || t.Z > MaxZoom || t.X < 0 || t.Y < 0 || t.X >= 1<<uint(t.Z) || t.Y >= 1<<uint(t.Z) {
+		return ErrBadTile
+	}
+	return nil
+}
+
+// Returns the position of the point in units of tiles at the zoom, e.g. (0.5, 0.5) for (0, 0) at
+// zoom 0.  Latitudes beyond MaxMercatorLatitude are clamped.
+func Mercator(lat, lon float64, zoom int) (x, y float64) {
+	n := math.Exp2(float64(zoom))
+	lat = math.Max(-MaxMercatorLatitude, math.Min(MaxMercatorLatitude, lat))
+	phi := lat * toRadians
+	x = (lon + 180.) / 360. * n
+	y = (1. - math.Log(math.Tan(phi)+1./math.Cos(phi))/math.Pi) / 2. * n
+	return
+}
+
+// Returns the latitude and longitude of the position in units of tiles at the zoom.
+func InverseMercator(x, y float64, zoom int) (lat, lon float64) {
+	n := math.Exp2(float64(zoom))
+	lon = x/n*360. - 180.
+	lat = math.Atan(math.Sinh(math.Pi*(1.-2.*y/n))) / toRadians
+	return
+}
+
+// Returns the box of the tile, widened on each side by the fraction of the tile's size, e.g. for
+// the symbols of points just outside it.
+func (t Tile) Bounds(buffer float64) Box {
+	north, west := InverseMercator(float64(t.X)-buffer, float64(t.Y)-buffer, t.Z)
+	south, east := InverseMercator(float64(t.X+1)+buffer, float64(t.Y+1)+buffer, t.Z)
+	if t.Z == 0 || buffer*2 >= math.Exp2(float64(t.Z))-1 {
+		west, east = -180., 180.
+	}
+	return Box{
+		South: math.Max(south, -MaxMercatorLatitude),
+		West:  normalizeLongitude(west),
+		North: math.Min(north, MaxMercatorLatitude),
+		East:  normalizeLongitude(east),
+	}
+}
+
+// Returns the position of the point within the tile, from (0, 0) at its north west corner to
+// (extent, extent) at its south east corner.  Points outside the tile are outside that range.
+func (t Tile) Point(lat, lon float64, extent int) (x, y float64) {
+	x, y = Mercator(lat, lon, t.Z)
+	n := math.Exp2(float64(t.Z))
+	// Nearest copy of the point across the antimeridian
+	if dx := x - float64(t.X); dx > n/2 {
+		x -= n
+	} else if dx < -n/2 {
+		x += n
+	}
+	return (x - float64(t.X)) * float64(extent), (y - float64(t.Y)) * float64(extent)
+}
@@ -0,0 +1,50 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTile(test *testing.T) {
+	if x, y := Mercator(0, 0, 0); x != 0.5 || y != 0.5 {
+		test.Error("Expecting the middle of the world", x, y)
+	}
+	// San Francisco is in tile 1310/3166 at zoom 13
+	x, y := Mercator(37.7749, -122.4194, 13)
+	if int(x) != 1310 || int(y) != 3166 {
+		test.Error("Expecting tile 1310/3166", x, y)
+	}
+	if lat, lon := InverseMercator(x, y, 13); math.Abs(lat-37.7749) > 1e-9 || math.Abs(lon+122.4194) > 1e-9 {
+		test.Error("Expecting the point back", lat, lon)
+	}
+
+	t := Tile{Z: 13, X: 1310, Y: 3166}
+	b := t.Bounds(0)
+	if !b.Contains(37.7749, -122.4194) || b.Contains(37.7749, -122.37) {
+		test.Error("Expecting the box of the tile", b)
+	}
+	if px, py := t.Point(b.North, b.West, 4096); math.Abs(px) > 1e-6 || math.Abs(py) > 1e-6 {
+		test.Error("Expecting the north west corner at 0, 0", px, py)
+	}
+	if px, py := t.Point(b.South, b.East, 4096); math.Abs(px-4096) > 1e-6 || math.Abs(py-4096) > 1e-6 {
+		test.Error("Expecting the south east corner at the extent", px, py)
+	}
+
+	// Tiles on the antimeridian see the points across it
+	east := Tile{Z: 2, X: 3, Y: 2}
+	if b := east.Bounds(0.25); !b.CrossesAntimeridian() || !b.Contains(-30, -179) {
+		test.Error("Expecting the buffer across the antimeridian", b)
+	}
+	if px, _ := east.Point(-30, -179, 4096); px-4096 < 45 || px-4096 > 46 {
+		test.Error("Expecting the point a degree east of the tile", px)
+	}
+	if b := (Tile{}).Bounds(0.1); b.West != -180 || b.East != 180 || b.North != MaxMercatorLatitude {
+		test.Error("Expecting the world", b)
+	}
+
+	for _, t := range []Tile{{Z: -1}, {Z: 1, X: 2}, {Z: 25}, {Z: 3, Y: -1}} {
+		if t.Validate() != ErrBadTile {
+			test.Error("Expecting ErrBadTile for", t)
+		}
+	}
+}
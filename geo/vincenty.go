@@ -0,0 +1,59 @@
+package geo
+
+import (
+	"math"
+)
+
+// Returns the geodesic distance in meters on the WGS84 ellipsoid by Vincenty's inverse formula.
+// The iteration does not converge for nearly antipodal points, for which the distance falls back
+// to the sphere scaled to the ellipsoid's meridian, within 0.1% there.
+//
+// See T. Vincenty, Direct and inverse solutions of geodesics on the ellipsoid with application of
+// nested equations, Survey Review 23 (176), 1975.
+func Vincenty(lat1, lon1, lat2, lon2 float64) float64 {
+	const b = WGS84A * (1 - WGS84F)
+
+	L := math.Remainder(lon2-lon1, 360.) * toRadians
+	U1 := math.Atan((1 - WGS84F) * math.Tan(lat1*toRadians))
+	U2 := math.Atan((1 - WGS84F) * math.Tan(lat2*toRadians))
+	sinU1, cosU1 := math.Sincos(U1)
+	sinU2, cosU2 := math.Sincos(U2)
+
+	lambda := L
+	var sinSigma, cosSigma, sigma, cosSqAlpha, cos2SigmaM float64
+	for i := 0; ; i++ {
+		if i == 200 {
+			return Haversine(lat1, lon1, lat2, lon2) * meridianScale
+		}
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma = math.Hypot(cosU2*sinLambda, cosU1*sinU2-sinU1*cosU2*cosLambda)
+		if sinSigma == 0 {
+			return 0 // coincident points
+		}
+		cosSigma = sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma = math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha = 1 - sinAlpha*sinAlpha
+		cos2SigmaM = 0
+		if cosSqAlpha != 0 { // else both points on the equator
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+		C := WGS84F / 16 * cosSqAlpha * (4 + WGS84F*(4-3*cosSqAlpha))
+		previous := lambda
+		lambda = L + (1-C)*WGS84F*sinAlpha*
+			(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+		if math.Abs(lambda-previous) < 1e-12 {
+			break
+		}
+	}
+
+	uSq := cosSqAlpha * (WGS84A*WGS84A - b*b) / (b * b)
+	A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+	B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+	deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+		B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+	return b * A * (sigma - deltaSigma)
+}
+
+// Ratio of the length of the WGS84 meridian to the circumference of the mean sphere
+const meridianScale = 20003931.4586 / (math.Pi * EarthRadius)
@@ -0,0 +1,203 @@
+package tally
+
+import (
+	"fmt"
+	"github.com/gyokuro/tally/geo"
+	"math"
+)
+
+// Most cells a heatmap query may span, so that a tiny cell over a large box is refused
+const MaxHeatmapCells = 1 << 18
+
+// Query for the density of cabs or events in a box, counted per cell.  Cells are either squares of
+// CellSize degrees, aligned to latitude -90 and longitude -180, or geohash cells of Precision
+// digits.  Only the cells with anything in them are returned.
+type HeatmapQuery struct {
+	Bounds    geo.Box
+	CellSize  float64 // degrees
+	Precision int     // geohash digits, instead of the cell size
+}
+
+// Count of what is in a cell.  The key is the geohash of the cell, or its row and column in the
+// grid, e.g. "12762/5750".
+type HeatCell struct {
+	Key    string  `json:"key"`
+	Bounds geo.Box `json:"bounds"`
+	Count  int     `json:"count"`
+}
+
+// Grid of cells Height by Width degrees from the South and West edges, on which event stores
+// count events.  Columns are counted eastward across the antimeridian.
+type Grid struct {
+	South, West   float64
+	Height, Width float64
+}
+
+// Count of the events in a cell of a grid, at their mean location
+type GridCell struct {
+	Row, Column int
+	Count       int
+	Latitude    float64
+	Longitude   float64
+}
+
+// Returns ErrorBadParam unless the edges are finite and the sizes finite and positive.
+func (g Grid) Validate() error {
+	for _, v := range []float64{g.South, g.West, g.Height, g.Width} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return ErrorBadParam
+		}
+	}
+	if g.Height <= 0 || g.Width <= 0 {
+		return ErrorBadParam
+	}
+	return nil
+}
+
+// Returns the row and column of the cell of the location.
+func (g Grid) Cell(lat, lon float64) (int, int) {
+	if lon < g.West {
+		lon += 360.
+	}
+	return int(math.Floor((lat - g.South) / g.Height)), int(math.Floor((lon - g.West) / g.Width))
+}
+
+// Service for heatmaps of the cabs currently present and of past events.
+type HeatmapService interface {
+
+	// Counts the cabs in the box per cell, of the status unless it is empty.  Cells are ordered
+	// by key.
+	Cabs(query HeatmapQuery, status CabStatus) ([]HeatCell, error)
+
+	// Counts the events matching the filter in the box per cell.  The filter's limit is ignored.
+	// Returns ErrorNotFound if no events are kept.
+	Events(query HeatmapQuery, filter EventQuery) ([]HeatCell, error)
+}
+
+// Returns the height and width in degrees of the cells.
+func (q HeatmapQuery) cellDegrees() (float64, float64) {
+	if q.Precision > 0 {
+		bits := 5 * q.Precision
+		return 180. / math.Exp2(float64(bits/2)), 360. / math.Exp2(float64(bits-bits/2))
+	}
+	return q.CellSize, q.CellSize
+}
+
+// Returns the grid of the cells, aligned to latitude -90 and longitude -180 as are geohash cells.
+func (q HeatmapQuery) Grid() Grid {
+	height, width := q.cellDegrees()
+	return Grid{South: -90., West: -180., Height: height, Width: width}
+}
+
+// Returns ErrorBadParam unless the box is valid and exactly one of the cell size and the geohash
+// precision is set, and the box spans at most MaxHeatmapCells cells.  Edges and sizes must be
+// finite numbers.
+func (q HeatmapQuery) Validate() error {
+	b := q.Bounds
+	for _, v := range []float64{b.South, b.West, b.North, b.East, q.CellSize} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return ErrorBadParam
+		}
+	}
+	if b.South < -90. || b.North > 90. || b.South > b.North ||
+		math.Abs(b.West) > 180. || math.Abs(b.East) > 180. {
+		return ErrorBadParam
+	}
+	if (q.CellSize > 0) == (q.Precision > 0) || q.CellSize < 0 || q.Precision > geo.MaxGeohashPrecision {
+		return ErrorBadParam
+	}
+	height, width := q.cellDegrees()
+	span := b.East - b.West
+	if b.CrossesAntimeridian() {
+		span += 360.
+	}
+	if math.Ceil((b.North-b.South)/height+1)*math.Ceil(span/width+1) > MaxHeatmapCells {
+		return ErrorBadParam
+	}
+	return nil
+}
+
+// Returns the key and bounds of the cell of the location.
+func (q HeatmapQuery) Cell(loc Location) (string, geo.Box) {
+	if q.Precision > 0 {
+		key := geo.Geohash(loc.Latitude, loc.Longitude, q.Precision)
+		box, _ := geo.GeohashBox(key)
+		return key, box
+	}
+	size := q.CellSize
+	row := math.Floor((math.Min(loc.Latitude, 90.-size/2) + 90.) / size)
+	column := math.Floor((math.Min(loc.Longitude, 180.-size/2) + 180.) / size)
+	box := geo.Box{South: row*size - 90., West: column*size - 180.}
+	box.North, box.East = math.Min(box.South+size, 90.), math.Min(box.West+size, 180.)
+	return fmt.Sprintf("%d/%d", int(row), int(column)), box
+}
+
+// Degrees of longitude between the vertices of the edges of a region along the parallels
+const regionStep = 5.
+
+// Returns the region of the box, as polygons at most 90 degrees wide so that none spans a
+// hemisphere, which mongo refuses.  As mongo takes the edges for geodesics, which stray poleward
+// of the parallels, the region may hold locations a little out of the box, to be filtered by its
+// Contains.
+func (q HeatmapQuery) Region() GeoRegion {
+	b := q.Bounds
+	ranges := [][2]float64{{b.West, b.East}}
+	if b.CrossesAntimeridian() {
+		ranges = [][2]float64{{b.West, 180.}, {-180., b.East}}
+	}
+	region := GeoRegion{Polygons: geo.MultiPolygon{}}
+	for _, r := range ranges {
+		// Counted rather than stepped to the east edge, at most 4 of 90 degrees in any case
+		n := 1
+		for n < 4 && r[0]+90.*float64(n) < r[1] {
+			n++
+		}
+		for k := 0; k < n; k++ {
+			west := r[0] + 90.*float64(k)
+			east := math.Min(west+90., r[1])
+			if k == n-1 {
+				east = r[1]
+			}
+			region.Polygons = append(region.Polygons, geo.Polygon{parallelRing(b.South, west, b.North, east)})
+		}
+	}
+	return region
+}
+
+// Returns the ring of the box at most 90 degrees wide, its south and north edges with vertices at
+// most regionStep degrees apart.  The edge nearer the equator is moved toward it for the geodesics
+// between its vertices not to stray into the box.
+func parallelRing(south, west, north, east float64) geo.Ring {
+	steps := 1
+	for steps < int(90./regionStep) && west+regionStep*float64(steps) < east {
+		steps++
+	}
+	step := (east - west) / float64(steps)
+	if south > 0. {
+		south = geodesicBase(south, step)
+	}
+	if north < 0. {
+		north = geodesicBase(north, step)
+	}
+
+	lon := func(i int) float64 {
+		if i == steps {
+			return east
+		}
+		return west + step*float64(i)
+	}
+	ring := make(geo.Ring, 0, 2*steps+2)
+	for i := 0; i <= steps; i++ {
+		ring = append(ring, geo.Position{lon(i), south})
+	}
+	for i := steps; i >= 0; i-- {
+		ring = append(ring, geo.Position{lon(i), north})
+	}
+	return ring
+}
+
+// Returns the latitude of the parallel from which the geodesic between two points the degrees of
+// longitude apart reaches the latitude at its middle.
+func geodesicBase(lat, lon float64) float64 {
+	return math.Atan(math.Tan(lat*math.Pi/180.)*math.Cos(lon*math.Pi/360.)) * 180. / math.Pi
+}
@@ -1,19 +1,41 @@
 package tally
 
 import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
 	"encoding/json"
-	"github.com/golang/glog"
+	"errors"
 	"github.com/gorilla/mux"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/proto"
 	"github.com/gyokuro/tally/util"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
+// Content types accepted by the bulk endpoints
+const (
+	contentTypeJson     = "application/json"
+	contentTypeNdjson   = "application/x-ndjson"
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+// Status of one item of a batch request.  The http status code applies to the item only;
+// the response to the batch request as a whole is 200 unless the entire batch failed.
+type BatchItem struct {
+	Id     Id     `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Cab    *Cab   `json:"cab,omitempty"`
+}
+
 var http_headers = map[string]string{
-	"Content-Type":                "application/protobuff",
+	"Content-Type":                contentTypeProtobuf,
 	"Access-Control-Allow-Origin": "*",
 }
 
@@ -25,32 +47,79 @@ func addHeaders(w *http.ResponseWriter) {
 	(*w).Header().Add("Access-Control-Allow-Origin", "*")
 }
 
+// Returns the url routes of the event api.  Batches of events are put as an EventList in
+// protobuf, or in the proto text format.
+func EventRoutes(service EventService) Routes {
+	return func(router *mux.Router) {
+		// Create / Update Request
+		router.Methods("PUT", "POST").Path("/v1/events/pb").HandlerFunc(handlePut(service))
+	}
+}
+
 func EventHttpServer(service EventService) *http.Server {
 	router := mux.NewRouter()
-
-	// Create / Update Request
-	router.Methods("PUT", "POST").Path("/v1/events/pb").HandlerFunc(handlePut(service))
+	EventRoutes(service)(router)
 
 	return &http.Server{
 		Handler: router,
 	}
 }
 
+// Largest body of a batch of events put, in bytes, as events may carry photos
+var maxEventBody int64 = 64 << 20
+
+// Largest body of the other requests, in bytes, e.g. of a bulk update of cabs.  About 50k cabs
+// in json.
+var maxBulkBody int64 = 8 << 20
+
 func handlePut(service EventService) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		util.AddHeaders(&w, http_headers)
-		params := mux.Vars(r)
-		glog.Info("Got params", params)
+
+		contentType := mediaType(r.Header.Get("Content-Type"))
+		if contentType != contentTypeProtoText {
+			contentType = contentTypeProtobuf
+		}
+		list := Tally.EventList{}
+		body, err := readBody(w, r, maxEventBody)
+		if err == nil {
+			err = unmarshalProto(body, contentType, &list)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
+		}
+		events := make([]Tally.Event, len(list.Events))
+		for i, event := range list.Events {
+			events[i] = *event
+		}
+		if err := service.Put(events); err != nil {
+			http.Error(w, err.Error(), statusOf(err))
+		}
 	}
 }
 
+// Registration of the URL routes of an additional api, e.g. dispatch, served along with the cabs.
+type Routes func(router *mux.Router)
+
 // Returns a http server from given service object
 // Registration of URL routes to handler functions that will invoke the service's methods to do CRUD.
-func HttpServer(service CabService) *http.Server {
+// Routes of other apis can be served by the same server by passing them in.
+func HttpServer(service CabService, more ...Routes) *http.Server {
 	router := mux.NewRouter()
 
+	// Query by a GeoWithin in the request body
+	router.Methods("POST").Path("/cabs/query").HandlerFunc(handlePostQuery(service))
+	// Query by a GeoRegion, i.e. polygons or a corridor, in the request body
+	router.Methods("POST").Path("/cabs/within").HandlerFunc(handleQueryRegion(service))
+	// Status Update Request, keeping the position
+	router.Methods("PUT", "POST").Path("/cabs/{cabId}/status").HandlerFunc(handleSetStatus(service))
 	// Create / Update Request
 	router.Methods("PUT", "POST").Path("/cabs/{cabId}").HandlerFunc(handleCreateUpdate(service))
+	// Bulk Create / Update Request
+	router.Methods("PUT", "POST").Path("/cabs").HandlerFunc(handleBulkCreateUpdate(service))
+	// Batch Get Request, by a comma separated list of ids.
+	router.Methods("GET").Path("/cabs").Queries("ids", "").HandlerFunc(handleBatchGet(service))
 	// Get Request
 	router.Methods("GET").Path("/cabs/{cabId}").HandlerFunc(handleGet(service))
 	// Query
@@ -66,6 +135,10 @@ func HttpServer(service CabService) *http.Server {
 	// Destroy All Request
 	router.Methods("POST").Path("/deleteAll").HandlerFunc(handleDeleteAll(service))
 
+	for _, routes := range more {
+		routes(router)
+	}
+
 	return &http.Server{
 		Handler: router,
 	}
@@ -109,23 +182,24 @@ func RunServer(server *http.Server, stop chan bool) (stopped chan bool) {
 
 func handleCreateUpdate(service CabService) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		addHeaders(&w)
+		if _, ok := addCabHeaders(w, r); !ok {
+			return
+		}
 
 		params := mux.Vars(r)
 
 		cabId, err := strconv.ParseUint(params["cabId"], 10, 64)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		body, err := ioutil.ReadAll(r.Body)
+		cab, err := decodeCab(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
 		}
 
-		cab := Cab{}
-		err = json.Unmarshal(body, &cab)
-
 		// A quick check to make sure we have id that matches
 		if cab.Id == Id(0) {
 			cab.Id = Id(cabId) // fill in the missing Id from the URL
@@ -136,13 +210,32 @@ func handleCreateUpdate(service CabService) func(http.ResponseWriter, *http.Requ
 			return
 		}
 
+		err = service.Upsert(cab)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), statusOf(err))
 			return
 		}
-		err = service.Upsert(cab)
+	}
+}
+
+func handleSetStatus(service CabService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		cabId, err := strconv.ParseUint(mux.Vars(r)["cabId"], 10, 64)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body := struct {
+			Status CabStatus `json:"status"`
+		}{}
+		if err = readJson(w, r, &body); err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
+		}
+		if err = service.SetStatus(Id(cabId), body.Status); err != nil {
+			http.Error(w, err.Error(), statusOf(err))
 			return
 		}
 	}
@@ -150,38 +243,29 @@ func handleCreateUpdate(service CabService) func(http.ResponseWriter, *http.Requ
 
 func handleGet(service CabService) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		addHeaders(&w)
+		contentType, ok := addCabHeaders(w, r)
+		if !ok {
+			return
+		}
 
 		params := mux.Vars(r)
 		cabId, err := strconv.ParseUint(params["cabId"], 10, 64)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
 		cab, err := service.Read(Id(cabId))
-		switch err {
-		case nil:
-			if jsonStr, err2 := json.Marshal(cab); err2 != nil {
-				http.Error(w, err2.Error(), http.StatusInternalServerError)
-				return
-			} else {
-				w.Write(jsonStr)
-				return
-			}
-
-		case ErrorNotFound:
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		writeCabs(w, contentType, cab, err)
 	}
 }
 
 func handleQuery(service CabService) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		addHeaders(&w)
+		contentType, ok := addCabHeaders(w, r)
+		if !ok {
+			return
+		}
 
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -207,40 +291,79 @@ func handleQuery(service CabService) func(http.ResponseWriter, *http.Request) {
 		if len(r.FormValue("limit")) > 0 {
 			limit, _ = strconv.ParseUint(r.FormValue("limit"), 10, 64)
 		}
+		model, err := geo.ParseModel(r.FormValue("model"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		maxAccuracy := 0.
+		if len(r.FormValue("maxAccuracy")) > 0 {
+			if maxAccuracy, err = strconv.ParseFloat(r.FormValue("maxAccuracy"), 64); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 
-		cabs, err := service.Query(GeoWithin{
+		query := GeoWithin{
 			Center: Location{
 				Longitude: longitude,
 				Latitude:  latitude,
 			},
-			Radius: radius,
-			Unit:   Meters,
-			Limit:  int(limit)})
-		switch err {
-		case nil:
-			if jsonStr, err2 := json.Marshal(cabs); err2 != nil {
-				http.Error(w, err2.Error(), http.StatusInternalServerError)
-				return
-			} else {
-				w.Write(jsonStr)
-				return
-			}
+			Radius:      radius,
+			Unit:        Meters,
+			Limit:       int(limit),
+			Model:       model,
+			MaxAccuracy: maxAccuracy}
+		cabs, err := service.Query(query)
+		writeCabs(w, contentType, queryResult{*Sanitize(&query), cabs}, err)
+	}
+}
 
-		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+func handlePostQuery(service CabService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contentType, ok := addCabHeaders(w, r)
+		if !ok {
+			return
+		}
+
+		query, err := decodeQuery(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
+		}
+		cabs, err := service.Query(query)
+		writeCabs(w, contentType, queryResult{*Sanitize(&query), cabs}, err)
+	}
+}
+
+func handleQueryRegion(service CabService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contentType, ok := addCabHeaders(w, r)
+		if !ok {
+			return
+		}
+
+		query := GeoRegion{}
+		if err := readJson(w, r, &query); err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
 			return
 		}
+		cabs, err := service.QueryRegion(query)
+		writeCabs(w, contentType, cabs, err)
 	}
 }
 
 func handleDelete(service CabService) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		addHeaders(&w)
+		if _, ok := addCabHeaders(w, r); !ok {
+			return
+		}
 
 		params := mux.Vars(r)
 		cabId, err := strconv.ParseUint(params["cabId"], 10, 64)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
 		err = service.Delete(Id(cabId))
@@ -252,7 +375,9 @@ func handleDelete(service CabService) func(http.ResponseWriter, *http.Request) {
 
 func handleDeleteAll(service CabService) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		addHeaders(&w)
+		if _, ok := addCabHeaders(w, r); !ok {
+			return
+		}
 
 		err := service.DeleteAll()
 		if err != nil {
@@ -260,3 +385,188 @@ func handleDeleteAll(service CabService) func(http.ResponseWriter, *http.Request
 		}
 	}
 }
+
+// Decodes the list of cabs in the request body of a bulk update.  The body is either a
+// json array, newline delimited json (one cab per line), or a CabList in protobuf or text format.
+func decodeCabs(w http.ResponseWriter, r *http.Request) (cabs []Cab, err error) {
+	contentType := mediaType(r.Header.Get("Content-Type"))
+	body, err := readBody(w, r, maxBulkBody)
+	if err != nil {
+		return
+	}
+
+	cabs = make([]Cab, 0)
+	switch contentType {
+	case contentTypeNdjson:
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(make([]byte, 4096), len(body)+1)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			cab := Cab{}
+			if err = json.Unmarshal(line, &cab); err != nil {
+				return
+			}
+			cabs = append(cabs, cab)
+		}
+		err = scanner.Err()
+	case contentTypeProtobuf, contentTypeProtoText:
+		list := Tally.CabList{}
+		if contentType == contentTypeProtoText {
+			err = proto.UnmarshalText(string(body), &list)
+		} else {
+			err = proto.Unmarshal(body, &list)
+		}
+		if err != nil {
+			return
+		}
+		for _, c := range list.Cabs {
+			cabs = append(cabs, fromProtoCab(c))
+		}
+	case contentTypeJson, "":
+		err = json.Unmarshal(body, &cabs)
+	default:
+		err = errors.New("Unsupported content type: " + contentType)
+	}
+	return
+}
+
+// Returns the http status of the error reading a request body: 413 if larger than allowed, or
+// else 400.
+func bodyStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Returns the http status of the error from a service call
+func statusOf(err error) int {
+	switch err {
+	case nil:
+		return http.StatusOK
+	case ErrorNotFound:
+		return http.StatusNotFound
+	case ErrorBadParam:
+		return http.StatusBadRequest
+	case ErrorInvalidState:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Writes the value as json, or the http error for the service call's error.
+func writeJson(w http.ResponseWriter, value interface{}, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	if jsonStr, err2 := json.Marshal(value); err2 != nil {
+		http.Error(w, err2.Error(), http.StatusInternalServerError)
+	} else {
+		w.Write(jsonStr)
+	}
+}
+
+// Decodes the json request body, up to maxBulkBody bytes, into the value.
+func readJson(w http.ResponseWriter, r *http.Request, value interface{}) error {
+	body, err := readBody(w, r, maxBulkBody)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, value)
+}
+
+// Reads the request body, or fails with a *http.MaxBytesError if larger than max bytes.
+func readBody(w http.ResponseWriter, r *http.Request, max int64) ([]byte, error) {
+	return ioutil.ReadAll(http.MaxBytesReader(w, r.Body, max))
+}
+
+func handleBulkCreateUpdate(service CabService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contentType, ok := addCabHeaders(w, r)
+		if !ok {
+			return
+		}
+
+		cabs, err := decodeCabs(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
+		}
+
+		// Cabs without an id are rejected individually and not sent to the service.
+		items := make([]BatchItem, len(cabs))
+		valid := make([]Cab, 0, len(cabs))
+		index := make([]int, 0, len(cabs))
+		for i, cab := range cabs {
+			items[i].Id = cab.Id
+			if cab.Id == Id(0) {
+				items[i].Status = http.StatusBadRequest
+				items[i].Error = "Missing cab id"
+				continue
+			}
+			valid = append(valid, cab)
+			index = append(index, i)
+		}
+
+		errs, err := service.UpsertBatch(valid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for j, i := range index {
+			items[i].Status = statusOf(errs[j])
+			if errs[j] != nil {
+				items[i].Error = errs[j].Error()
+			}
+		}
+
+		writeCabs(w, contentType, items, nil)
+	}
+}
+
+func handleBatchGet(service CabService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contentType, ok := addCabHeaders(w, r)
+		if !ok {
+			return
+		}
+
+		ids := make([]Id, 0)
+		for _, s := range strings.Split(r.FormValue("ids"), ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			cabId, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ids = append(ids, Id(cabId))
+		}
+
+		cabs, errs, err := service.ReadBatch(ids)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		items := make([]BatchItem, len(ids))
+		for i, id := range ids {
+			items[i].Id = id
+			items[i].Status = statusOf(errs[i])
+			if errs[i] != nil {
+				items[i].Error = errs[i].Error()
+			} else {
+				cab := cabs[i]
+				items[i].Cab = &cab
+			}
+		}
+
+		writeCabs(w, contentType, items, nil)
+	}
+}
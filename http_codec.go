@@ -0,0 +1,288 @@
+package tally
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/json"
+	"errors"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/proto"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Media types of the cab endpoints, besides json.  The proto text format is mostly for debugging.
+const (
+	contentTypeProtoText = "text/x-protobuf"
+)
+
+// Aliases of the protobuf media type used by other clients
+var protobufAliases = map[string]string{
+	"application/protobuf":            contentTypeProtobuf,
+	"application/vnd.google.protobuf": contentTypeProtobuf,
+	"application/x-protobuf":          contentTypeProtobuf,
+	contentTypeProtoText:              contentTypeProtoText,
+}
+
+// Returns the media type, mapping the aliases of protobuf.
+func mediaType(header string) string {
+	contentType, _, _ := mime.ParseMediaType(header)
+	if alias, exists := protobufAliases[contentType]; exists {
+		return alias
+	}
+	return contentType
+}
+
+// Returns the media type of the response by the Accept header: json, protobuf or proto text,
+// whichever the client prefers by quality.  Json is the default, including for wildcards.
+// Returns false if none of the accepted types is supported.
+func negotiate(r *http.Request) (string, bool) {
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return contentTypeJson, true
+	}
+	best, bestQ := "", 0.
+	for _, part := range strings.Split(accept, ",") {
+		contentType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.
+		if s, exists := params["q"]; exists {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		switch contentType {
+		case "*/*", "application/*", contentTypeJson:
+			contentType = contentTypeJson
+		default:
+			if contentType = protobufAliases[contentType]; contentType == "" {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = contentType, q
+		}
+	}
+	return best, best != ""
+}
+
+// Sets the headers of a cab endpoint's response by the negotiated media type.  If none of the
+// accepted types is supported, responds 406 and returns false.
+func addCabHeaders(w http.ResponseWriter, r *http.Request) (string, bool) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Vary", "Accept")
+	contentType, ok := negotiate(r)
+	if !ok {
+		http.Error(w, "Supported types: "+contentTypeJson+", "+contentTypeProtobuf+", "+contentTypeProtoText,
+			http.StatusNotAcceptable)
+		return "", false
+	}
+	w.Header().Set("Content-Type", contentType)
+	return contentType, true
+}
+
+// Writes the value in the media type, or the http error for the service call's error.
+// Values written as protobuf are a Cab, a list of cabs, a QueryResult or a list of BatchItems.
+func writeCabs(w http.ResponseWriter, contentType string, value interface{}, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	var buff []byte
+	switch contentType {
+	case contentTypeProtobuf:
+		buff, err = proto.Marshal(toProto(value))
+	case contentTypeProtoText:
+		buff = []byte(proto.MarshalTextString(toProto(value)))
+	default:
+		buff, err = json.Marshal(value)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(buff)
+}
+
+// Decodes the request body, up to maxBulkBody bytes, into the protobuf message, in binary or text
+// format.
+func readProto(w http.ResponseWriter, r *http.Request, contentType string, pb proto.Message) error {
+	body, err := readBody(w, r, maxBulkBody)
+	if err != nil {
+		return err
+	}
+	return unmarshalProto(body, contentType, pb)
+}
+
+// Decodes the protobuf message in binary or text format.
+func unmarshalProto(body []byte, contentType string, pb proto.Message) error {
+	if contentType == contentTypeProtoText {
+		return proto.UnmarshalText(string(body), pb)
+	}
+	return proto.Unmarshal(body, pb)
+}
+
+// Decodes the cab in the request body, in json, protobuf or proto text format.
+func decodeCab(w http.ResponseWriter, r *http.Request) (cab Cab, err error) {
+	switch contentType := mediaType(r.Header.Get("Content-Type")); contentType {
+	case contentTypeProtobuf, contentTypeProtoText:
+		pb := Tally.Cab{}
+		if err = readProto(w, r, contentType, &pb); err == nil {
+			cab = fromProtoCab(&pb)
+		}
+	case contentTypeJson, "":
+		err = readJson(w, r, &cab)
+	default:
+		err = errors.New("Unsupported content type: " + contentType)
+	}
+	return
+}
+
+// Decodes the query in the request body, in json, protobuf or proto text format.  The json
+// query has the same fields as the query parameters.
+func decodeQuery(w http.ResponseWriter, r *http.Request) (query GeoWithin, err error) {
+	switch contentType := mediaType(r.Header.Get("Content-Type")); contentType {
+	case contentTypeProtobuf, contentTypeProtoText:
+		pb := Tally.GeoWithin{}
+		if err = readProto(w, r, contentType, &pb); err == nil {
+			query, err = fromProtoQuery(&pb)
+		}
+	case contentTypeJson, "":
+		q := struct {
+			Latitude    float64   `json:"latitude"`
+			Longitude   float64   `json:"longitude"`
+			Radius      float64   `json:"radius"`
+			Limit       int       `json:"limit"`
+			Model       geo.Model `json:"model"`
+			MaxAccuracy float64   `json:"maxAccuracy"`
+		}{}
+		if err = readJson(w, r, &q); err == nil {
+			query = GeoWithin{
+				Center:      Location{Latitude: q.Latitude, Longitude: q.Longitude},
+				Radius:      q.Radius,
+				Unit:        Meters,
+				Limit:       q.Limit,
+				Model:       q.Model,
+				MaxAccuracy: q.MaxAccuracy,
+			}
+		}
+	default:
+		err = errors.New("Unsupported content type: " + contentType)
+	}
+	return
+}
+
+func toProtoCab(cab Cab) *Tally.Cab {
+	pb := &Tally.Cab{
+		Id:        proto.Uint64(uint64(cab.Id)),
+		Latitude:  proto.Float64(cab.Latitude),
+		Longitude: proto.Float64(cab.Longitude),
+	}
+	if cab.Status != "" {
+		pb.Status = proto.String(string(cab.Status))
+	}
+	if cab.Accuracy != 0 {
+		pb.Accuracy = proto.Float64(cab.Accuracy)
+	}
+	if cab.Altitude != 0 {
+		pb.Altitude = proto.Float64(cab.Altitude)
+	}
+	if cab.Speed != 0 {
+		pb.Speed = proto.Float64(cab.Speed)
+	}
+	if cab.Heading != 0 {
+		pb.Heading = proto.Float64(cab.Heading)
+	}
+	return pb
+}
+
+func fromProtoCab(pb *Tally.Cab) Cab {
+	return Cab{
+		Id:        Id(pb.GetId()),
+		Latitude:  pb.GetLatitude(),
+		Longitude: pb.GetLongitude(),
+		Status:    CabStatus(pb.GetStatus()),
+		Accuracy:  pb.GetAccuracy(),
+		Altitude:  pb.GetAltitude(),
+		Speed:     pb.GetSpeed(),
+		Heading:   pb.GetHeading(),
+	}
+}
+
+func fromProtoQuery(pb *Tally.GeoWithin) (GeoWithin, error) {
+	model, err := geo.ParseModel(pb.GetModel())
+	return GeoWithin{
+		Center:      Location{Latitude: pb.GetLatitude(), Longitude: pb.GetLongitude()},
+		Radius:      pb.GetRadius(),
+		Unit:        Meters,
+		Limit:       int(pb.GetLimit()),
+		Model:       model,
+		MaxAccuracy: pb.GetMaxAccuracy(),
+	}, err
+}
+
+func toProtoQuery(q GeoWithin) *Tally.GeoWithin {
+	pb := &Tally.GeoWithin{
+		Latitude:  proto.Float64(q.Center.Latitude),
+		Longitude: proto.Float64(q.Center.Longitude),
+		Radius:    proto.Float64(q.Radius),
+		Limit:     proto.Uint32(uint32(q.Limit)),
+	}
+	if q.Model != geo.DefaultModel {
+		pb.Model = proto.String(q.Model.String())
+	}
+	if q.MaxAccuracy > 0 {
+		pb.MaxAccuracy = proto.Float64(q.MaxAccuracy)
+	}
+	return pb
+}
+
+// Result of a query, with the query echoed in the protobuf encoding.  The json encoding is
+// the list of cabs only, as it always was.
+type queryResult struct {
+	query GeoWithin
+	cabs  []Cab
+}
+
+func (q queryResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.cabs)
+}
+
+// Returns the protobuf message of the value written by a cab endpoint.
+func toProto(value interface{}) proto.Message {
+	switch v := value.(type) {
+	case Cab:
+		return toProtoCab(v)
+	case []Cab:
+		list := &Tally.CabList{Cabs: make([]*Tally.Cab, len(v))}
+		for i, cab := range v {
+			list.Cabs[i] = toProtoCab(cab)
+		}
+		return list
+	case queryResult:
+		result := &Tally.QueryResult{Query: toProtoQuery(v.query), Cabs: make([]*Tally.Cab, len(v.cabs))}
+		for i, cab := range v.cabs {
+			result.Cabs[i] = toProtoCab(cab)
+		}
+		return result
+	case []BatchItem:
+		result := &Tally.BatchResult{Items: make([]*Tally.BatchItem, len(v))}
+		for i, item := range v {
+			result.Items[i] = &Tally.BatchItem{
+				Id:     proto.Uint64(uint64(item.Id)),
+				Status: proto.Int32(int32(item.Status)),
+			}
+			if item.Error != "" {
+				result.Items[i].Error = proto.String(item.Error)
+			}
+			if item.Cab != nil {
+				result.Items[i].Cab = toProtoCab(*item.Cab)
+			}
+		}
+		return result
+	}
+	panic("No protobuf message for the value")
+}
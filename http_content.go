@@ -0,0 +1,60 @@
+package tally
+
+import (
+	"github.com/gorilla/mux"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Returns the url routes of the content api, serving the blobs stored out of line by their hash,
+// e.g. the photo of an event.  Ranges are served for seeking in audio and video, and blobs never
+// change, so they are cached for good.  Only images, audio and video are served as their type;
+// other blobs are served as attachments, so that an uploaded page cannot run on this origin:
+//
+//	GET /v1/content/9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+func ContentRoutes(store ContentStore) Routes {
+	return func(router *mux.Router) {
+		router.Methods("GET", "HEAD").Path("/v1/content/{hash}").HandlerFunc(handleGetContent(store))
+	}
+}
+
+func handleGetContent(store ContentStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := mux.Vars(r)["hash"]
+		blob, err := store.Open(hash)
+		if err != nil {
+			http.Error(w, err.Error(), statusOf(err))
+			return
+		}
+		defer blob.Close()
+
+		if mediaType, inline := servedMime(blob.Mime()); inline {
+			w.Header().Set("Content-Type", mediaType)
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", "attachment")
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("ETag", `"`+hash+`"`)
+		http.ServeContent(w, r, "", time.Time{}, blob)
+	}
+}
+
+// Returns the media type of the mime type and true if blobs of it are served as such: images,
+// audio and video, but not SVG images, which may carry scripts.
+func servedMime(mimeType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil || mediaType == "image/svg+xml" {
+		return "", false
+	}
+	for _, prefix := range []string{"image/", "audio/", "video/"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return mediaType, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,95 @@
+package tally
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// Returns the url routes of the dispatch api.  Riders submit and poll pickups; cabs poll their
+// offers and accept or decline them.  Offers not replied to in time are timed out by the service.
+func DispatchRoutes(service DispatchService) Routes {
+	return func(router *mux.Router) {
+		// Rider requests
+		router.Methods("POST").Path("/dispatch/pickups").HandlerFunc(handleRequestPickup(service))
+		router.Methods("GET").Path("/dispatch/pickups/{pickupId}").HandlerFunc(handleGetPickup(service))
+		router.Methods("DELETE").Path("/dispatch/pickups/{pickupId}").HandlerFunc(handleCancelPickup(service))
+		// Hack to work around browsers problems with DELETE
+		router.Methods("POST").Path("/dispatch/pickups/{pickupId}/cancel").HandlerFunc(handleCancelPickup(service))
+
+		// Cab replies
+		router.Methods("GET").Path("/dispatch/cabs/{cabId}/offers").HandlerFunc(handleGetOffers(service))
+		router.Methods("POST").Path("/dispatch/offers/{offerId}/accept").HandlerFunc(handleReplyOffer(service.Accept))
+		router.Methods("POST").Path("/dispatch/offers/{offerId}/decline").HandlerFunc(handleReplyOffer(service.Decline))
+	}
+}
+
+func handleRequestPickup(service DispatchService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		pickup := Pickup{}
+		if err := readJson(w, r, &pickup); err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
+		}
+		pickup, err := service.Request(pickup)
+		writeJson(w, pickup, err)
+	}
+}
+
+func handleGetPickup(service DispatchService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		pickupId, err := strconv.ParseUint(mux.Vars(r)["pickupId"], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pickup, err := service.Pickup(Id(pickupId))
+		writeJson(w, pickup, err)
+	}
+}
+
+func handleCancelPickup(service DispatchService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		pickupId, err := strconv.ParseUint(mux.Vars(r)["pickupId"], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pickup, err := service.Cancel(Id(pickupId))
+		writeJson(w, pickup, err)
+	}
+}
+
+func handleGetOffers(service DispatchService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		cabId, err := strconv.ParseUint(mux.Vars(r)["cabId"], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		offers, err := service.Offers(Id(cabId))
+		writeJson(w, offers, err)
+	}
+}
+
+func handleReplyOffer(reply func(Id) (Offer, error)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		offerId, err := strconv.ParseUint(mux.Vars(r)["offerId"], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		offer, err := reply(Id(offerId))
+		writeJson(w, offer, err)
+	}
+}
@@ -0,0 +1,100 @@
+package tally
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returns the url routes of the heatmap api.  The box is given by the south, west, north and east
+// parameters, and the cells by either cell, in degrees, or precision, in geohash digits, e.g.
+//
+//	/v1/heatmap/cabs?south=37.7&west=-122.5&north=37.8&east=-122.4&cell=0.01&status=available
+//	/v1/heatmap/events?south=37.7&west=-122.5&north=37.8&east=-122.4&precision=6&type=pickup
+//		&from=2014-05-01T00:00:00Z&to=2014-05-02T00:00:00Z
+func HeatmapRoutes(service HeatmapService) Routes {
+	return func(router *mux.Router) {
+		router.Methods("GET").Path("/v1/heatmap/cabs").HandlerFunc(handleCabHeatmap(service))
+		router.Methods("GET").Path("/v1/heatmap/events").HandlerFunc(handleEventHeatmap(service))
+	}
+}
+
+// Parses the box and cells of a heatmap query from the url parameters.
+func parseHeatmapQuery(r *http.Request) (q HeatmapQuery, err error) {
+	bounds := []*float64{&q.Bounds.South, &q.Bounds.West, &q.Bounds.North, &q.Bounds.East}
+	for i, name := range []string{"south", "west", "north", "east"} {
+		if *bounds[i], err = strconv.ParseFloat(r.FormValue(name), 64); err != nil {
+			return
+		}
+	}
+	if s := r.FormValue("cell"); s != "" {
+		if q.CellSize, err = strconv.ParseFloat(s, 64); err != nil {
+			return
+		}
+	}
+	if s := r.FormValue("precision"); s != "" {
+		if q.Precision, err = strconv.Atoi(s); err != nil {
+			return
+		}
+	}
+	return q, q.Validate()
+}
+
+// Parses the filter of events from the url parameters id, type, source, tags as a comma separated
+// list, maxAccuracy in meters, and from and to in RFC 3339, e.g. 2014-05-01T00:00:00-04:00.  Those
+// missing match all events.
+func EventFilter(r *http.Request) (filter EventQuery, err error) {
+	filter = EventQuery{Id: r.FormValue("id"), Type: r.FormValue("type"), Source: r.FormValue("source")}
+	if s := r.FormValue("tags"); s != "" {
+		filter.Tags = strings.Split(s, ",")
+	}
+	if s := r.FormValue("maxAccuracy"); s != "" {
+		if filter.MaxAccuracy, err = strconv.ParseFloat(s, 64); err != nil {
+			return
+		}
+	}
+	times := []*time.Time{&filter.From, &filter.To}
+	for i, name := range []string{"from", "to"} {
+		if s := r.FormValue(name); s != "" {
+			if *times[i], err = time.Parse(time.RFC3339, s); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func handleCabHeatmap(service HeatmapService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		q, err := parseHeatmapQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cells, err := service.Cabs(q, CabStatus(r.FormValue("status")))
+		writeJson(w, cells, err)
+	}
+}
+
+func handleEventHeatmap(service HeatmapService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		q, err := parseHeatmapQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter, err := EventFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cells, err := service.Events(q, filter)
+		writeJson(w, cells, err)
+	}
+}
@@ -0,0 +1,110 @@
+package tally
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// Returns the url routes of the places api.  Places of a source are detected from its location
+// events on request, and can then be listed, named and their visits read, e.g.
+//
+//	POST /v1/places/detect?source=alice
+//	GET  /v1/places?source=alice
+//	PUT  /v1/places/1 {"name": "home"}
+//	GET  /v1/places/1/visits
+func PlaceRoutes(service PlaceService) Routes {
+	return func(router *mux.Router) {
+		router.Methods("POST").Path("/v1/places/detect").HandlerFunc(handleDetectPlaces(service))
+		router.Methods("GET").Path("/v1/places").HandlerFunc(handleGetPlaces(service))
+		router.Methods("GET").Path("/v1/places/{placeId}").HandlerFunc(handleGetPlace(service))
+		router.Methods("PUT").Path("/v1/places/{placeId}").HandlerFunc(handleNamePlace(service))
+		router.Methods("GET").Path("/v1/places/{placeId}/visits").HandlerFunc(handleGetVisits(service))
+
+		// Hack to work around browsers problems with PUT
+		router.Methods("POST").Path("/v1/places/{placeId}").HandlerFunc(handleNamePlace(service))
+	}
+}
+
+// Parses the place id from the url.
+func placeIdOf(r *http.Request) (Id, error) {
+	placeId, err := strconv.ParseUint(mux.Vars(r)["placeId"], 10, 64)
+	return Id(placeId), err
+}
+
+func handleDetectPlaces(service PlaceService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		source := r.FormValue("source")
+		if source == "" {
+			http.Error(w, "Missing source", http.StatusBadRequest)
+			return
+		}
+		places, err := service.Detect(source)
+		writeJson(w, places, err)
+	}
+}
+
+func handleGetPlaces(service PlaceService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		source := r.FormValue("source")
+		if source == "" {
+			http.Error(w, "Missing source", http.StatusBadRequest)
+			return
+		}
+		places, err := service.Places(source)
+		writeJson(w, places, err)
+	}
+}
+
+func handleGetPlace(service PlaceService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		placeId, err := placeIdOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		place, err := service.Read(placeId)
+		writeJson(w, place, err)
+	}
+}
+
+func handleNamePlace(service PlaceService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		placeId, err := placeIdOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		named := struct {
+			Name string `json:"name"`
+		}{}
+		if err := readJson(w, r, &named); err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
+		}
+		place, err := service.Name(placeId, named.Name)
+		writeJson(w, place, err)
+	}
+}
+
+func handleGetVisits(service PlaceService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		placeId, err := placeIdOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		visits, err := service.Visits(placeId)
+		writeJson(w, visits, err)
+	}
+}
@@ -0,0 +1,178 @@
+package tally
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// Returns the url routes of the rides api.
+func RideRoutes(service RideService) Routes {
+	return func(router *mux.Router) {
+		router.Methods("POST").Path("/rides").HandlerFunc(handleCreateRide(service))
+		router.Methods("GET").Path("/rides/{rideId}").HandlerFunc(handleGetRide(service))
+		router.Methods("PUT").Path("/rides/{rideId}").HandlerFunc(handleUpdateRide(service))
+		router.Methods("DELETE").Path("/rides/{rideId}").HandlerFunc(handleDeleteRide(service))
+		router.Methods("POST").Path("/rides/{rideId}/transitions").HandlerFunc(handleTransitionRide(service))
+		router.Methods("POST").Path("/rides/{rideId}/track").HandlerFunc(handleTrackRide(service))
+
+		// Hack to work around browsers problems with PUT and DELETE
+		router.Methods("POST").Path("/rides/{rideId}").HandlerFunc(handleUpdateRide(service))
+		router.Methods("POST").Path("/rides/{rideId}/delete").HandlerFunc(handleDeleteRide(service))
+	}
+}
+
+// Returns the url routes for the fares of rides.  The fare of a stored ride is computed from its
+// track, and the fare of any completed ride with its track can be computed by posting it.
+func FareRoutes(rides RideService, fares FareCalculator) Routes {
+	return func(router *mux.Router) {
+		router.Methods("GET").Path("/rides/{rideId}/fare").HandlerFunc(handleGetFare(rides, fares))
+		router.Methods("POST").Path("/fares").HandlerFunc(handleComputeFare(fares))
+	}
+}
+
+// Parses the ride id from the url.
+func rideIdOf(r *http.Request) (Id, error) {
+	rideId, err := strconv.ParseUint(mux.Vars(r)["rideId"], 10, 64)
+	return Id(rideId), err
+}
+
+func handleCreateRide(service RideService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		ride := Ride{}
+		if err := readJson(w, r, &ride); err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
+		}
+		ride, err := service.Create(ride)
+		writeJson(w, ride, err)
+	}
+}
+
+func handleGetRide(service RideService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		rideId, err := rideIdOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ride, err := service.Read(rideId)
+		writeJson(w, ride, err)
+	}
+}
+
+func handleUpdateRide(service RideService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		rideId, err := rideIdOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ride := Ride{}
+		if err := readJson(w, r, &ride); err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
+		}
+		if ride.Id == Id(0) {
+			ride.Id = rideId // fill in the missing Id from the URL
+		}
+		if ride.Id != rideId {
+			http.Error(w, "Ride Id and URL mismatch", http.StatusBadRequest)
+			return
+		}
+		ride, err = service.Update(ride)
+		writeJson(w, ride, err)
+	}
+}
+
+func handleDeleteRide(service RideService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		rideId, err := rideIdOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = service.Delete(rideId); err != nil {
+			http.Error(w, err.Error(), statusOf(err))
+		}
+	}
+}
+
+func handleTransitionRide(service RideService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		rideId, err := rideIdOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		transition := RideTransition{}
+		if err := readJson(w, r, &transition); err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
+		}
+		ride, err := service.Transition(rideId, transition)
+		writeJson(w, ride, err)
+	}
+}
+
+func handleTrackRide(service RideService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		rideId, err := rideIdOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		points := []TrackPoint{}
+		if err := readJson(w, r, &points); err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
+		}
+		ride, err := service.Track(rideId, points)
+		writeJson(w, ride, err)
+	}
+}
+
+func handleGetFare(rides RideService, fares FareCalculator) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		rideId, err := rideIdOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ride, err := rides.Read(rideId)
+		if err != nil {
+			http.Error(w, err.Error(), statusOf(err))
+			return
+		}
+		receipt, err := fares.Fare(ride)
+		writeJson(w, receipt, err)
+	}
+}
+
+func handleComputeFare(fares FareCalculator) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		ride := Ride{}
+		if err := readJson(w, r, &ride); err != nil {
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
+		}
+		receipt, err := fares.Fare(ride)
+		writeJson(w, receipt, err)
+	}
+}
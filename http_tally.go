@@ -0,0 +1,66 @@
+package tally
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+// Number of events in a period starting at the time
+type EventTally struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// Returns the url routes of the event tallies: the number of events matching the filter by day,
+// week or month, in the IANA time zone tz or else the source's in the zones, e.g.
+//
+//	GET /v1/events/tally?source=alice&type=coffee&from=2014-06-01T00:00:00Z&to=2014-07-01T00:00:00Z&period=day&tz=Europe/Paris
+func EventTallyRoutes(store EventStore, zones Zones) Routes {
+	return func(router *mux.Router) {
+		router.Methods("GET").Path("/v1/events/tally").HandlerFunc(handleTallyEvents(store, zones))
+	}
+}
+
+func handleTallyEvents(store EventStore, zones Zones) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		filter, err := EventFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filter.From.IsZero() || !filter.To.After(filter.From) {
+			http.Error(w, "Missing time range", http.StatusBadRequest)
+			return
+		}
+		period := PeriodDay
+		if s := r.FormValue("period"); s != "" {
+			period = Period(s)
+		}
+		zone, err := parseZone(r, filter.Source, zones)
+		if err == nil {
+			err = period.Validate()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Whole periods, from the start of the first
+		starts := Buckets(filter.From.In(zone), filter.To, period)
+		tallies := make([]EventTally, len(starts))
+		for i, start := range starts {
+			tallies[i].Start = start
+		}
+		filter.From = starts[0]
+		events, err := store.Find(filter)
+		for i := range events {
+			if b := BucketOf(starts, EventTime(&events[i])); b >= 0 {
+				tallies[b].Count++
+			}
+		}
+		writeJson(w, tallies, err)
+	}
+}
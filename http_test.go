@@ -2,12 +2,20 @@ package tally
 
 import (
 	"bytes"
+	"code.google.com/p/goprotobuf/proto"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/proto"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var client = &http.Client{}
@@ -18,10 +26,16 @@ type mock struct {
 	// record the parameters passed to the api calls
 	id          Id
 	withinQuery GeoWithin
+	regionQuery *GeoRegion
 	cab         Cab
 
 	// which method is called?
 	calledRead, calledUpsert, calledWithin, calledDelete, calledDeleteAll bool
+	calledUpsertBatch, calledReadBatch, calledSetStatus                   bool
+
+	// parameters of the batch calls
+	batchCabs *[]Cab
+	batchIds  *[]Id
 
 	// mock responses
 	mockGetResponse   *Cab
@@ -44,14 +58,54 @@ func (ts *mock) Read(id Id) (cab Cab, err error) {
 	return
 }
 
-// Implements CabService
+// Implements CabService.  Cabs with negative latitude fail, e.g. as outside every shard.
 func (ts *mock) Upsert(cab Cab) (err error) {
 	ts.calledUpsert = true
 	ts.id = cab.Id
 	ts.cab = cab
+	if cab.Latitude < 0 {
+		return ErrorBadParam
+	}
+	return nil
+}
+
+// Implements CabService
+func (ts *mock) SetStatus(id Id, status CabStatus) (err error) {
+	ts.calledSetStatus = true
+	ts.id = id
+	ts.cab.Status = status
 	return nil
 }
 
+// Implements CabService.  Cabs with negative latitude fail.
+func (ts *mock) UpsertBatch(cabs []Cab) (errs []error, err error) {
+	ts.calledUpsertBatch = true
+	ts.batchCabs = &cabs
+	errs = make([]error, len(cabs))
+	for i, cab := range cabs {
+		if cab.Latitude < 0 {
+			errs[i] = ErrorBadParam
+		}
+	}
+	return
+}
+
+// Implements CabService.  Only odd ids are found.
+func (ts *mock) ReadBatch(ids []Id) (cabs []Cab, errs []error, err error) {
+	ts.calledReadBatch = true
+	ts.batchIds = &ids
+	cabs = make([]Cab, len(ids))
+	errs = make([]error, len(ids))
+	for i, id := range ids {
+		if id%2 == 1 {
+			cabs[i] = Cab{Id: id, Latitude: 1., Longitude: 2.}
+		} else {
+			errs[i] = ErrorNotFound
+		}
+	}
+	return
+}
+
 // Implements CabService
 func (ts *mock) Delete(id Id) (err error) {
 	ts.calledDelete = true
@@ -70,6 +124,17 @@ func (ts *mock) Query(q GeoWithin) (cabs []Cab, err error) {
 	return
 }
 
+// Implements CabService
+func (ts *mock) QueryRegion(q GeoRegion) (cabs []Cab, err error) {
+	ts.calledWithin = true
+	ts.regionQuery = &q
+	if ts.mockQueryResponse != nil {
+		cabs = *ts.mockQueryResponse
+		ts.clear()
+	}
+	return
+}
+
 // Implements CabService
 func (ts *mock) DeleteAll() (err error) {
 	ts.calledDeleteAll = true
@@ -146,6 +211,44 @@ func TestHttpCreateUpdate(test *testing.T) {
 	}
 }
 
+func TestHttpCreateUpdateBadParam(test *testing.T) {
+	_, stop, stopped := runServer(8202)
+	defer func() {
+		stop <- true
+		<-stopped
+	}()
+
+	req, err := http.NewRequest("PUT", "http://localhost:8202/cabs/1234",
+		strings.NewReader(`{"latitude": -10, "longitude": 100}`))
+	check(err)
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	check(err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		test.Error("Expect 400", resp)
+	}
+}
+
+func TestHttpSetStatus(test *testing.T) {
+	service, stop, stopped := runServer(8203)
+	defer func() {
+		stop <- true
+		<-stopped
+	}()
+
+	req, err := http.NewRequest("PUT", "http://localhost:8203/cabs/1234/status",
+		strings.NewReader(`{"status": "dispatched"}`))
+	check(err)
+	resp, err := client.Do(req)
+	check(err)
+	resp.Body.Close()
+	expected := mock{calledSetStatus: true, id: 1234, cab: Cab{Status: CabDispatched}}
+	if resp.StatusCode != 200 || *service != expected {
+		test.Error("Expect the status set", resp.StatusCode, *service)
+	}
+}
+
 func TestHttpGet(test *testing.T) {
 	service, stop, stopped := runServer(8182)
 
@@ -257,6 +360,51 @@ func TestHttpQuery(test *testing.T) {
 	}
 }
 
+func TestHttpQueryRegion(test *testing.T) {
+	port := 8193
+	service, stop, stopped := runServer(port)
+	defer func() {
+		stop <- true
+		<-stopped
+	}()
+
+	mockResult := []Cab{Cab{Id: 1234, Latitude: 37.78, Longitude: -122.41}}
+	service.mockQueryResponse = &mockResult
+
+	url := fmt.Sprintf("http://localhost:%d/cabs/within", port)
+	body := `{"geometry": {"type": "LineString", "coordinates": [[-122.42, 37.77], [-122.40, 37.79]]},
+		"distance": 300, "unit": "m", "limit": 20}`
+	resp, err := client.Post(url, "application/json", strings.NewReader(body))
+	check(err)
+	if resp.StatusCode != 200 {
+		test.Error("Expect 200", resp)
+	}
+	q := service.regionQuery
+	if q == nil || len(q.Route) != 2 || q.Route[1] != [2]float64{-122.40, 37.79} ||
+		q.Distance != 300 || q.Unit != Meters || q.Limit != 20 {
+		test.Error("Query failed", q)
+	}
+	buff, err := ioutil.ReadAll(resp.Body)
+	check(err)
+	cabs := []Cab{}
+	check(json.Unmarshal(buff, &cabs))
+	if equal, index := checkSlices(mockResult, cabs); !equal {
+		test.Error("Expect response", index, mockResult, cabs)
+	}
+
+	// Unsupported geometries and open polygons are bad requests
+	for _, body := range []string{
+		`{"geometry": {"type": "Circle", "coordinates": [0, 0]}}`,
+		`{"geometry": {"type": "Polygon", "coordinates": [[[0, 0], [1, 1]]]}}`,
+	} {
+		resp, err := client.Post(url, "application/json", strings.NewReader(body))
+		check(err)
+		if resp.StatusCode != 400 {
+			test.Error("Expect 400 for", body, resp.StatusCode)
+		}
+	}
+}
+
 func TestHttpDestroy(test *testing.T) {
 	port := 8184
 	service, stop, stopped := runServer(port)
@@ -313,3 +461,913 @@ func TestHttpDestroyAll(test *testing.T) {
 		test.Error("Expect 200", resp)
 	}
 }
+
+func postBulk(test *testing.T, port int, contentType string, body []byte) (service *mock, items []BatchItem) {
+	service, stop, stopped := runServer(port)
+
+	url := fmt.Sprintf("http://localhost:%d/cabs", port)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	check(err)
+	req.Header.Add("Content-Type", contentType)
+
+	resp, err := client.Do(req)
+	check(err)
+
+	stop <- true
+	<-stopped
+
+	if resp.StatusCode != 200 {
+		test.Error("Expect 200", resp)
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	check(err)
+	items = []BatchItem{}
+	check(json.Unmarshal(respBody, &items))
+	return
+}
+
+func TestHttpBulkCreateUpdate(test *testing.T) {
+	cabs := []Cab{
+		Cab{Id: 1, Latitude: 10., Longitude: 100.},
+		Cab{Latitude: 11., Longitude: 101.},
+		Cab{Id: 3, Latitude: -12., Longitude: 102.},
+	}
+	expected := []BatchItem{
+		BatchItem{Id: 1, Status: http.StatusOK},
+		BatchItem{Id: 0, Status: http.StatusBadRequest, Error: "Missing cab id"},
+		BatchItem{Id: 3, Status: http.StatusBadRequest, Error: ErrorBadParam.Error()},
+	}
+
+	jsonArray, err := json.Marshal(cabs)
+	check(err)
+
+	ndjson := []byte{}
+	for _, cab := range cabs {
+		line, err := json.Marshal(cab)
+		check(err)
+		ndjson = append(append(ndjson, line...), '\n')
+	}
+
+	list := Tally.CabList{}
+	for _, cab := range cabs {
+		list.Cabs = append(list.Cabs, &Tally.Cab{
+			Id:        proto.Uint64(uint64(cab.Id)),
+			Latitude:  proto.Float64(cab.Latitude),
+			Longitude: proto.Float64(cab.Longitude),
+		})
+	}
+	pb, err := proto.Marshal(&list)
+	check(err)
+
+	bodies := map[string][]byte{
+		"application/json":       jsonArray,
+		"application/x-ndjson":   ndjson,
+		"application/x-protobuf": pb,
+	}
+	port := 8186
+	for contentType, body := range bodies {
+		service, items := postBulk(test, port, contentType, body)
+		port++
+
+		if !service.calledUpsertBatch || service.batchCabs == nil {
+			test.Error("UpsertBatch not called", contentType)
+			continue
+		}
+		if equal, index := checkSlices([]Cab{cabs[0], cabs[2]}, *service.batchCabs); !equal {
+			test.Error("Expect cabs", contentType, index, *service.batchCabs)
+		}
+		if len(items) != len(expected) {
+			test.Error("Expect response", contentType, expected, items)
+			continue
+		}
+		for i := range items {
+			if items[i] != expected[i] {
+				test.Error("Expect item", contentType, expected[i], items[i])
+			}
+		}
+	}
+}
+
+func TestHttpBodyLimits(test *testing.T) {
+	port := 8201
+	service, stop, stopped := runServer(port)
+	defer func() {
+		stop <- true
+		<-stopped
+	}()
+	defer func(max int64) { maxBulkBody = max }(maxBulkBody)
+	maxBulkBody = 16
+
+	// Bulk updates, json bodies and protobuf bodies larger than allowed are refused
+	for _, r := range []struct{ method, path, contentType, body string }{
+		{"POST", "/cabs", "application/json", `[{"id": 1, "latitude": 10, "longitude": 100}]`},
+		{"POST", "/cabs", "application/x-ndjson", `{"id": 1, "latitude": 10, "longitude": 100}`},
+		{"POST", "/cabs/within", "application/json", `{"geometry": {"type": "Point", "coordinates": [0, 0]}}`},
+		{"PUT", "/cabs/1", contentTypeProtoText, "id: 1 latitude: 10 longitude: 100"},
+		{"POST", "/cabs/query", contentTypeProtoText, "latitude: 10 longitude: 100 radius: 100"},
+	} {
+		req, err := http.NewRequest(r.method, fmt.Sprintf("http://localhost:%d%s", port, r.path),
+			strings.NewReader(r.body))
+		check(err)
+		req.Header.Set("Content-Type", r.contentType)
+		resp, err := client.Do(req)
+		check(err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			test.Error("Expect 413 for", r.method, r.path, r.contentType, resp.StatusCode)
+		}
+	}
+	if service.calledUpsertBatch || service.regionQuery != nil {
+		test.Error("Expect no calls to the service", *service)
+	}
+}
+
+func TestHttpBatchGet(test *testing.T) {
+	port := 8189
+	service, stop, stopped := runServer(port)
+
+	url := fmt.Sprintf("http://localhost:%d/cabs?ids=1,2,3", port)
+	req, err := http.NewRequest("GET", url, nil)
+	check(err)
+
+	resp, err := client.Do(req)
+	check(err)
+
+	stop <- true
+	<-stopped
+
+	if !service.calledReadBatch || service.calledWithin {
+		test.Error("Expect ReadBatch called", *service)
+	}
+	if service.batchIds == nil || len(*service.batchIds) != 3 {
+		test.Error("Expect ids", service.batchIds)
+	}
+	if resp.StatusCode != 200 {
+		test.Error("Expect 200", resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	check(err)
+	items := []BatchItem{}
+	check(json.Unmarshal(body, &items))
+	if len(items) != 3 {
+		test.Error("Expect 3 items", items)
+		return
+	}
+	if items[0].Status != http.StatusOK || items[0].Cab == nil || *items[0].Cab != (Cab{Id: 1, Latitude: 1., Longitude: 2.}) {
+		test.Error("Expect found", items[0])
+	}
+	if items[1].Status != http.StatusNotFound || items[1].Cab != nil {
+		test.Error("Expect not found", items[1])
+	}
+	if items[2].Status != http.StatusOK || items[2].Cab == nil || items[2].Cab.Id != 3 {
+		test.Error("Expect found", items[2])
+	}
+}
+
+// Mock of the dispatch service that records the calls
+type mockDispatch struct {
+	pickup        Pickup
+	acceptedOffer Id
+}
+
+func (d *mockDispatch) Request(p Pickup) (Pickup, error) {
+	d.pickup = p
+	p.Id = 42
+	p.State = PickupPending
+	return p, nil
+}
+
+func (d *mockDispatch) Pickup(id Id) (Pickup, error) {
+	return Pickup{}, ErrorNotFound
+}
+
+func (d *mockDispatch) Cancel(id Id) (Pickup, error) {
+	return Pickup{}, ErrorNotFound
+}
+
+func (d *mockDispatch) Offers(cab Id) ([]Offer, error) {
+	return []Offer{}, nil
+}
+
+func (d *mockDispatch) Accept(offer Id) (Offer, error) {
+	d.acceptedOffer = offer
+	return Offer{Id: offer}, ErrorInvalidState
+}
+
+func (d *mockDispatch) Decline(offer Id) (Offer, error) {
+	return Offer{Id: offer}, nil
+}
+
+func (d *mockDispatch) Close() {
+}
+
+func TestHttpDispatch(test *testing.T) {
+	port := 8190
+	dispatch := &mockDispatch{}
+	httpServer := HttpServer(&mock{}, DispatchRoutes(dispatch))
+	httpServer.Addr = ":" + strconv.Itoa(port)
+	stop := make(chan bool)
+	stopped := RunServer(httpServer, stop)
+
+	body := []byte(`{"rider":"r1","location":{"latitude":40.5,"longitude":-74.2}}`)
+	resp, err := client.Post(fmt.Sprintf("http://localhost:%d/dispatch/pickups", port),
+		"application/json", bytes.NewBuffer(body))
+	check(err)
+	respBody, err := ioutil.ReadAll(resp.Body)
+	check(err)
+
+	accept, err := client.Post(fmt.Sprintf("http://localhost:%d/dispatch/offers/7/accept", port),
+		"application/json", nil)
+	check(err)
+
+	missing, err := client.Get(fmt.Sprintf("http://localhost:%d/dispatch/pickups/5", port))
+	check(err)
+
+	stop <- true
+	<-stopped
+
+	expected := Pickup{Rider: "r1", Location: Location{Latitude: 40.5, Longitude: -74.2}}
+	if dispatch.pickup.Rider != expected.Rider || dispatch.pickup.Location != expected.Location {
+		test.Error("Expect pickup", expected, dispatch.pickup)
+	}
+	pickup := Pickup{}
+	check(json.Unmarshal(respBody, &pickup))
+	if resp.StatusCode != 200 || pickup.Id != 42 || pickup.State != PickupPending {
+		test.Error("Expect pending pickup", resp.StatusCode, pickup)
+	}
+	if dispatch.acceptedOffer != 7 || accept.StatusCode != http.StatusConflict {
+		test.Error("Expect conflict on accepting offer 7", dispatch.acceptedOffer, accept.StatusCode)
+	}
+	if missing.StatusCode != http.StatusNotFound {
+		test.Error("Expect 404", missing.StatusCode)
+	}
+}
+
+// Mock of the ride service that records the transition requested
+type mockRides struct {
+	id         Id
+	transition RideTransition
+}
+
+func (m *mockRides) Create(ride Ride) (Ride, error) { return ride, nil }
+func (m *mockRides) Read(id Id) (Ride, error)       { return Ride{}, ErrorNotFound }
+func (m *mockRides) Update(ride Ride) (Ride, error) { return ride, ErrorInvalidState }
+func (m *mockRides) Delete(id Id) error             { return nil }
+func (m *mockRides) Close()                         {}
+
+func (m *mockRides) Track(id Id, points []TrackPoint) (Ride, error) {
+	return Ride{}, ErrorInvalidState
+}
+
+func (m *mockRides) Transition(id Id, t RideTransition) (Ride, error) {
+	m.id = id
+	m.transition = t
+	return Ride{Id: id, State: t.State, Cab: t.Cab}, nil
+}
+
+func TestHttpRideTransition(test *testing.T) {
+	port := 8191
+	rides := &mockRides{}
+	httpServer := HttpServer(&mock{}, RideRoutes(rides))
+	httpServer.Addr = ":" + strconv.Itoa(port)
+	stop := make(chan bool)
+	stopped := RunServer(httpServer, stop)
+
+	body := []byte(`{"state":"assigned","cab":12}`)
+	resp, err := client.Post(fmt.Sprintf("http://localhost:%d/rides/3/transitions", port),
+		"application/json", bytes.NewBuffer(body))
+	check(err)
+	respBody, err := ioutil.ReadAll(resp.Body)
+	check(err)
+
+	update, err := client.Post(fmt.Sprintf("http://localhost:%d/rides/3", port),
+		"application/json", bytes.NewBuffer([]byte(`{"rider":"x"}`)))
+	check(err)
+
+	stop <- true
+	<-stopped
+
+	if rides.id != 3 || rides.transition.State != RideAssigned || rides.transition.Cab != 12 {
+		test.Error("Expect transition", *rides)
+	}
+	ride := Ride{}
+	check(json.Unmarshal(respBody, &ride))
+	if resp.StatusCode != 200 || ride.Id != 3 || ride.State != RideAssigned {
+		test.Error("Expect assigned ride", resp.StatusCode, ride)
+	}
+	if update.StatusCode != http.StatusConflict {
+		test.Error("Expect 409", update.StatusCode)
+	}
+}
+
+func TestHttpContentNegotiation(test *testing.T) {
+	port := 8192
+	service, stop, stopped := runServer(port)
+	defer func() {
+		stop <- true
+		<-stopped
+	}()
+
+	do := func(method, path, contentType, accept string, body []byte) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", port, path), bytes.NewReader(body))
+		check(err)
+		if contentType != "" {
+			req.Header.Add("Content-Type", contentType)
+		}
+		if accept != "" {
+			req.Header.Add("Accept", accept)
+		}
+		resp, err := client.Do(req)
+		check(err)
+		buff, err := ioutil.ReadAll(resp.Body)
+		check(err)
+		return resp, buff
+	}
+
+	// Update in protobuf
+	pb, err := proto.Marshal(&Tally.Cab{Id: proto.Uint64(7), Latitude: proto.Float64(1.), Longitude: proto.Float64(2.)})
+	check(err)
+	if resp, _ := do("PUT", "/cabs/7", "application/x-protobuf", "", pb); resp.StatusCode != 200 ||
+		service.cab != (Cab{Id: 7, Latitude: 1., Longitude: 2.}) {
+		test.Error("Expect protobuf update", resp, service.cab)
+	}
+
+	// Read in protobuf, preferred by quality
+	service.mockGetResponse = &Cab{Id: 7, Latitude: 1., Longitude: 2., Status: CabOccupied}
+	resp, body := do("GET", "/cabs/7", "", "application/json;q=0.5, application/x-protobuf", nil)
+	cab := Tally.Cab{}
+	check(proto.Unmarshal(body, &cab))
+	if resp.Header.Get("Content-Type") != "application/x-protobuf" || cab.GetId() != 7 || cab.GetStatus() != "occupied" {
+		test.Error("Expect protobuf cab", resp.Header, cab)
+	}
+
+	// Query by a protobuf body, answered in proto text format
+	service.mockQueryResponse = &[]Cab{Cab{Id: 1, Latitude: 1., Longitude: 2.}}
+	pb, err = proto.Marshal(&Tally.GeoWithin{Latitude: proto.Float64(1.), Longitude: proto.Float64(2.), Radius: proto.Float64(100.)})
+	check(err)
+	resp, body = do("POST", "/cabs/query", "application/x-protobuf", "text/x-protobuf", pb)
+	result := Tally.QueryResult{}
+	check(proto.UnmarshalText(string(body), &result))
+	if service.withinQuery.Limit != 8 || service.withinQuery.Radius != 100. {
+		test.Error("Expect query with default limit", service.withinQuery)
+	}
+	if len(result.Cabs) != 1 || result.Cabs[0].GetId() != 1 || result.Query.GetRadius() != 100. {
+		test.Error("Expect query result", string(body))
+	}
+
+	// Batch read in protobuf
+	resp, body = do("GET", "/cabs?ids=1,2", "", "application/protobuf", nil)
+	batch := Tally.BatchResult{}
+	check(proto.Unmarshal(body, &batch))
+	if len(batch.Items) != 2 || batch.Items[0].GetCab().GetId() != 1 || batch.Items[1].GetStatus() != 404 {
+		test.Error("Expect batch result", batch)
+	}
+
+	// Json by default, and nothing else
+	if resp, _ = do("GET", "/cabs/7", "", "*/*", nil); resp.Header.Get("Content-Type") != "application/json" {
+		test.Error("Expect json", resp.Header)
+	}
+	if resp, _ = do("GET", "/cabs/7", "", "image/png", nil); resp.StatusCode != http.StatusNotAcceptable {
+		test.Error("Expect 406", resp)
+	}
+}
+
+// Mock of the heatmap service that records the queries, and of the event service
+type mockHeatmap struct {
+	query  HeatmapQuery
+	status CabStatus
+	filter EventQuery
+	events []Tally.Event
+}
+
+func (m *mockHeatmap) Cabs(q HeatmapQuery, status CabStatus) ([]HeatCell, error) {
+	m.query, m.status = q, status
+	return []HeatCell{HeatCell{Key: "9q8yy", Count: 2}}, nil
+}
+
+func (m *mockHeatmap) Events(q HeatmapQuery, filter EventQuery) ([]HeatCell, error) {
+	m.query, m.filter = q, filter
+	return nil, ErrorNotFound
+}
+
+func (m *mockHeatmap) Put(events []Tally.Event) error {
+	m.events = append(m.events, events...)
+	return nil
+}
+
+func TestHttpHeatmapAndEvents(test *testing.T) {
+	port := 8194
+	heatmap := &mockHeatmap{}
+	httpServer := HttpServer(&mock{}, HeatmapRoutes(heatmap), EventRoutes(heatmap))
+	httpServer.Addr = ":" + strconv.Itoa(port)
+	stop := make(chan bool)
+	stopped := RunServer(httpServer, stop)
+	defer func() {
+		stop <- true
+		<-stopped
+	}()
+	get := func(path string) (*http.Response, []byte) {
+		resp, err := client.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+		check(err)
+		buff, err := ioutil.ReadAll(resp.Body)
+		check(err)
+		return resp, buff
+	}
+
+	resp, body := get("/v1/heatmap/cabs?south=37.7&west=-122.5&north=37.8&east=-122.4&precision=5&status=available")
+	cells := []HeatCell{}
+	check(json.Unmarshal(body, &cells))
+	box := geo.Box{South: 37.7, West: -122.5, North: 37.8, East: -122.4}
+	if resp.StatusCode != 200 || heatmap.query != (HeatmapQuery{Bounds: box, Precision: 5}) ||
+		heatmap.status != CabAvailable || len(cells) != 1 || cells[0].Count != 2 {
+		test.Error("Expect the cells of the cabs", resp.StatusCode, *heatmap, string(body))
+	}
+
+	resp, _ = get("/v1/heatmap/events?south=37.7&west=-122.5&north=37.8&east=-122.4&cell=0.01&type=pickup" +
+		"&from=2014-05-01T00:00:00-04:00")
+	if resp.StatusCode != 404 || heatmap.query.CellSize != 0.01 || heatmap.filter.Type != "pickup" ||
+		!heatmap.filter.From.Equal(time.Date(2014, 5, 1, 4, 0, 0, 0, time.UTC)) {
+		test.Error("Expect the event query", resp.StatusCode, *heatmap)
+	}
+	for _, path := range []string{
+		"/v1/heatmap/cabs?south=37.7&west=-122.5&north=37.8&east=-122.4",
+		"/v1/heatmap/cabs?south=37.7&west=-122.5&north=37.8&cell=0.01",
+		"/v1/heatmap/events?south=37.7&west=-122.5&north=37.8&east=-122.4&cell=0.01&from=yesterday",
+	} {
+		if resp, _ := get(path); resp.StatusCode != 400 {
+			test.Error("Expect 400 for", path, resp.StatusCode)
+		}
+	}
+
+	// Events put in protobuf
+	list := &Tally.EventList{Events: []*Tally.Event{&Tally.Event{
+		Timestamp: proto.Float64(1.4e9),
+		Type:      proto.String("pickup"),
+		Source:    proto.String("test"),
+	}}}
+	buff, err := proto.Marshal(list)
+	check(err)
+	resp, err = client.Post(fmt.Sprintf("http://localhost:%d/v1/events/pb", port), contentTypeProtobuf,
+		bytes.NewReader(buff))
+	check(err)
+	if resp.StatusCode != 200 || len(heatmap.events) != 1 || heatmap.events[0].GetType() != "pickup" {
+		test.Error("Expect the event put", resp.StatusCode, heatmap.events)
+	}
+
+	// Bodies larger than allowed are refused
+	defer func(max int64) { maxEventBody = max }(maxEventBody)
+	maxEventBody = int64(len(buff) - 1)
+	resp, err = client.Post(fmt.Sprintf("http://localhost:%d/v1/events/pb", port), contentTypeProtobuf,
+		bytes.NewReader(buff))
+	check(err)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || len(heatmap.events) != 1 {
+		test.Error("Expect 413 for a body too large", resp.StatusCode)
+	}
+}
+
+// Event service keeping the events put, or failing with the error if any
+type mockEvents struct {
+	events []Tally.Event
+	err    error
+}
+
+func (m *mockEvents) Put(events []Tally.Event) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.events = append(m.events, events...)
+	return nil
+}
+
+func TestHttpPutEvents(test *testing.T) {
+	port := 8200
+	events := &mockEvents{}
+	httpServer := EventHttpServer(events)
+	httpServer.Addr = ":" + strconv.Itoa(port)
+	stop := make(chan bool)
+	stopped := RunServer(httpServer, stop)
+	defer func() {
+		stop <- true
+		<-stopped
+	}()
+	put := func(contentType, body string) int {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://localhost:%d/v1/events/pb", port),
+			strings.NewReader(body))
+		check(err)
+		req.Header.Set("Content-Type", contentType)
+		resp, err := client.Do(req)
+		check(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// A batch in the proto text format
+	text := `events < timestamp: 1.4e9 type: "pickup" source: "a" >
+		events < timestamp: 1.4e9 type: "dropoff" source: "b" location < lat: 37.7 lon: -122.4 > >`
+	if status := put(contentTypeProtoText, text); status != 200 || len(events.events) != 2 ||
+		events.events[0].GetSource() != "a" || events.events[1].Location.GetLat() != 37.7 {
+		test.Error("Expect the events put", status, events.events)
+	}
+
+	// Bodies that do not decode are refused, and read as protobuf unless in the text format
+	for _, body := range []string{`events < type: "pickup" source: "a" >`, "not a proto"} {
+		if status := put(contentTypeProtoText, body); status != 400 {
+			test.Error("Expect 400 for", body, status)
+		}
+	}
+	if status := put("application/json", `{"events": []}`); status != 400 {
+		test.Error("Expect 400 for json", status)
+	}
+
+	// Errors of the service
+	events.err = ErrorBadParam
+	if status := put(contentTypeProtoText, text); status != 400 || len(events.events) != 2 {
+		test.Error("Expect 400 for events refused", status, events.events)
+	}
+	events.err = errors.New("down")
+	if status := put(contentTypeProtoText, text); status != 500 {
+		test.Error("Expect 500 for a service failure", status)
+	}
+}
+
+type mockPlaces struct {
+	detected string
+	named    string
+}
+
+func (m *mockPlaces) Detect(source string) ([]Place, error) {
+	m.detected = source
+	return []Place{Place{Id: 1, Source: source, Visits: 3}}, nil
+}
+
+func (m *mockPlaces) Places(source string) ([]Place, error) {
+	return []Place{Place{Id: 1, Source: source, Visits: 3}}, nil
+}
+
+func (m *mockPlaces) Read(id Id) (Place, error) {
+	if id != 1 {
+		return Place{}, ErrorNotFound
+	}
+	return Place{Id: 1, Name: m.named}, nil
+}
+
+func (m *mockPlaces) Name(id Id, name string) (Place, error) {
+	m.named = name
+	return m.Read(id)
+}
+
+func (m *mockPlaces) Visits(id Id) ([]Stay, error) {
+	return []Stay{Stay{Place: id, Arrived: time.Unix(1.4e9, 0), Departed: time.Unix(1.4e9+3600, 0)}}, nil
+}
+
+func (m *mockPlaces) Stays(source string, from, to time.Time) ([]Stay, error) {
+	return []Stay{}, nil
+}
+
+func (m *mockPlaces) Close() {}
+
+func TestHttpPlaces(test *testing.T) {
+	port := 8195
+	places := &mockPlaces{}
+	httpServer := HttpServer(&mock{}, PlaceRoutes(places))
+	httpServer.Addr = ":" + strconv.Itoa(port)
+	stop := make(chan bool)
+	stopped := RunServer(httpServer, stop)
+	defer func() {
+		stop <- true
+		<-stopped
+	}()
+	url := func(path string) string {
+		return fmt.Sprintf("http://localhost:%d%s", port, path)
+	}
+
+	resp, err := client.Post(url("/v1/places/detect?source=alice"), "application/json", nil)
+	check(err)
+	found := []Place{}
+	check(json.NewDecoder(resp.Body).Decode(&found))
+	if resp.StatusCode != 200 || places.detected != "alice" || len(found) != 1 || found[0].Visits != 3 {
+		test.Error("Expect the places detected", resp.StatusCode, found)
+	}
+	if resp, err = client.Post(url("/v1/places/detect"), "application/json", nil); err != nil || resp.StatusCode != 400 {
+		test.Error("Expect 400 detecting without source", resp, err)
+	}
+	if resp, err = client.Get(url("/v1/places")); err != nil || resp.StatusCode != 400 {
+		test.Error("Expect 400 listing without source", resp, err)
+	}
+
+	resp, err = client.Post(url("/v1/places/1"), "application/json", strings.NewReader(`{"name": "home"}`))
+	check(err)
+	place := Place{}
+	check(json.NewDecoder(resp.Body).Decode(&place))
+	if resp.StatusCode != 200 || place.Name != "home" {
+		test.Error("Expect the place named", resp.StatusCode, place)
+	}
+	if resp, err = client.Get(url("/v1/places/2")); err != nil || resp.StatusCode != 404 {
+		test.Error("Expect 404", resp, err)
+	}
+
+	resp, err = client.Get(url("/v1/places/1/visits"))
+	check(err)
+	visits := []Stay{}
+	check(json.NewDecoder(resp.Body).Decode(&visits))
+	if resp.StatusCode != 200 || len(visits) != 1 || visits[0].Duration() != time.Hour {
+		test.Error("Expect the visits", resp.StatusCode, visits)
+	}
+}
+
+type mockTrips struct {
+	detected string
+	query    TripQuery
+}
+
+func (m *mockTrips) Detect(source string) ([]Trip, error) {
+	m.detected = source
+	return []Trip{Trip{Source: source, Mode: ModeWalk, Distance: 1200}}, nil
+}
+
+func (m *mockTrips) Trips(q TripQuery) ([]Trip, error) {
+	m.query = q
+	return []Trip{}, nil
+}
+
+func (m *mockTrips) Tally(q TripQuery) ([]TripTally, error) {
+	m.query = q
+	return []TripTally{TripTally{Start: q.From, Trips: 2, Duration: time.Hour}}, nil
+}
+
+func TestHttpTrips(test *testing.T) {
+	port := 8196
+	trips := &mockTrips{}
+	httpServer := HttpServer(&mock{}, TripRoutes(trips, Zones{"alice": "Europe/Paris"}))
+	httpServer.Addr = ":" + strconv.Itoa(port)
+	stop := make(chan bool)
+	stopped := RunServer(httpServer, stop)
+	defer func() {
+		stop <- true
+		<-stopped
+	}()
+	url := func(path string) string {
+		return fmt.Sprintf("http://localhost:%d%s", port, path)
+	}
+
+	resp, err := client.Post(url("/v1/trips/detect?source=alice"), "application/json", nil)
+	check(err)
+	found := []Trip{}
+	check(json.NewDecoder(resp.Body).Decode(&found))
+	if resp.StatusCode != 200 || trips.detected != "alice" || len(found) != 1 || found[0].Mode != ModeWalk {
+		test.Error("Expect the trips detected", resp.StatusCode, found)
+	}
+
+	resp, err = client.Get(url("/v1/trips/tally?source=alice&places=1,2&from=2014-06-02T00:00:00Z" +
+		"&to=2014-06-30T00:00:00Z&period=week"))
+	check(err)
+	tallies := []TripTally{}
+	check(json.NewDecoder(resp.Body).Decode(&tallies))
+	from := time.Date(2014, 6, 2, 0, 0, 0, 0, time.UTC)
+	if resp.StatusCode != 200 || !reflect.DeepEqual(trips.query.Places, []Id{1, 2}) || trips.query.Period != PeriodWeek ||
+		!trips.query.From.Equal(from) || trips.query.From.Location().String() != "Europe/Paris" ||
+		len(tallies) != 1 || tallies[0].Duration != time.Hour {
+		test.Error("Expect the tallies in the zone of alice", resp.StatusCode, trips.query, tallies)
+	}
+	resp, err = client.Get(url("/v1/trips/tally?source=alice&from=2014-06-02T00:00:00Z&to=2014-06-30T00:00:00Z" +
+		"&period=month&tz=Asia/Tokyo"))
+	check(err)
+	if resp.StatusCode != 200 || trips.query.Period != PeriodMonth || trips.query.To.Location().String() != "Asia/Tokyo" {
+		test.Error("Expect the tallies in Tokyo", resp.StatusCode, trips.query)
+	}
+
+	resp, err = client.Get(url("/v1/trips?source=alice&mode=walk"))
+	check(err)
+	if resp.StatusCode != 200 || trips.query.Mode != ModeWalk || trips.query.Source != "alice" {
+		test.Error("Expect the trips", resp.StatusCode, trips.query)
+	}
+	for _, path := range []string{"/v1/trips?places=one", "/v1/trips/tally?period=day",
+		"/v1/trips/tally?from=2014-06-02T00:00:00Z&to=2014-06-30T00:00:00Z&period=168h"} {
+		if resp, err := client.Get(url(path)); err != nil || resp.StatusCode != 400 {
+			test.Error("Expect 400 for", path, resp, err)
+		}
+	}
+}
+
+type mockTimeline struct {
+	source string
+	date   time.Time
+}
+
+func (m *mockTimeline) Day(source string, date time.Time) (Timeline, error) {
+	m.source, m.date = source, date
+	return Timeline{Source: source, TimeZone: date.Location().String(), Entries: []TimelineEntry{}}, nil
+}
+
+func TestHttpTimeline(test *testing.T) {
+	port := 8197
+	timeline := &mockTimeline{}
+	httpServer := HttpServer(&mock{}, TimelineRoutes(timeline, Zones{"alice": "Europe/Paris"}))
+	httpServer.Addr = ":" + strconv.Itoa(port)
+	stop := make(chan bool)
+	stopped := RunServer(httpServer, stop)
+	defer func() {
+		stop <- true
+		<-stopped
+	}()
+	url := func(path string) string {
+		return fmt.Sprintf("http://localhost:%d%s", port, path)
+	}
+
+	resp, err := client.Get(url("/v1/timeline?source=alice&date=2014-06-02&tz=America/Los_Angeles"))
+	check(err)
+	day := Timeline{}
+	check(json.NewDecoder(resp.Body).Decode(&day))
+	if resp.StatusCode != 200 || timeline.source != "alice" || day.TimeZone != "America/Los_Angeles" ||
+		timeline.date.Format(time.RFC3339) != "2014-06-02T00:00:00-07:00" {
+		test.Error("Expect the day in Los Angeles", resp.StatusCode, timeline.date, day)
+	}
+	resp, err = client.Get(url("/v1/timeline?source=alice"))
+	check(err)
+	if resp.StatusCode != 200 || timeline.date.Location().String() != "Europe/Paris" {
+		test.Error("Expect today in the zone of alice", resp.StatusCode, timeline.date)
+	}
+	resp, err = client.Get(url("/v1/timeline?source=bob"))
+	check(err)
+	if resp.StatusCode != 200 || timeline.date.Location() != time.UTC {
+		test.Error("Expect today in UTC", resp.StatusCode, timeline.date)
+	}
+	for _, path := range []string{"/v1/timeline?date=2014-06-02", "/v1/timeline?source=alice&tz=Mars/Olympus",
+		"/v1/timeline?source=alice&date=June"} {
+		if resp, err := client.Get(url(path)); err != nil || resp.StatusCode != 400 {
+			test.Error("Expect 400 for", path, resp, err)
+		}
+	}
+}
+
+// Event store of events at the times
+type mockEventStore struct {
+	times []time.Time
+	query EventQuery
+}
+
+func (m *mockEventStore) Put(events []Tally.Event) error {
+	return nil
+}
+
+func (m *mockEventStore) Find(q EventQuery) ([]Tally.Event, error) {
+	m.query = q
+	events := []Tally.Event{}
+	for _, t := range m.times {
+		if !t.Before(q.From) && t.Before(q.To) {
+			event := Tally.Event{Type: proto.String("coffee"), Source: proto.String("alice")}
+			SetEventTime(&event, t)
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (m *mockEventStore) Count(q EventQuery, box geo.Box, grid Grid) ([]GridCell, error) {
+	return nil, nil
+}
+
+func (m *mockEventStore) Remove(q EventQuery) (int, error) {
+	return 0, nil
+}
+
+func (m *mockEventStore) Close() {}
+
+func TestHttpEventTally(test *testing.T) {
+	port := 8198
+	// Coffees at 23:30 UTC, after midnight in Paris, on the 1st and 2nd of June
+	store := &mockEventStore{times: []time.Time{
+		time.Date(2014, 5, 31, 23, 30, 0, 0, time.UTC),
+		time.Date(2014, 6, 1, 23, 30, 0, 0, time.UTC),
+		time.Date(2014, 6, 1, 23, 45, 0, 0, time.UTC),
+	}}
+	httpServer := HttpServer(&mock{}, EventTallyRoutes(store, Zones{"alice": "Europe/Paris"}))
+	httpServer.Addr = ":" + strconv.Itoa(port)
+	stop := make(chan bool)
+	stopped := RunServer(httpServer, stop)
+	defer func() {
+		stop <- true
+		<-stopped
+	}()
+	get := func(path string) (*http.Response, []EventTally) {
+		resp, err := client.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+		check(err)
+		tallies := []EventTally{}
+		if resp.StatusCode == 200 {
+			check(json.NewDecoder(resp.Body).Decode(&tallies))
+		}
+		return resp, tallies
+	}
+
+	counts := func(tallies []EventTally) []int {
+		c := []int{}
+		for _, t := range tallies {
+			c = append(c, t.Count)
+		}
+		return c
+	}
+	resp, tallies := get("/v1/events/tally?source=alice&type=coffee&from=2014-06-01T00:00:00Z&to=2014-06-03T00:00:00Z")
+	if resp.StatusCode != 200 || !reflect.DeepEqual(counts(tallies), []int{1, 2, 0}) ||
+		tallies[0].Start.Format(time.RFC3339) != "2014-06-01T00:00:00+02:00" || store.query.Type != "coffee" {
+		test.Error("Expect the days in Paris", resp.StatusCode, tallies, store.query)
+	}
+	resp, tallies = get("/v1/events/tally?source=alice&from=2014-06-01T00:00:00Z&to=2014-06-03T00:00:00Z&tz=UTC")
+	if resp.StatusCode != 200 || !reflect.DeepEqual(counts(tallies), []int{2, 0}) {
+		test.Error("Expect the days in UTC", resp.StatusCode, tallies)
+	}
+	resp, tallies = get("/v1/events/tally?source=alice&from=2014-06-01T00:00:00Z&to=2014-06-03T00:00:00Z&period=month")
+	if resp.StatusCode != 200 || !reflect.DeepEqual(counts(tallies), []int{3}) {
+		test.Error("Expect the month", resp.StatusCode, tallies)
+	}
+	for _, path := range []string{"/v1/events/tally?source=alice", "/v1/events/tally?from=2014-06-01T00:00:00Z" +
+		"&to=2014-06-03T00:00:00Z&period=year", "/v1/events/tally?from=2014-06-01T00:00:00Z&to=2014-06-03T00:00:00Z&tz=Nowhere"} {
+		if resp, _ := get(path); resp.StatusCode != 400 {
+			test.Error("Expect 400 for", path, resp.StatusCode)
+		}
+	}
+}
+
+// Content store of blobs in memory
+type mockContent map[string]mockBlob
+
+type mockBlob struct {
+	*bytes.Reader
+	mime string
+}
+
+func (b mockBlob) Mime() string { return b.mime }
+func (b mockBlob) Close() error { return nil }
+
+func (m mockContent) Put(mime string, data []byte) (string, error) {
+	hash := ContentHash(data)
+	m[hash] = mockBlob{bytes.NewReader(data), mime}
+	return hash, nil
+}
+
+func (m mockContent) Open(hash string) (Blob, error) {
+	if !ValidContentHash(hash) {
+		return nil, ErrorBadParam
+	}
+	blob, exists := m[hash]
+	if !exists {
+		return nil, ErrorNotFound
+	}
+	blob.Seek(0, io.SeekStart)
+	return blob, nil
+}
+
+func (m mockContent) Close() {}
+
+func TestHttpContent(test *testing.T) {
+	port := 8199
+	store := mockContent{}
+	hash, _ := store.Put("audio/mpeg", []byte("0123456789"))
+	httpServer := HttpServer(&mock{}, ContentRoutes(store))
+	httpServer.Addr = ":" + strconv.Itoa(port)
+	stop := make(chan bool)
+	stopped := RunServer(httpServer, stop)
+	defer func() {
+		stop <- true
+		<-stopped
+	}()
+	get := func(path, ranges string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+		check(err)
+		if ranges != "" {
+			req.Header.Set("Range", ranges)
+		}
+		resp, err := client.Do(req)
+		check(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		check(err)
+		return resp, string(body)
+	}
+
+	resp, body := get("/v1/content/"+hash, "")
+	if resp.StatusCode != 200 || body != "0123456789" || resp.Header.Get("Content-Type") != "audio/mpeg" ||
+		resp.Header.Get("ETag") != `"`+hash+`"` {
+		test.Error("Expect the blob", resp.StatusCode, body, resp.Header)
+	}
+	resp, body = get("/v1/content/"+hash, "bytes=2-5")
+	if resp.StatusCode != 206 || body != "2345" || resp.Header.Get("Content-Range") != "bytes 2-5/10" {
+		test.Error("Expect the range", resp.StatusCode, body, resp.Header)
+	}
+	if resp, _ = get("/v1/content/"+ContentHash([]byte("missing")), ""); resp.StatusCode != 404 {
+		test.Error("Expect 404", resp.StatusCode)
+	}
+	if resp, _ = get("/v1/content/ABC", ""); resp.StatusCode != 400 {
+		test.Error("Expect 400", resp.StatusCode)
+	}
+
+	// Pages and SVG images are downloaded rather than rendered
+	for _, mime := range []string{"text/html", "image/svg+xml", "application/javascript", "bad mime"} {
+		hash, _ := store.Put(mime, []byte("<script>alert(1)</script>"+mime))
+		resp, _ := get("/v1/content/"+hash, "")
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/octet-stream" ||
+			resp.Header.Get("Content-Disposition") != "attachment" ||
+			resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+			test.Error("Expect an attachment for", mime, resp.Header)
+		}
+	}
+}
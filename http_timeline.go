@@ -0,0 +1,51 @@
+package tally
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+// Returns the url routes of the timeline api.  The day is given by date, as 2014-06-02, in the
+// IANA time zone tz, e.g. America/New_York, or else the source's in the zones; today by default:
+//
+//	GET /v1/timeline?source=alice&date=2014-06-02&tz=America/Los_Angeles
+func TimelineRoutes(service TimelineService, zones Zones) Routes {
+	return func(router *mux.Router) {
+		router.Methods("GET").Path("/v1/timeline").HandlerFunc(handleGetTimeline(service, zones))
+	}
+}
+
+// Parses the time zone from the url parameter tz, or else returns the source's.
+func parseZone(r *http.Request, source string, zones Zones) (*time.Location, error) {
+	if tz := r.FormValue("tz"); tz != "" {
+		return LoadZone(tz)
+	}
+	return zones.Of(source), nil
+}
+
+func handleGetTimeline(service TimelineService, zones Zones) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		source := r.FormValue("source")
+		if source == "" {
+			http.Error(w, "Missing source", http.StatusBadRequest)
+			return
+		}
+		zone, err := parseZone(r, source, zones)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		date := time.Now().In(zone)
+		if s := r.FormValue("date"); s != "" {
+			if date, err = time.ParseInLocation("2006-01-02", s, zone); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		timeline, err := service.Day(source, date)
+		writeJson(w, timeline, err)
+	}
+}
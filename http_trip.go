@@ -0,0 +1,96 @@
+package tally
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Returns the url routes of the trips api.  Trips of a source are detected from its location
+// events on request, and then queried and tallied by mode, places and time, e.g. the commutes
+// between places 1 and 2 by week, or the walks.  Tallies are by day, week or month in the IANA
+// time zone tz, or else the source's in the zones:
+//
+//	POST /v1/trips/detect?source=alice
+//	GET  /v1/trips?source=alice&mode=walk&from=2014-06-01T00:00:00Z
+//	GET  /v1/trips/tally?source=alice&places=1,2&from=2014-06-02T00:00:00Z&to=2014-06-30T00:00:00Z&period=week
+func TripRoutes(service TripService, zones Zones) Routes {
+	return func(router *mux.Router) {
+		router.Methods("POST").Path("/v1/trips/detect").HandlerFunc(handleDetectTrips(service))
+		router.Methods("GET").Path("/v1/trips").HandlerFunc(handleGetTrips(service, zones))
+		router.Methods("GET").Path("/v1/trips/tally").HandlerFunc(handleTallyTrips(service, zones))
+	}
+}
+
+// Parses the trip query from the url parameters source, mode, places as a comma separated list of
+// ids, from and to in RFC 3339, and period and tz.  The range is in the time zone.
+func parseTripQuery(r *http.Request, zones Zones) (q TripQuery, err error) {
+	filter, err := EventFilter(r)
+	if err != nil {
+		return
+	}
+	zone, err := parseZone(r, filter.Source, zones)
+	if err != nil {
+		return
+	}
+	q = TripQuery{
+		Source: filter.Source,
+		Mode:   TravelMode(r.FormValue("mode")),
+		From:   filter.From.In(zone),
+		To:     filter.To.In(zone),
+		Period: Period(r.FormValue("period")),
+	}
+	if s := r.FormValue("places"); s != "" {
+		for _, id := range strings.Split(s, ",") {
+			placeId, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				return q, err
+			}
+			q.Places = append(q.Places, Id(placeId))
+		}
+	}
+	return q, q.Validate()
+}
+
+func handleDetectTrips(service TripService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		source := r.FormValue("source")
+		if source == "" {
+			http.Error(w, "Missing source", http.StatusBadRequest)
+			return
+		}
+		trips, err := service.Detect(source)
+		writeJson(w, trips, err)
+	}
+}
+
+func handleGetTrips(service TripService, zones Zones) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		q, err := parseTripQuery(r, zones)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		trips, err := service.Trips(q)
+		writeJson(w, trips, err)
+	}
+}
+
+func handleTallyTrips(service TripService, zones Zones) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addHeaders(&w)
+
+		q, err := parseTripQuery(r, zones)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tallies, err := service.Tally(q)
+		writeJson(w, tallies, err)
+	}
+}
@@ -0,0 +1,92 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/tallytest"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSimpleConformance(test *testing.T) {
+	tallytest.RunCabServiceSuite(test, func() tally.CabService {
+		return NewSimpleCabService()
+	})
+}
+
+func TestExpiringSimpleConformance(test *testing.T) {
+	tallytest.RunCabServiceSuite(test, func() tally.CabService {
+		return NewExpiringSimpleCabService(tally.Expiry{TTL: time.Hour})
+	})
+}
+
+// Shards split at the prime meridian, each behind its own http server
+func TestShardedConformance(test *testing.T) {
+	tallytest.RunCabServiceSuite(test, func() tally.CabService {
+		west := httptest.NewServer(tally.HttpServer(NewSimpleCabService()).Handler)
+		east := httptest.NewServer(tally.HttpServer(NewSimpleCabService()).Handler)
+		return &closingService{
+			CabService: NewShardedCabService([]Shard{
+				Shard{
+					Name: "west",
+					Polygon: []tally.Location{
+						tally.Location{Latitude: -90., Longitude: -180.},
+						tally.Location{Latitude: -90., Longitude: 0.},
+						tally.Location{Latitude: 90., Longitude: 0.},
+						tally.Location{Latitude: 90., Longitude: -180.},
+					},
+					Service: NewRemoteCabService(west.URL),
+				},
+				Shard{Name: "east", Service: NewRemoteCabService(east.URL)},
+			}),
+			close: func() {
+				west.Close()
+				east.Close()
+			},
+		}
+	})
+}
+
+func TestMongoDbConformance(test *testing.T) {
+	needMongoDb(test)
+	tallytest.RunCabServiceSuite(test, func() tally.CabService {
+		service, err := NewMongoDbCabService(mongoUrl, "test", "conformance")
+		if err != nil {
+			test.Fatal(err)
+		}
+		return service
+	})
+}
+
+func TestEventConformance(test *testing.T) {
+	tallytest.RunEventServiceSuite(test, NewMockEventService())
+}
+
+// Service that also closes the test servers behind it
+type closingService struct {
+	tally.CabService
+	close func()
+}
+
+func (s *closingService) Close() {
+	s.CabService.Close()
+	s.close()
+}
+
+func TestSimpleEventStoreConformance(test *testing.T) {
+	tallytest.RunEventStoreSuite(test, func() tally.EventStore {
+		return NewSimpleEventStore()
+	})
+}
+
+func TestMongoDbEventStoreConformance(test *testing.T) {
+	needMongoDb(test)
+	tallytest.RunEventStoreSuite(test, func() tally.EventStore {
+		store, err := NewMongoDbEventStore(mongoUrl, "test", "events")
+		if err != nil {
+			test.Fatal(err)
+		}
+		store.collection.RemoveAll(nil)
+		return store
+	})
+}
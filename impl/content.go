@@ -0,0 +1,177 @@
+package impl
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/proto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Storage of content blobs in a local directory, each in a file named by its hash under a
+// directory of the first two digits, with its mime type in a file alongside.  Files are written
+// under temporary names and renamed, so a blob is there in full or not at all.
+type fileContentStore struct {
+	dir string
+}
+
+// Blob read from a file
+type fileBlob struct {
+	*os.File
+	mime string
+	size int64
+}
+
+func (b *fileBlob) Mime() string { return b.mime }
+func (b *fileBlob) Size() int64  { return b.size }
+
+// Constructor method.  Creates the directory if missing.
+func NewFileContentStore(dir string) (*fileContentStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileContentStore{dir: dir}, nil
+}
+
+// Returns the path of the blob of the hash.
+func (s *fileContentStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// Writes the data to the path through a temporary file in the same directory.
+func writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Implements ContentStore
+func (s *fileContentStore) Put(mime string, data []byte) (string, error) {
+	hash := tally.ContentHash(data)
+	path := s.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := writeFile(path+".mime", []byte(mime)); err != nil {
+		return "", err
+	}
+	return hash, writeFile(path, data)
+}
+
+// Implements ContentStore
+func (s *fileContentStore) Open(hash string) (tally.Blob, error) {
+	if !tally.ValidContentHash(hash) {
+		return nil, tally.ErrorBadParam
+	}
+	path := s.path(hash)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, tally.ErrorNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	mime, err := ioutil.ReadFile(path + ".mime")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileBlob{File: file, mime: string(mime), size: info.Size()}, nil
+}
+
+// Implements ContentStore
+func (s *fileContentStore) Close() {
+	// do nothing
+}
+
+// Event store keeping the contents larger than the threshold out of line, in the content store,
+// and only their references in the events.  Queries and removals are of the events as stored;
+// blobs are kept when their events are removed, as other events may share them.
+type contentEventStore struct {
+	tally.EventStore
+	contents  tally.ContentStore
+	threshold int
+}
+
+// Constructor method.  Contents of more than threshold bytes are stored out of line.  Closing
+// the store closes the events but not the contents.
+func NewContentEventStore(events tally.EventStore, contents tally.ContentStore, threshold int) *contentEventStore {
+	return &contentEventStore{
+		EventStore: events,
+		contents:   contents,
+		threshold:  threshold,
+	}
+}
+
+// Implements EventService.  The events put are not changed.
+func (s *contentEventStore) Put(events []Tally.Event) error {
+	stored := make([]Tally.Event, len(events))
+	for i := range events {
+		stored[i] = events[i]
+		attributes, err := s.offload(events[i].Attributes)
+		if err != nil {
+			return err
+		}
+		stored[i].Attributes = attributes
+	}
+	return s.EventStore.Put(stored)
+}
+
+// Returns the attributes with the large contents, also in lists and maps, stored and replaced by
+// their references, which keep the dimensions and thumbnails of images.  Attributes changed are
+// copies.
+func (s *contentEventStore) offload(attributes []*Tally.Attribute) ([]*Tally.Attribute, error) {
+	if len(attributes) == 0 {
+		return attributes, nil
+	}
+	result := make([]*Tally.Attribute, len(attributes))
+	for i, a := range attributes {
+		result[i] = a
+		switch {
+		case a.ContentValue != nil && len(a.ContentValue.Data) > s.threshold:
+			hash, err := s.contents.Put(a.ContentValue.GetMime(), a.ContentValue.Data)
+			if err != nil {
+				return nil, err
+			}
+			content := *a.ContentValue
+			content.Hash, content.Size = &hash, proto.Int64(int64(len(content.Data)))
+			content.Data = []byte{}
+			ref := *a
+			ref.ContentValue = &content
+			result[i] = &ref
+		case len(a.ListValue) > 0 || len(a.MapValue) > 0:
+			list, err := s.offload(a.ListValue)
+			if err != nil {
+				return nil, err
+			}
+			entries, err := s.offload(a.MapValue)
+			if err != nil {
+				return nil, err
+			}
+			nested := *a
+			nested.ListValue, nested.MapValue = list, entries
+			result[i] = &nested
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,101 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"io"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Storage of content blobs in mongodb GridFS, each file named by its hash and typed by its mime
+// type.
+type mgoContentStore struct {
+	session *mgo.Session
+	fs      *mgo.GridFS
+}
+
+// Blob read from a GridFS file.  Reads go through a section of the file, which cannot seek to
+// its end when its length is a multiple of the chunk size.
+type gridBlob struct {
+	*io.SectionReader
+	file *mgo.GridFile
+}
+
+func (b *gridBlob) Mime() string { return b.file.ContentType() }
+func (b *gridBlob) Close() error { return b.file.Close() }
+
+// Reader of a GridFS file at offsets
+type gridFileAt struct {
+	file *mgo.GridFile
+}
+
+func (f gridFileAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.file.Size() {
+		return 0, io.EOF
+	}
+	if _, err := f.file.Seek(off, 0); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f.file, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Constructor method.  Returns a content store keeping the blobs in the GridFS of the prefix,
+// e.g. "content" for the collections content.files and content.chunks.
+func NewMongoDbContentStore(url, db, prefix string) (store *mgoContentStore, err error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return
+	}
+	store = &mgoContentStore{
+		session: session,
+		fs:      session.DB(db).GridFS(prefix),
+	}
+	store.fs.Files.EnsureIndex(mgo.Index{
+		Key:  []string{"filename"},
+		Name: "filename",
+	})
+	return
+}
+
+// Implements ContentStore.  Blobs put at the same time by two servers may be stored twice; either
+// is served.
+func (s *mgoContentStore) Put(mime string, data []byte) (string, error) {
+	hash := tally.ContentHash(data)
+	if n, err := s.fs.Find(bson.M{"filename": hash}).Count(); err != nil || n > 0 {
+		return hash, err
+	}
+	file, err := s.fs.Create(hash)
+	if err != nil {
+		return "", err
+	}
+	file.SetContentType(mime)
+	_, err = file.Write(data)
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	return hash, err
+}
+
+// Implements ContentStore
+func (s *mgoContentStore) Open(hash string) (tally.Blob, error) {
+	if !tally.ValidContentHash(hash) {
+		return nil, tally.ErrorBadParam
+	}
+	file, err := s.fs.Open(hash)
+	switch err {
+	case nil:
+		return &gridBlob{io.NewSectionReader(gridFileAt{file}, 0, file.Size()), file}, nil
+	case mgo.ErrNotFound:
+		return nil, tally.ErrorNotFound
+	}
+	return nil, err
+}
+
+// Implements ContentStore
+func (s *mgoContentStore) Close() {
+	s.session.Close()
+}
@@ -0,0 +1,156 @@
+package impl
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/proto"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Returns the bytes of a blob of the size.
+func blobOf(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+	return data
+}
+
+func testContentStore(test *testing.T, store tally.ContentStore) {
+	// Two GridFS chunks exactly, for the end of the last to be the end of the blob
+	data := blobOf(2 * 255 * 1024)
+	hash, err := store.Put("audio/mpeg", data)
+	if err != nil || hash != tally.ContentHash(data) {
+		test.Fatal("Expecting the hash of the data", hash, err)
+	}
+	if again, err := store.Put("audio/mpeg", data); err != nil || again != hash {
+		test.Error("Expecting the same hash", again, err)
+	}
+
+	blob, err := store.Open(hash)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer blob.Close()
+	if blob.Mime() != "audio/mpeg" || blob.Size() != int64(len(data)) {
+		test.Error("Expecting the mime type and size", blob.Mime(), blob.Size())
+	}
+	if end, err := blob.Seek(0, io.SeekEnd); err != nil || end != int64(len(data)) {
+		test.Error("Expecting to seek to the end", end, err)
+	}
+	part := make([]byte, 10)
+	if _, err := blob.Seek(300000, io.SeekStart); err != nil {
+		test.Fatal(err)
+	}
+	if _, err := io.ReadFull(blob, part); err != nil || !bytes.Equal(part, data[300000:300010]) {
+		test.Error("Expecting the bytes at the offset", part, err)
+	}
+	blob.Seek(0, io.SeekStart)
+	if all, err := ioutil.ReadAll(blob); err != nil || !bytes.Equal(all, data) {
+		test.Error("Expecting the data", len(all), err)
+	}
+
+	if _, err := store.Open(tally.ContentHash([]byte("missing"))); err != tally.ErrorNotFound {
+		test.Error("Expecting ErrorNotFound", err)
+	}
+	if _, err := store.Open("../../etc/passwd"); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam", err)
+	}
+}
+
+func TestFileContentStore(test *testing.T) {
+	dir, err := ioutil.TempDir("", "content")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileContentStore(dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer store.Close()
+	testContentStore(test, store)
+}
+
+func TestMongoDbContentStore(test *testing.T) {
+	needMongoDb(test)
+	store, err := NewMongoDbContentStore(mongoUrl, "test", "content")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer store.Close()
+	store.fs.Files.RemoveAll(nil)
+	store.fs.Chunks.RemoveAll(nil)
+	testContentStore(test, store)
+	if n, err := store.fs.Find(nil).Count(); err != nil || n != 1 {
+		test.Error("Expecting the blob stored once", n, err)
+	}
+}
+
+func TestContentEventStore(test *testing.T) {
+	dir, err := ioutil.TempDir("", "content")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	contents, err := NewFileContentStore(dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+	store := NewContentEventStore(NewSimpleEventStore(), contents, 1024)
+	defer store.Close()
+
+	photo := blobOf(4096)
+	content := func(mime string, data []byte) *Tally.Content {
+		return &Tally.Content{Mime: proto.String(mime), Data: data}
+	}
+	event := Tally.Event{
+		Timestamp: proto.Float64(1.4e9),
+		Type:      proto.String("journal"),
+		Source:    proto.String("alice"),
+		Attributes: []*Tally.Attribute{
+			{Key: proto.String("photo"), ContentValue: content("image/jpeg", photo)},
+			{Key: proto.String("notes"), ListValue: []*Tally.Attribute{
+				{Key: proto.String(""), ContentValue: content("text/plain", []byte("sunny"))},
+				{Key: proto.String(""), ContentValue: content("image/jpeg", photo)},
+			}},
+		},
+	}
+	event.Attributes[0].ContentValue.Width = proto.Int32(640)
+	original := proto.Clone(&event)
+	if err := store.Put([]Tally.Event{event}); err != nil {
+		test.Fatal(err)
+	}
+	if !proto.Equal(&event, original) {
+		test.Error("Expecting the event put unchanged", event)
+	}
+
+	found, err := store.Find(tally.EventQuery{Source: "alice"})
+	if err != nil || len(found) != 1 {
+		test.Fatal("Expecting the event", found, err)
+	}
+	ref := found[0].Attributes[0].ContentValue
+	notes := found[0].Attributes[1].ListValue
+	if ref.Data == nil || len(ref.Data) != 0 || ref.GetHash() != tally.ContentHash(photo) || tally.ContentSize(ref) != 4096 ||
+		ref.GetMime() != "image/jpeg" || ref.GetWidth() != 640 {
+		test.Error("Expecting a reference to the photo, with its width", ref)
+	}
+	if _, err := proto.Marshal(&found[0]); err != nil {
+		test.Error("Expecting the reference to have its required data, empty", err)
+	}
+	if string(notes[0].ContentValue.Data) != "sunny" || notes[1].ContentValue.GetHash() != ref.GetHash() {
+		test.Error("Expecting the small content inline and the photo in the list by reference", notes)
+	}
+	blob, err := contents.Open(ref.GetHash())
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer blob.Close()
+	if data, err := ioutil.ReadAll(blob); err != nil || !bytes.Equal(data, photo) {
+		test.Error("Expecting the photo stored", len(data), err)
+	}
+}
@@ -0,0 +1,436 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cost of a pickup and cab pair that must not be matched, in meters.  This is far larger than
+// any distance on earth so the optimal matching never prefers it over a real pair.
+const unmatchable = 1e12
+
+// Implementation of the DispatchService on top of a CabService.  Pickups and offers are kept
+// in memory.  Pending pickups are matched to available cabs once per window; a cab is engaged
+// from the time an offer is sent until it replies, so it is not offered two pickups at once.
+// Once accepted, the cab's status is set to dispatched in the CabService.  Closed pickups and
+// their offers are evicted after the retention window.
+type dispatcher struct {
+	lock    sync.Mutex
+	cabs    tally.CabService
+	config  tally.DispatchConfig
+	pickups map[tally.Id]*tally.Pickup
+	offers  map[tally.Id]*tally.Offer
+	engaged map[tally.Id]tally.Id  // cab id to pending offer id
+	closed  map[tally.Id]time.Time // pickup id to the time it was assigned, cancelled or expired
+	lastId  tally.Id
+	stop    chan bool
+	now     func() time.Time
+}
+
+// Constructor method.  Returns an instance of the dispatch service that finds cabs in the
+// given CabService, and starts matching pickups in the background.
+func NewDispatchService(cabs tally.CabService, config tally.DispatchConfig) *dispatcher {
+	d := newDispatcher(cabs, config)
+	d.stop = make(chan bool)
+	go d.run(d.stop)
+	return d
+}
+
+// Returns the dispatcher without starting the background matching.
+func newDispatcher(cabs tally.CabService, config tally.DispatchConfig) *dispatcher {
+	return &dispatcher{
+		cabs:    cabs,
+		config:  *tally.SanitizeDispatch(&config),
+		pickups: make(map[tally.Id]*tally.Pickup),
+		offers:  make(map[tally.Id]*tally.Offer),
+		engaged: make(map[tally.Id]tally.Id),
+		closed:  make(map[tally.Id]time.Time),
+		now:     time.Now,
+	}
+}
+
+// Background loop that matches and expires once per window until closed.
+func (d *dispatcher) run(stop <-chan bool) {
+	ticker := time.NewTicker(d.config.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.expire()
+			if err := d.match(); err != nil {
+				log.Println("Warning: dispatch matching failed", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (d *dispatcher) nextId() tally.Id {
+	d.lastId++
+	return d.lastId
+}
+
+// Implements DispatchService
+func (d *dispatcher) Request(pickup tally.Pickup) (tally.Pickup, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	p := &tally.Pickup{
+		Id:       d.nextId(),
+		Rider:    pickup.Rider,
+		Location: pickup.Location,
+		State:    tally.PickupPending,
+		Created:  d.now(),
+	}
+	d.pickups[p.Id] = p
+	return *p, nil
+}
+
+// Implements DispatchService
+func (d *dispatcher) Pickup(id tally.Id) (tally.Pickup, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if p, exists := d.pickups[id]; exists {
+		return *p, nil
+	}
+	return tally.Pickup{}, tally.ErrorNotFound
+}
+
+// Implements DispatchService
+func (d *dispatcher) Cancel(id tally.Id) (tally.Pickup, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	p, exists := d.pickups[id]
+	if !exists {
+		return tally.Pickup{}, tally.ErrorNotFound
+	}
+	switch p.State {
+	case tally.PickupPending:
+	case tally.PickupOffered:
+		d.closeOffer(d.offers[p.Offer], tally.OfferCancelled)
+	case tally.PickupAssigned:
+		if err := d.cabs.SetStatus(p.Cab, tally.CabAvailable); err != nil {
+			return *p, err
+		}
+	default:
+		return *p, tally.ErrorInvalidState
+	}
+	d.closePickup(p, tally.PickupCancelled)
+	return *p, nil
+}
+
+// Implements DispatchService
+func (d *dispatcher) Offers(cab tally.Id) (offers []tally.Offer, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	offers = make([]tally.Offer, 0)
+	if id, exists := d.engaged[cab]; exists {
+		offers = append(offers, *d.offers[id])
+	}
+	return
+}
+
+// Implements DispatchService
+func (d *dispatcher) Accept(id tally.Id) (tally.Offer, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	o, exists := d.offers[id]
+	if !exists {
+		return tally.Offer{}, tally.ErrorNotFound
+	}
+	if o.State != tally.OfferPending || !d.now().Before(o.Expires) {
+		return *o, tally.ErrorInvalidState
+	}
+	if err := d.cabs.SetStatus(o.Cab, tally.CabDispatched); err != nil {
+		return *o, err
+	}
+	d.closeOffer(o, tally.OfferAccepted)
+	d.closePickup(d.pickups[o.Pickup], tally.PickupAssigned)
+	return *o, nil
+}
+
+// Implements DispatchService
+func (d *dispatcher) Decline(id tally.Id) (tally.Offer, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	o, exists := d.offers[id]
+	if !exists {
+		return tally.Offer{}, tally.ErrorNotFound
+	}
+	if o.State != tally.OfferPending {
+		return *o, tally.ErrorInvalidState
+	}
+	d.rematch(o, tally.OfferDeclined)
+	return *o, nil
+}
+
+// Implements DispatchService
+func (d *dispatcher) Close() {
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+}
+
+// Sets the final state of the offer and frees the cab.  Caller must hold the lock.
+func (d *dispatcher) closeOffer(o *tally.Offer, state tally.OfferState) {
+	o.State = state
+	if d.engaged[o.Cab] == o.Id {
+		delete(d.engaged, o.Cab)
+	}
+}
+
+// Sets the final state of the pickup and starts its retention.  Caller must hold the lock.
+func (d *dispatcher) closePickup(p *tally.Pickup, state tally.PickupState) {
+	p.State = state
+	d.closed[p.Id] = d.now()
+}
+
+// Closes the offer and puts its pickup back to pending, excluding the cab from further
+// matching for the pickup.  Caller must hold the lock.
+func (d *dispatcher) rematch(o *tally.Offer, state tally.OfferState) {
+	d.closeOffer(o, state)
+	p := d.pickups[o.Pickup]
+	p.State = tally.PickupPending
+	p.Cab = 0
+	p.Offer = 0
+	p.Declined = append(p.Declined, o.Cab)
+}
+
+// Times out the offers not replied to, and expires the pickups pending for too long.  Evicts
+// the pickups closed for longer than the retention window with their offers, and the offers
+// closed for as long that are no longer current, e.g. declined ones.
+func (d *dispatcher) expire() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.now()
+	for _, o := range d.offers {
+		if o.State == tally.OfferPending && !now.Before(o.Expires) {
+			d.rematch(o, tally.OfferTimedOut)
+		}
+	}
+	for id, p := range d.pickups {
+		if p.State == tally.PickupPending && now.Sub(p.Created) >= d.config.RequestTimeout {
+			d.closePickup(p, tally.PickupExpired)
+		}
+		if closed, exists := d.closed[id]; exists && now.Sub(closed) >= d.config.Retention {
+			delete(d.pickups, id)
+			delete(d.closed, id)
+		}
+	}
+	for id, o := range d.offers {
+		// An offer is closed at the latest when it expires
+		p, exists := d.pickups[o.Pickup]
+		if !exists || o.State != tally.OfferPending && p.Offer != id && now.Sub(o.Expires) >= d.config.Retention {
+			delete(d.offers, id)
+		}
+	}
+}
+
+// A candidate pair of pickup and cab
+type candidate struct {
+	pickup, cab int // indexes into the pending pickups and candidate cabs
+	distance    float64
+}
+
+// Matches the pending pickups to available cabs and sends the offers.  The cabs are queried
+// without holding the lock, as the CabService may be remote, so the pickups and cabs are checked
+// again once it is taken back.
+func (d *dispatcher) match() error {
+	d.lock.Lock()
+	snapshot := make([]*tally.Pickup, 0)
+	for _, p := range d.pickups {
+		if p.State == tally.PickupPending {
+			copied := *p
+			snapshot = append(snapshot, &copied)
+		}
+	}
+	engaged := len(d.engaged)
+	d.lock.Unlock()
+
+	if len(snapshot) == 0 {
+		return nil
+	}
+	// Earlier requests first, so the greedy strategy breaks ties in their favor.
+	sort.Sort(byCreated(snapshot))
+
+	// Find the cabs near each pickup
+	found := make([][]tally.Cab, len(snapshot))
+	for i, p := range snapshot {
+		var err error
+		found[i], err = d.cabs.Query(tally.GeoWithin{
+			Center: p.Location,
+			Radius: d.config.Radius,
+			Unit:   tally.Meters,
+			Limit:  d.config.Candidates + engaged + len(p.Declined),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Pair the pickups still pending with the candidate cabs that are not engaged meanwhile
+	pending := make([]*tally.Pickup, 0, len(snapshot))
+	cabs := make([]tally.Cab, 0)
+	cabIndex := make(map[tally.Id]int)
+	candidates := make([]candidate, 0)
+	for k, s := range snapshot {
+		p, exists := d.pickups[s.Id]
+		if !exists || p.State != tally.PickupPending {
+			continue
+		}
+		i := len(pending)
+		pending = append(pending, p)
+		n := 0
+		for _, cab := range found[k] {
+			if !cab.Available() || d.isEngaged(cab.Id) || declined(p, cab.Id) {
+				continue
+			}
+			j, exists := cabIndex[cab.Id]
+			if !exists {
+				j = len(cabs)
+				cabIndex[cab.Id] = j
+				cabs = append(cabs, cab)
+			}
+			candidates = append(candidates, candidate{
+				pickup:   i,
+				cab:      j,
+				distance: Haversine(p.Location, locationOfCab(cab), tally.Meters),
+			})
+			if n++; n == d.config.Candidates {
+				break
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var assigned []int
+	switch d.config.Strategy {
+	case tally.MatchOptimal:
+		assigned = matchOptimal(len(pending), len(cabs), candidates)
+	default:
+		assigned = matchGreedy(len(pending), len(cabs), candidates)
+	}
+
+	distances := make(map[[2]int]float64)
+	for _, c := range candidates {
+		distances[[2]int{c.pickup, c.cab}] = c.distance
+	}
+	now := d.now()
+	for i, j := range assigned {
+		if j < 0 {
+			continue
+		}
+		p := pending[i]
+		o := &tally.Offer{
+			Id:       d.nextId(),
+			Pickup:   p.Id,
+			Cab:      cabs[j].Id,
+			Location: p.Location,
+			Distance: distances[[2]int{i, j}],
+			State:    tally.OfferPending,
+			Created:  now,
+			Expires:  now.Add(d.config.OfferTimeout),
+		}
+		d.offers[o.Id] = o
+		d.engaged[o.Cab] = o.Id
+		p.State = tally.PickupOffered
+		p.Cab = o.Cab
+		p.Offer = o.Id
+	}
+	return nil
+}
+
+func (d *dispatcher) isEngaged(cab tally.Id) bool {
+	_, exists := d.engaged[cab]
+	return exists
+}
+
+func declined(p *tally.Pickup, cab tally.Id) bool {
+	for _, id := range p.Declined {
+		if id == cab {
+			return true
+		}
+	}
+	return false
+}
+
+func locationOfCab(cab tally.Cab) tally.Location {
+	return tally.Location{
+		Latitude:  cab.Latitude,
+		Longitude: cab.Longitude,
+	}
+}
+
+// Assigns the closest pairs first.  Returns for each pickup the index of the cab, or -1.
+func matchGreedy(pickups, cabs int, candidates []candidate) []int {
+	sorted := make([]candidate, len(candidates))
+	copy(sorted, candidates)
+	sort.Stable(byDistance(sorted))
+
+	assigned := make([]int, pickups)
+	for i := range assigned {
+		assigned[i] = -1
+	}
+	taken := make([]bool, cabs)
+	for _, c := range sorted {
+		if assigned[c.pickup] < 0 && !taken[c.cab] {
+			assigned[c.pickup] = c.cab
+			taken[c.cab] = true
+		}
+	}
+	return assigned
+}
+
+// Minimizes the total distance over all pickups.  Returns for each pickup the index of the cab, or -1.
+func matchOptimal(pickups, cabs int, candidates []candidate) []int {
+	cost := make([][]float64, pickups)
+	for i := range cost {
+		cost[i] = make([]float64, cabs)
+		for j := range cost[i] {
+			cost[i][j] = unmatchable
+		}
+	}
+	for _, c := range candidates {
+		cost[c.pickup][c.cab] = c.distance
+	}
+	assigned := hungarian(cost)
+	for i, j := range assigned {
+		if j >= 0 && cost[i][j] >= unmatchable {
+			assigned[i] = -1
+		}
+	}
+	return assigned
+}
+
+type byCreated []*tally.Pickup
+
+func (s byCreated) Len() int      { return len(s) }
+func (s byCreated) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCreated) Less(i, j int) bool {
+	if s[i].Created.Equal(s[j].Created) {
+		return s[i].Id < s[j].Id
+	}
+	return s[i].Created.Before(s[j].Created)
+}
+
+type byDistance []candidate
+
+func (s byDistance) Len() int           { return len(s) }
+func (s byDistance) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDistance) Less(i, j int) bool { return s[i].distance < s[j].distance }
@@ -0,0 +1,217 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"testing"
+	"time"
+)
+
+// Positions along a parallel, in thousandths of a degree of longitude from the origin.
+func along(x float64) tally.Location {
+	return tally.Location{Latitude: 40., Longitude: -74. + x*0.001}
+}
+
+func newTestDispatcher(test *testing.T, strategy tally.MatchStrategy) (*dispatcher, *time.Time) {
+	cabService := NewSimpleCabService()
+	for id, x := range map[tally.Id]float64{1: 2., 2: 5.5} {
+		loc := along(x)
+		if err := cabService.Upsert(tally.Cab{Id: id, Latitude: loc.Latitude, Longitude: loc.Longitude}); err != nil {
+			test.Fatal(err)
+		}
+	}
+	d := newDispatcher(cabService, tally.DispatchConfig{Strategy: strategy, OfferTimeout: 10 * time.Second})
+	clock := time.Unix(1400000000, 0)
+	d.now = func() time.Time { return clock }
+	return d, &clock
+}
+
+func requestPickups(test *testing.T, d *dispatcher) (p1, p2 tally.Pickup) {
+	var err error
+	if p1, err = d.Request(tally.Pickup{Rider: "a", Location: along(0.)}); err != nil {
+		test.Fatal(err)
+	}
+	if p2, err = d.Request(tally.Pickup{Rider: "b", Location: along(3.)}); err != nil {
+		test.Fatal(err)
+	}
+	if err = d.match(); err != nil {
+		test.Fatal(err)
+	}
+	p1, _ = d.Pickup(p1.Id)
+	p2, _ = d.Pickup(p2.Id)
+	return
+}
+
+func TestDispatchGreedy(test *testing.T) {
+	d, _ := newTestDispatcher(test, tally.MatchGreedy)
+	p1, p2 := requestPickups(test, d)
+
+	// The closest pair is taken first, leaving the far cab to the first rider.
+	if p1.State != tally.PickupOffered || p1.Cab != 2 || p2.Cab != 1 {
+		test.Error("Expecting greedy match", p1, p2)
+	}
+}
+
+func TestDispatchOptimal(test *testing.T) {
+	d, _ := newTestDispatcher(test, tally.MatchOptimal)
+	p1, p2 := requestPickups(test, d)
+
+	if p1.State != tally.PickupOffered || p1.Cab != 1 || p2.Cab != 2 {
+		test.Error("Expecting optimal match", p1, p2)
+	}
+}
+
+func TestDispatchAcceptDecline(test *testing.T) {
+	d, _ := newTestDispatcher(test, tally.MatchOptimal)
+	p1, p2 := requestPickups(test, d)
+
+	offers, _ := d.Offers(1)
+	if len(offers) != 1 || offers[0].Pickup != p1.Id || offers[0].Distance < 150. {
+		test.Error("Expecting offer for cab 1", offers)
+	}
+
+	// Cab 1 accepts: pickup assigned and cab dispatched
+	if o, err := d.Accept(p1.Offer); err != nil || o.State != tally.OfferAccepted {
+		test.Error("Expecting accepted", o, err)
+	}
+	if _, err := d.Accept(p1.Offer); err != tally.ErrorInvalidState {
+		test.Error("Accepting twice should fail", err)
+	}
+	if p, _ := d.Pickup(p1.Id); p.State != tally.PickupAssigned {
+		test.Error("Expecting assigned", p)
+	}
+	if cab, _ := d.cabs.Read(1); cab.Status != tally.CabDispatched {
+		test.Error("Expecting cab dispatched", cab)
+	}
+
+	// Cab 2 declines: pickup pending again and no cab left to offer.
+	if o, err := d.Decline(p2.Offer); err != nil || o.State != tally.OfferDeclined {
+		test.Error("Expecting declined", o, err)
+	}
+	if p, _ := d.Pickup(p2.Id); p.State != tally.PickupPending || len(p.Declined) != 1 {
+		test.Error("Expecting pending", p)
+	}
+
+	// Cancelling the assigned pickup makes the cab available again
+	if p, err := d.Cancel(p1.Id); err != nil || p.State != tally.PickupCancelled {
+		test.Error("Expecting cancelled", p, err)
+	}
+	if cab, _ := d.cabs.Read(1); !cab.Available() {
+		test.Error("Expecting cab available", cab)
+	}
+	d.match()
+	if p, _ := d.Pickup(p2.Id); p.State != tally.PickupOffered || p.Cab != 1 {
+		test.Error("Expecting offered to cab 1", p)
+	}
+}
+
+func TestDispatchTimeout(test *testing.T) {
+	d, clock := newTestDispatcher(test, tally.MatchOptimal)
+	p1, _ := requestPickups(test, d)
+
+	*clock = clock.Add(11 * time.Second)
+	d.expire()
+
+	if o, err := d.Accept(p1.Offer); err != tally.ErrorInvalidState || o.State != tally.OfferTimedOut {
+		test.Error("Expecting timed out", o, err)
+	}
+	if offers, _ := d.Offers(1); len(offers) != 0 {
+		test.Error("Expecting no offers", offers)
+	}
+
+	// Both offers timed out; each rider is offered the cab that has not timed out on them.
+	d.match()
+	if p, _ := d.Pickup(p1.Id); p.State != tally.PickupOffered || p.Cab != 2 {
+		test.Error("Expecting offered to cab 2", p)
+	}
+
+	// No cab accepted within the request timeout
+	*clock = clock.Add(5 * time.Minute)
+	d.expire()
+	if p, _ := d.Pickup(p1.Id); p.State != tally.PickupExpired {
+		test.Error("Expecting expired", p)
+	}
+}
+
+func TestDispatchEviction(test *testing.T) {
+	d, clock := newTestDispatcher(test, tally.MatchOptimal)
+	p1, p2 := requestPickups(test, d)
+
+	// The first rider is assigned a cab, and the second is declined by the other and cancels.
+	if _, err := d.Accept(p1.Offer); err != nil {
+		test.Fatal(err)
+	}
+	if _, err := d.Decline(p2.Offer); err != nil {
+		test.Fatal(err)
+	}
+	if _, err := d.Cancel(p2.Id); err != nil {
+		test.Fatal(err)
+	}
+	p3, _ := d.Request(tally.Pickup{Rider: "c", Location: along(1.)})
+
+	// Closed pickups are kept for the retention window
+	*clock = clock.Add(4 * time.Minute)
+	d.expire()
+	if len(d.pickups) != 3 || len(d.offers) != 2 || len(d.closed) != 2 {
+		test.Error("Expecting closed pickups kept", d.pickups, d.offers, d.closed)
+	}
+	if p, _ := d.Pickup(p1.Id); p.State != tally.PickupAssigned {
+		test.Error("Expecting assigned", p)
+	}
+
+	// The assigned and cancelled pickups are evicted with their offers; the third has expired.
+	*clock = clock.Add(2 * time.Minute)
+	d.expire()
+	if len(d.pickups) != 1 || len(d.offers) != 0 || len(d.closed) != 1 {
+		test.Error("Expecting closed pickups evicted", d.pickups, d.offers, d.closed)
+	}
+	if _, err := d.Pickup(p1.Id); err != tally.ErrorNotFound {
+		test.Error("Expecting assigned pickup evicted", err)
+	}
+	if p, _ := d.Pickup(p3.Id); p.State != tally.PickupExpired {
+		test.Error("Expecting expired", p)
+	}
+
+	*clock = clock.Add(5 * time.Minute)
+	d.expire()
+	if len(d.pickups) != 0 || len(d.offers) != 0 || len(d.closed) != 0 || len(d.engaged) != 0 {
+		test.Error("Expecting all evicted", d.pickups, d.offers, d.closed, d.engaged)
+	}
+}
+
+// Cab service that calls back before each query
+type hookedCabService struct {
+	tally.CabService
+	beforeQuery func()
+}
+
+func (s *hookedCabService) Query(q tally.GeoWithin) ([]tally.Cab, error) {
+	s.beforeQuery()
+	return s.CabService.Query(q)
+}
+
+func TestDispatchMatchUnlocked(test *testing.T) {
+	d, _ := newTestDispatcher(test, tally.MatchGreedy)
+	p1, _ := d.Request(tally.Pickup{Rider: "a", Location: along(0.)})
+	p2, _ := d.Request(tally.Pickup{Rider: "b", Location: along(3.)})
+
+	// The first rider cancels while the cabs are queried
+	d.cabs = &hookedCabService{CabService: d.cabs, beforeQuery: func() {
+		if !d.lock.TryLock() {
+			test.Fatal("Expecting the cabs queried without the lock")
+		}
+		d.lock.Unlock()
+		d.Cancel(p1.Id)
+	}}
+	if err := d.match(); err != nil {
+		test.Fatal(err)
+	}
+	if p, _ := d.Pickup(p1.Id); p.State != tally.PickupCancelled || p.Offer != 0 {
+		test.Error("Expecting cancelled without an offer", p)
+	}
+	if p, _ := d.Pickup(p2.Id); p.State != tally.PickupOffered || p.Cab != 1 {
+		test.Error("Expecting offered to cab 1", p)
+	}
+	if len(d.offers) != 1 || len(d.engaged) != 1 {
+		test.Error("Expecting only the offer of the pending pickup", d.offers, d.engaged)
+	}
+}
@@ -0,0 +1,136 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/proto"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Simple implementation of the EventStore interface.  Events are kept in memory in the order
+// they were put, and queries scan all of them.  Those with ids are indexed by source and id, to
+// be replaced.
+type simpleEventStore struct {
+	lock   sync.RWMutex
+	events []Tally.Event
+	byId   map[eventKey]int
+}
+
+// Key of an event with an id, given by its source
+type eventKey struct {
+	source, id string
+}
+
+// Constructor method.  Returns an empty in-memory event store.
+func NewSimpleEventStore() *simpleEventStore {
+	return &simpleEventStore{events: make([]Tally.Event, 0), byId: make(map[eventKey]int)}
+}
+
+// Returns the time of the event.
+func eventTime(event *Tally.Event) time.Time {
+	return tally.EventTime(event)
+}
+
+// Returns the timestamp in seconds since the epoch of the time.
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// Sorts the events by their timestamps, keeping the order of those at the same time, and limits
+// them unless the limit is zero.
+func sortEvents(events []Tally.Event, limit int) []Tally.Event {
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventTime(&events[i]).Before(eventTime(&events[j]))
+	})
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return events
+}
+
+// Implements EventService
+func (s *simpleEventStore) Put(events []Tally.Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, event := range events {
+		if event.Id == nil {
+			s.events = append(s.events, event)
+			continue
+		}
+		key := eventKey{event.GetSource(), event.GetId()}
+		if i, exists := s.byId[key]; exists {
+			s.events[i] = event
+		} else {
+			s.byId[key] = len(s.events)
+			s.events = append(s.events, event)
+		}
+	}
+	return nil
+}
+
+// Implements EventStore
+func (s *simpleEventStore) Find(q tally.EventQuery) ([]Tally.Event, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	found := make([]Tally.Event, 0)
+	for i := range s.events {
+		if matchesEvent(q, &s.events[i]) && eventWithin(q, &s.events[i]) {
+			found = append(found, s.events[i])
+		}
+	}
+	return sortEvents(found, q.Limit), nil
+}
+
+// Implements EventStore
+func (s *simpleEventStore) Count(q tally.EventQuery, box geo.Box, grid tally.Grid) ([]tally.GridCell, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if err := grid.Validate(); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	counter := newGridCounter(grid)
+	for i := range s.events {
+		loc, ok := eventLocation(&s.events[i])
+		if ok && box.Contains(loc.Latitude, loc.Longitude) && matchesEvent(q, &s.events[i]) &&
+			eventWithin(q, &s.events[i]) {
+			counter.add(loc)
+		}
+	}
+	return counter.result(), nil
+}
+
+// Implements EventStore
+func (s *simpleEventStore) Remove(q tally.EventQuery) (int, error) {
+	if q.Within != nil || q.Region != nil || q.Limit != 0 {
+		return 0, tally.ErrorBadParam
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	kept := make([]Tally.Event, 0, len(s.events))
+	s.byId = make(map[eventKey]int)
+	for i := range s.events {
+		if matchesEvent(q, &s.events[i]) {
+			continue
+		}
+		if s.events[i].Id != nil {
+			s.byId[eventKey{s.events[i].GetSource(), s.events[i].GetId()}] = len(kept)
+		}
+		kept = append(kept, s.events[i])
+	}
+	removed := len(s.events) - len(kept)
+	s.events = kept
+	return removed, nil
+}
+
+// Implements EventStore
+func (s *simpleEventStore) Close() {
+	// do nothing
+}
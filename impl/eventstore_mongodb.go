@@ -0,0 +1,296 @@
+package impl
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/proto"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Storage of events in a mongodb collection.  Each event is stored as its protobuf encoding along
+// with the fields that queries select on, indexed.
+type mgoEventStore struct {
+	session    *mgo.Session
+	collection *mgo.Collection
+}
+
+// Record of an event in mongodb.  The location is a legacy coordinate pair, longitude first, for
+// the 2dsphere index.  The end is the timestamp of instants, and missing from older records.
+type mgo_event struct {
+	Id        string    `bson:"eid,omitempty"`
+	Timestamp float64   `bson:"timestamp"`
+	End       float64   `bson:"end"`
+	Type      string    `bson:"type"`
+	Source    string    `bson:"source"`
+	Context   string    `bson:"context,omitempty"`
+	Tags      []string  `bson:"tags,omitempty"`
+	Loc       []float64 `bson:"loc,omitempty"`
+	Accuracy  float64   `bson:"accuracy,omitempty"`
+	Pb        []byte    `bson:"pb"`
+}
+
+// Constructor method.  Returns an event store keeping the events in mongodb.
+func NewMongoDbEventStore(url, db, collection string) (store *mgoEventStore, err error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return
+	}
+	store = &mgoEventStore{
+		session:    session,
+		collection: session.DB(db).C(collection),
+	}
+	store.collection.EnsureIndex(mgo.Index{
+		Key:  []string{"$2dsphere:loc"},
+		Name: "2dsphere",
+	})
+	store.collection.EnsureIndex(mgo.Index{
+		Key:  []string{"type", "timestamp"},
+		Name: "type_timestamp",
+	})
+	store.collection.EnsureIndex(mgo.Index{
+		Key:    []string{"source", "eid"},
+		Name:   "source_eid",
+		Sparse: true,
+	})
+	return
+}
+
+func to_mgo_event(event *Tally.Event) (*mgo_event, error) {
+	pb, err := proto.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	r := &mgo_event{
+		Id:        event.GetId(),
+		Timestamp: unixSeconds(eventTime(event)),
+		End:       unixSeconds(tally.EventEnd(event)),
+		Type:      event.GetType(),
+		Source:    event.GetSource(),
+		Context:   event.GetContext(),
+		Tags:      event.Tags,
+		Pb:        pb,
+	}
+	if event.Location != nil {
+		r.Loc = []float64{event.Location.GetLon(), event.Location.GetLat()}
+		r.Accuracy = event.Location.GetAccuracy()
+	}
+	return r, nil
+}
+
+// Implements EventService.  Events without ids are inserted in one batch, and those with ids
+// upserted by source and id.
+func (s *mgoEventStore) Put(events []Tally.Event) error {
+	docs := make([]interface{}, 0, len(events))
+	for i := range events {
+		r, err := to_mgo_event(&events[i])
+		if err != nil {
+			return tally.ErrorBadParam
+		}
+		if r.Id == "" {
+			docs = append(docs, r)
+			continue
+		}
+		if _, err := s.collection.Upsert(bson.M{"source": r.Source, "eid": r.Id}, r); err != nil {
+			return err
+		}
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	return s.collection.Insert(docs...)
+}
+
+// Returns the mongo query of the events by the id, type, source, tags, time range and accuracy of
+// the query.  Events overlap the range if they start before its end, and start at or end after its
+// start, for the older records without an end to match as instants.
+func mgo_event_query(q tally.EventQuery) bson.M {
+	query := bson.M{}
+	if q.Id != "" {
+		query["eid"] = q.Id
+	}
+	if q.Type != "" {
+		query["type"] = q.Type
+	}
+	if q.Source != "" {
+		query["source"] = q.Source
+	}
+	if len(q.Tags) > 0 {
+		query["tags"] = bson.M{"$all": q.Tags}
+	}
+	and := []interface{}{}
+	if !q.From.IsZero() {
+		from := unixSeconds(q.From)
+		and = append(and, bson.M{"$or": []interface{}{
+			bson.M{"timestamp": bson.M{"$gte": from}},
+			bson.M{"end": bson.M{"$gt": from}},
+		}})
+	}
+	if q.MaxAccuracy > 0 {
+		and = append(and, bson.M{"$or": mgo_accurate(q.MaxAccuracy)})
+	}
+	if len(and) > 0 {
+		query["$and"] = and
+	}
+	if !q.To.IsZero() {
+		query["timestamp"] = bson.M{"$lt": unixSeconds(q.To)}
+	}
+	return query
+}
+
+// Implements EventStore.  Circles are matched by mongo on the sphere, widened a little, and then
+// filtered by the query's distance model, as are corridors.
+func (s *mgoEventStore) Find(q tally.EventQuery) (events []Tally.Event, err error) {
+	if err = q.Validate(); err != nil {
+		return
+	}
+	query := mgo_event_query(q)
+	filter := false
+	switch {
+	case q.Within != nil:
+		w := *q.Within
+		tally.Sanitize(&w)
+		query["loc"] = bson.M{"$geoWithin": bson.M{"$centerSphere": []interface{}{
+			[]float64{w.Center.Longitude, w.Center.Latitude},
+			w.Unit.Meters(w.Radius) * 1.01 / geo.EarthRadius,
+		}}}
+		filter = true
+	case q.Region != nil:
+		for k, v := range mgo_region("loc", *q.Region) {
+			query[k] = v
+		}
+		filter = len(q.Region.Route) > 0
+	}
+
+	find := s.collection.Find(query).Sort("timestamp", "_id")
+	if q.Limit > 0 && !filter {
+		find = find.Limit(q.Limit)
+	}
+	itr := find.Iter()
+	events = make([]Tally.Event, 0)
+	r := mgo_event{}
+	for itr.Next(&r) {
+		event := Tally.Event{}
+		if err = proto.Unmarshal(r.Pb, &event); err != nil {
+			itr.Close()
+			return nil, err
+		}
+		if !filter || eventWithin(q, &event) {
+			events = append(events, event)
+		}
+	}
+	if err = itr.Close(); err != nil {
+		return nil, err
+	}
+	return sortEvents(events, q.Limit), nil
+}
+
+// Implements EventStore.  Events are counted by an aggregation, which needs mongodb 3.2, in the box
+// by their coordinates and by the region of the query or else of the box for the index.  Circles
+// and corridors, which mongo does not match exactly, are counted from the events found instead.
+func (s *mgoEventStore) Count(q tally.EventQuery, box geo.Box, grid tally.Grid) ([]tally.GridCell, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if err := grid.Validate(); err != nil {
+		return nil, err
+	}
+	if q.Within != nil || q.Region != nil && len(q.Region.Route) > 0 {
+		q.Limit = 0
+		events, err := s.Find(q)
+		if err != nil {
+			return nil, err
+		}
+		counter := newGridCounter(grid)
+		for i := range events {
+			if loc, ok := eventLocation(&events[i]); ok && box.Contains(loc.Latitude, loc.Longitude) {
+				counter.add(loc)
+			}
+		}
+		return counter.result(), nil
+	}
+
+	query := mgo_event_query(q)
+	region := tally.HeatmapQuery{Bounds: box}.Region()
+	if q.Region != nil {
+		region = *q.Region
+	}
+	for k, v := range mgo_region("loc", region) {
+		query[k] = v
+	}
+	query["loc.1"] = bson.M{"$gte": box.South, "$lte": box.North}
+	if box.CrossesAntimeridian() {
+		and, _ := query["$and"].([]interface{})
+		query["$and"] = append(and, bson.M{"$or": []interface{}{
+			bson.M{"loc.0": bson.M{"$gte": box.West}},
+			bson.M{"loc.0": bson.M{"$lte": box.East}},
+		}})
+	} else {
+		query["loc.0"] = bson.M{"$gte": box.West, "$lte": box.East}
+	}
+
+	// Longitudes eastward of the grid's west edge, as by its Cell
+	lon := bson.M{"$arrayElemAt": []interface{}{"$loc", 0}}
+	east := bson.M{"$cond": []interface{}{
+		bson.M{"$lt": []interface{}{lon, grid.West}}, bson.M{"$add": []interface{}{lon, 360.}}, lon,
+	}}
+	cell := func(field string, edge, size float64) bson.M {
+		return bson.M{"$floor": bson.M{"$divide": []interface{}{
+			bson.M{"$subtract": []interface{}{field, edge}}, size,
+		}}}
+	}
+	pipeline := []bson.M{
+		{"$match": query},
+		{"$project": bson.M{"lat": bson.M{"$arrayElemAt": []interface{}{"$loc", 1}}, "east": east}},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"row":    cell("$lat", grid.South, grid.Height),
+				"column": cell("$east", grid.West, grid.Width),
+			},
+			"count": bson.M{"$sum": 1},
+			"lat":   bson.M{"$avg": "$lat"},
+			"east":  bson.M{"$avg": "$east"},
+		}},
+	}
+	results := []struct {
+		Id struct {
+			Row    float64 `bson:"row"`
+			Column float64 `bson:"column"`
+		} `bson:"_id"`
+		Count int     `bson:"count"`
+		Lat   float64 `bson:"lat"`
+		East  float64 `bson:"east"`
+	}{}
+	if err := s.collection.Pipe(pipeline).All(&results); err != nil {
+		return nil, err
+	}
+	cells := make([]tally.GridCell, len(results))
+	for i, r := range results {
+		cells[i] = tally.GridCell{
+			Row:       int(r.Id.Row),
+			Column:    int(r.Id.Column),
+			Count:     r.Count,
+			Latitude:  r.Lat,
+			Longitude: r.East,
+		}
+	}
+	return sortCells(cells), nil
+}
+
+// Implements EventStore
+func (s *mgoEventStore) Remove(q tally.EventQuery) (int, error) {
+	if q.Within != nil || q.Region != nil || q.Limit != 0 {
+		return 0, tally.ErrorBadParam
+	}
+	info, err := s.collection.RemoveAll(mgo_event_query(q))
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// Implements EventStore
+func (s *mgoEventStore) Close() {
+	s.session.Close()
+}
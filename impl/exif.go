@@ -0,0 +1,244 @@
+package impl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// Metadata of a photo read from its EXIF: where and when it was taken, and how it is turned.
+type exif struct {
+	hasLocation bool
+	latitude    float64
+	longitude   float64
+	altitude    *float64
+
+	gpsTime  time.Time // UTC, or zero if not stamped
+	original string    // local date and time taken, as 2006:01:02 15:04:05
+	offset   string    // of the local time from UTC, as -07:00, if known
+
+	orientation int // 1 to 8, 1 if upright
+}
+
+// EXIF tags read, in the first IFD, the EXIF IFD and the GPS IFD
+const (
+	tagOrientation        = 0x0112
+	tagDateTime           = 0x0132
+	tagExifIfd            = 0x8769
+	tagGpsIfd             = 0x8825
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+
+	tagGpsLatitudeRef  = 0x01
+	tagGpsLatitude     = 0x02
+	tagGpsLongitudeRef = 0x03
+	tagGpsLongitude    = 0x04
+	tagGpsAltitudeRef  = 0x05
+	tagGpsAltitude     = 0x06
+	tagGpsTimeStamp    = 0x07
+	tagGpsDateStamp    = 0x1d
+)
+
+// Bytes per value of the TIFF field types, by type
+var tiffSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// Field of an IFD: its type, count and the bytes of its values
+type tiffField struct {
+	kind  uint16
+	count uint32
+	data  []byte
+}
+
+// TIFF structure of the EXIF, in its byte order
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// Returns the EXIF of the JPEG, from its APP1 segment, or false if it has none or it is malformed.
+func parseExif(jpeg []byte) (x exif, ok bool) {
+	segment := exifSegment(jpeg)
+	if len(segment) < 8 {
+		return
+	}
+	t := tiff{data: segment}
+	switch string(segment[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return
+	}
+	if t.order.Uint16(segment[2:]) != 42 {
+		return
+	}
+	ifd0, ok := t.ifd(t.order.Uint32(segment[4:]))
+	if !ok {
+		return
+	}
+
+	x.orientation = 1
+	if o, ok := t.uint(ifd0[tagOrientation]); ok && o >= 1 && o <= 8 {
+		x.orientation = int(o)
+	}
+	x.original = t.ascii(ifd0[tagDateTime])
+	if offset, ok := t.uint(ifd0[tagExifIfd]); ok {
+		if sub, ok := t.ifd(offset); ok {
+			if original := t.ascii(sub[tagDateTimeOriginal]); original != "" {
+				x.original = original
+			}
+			x.offset = t.ascii(sub[tagOffsetTimeOriginal])
+		}
+	}
+	if offset, ok := t.uint(ifd0[tagGpsIfd]); ok {
+		if gps, ok := t.ifd(offset); ok {
+			x.readGps(t, gps)
+		}
+	}
+	return x, true
+}
+
+// Reads the location, altitude and time stamp of the GPS IFD.
+func (x *exif) readGps(t tiff, gps map[uint16]tiffField) {
+	lat, latOk := t.degrees(gps[tagGpsLatitude])
+	lon, lonOk := t.degrees(gps[tagGpsLongitude])
+	if latOk && lonOk && lat <= 90 && lon <= 180 {
+		if strings.HasPrefix(t.ascii(gps[tagGpsLatitudeRef]), "S") {
+			lat = -lat
+		}
+		if strings.HasPrefix(t.ascii(gps[tagGpsLongitudeRef]), "W") {
+			lon = -lon
+		}
+		x.hasLocation, x.latitude, x.longitude = true, lat, lon
+	}
+	if alt, ok := t.rationals(gps[tagGpsAltitude]); ok && len(alt) == 1 {
+		if ref := gps[tagGpsAltitudeRef]; len(ref.data) > 0 && ref.data[0] == 1 {
+			alt[0] = -alt[0] // below sea level
+		}
+		x.altitude = &alt[0]
+	}
+	date := t.ascii(gps[tagGpsDateStamp])
+	hms, ok := t.rationals(gps[tagGpsTimeStamp])
+	if day, err := time.Parse("2006:01:02", date); err == nil && ok && len(hms) == 3 {
+		seconds := hms[0]*3600 + hms[1]*60 + hms[2]
+		x.gpsTime = day.Add(time.Duration(seconds * float64(time.Second)))
+	}
+}
+
+// Returns the time the photo was taken: stamped by the GPS, or else its local time at its offset
+// if known, or else in the zone.  Returns false if the EXIF has none.
+func (x *exif) taken(zone *time.Location) (time.Time, bool) {
+	if !x.gpsTime.IsZero() {
+		return x.gpsTime, true
+	}
+	if x.offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", x.original+x.offset); err == nil {
+			return t, true
+		}
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", x.original, zone)
+	return t, err == nil
+}
+
+// Returns the TIFF structure of the EXIF APP1 segment of the JPEG, or nil if none.
+func exifSegment(jpeg []byte) []byte {
+	if len(jpeg) < 2 || jpeg[0] != 0xff || jpeg[1] != 0xd8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(jpeg) && jpeg[i] == 0xff; {
+		marker := jpeg[i+1]
+		if marker == 0xda || marker == 0xd9 { // start of scan, or end of image
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(jpeg[i+2:]))
+		if length < 2 || i+2+length > len(jpeg) {
+			return nil
+		}
+		segment := jpeg[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+// Returns the fields of the IFD at the offset by tag, or false if out of bounds.
+func (t tiff) ifd(offset uint32) (map[uint16]tiffField, bool) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, false
+	}
+	n := uint64(t.order.Uint16(t.data[offset:]))
+	start := uint64(offset) + 2
+	if start+12*n > uint64(len(t.data)) {
+		return nil, false
+	}
+	fields := make(map[uint16]tiffField, n)
+	for k := uint64(0); k < n; k++ {
+		entry := t.data[start+12*k : start+12*k+12]
+		f := tiffField{kind: t.order.Uint16(entry[2:]), count: t.order.Uint32(entry[4:])}
+		size, known := tiffSizes[f.kind]
+		if !known {
+			continue
+		}
+		length := uint64(size) * uint64(f.count)
+		if length <= 4 {
+			f.data = entry[8 : 8+length]
+		} else if at := uint64(t.order.Uint32(entry[8:])); at+length <= uint64(len(t.data)) {
+			f.data = t.data[at : at+length]
+		} else {
+			continue
+		}
+		fields[t.order.Uint16(entry)] = f
+	}
+	return fields, true
+}
+
+// Returns the first value of the short or long field, or false if neither.
+func (t tiff) uint(f tiffField) (uint32, bool) {
+	switch {
+	case f.kind == 3 && f.count > 0:
+		return uint32(t.order.Uint16(f.data)), true
+	case f.kind == 4 && f.count > 0:
+		return t.order.Uint32(f.data), true
+	}
+	return 0, false
+}
+
+// Returns the text of the ascii field, up to its terminating nul, or "" if not ascii.
+func (t tiff) ascii(f tiffField) string {
+	if f.kind != 2 {
+		return ""
+	}
+	if end := bytes.IndexByte(f.data, 0); end >= 0 {
+		return string(f.data[:end])
+	}
+	return string(f.data)
+}
+
+// Returns the values of the unsigned rational field, or false if not rational or divided by 0.
+func (t tiff) rationals(f tiffField) ([]float64, bool) {
+	if f.kind != 5 {
+		return nil, false
+	}
+	values := make([]float64, f.count)
+	for k := range values {
+		num, den := t.order.Uint32(f.data[8*k:]), t.order.Uint32(f.data[8*k+4:])
+		if den == 0 {
+			return nil, false
+		}
+		values[k] = float64(num) / float64(den)
+	}
+	return values, true
+}
+
+// Returns the degrees of the GPS field of degrees, minutes and seconds, or false if not such.
+func (t tiff) degrees(f tiffField) (float64, bool) {
+	dms, ok := t.rationals(f)
+	if !ok || len(dms) != 3 {
+		return 0, false
+	}
+	return dms[0] + dms[1]/60 + dms[2]/3600, true
+}
@@ -0,0 +1,174 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"math"
+	"time"
+)
+
+// Computes fares by a tariff.
+type fareCalculator struct {
+	tariff   tally.Tariff
+	location *time.Location
+}
+
+// Constructor method.  Returns the fare calculator for the tariff, or an error if the
+// tariff's time zone or surcharge times are not valid.
+func NewFareCalculator(tariff tally.Tariff) (calculator *fareCalculator, err error) {
+	calculator = &fareCalculator{tariff: tariff}
+	if calculator.location, err = time.LoadLocation(tariff.TimeZone); err != nil {
+		return
+	}
+	for _, s := range tariff.Surcharges {
+		if _, err = minuteOfDay(s.From); err != nil {
+			return
+		}
+		if _, err = minuteOfDay(s.To); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Parses HH:MM into the minutes since midnight
+func minuteOfDay(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Rounds to cents
+func round2(v float64) float64 {
+	return math.Floor(v*100.+.5) / 100.
+}
+
+// Implements FareCalculator
+func (c *fareCalculator) Fare(ride tally.Ride) (receipt tally.Receipt, err error) {
+	if ride.State != tally.RideCompleted || len(ride.Track) == 0 {
+		err = tally.ErrorInvalidState
+		return
+	}
+	t := c.tariff
+	receipt = tally.Receipt{
+		Ride:     ride.Id,
+		Currency: t.Currency,
+		Items:    make([]tally.FareItem, 0),
+	}
+
+	// Meter the track segment by segment: the distance is charged once the cab moved further
+	// than the accuracy of its fixes, so the jitter of inaccurate fixes does not add up, and the
+	// time is charged either as moving or waiting depending on the speed over the segment.
+	fixes := fixesOfTrack(ride.Track)
+	moving, last := 0., fixes[0]
+	for i := 1; i < len(fixes); i++ {
+		from, to := fixes[i-1], fixes[i]
+		d := 0.
+		if i == len(fixes)-1 || to.movedFrom(last) {
+			d, last = Distance(last.loc, to.loc, t.Unit, t.Model), to
+		}
+		minutes := to.time.Sub(from.time).Minutes()
+		receipt.Distance += d
+		if minutes <= 0 {
+			continue
+		}
+		if d/(minutes/60.) < t.WaitingSpeed {
+			receipt.Waiting += minutes
+		} else {
+			moving += minutes
+		}
+	}
+	receipt.Minutes = moving + receipt.Waiting
+
+	if zone := c.zone(fixes); zone != nil {
+		receipt.Items = append(receipt.Items, tally.FareItem{Name: zone.Name, Amount: zone.Fare})
+	} else {
+		receipt.Items = append(receipt.Items,
+			tally.FareItem{Name: "base", Amount: t.BaseFare},
+			tally.FareItem{Name: "distance", Quantity: receipt.Distance, Rate: t.PerDistance,
+				Amount: round2(receipt.Distance * t.PerDistance)},
+			tally.FareItem{Name: "time", Quantity: moving, Rate: t.PerMinute,
+				Amount: round2(moving * t.PerMinute)},
+			tally.FareItem{Name: "waiting", Quantity: receipt.Waiting, Rate: t.WaitingPerMinute,
+				Amount: round2(receipt.Waiting * t.WaitingPerMinute)})
+	}
+
+	subtotal := 0.
+	for _, item := range receipt.Items {
+		subtotal += item.Amount
+	}
+	if subtotal < t.MinimumFare {
+		receipt.Items = append(receipt.Items, tally.FareItem{Name: "minimum", Amount: round2(t.MinimumFare - subtotal)})
+		subtotal = t.MinimumFare
+	}
+
+	pickedUp := ride.Track[0].Time.In(c.location)
+	for _, s := range t.Surcharges {
+		if !c.applies(s, pickedUp) {
+			continue
+		}
+		amount := s.Flat
+		if s.Multiplier > 0 {
+			amount += subtotal * (s.Multiplier - 1.)
+		}
+		receipt.Items = append(receipt.Items, tally.FareItem{Name: s.Name, Rate: s.Multiplier, Amount: round2(amount)})
+	}
+
+	for _, item := range receipt.Items {
+		receipt.Total += item.Amount
+	}
+	receipt.Total = round2(receipt.Total)
+	return
+}
+
+// Returns the fixes of the track.
+func fixesOfTrack(track []tally.TrackPoint) []fix {
+	fixes := make([]fix, len(track))
+	for i, p := range track {
+		fixes[i] = fix{p.Time, p.Location, p.Accuracy}
+	}
+	return fixes
+}
+
+// Returns the most accurate of the fixes at the end of the track, the first or the last, that are
+// within the accuracy of the end, e.g. of a cab at the curb after an indoor fix.  Fixes without
+// an accuracy are taken as accurate.
+func settledFix(fixes []fix, step int) tally.Location {
+	end := 0
+	if step < 0 {
+		end = len(fixes) - 1
+	}
+	best := fixes[end]
+	for k := end + step; k >= 0 && k < len(fixes) && !fixes[k].movedFrom(fixes[end]); k += step {
+		if fixes[k].accuracy < best.accuracy {
+			best = fixes[k]
+		}
+	}
+	return best.loc
+}
+
+// Returns the first zone rate for the ride's pickup and dropoff, or nil if none applies.  The
+// pickup and dropoff are the most accurate fixes where the cab stood at either end of the track.
+func (c *fareCalculator) zone(fixes []fix) *tally.ZoneRate {
+	pickup := settledFix(fixes, 1)
+	dropoff := settledFix(fixes, -1)
+	for i, z := range c.tariff.Zones {
+		if (len(z.Pickup) == 0 || inPolygon(pickup, z.Pickup)) &&
+			(len(z.Dropoff) == 0 || inPolygon(dropoff, z.Dropoff)) {
+			return &c.tariff.Zones[i]
+		}
+	}
+	return nil
+}
+
+// Returns true if the local time is within the surcharge's range of the day.
+func (c *fareCalculator) applies(s tally.Surcharge, local time.Time) bool {
+	from, _ := minuteOfDay(s.From)
+	to, _ := minuteOfDay(s.To)
+	m := local.Hour()*60 + local.Minute()
+	if from <= to {
+		return m >= from && m < to
+	}
+	return m >= from || m < to // wraps around midnight
+}
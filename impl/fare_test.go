@@ -0,0 +1,163 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"testing"
+	"time"
+)
+
+// Track north along a meridian: 1 km in 2 minutes, waits 3 minutes, then another 1 km in 2 minutes.
+func testRide(start time.Time) tally.Ride {
+	point := func(lat float64, minutes int) tally.TrackPoint {
+		return tally.TrackPoint{
+			Location: tally.Location{Latitude: lat, Longitude: -74.},
+			Time:     start.Add(time.Duration(minutes) * time.Minute),
+		}
+	}
+	return tally.Ride{
+		Id:    1,
+		State: tally.RideCompleted,
+		Track: []tally.TrackPoint{
+			point(40., 0), point(40.009, 2), point(40.009, 5), point(40.018, 7),
+		},
+	}
+}
+
+var testTariff = tally.Tariff{
+	Currency:         "USD",
+	BaseFare:         3.,
+	PerDistance:      2.,
+	Unit:             tally.Kilometers,
+	PerMinute:        .5,
+	WaitingSpeed:     10.,
+	WaitingPerMinute: .4,
+	TimeZone:         "America/New_York",
+	Surcharges: []tally.Surcharge{
+		tally.Surcharge{Name: "night", From: "20:00", To: "06:00", Multiplier: 1.2},
+	},
+}
+
+func fareOf(test *testing.T, tariff tally.Tariff, ride tally.Ride) tally.Receipt {
+	calculator, err := NewFareCalculator(tariff)
+	if err != nil {
+		test.Fatal(err)
+	}
+	receipt, err := calculator.Fare(ride)
+	if err != nil {
+		test.Fatal(err)
+	}
+	return receipt
+}
+
+func TestFareMetered(test *testing.T) {
+	noon, _ := time.Parse(time.RFC3339, "2014-05-01T12:00:00-04:00")
+	receipt := fareOf(test, testTariff, testRide(noon))
+
+	if !check(receipt.Distance, 2., 2) || receipt.Minutes != 7. || receipt.Waiting != 3. {
+		test.Error("Expecting 2 km, 7 minutes with 3 waiting", receipt)
+	}
+	expected := map[string]float64{"base": 3., "distance": 4., "time": 2., "waiting": 1.2}
+	if len(receipt.Items) != len(expected) {
+		test.Error("Expecting items", expected, receipt.Items)
+	}
+	for _, item := range receipt.Items {
+		if item.Amount != expected[item.Name] {
+			test.Error("Expecting", item.Name, expected[item.Name], "got", item.Amount)
+		}
+	}
+	if receipt.Total != 10.2 || receipt.Currency != "USD" {
+		test.Error("Expecting total 10.2", receipt)
+	}
+}
+
+func TestFareSurchargeAndMinimum(test *testing.T) {
+	// 11pm in New York is the next day in UTC
+	night, _ := time.Parse(time.RFC3339, "2014-05-02T03:00:00Z")
+	receipt := fareOf(test, testTariff, testRide(night))
+	last := receipt.Items[len(receipt.Items)-1]
+	if last.Name != "night" || last.Amount != 2.04 || receipt.Total != 12.24 {
+		test.Error("Expecting night surcharge", receipt)
+	}
+
+	tariff := testTariff
+	tariff.MinimumFare = 15.
+	noon, _ := time.Parse(time.RFC3339, "2014-05-01T12:00:00-04:00")
+	if receipt = fareOf(test, tariff, testRide(noon)); receipt.Total != 15. {
+		test.Error("Expecting minimum fare", receipt)
+	}
+}
+
+func TestFareZone(test *testing.T) {
+	tariff := testTariff
+	tariff.Zones = []tally.ZoneRate{
+		tally.ZoneRate{
+			Name: "airport",
+			Dropoff: []tally.Location{
+				tally.Location{Latitude: 40.01, Longitude: -74.01},
+				tally.Location{Latitude: 40.01, Longitude: -73.99},
+				tally.Location{Latitude: 40.03, Longitude: -73.99},
+				tally.Location{Latitude: 40.03, Longitude: -74.01},
+			},
+			Fare: 52.,
+		},
+	}
+	noon, _ := time.Parse(time.RFC3339, "2014-05-01T12:00:00-04:00")
+	receipt := fareOf(test, tariff, testRide(noon))
+	if len(receipt.Items) != 1 || receipt.Items[0].Name != "airport" || receipt.Total != 52. {
+		test.Error("Expecting flat airport fare", receipt)
+	}
+
+	calculator, _ := NewFareCalculator(tariff)
+	if _, err := calculator.Fare(tally.Ride{State: tally.RidePickedUp}); err != tally.ErrorInvalidState {
+		test.Error("Expecting fare of ride in progress to fail", err)
+	}
+}
+
+// Waits at the pickup with indoor fixes, drives 1 km in 2 minutes and stops at the curb, where the
+// last fix is indoors again in the airport.
+func TestFareJitter(test *testing.T) {
+	noon, _ := time.Parse(time.RFC3339, "2014-05-01T12:00:00-04:00")
+	point := func(lat float64, minutes int, accuracy float64) tally.TrackPoint {
+		return tally.TrackPoint{
+			Location: tally.Location{Latitude: lat, Longitude: -74.},
+			Time:     noon.Add(time.Duration(minutes) * time.Minute),
+			Accuracy: accuracy,
+		}
+	}
+	ride := tally.Ride{
+		Id:    1,
+		State: tally.RideCompleted,
+		Track: []tally.TrackPoint{
+			point(40., 0, 50.), point(40.0003, 1, 50.), point(39.9997, 2, 50.), point(40.0002, 3, 50.),
+			point(40.009, 5, 5.), point(40.0093, 6, 50.), point(40.0098, 8, 200.),
+		},
+	}
+
+	// The jitter within the accuracy adds no distance, only the move to the last fix does
+	receipt := fareOf(test, testTariff, ride)
+	if !check(receipt.Distance, 1.090, 2) || receipt.Minutes != 8. || receipt.Waiting != 6. {
+		test.Error("Expecting 1.09 km, 8 minutes with 6 waiting", receipt)
+	}
+
+	// The dropoff is the accurate fix at the curb, outside the airport
+	tariff := testTariff
+	tariff.Zones = []tally.ZoneRate{
+		tally.ZoneRate{
+			Name: "airport",
+			Dropoff: []tally.Location{
+				tally.Location{Latitude: 40.0095, Longitude: -74.01},
+				tally.Location{Latitude: 40.0095, Longitude: -73.99},
+				tally.Location{Latitude: 40.02, Longitude: -73.99},
+				tally.Location{Latitude: 40.02, Longitude: -74.01},
+			},
+			Fare: 52.,
+		},
+	}
+	if receipt = fareOf(test, tariff, ride); receipt.Items[0].Name != "base" {
+		test.Error("Expecting the metered fare", receipt)
+	}
+	ride.Track[4].Latitude = 40.0096
+	if receipt = fareOf(test, tariff, ride); receipt.Items[0].Name != "airport" {
+		test.Error("Expecting the airport fare", receipt)
+	}
+}
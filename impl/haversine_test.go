@@ -2,6 +2,7 @@ package impl
 
 import (
 	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
 	"math"
 	"testing"
 )
@@ -54,3 +55,49 @@ func TestHaversine(test *testing.T) {
 		test.Error("Expect in m", expected, d)
 	}
 }
+
+// Queries a cab a degree north of the equator, which is 110.6 km away on the ellipsoid but
+// 111.2 km on the sphere, so the model decides if it is within 110.9 km.  All models find it within
+// 111.25 km, short of its 111.32 km on the sphere of mongod's radius.  The model set as the
+// service's default is that of the queries that do not choose one.
+func testDistanceModels(service tally.CabService, model *geo.Model, test *testing.T) {
+	service.DeleteAll()
+	cab := tally.Cab{Id: 1, Latitude: 1., Longitude: 0.}
+	if err := service.Upsert(cab); err != nil {
+		test.Fatal(err)
+	}
+	center := tally.Location{Latitude: 0., Longitude: 0.}
+	for model, expected := range map[geo.Model]int{geo.Spherical: 0, geo.Ellipsoidal: 1, geo.Equirectangular: 0} {
+		q := tally.GeoWithin{Center: center, Radius: 110.9, Unit: tally.Kilometers, Model: model}
+		if found, err := service.Query(q); err != nil || len(found) != expected {
+			test.Error("Expecting", expected, "cabs by the", model, "model, got", found, err)
+		}
+		q.Radius = 111.25
+		if found, err := service.Query(q); err != nil || len(found) != 1 {
+			test.Error("Expecting the cab by the", model, "model, got", found, err)
+		}
+	}
+	*model = geo.Ellipsoidal
+	defer func() { *model = geo.DefaultModel }()
+	q := tally.GeoWithin{Center: center, Radius: 110.9, Unit: tally.Kilometers}
+	if found, err := service.Query(q); err != nil || len(found) != 1 {
+		test.Error("Expecting the cab by the service's model, got", found, err)
+	}
+	for _, model := range []geo.Model{geo.Spherical, geo.Equirectangular} {
+		q.Model = model
+		if found, err := service.Query(q); err != nil || len(found) != 0 {
+			test.Error("Expecting no cab by the query's", model, "model, got", found, err)
+		}
+	}
+}
+
+func TestDistanceModels(test *testing.T) {
+	service := NewSimpleCabService()
+	testDistanceModels(service, &service.Model, test)
+
+	d := Distance(tally.Location{Latitude: 0., Longitude: 0.}, tally.Location{Latitude: 1., Longitude: 0.},
+		tally.Kilometers, geo.Ellipsoidal)
+	if !check(110.574, d, 3) {
+		test.Error("Expecting a degree of the meridian in km", d)
+	}
+}
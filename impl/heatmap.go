@@ -0,0 +1,154 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/proto"
+	"math"
+	"sort"
+)
+
+// Implementation of the HeatmapService over any cab service and event store.  The cabs in the box
+// are found by the cab service's region query and counted here, and the events counted by the
+// store.
+type heatmapService struct {
+	cabs   tally.CabService
+	events tally.EventStore
+}
+
+// Constructor method.  The event store may be nil if no events are kept.
+func NewHeatmapService(cabs tally.CabService, events tally.EventStore) *heatmapService {
+	return &heatmapService{cabs: cabs, events: events}
+}
+
+// Counts of the cells by key, as they are found
+type heatCounter struct {
+	query tally.HeatmapQuery
+	cells map[string]*tally.HeatCell
+}
+
+func (c *heatCounter) add(loc tally.Location, count int) {
+	key, bounds := c.query.Cell(loc)
+	cell, exists := c.cells[key]
+	if !exists {
+		cell = &tally.HeatCell{Key: key, Bounds: bounds}
+		c.cells[key] = cell
+	}
+	cell.Count += count
+}
+
+// Returns the cells ordered by key.
+func (c *heatCounter) result() []tally.HeatCell {
+	cells := make([]tally.HeatCell, 0, len(c.cells))
+	for _, cell := range c.cells {
+		cells = append(cells, *cell)
+	}
+	sort.Slice(cells, func(i, j int) bool { return cells[i].Key < cells[j].Key })
+	return cells
+}
+
+// Implements HeatmapService
+func (s *heatmapService) Cabs(q tally.HeatmapQuery, status tally.CabStatus) ([]tally.HeatCell, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	cabs, err := s.cabs.QueryRegion(q.Region())
+	if err != nil {
+		return nil, err
+	}
+	counter := &heatCounter{q, make(map[string]*tally.HeatCell)}
+	for _, cab := range cabs {
+		if (status == "" || cab.Status == status) && q.Bounds.Contains(cab.Latitude, cab.Longitude) {
+			counter.add(locationOfCab(cab), 1)
+		}
+	}
+	return counter.result(), nil
+}
+
+// Implements HeatmapService.  A circle or region of the filter is applied along with the box.
+func (s *heatmapService) Events(q tally.HeatmapQuery, filter tally.EventQuery) ([]tally.HeatCell, error) {
+	if s.events == nil {
+		return nil, tally.ErrorNotFound
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	grid := q.Grid()
+	cells, err := s.events.Count(filter, q.Bounds, grid)
+	if err != nil {
+		return nil, err
+	}
+	counter := &heatCounter{q, make(map[string]*tally.HeatCell)}
+	for _, cell := range cells {
+		// Keyed by the center of the cell, within the poles and the antimeridian for the cells of
+		// locations on them to be merged with the last cells, as by the query's Cell
+		counter.add(tally.Location{
+			Latitude:  math.Min(grid.South+(float64(cell.Row)+.5)*grid.Height, 90.),
+			Longitude: math.Min(grid.West+(float64(cell.Column)+.5)*grid.Width, 180.),
+		}, cell.Count)
+	}
+	return counter.result(), nil
+}
+
+// Counts of the events per cell of a grid, as they are found, with the sums of their locations
+// until the result
+type gridCounter struct {
+	grid  tally.Grid
+	cells map[[2]int]*tally.GridCell
+}
+
+func newGridCounter(grid tally.Grid) *gridCounter {
+	return &gridCounter{grid: grid, cells: make(map[[2]int]*tally.GridCell)}
+}
+
+// Counts the location.  Longitudes are summed eastward of the grid's west edge, for the cells
+// across the antimeridian.
+func (c *gridCounter) add(loc tally.Location) {
+	row, column := c.grid.Cell(loc.Latitude, loc.Longitude)
+	cell, exists := c.cells[[2]int{row, column}]
+	if !exists {
+		cell = &tally.GridCell{Row: row, Column: column}
+		c.cells[[2]int{row, column}] = cell
+	}
+	cell.Count++
+	cell.Latitude += loc.Latitude
+	if loc.Longitude < c.grid.West {
+		loc.Longitude += 360.
+	}
+	cell.Longitude += loc.Longitude
+}
+
+// Returns the cells at the mean locations of their events, ordered by row and column.
+func (c *gridCounter) result() []tally.GridCell {
+	cells := make([]tally.GridCell, 0, len(c.cells))
+	for _, cell := range c.cells {
+		cells = append(cells, tally.GridCell{
+			Row:       cell.Row,
+			Column:    cell.Column,
+			Count:     cell.Count,
+			Latitude:  cell.Latitude / float64(cell.Count),
+			Longitude: cell.Longitude / float64(cell.Count),
+		})
+	}
+	return sortCells(cells)
+}
+
+// Sorts the cells by row and column, bringing their longitudes back within the antimeridian.
+func sortCells(cells []tally.GridCell) []tally.GridCell {
+	for i := range cells {
+		if cells[i].Longitude > 180. {
+			cells[i].Longitude -= 360.
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		return cells[i].Row < cells[j].Row || cells[i].Row == cells[j].Row && cells[i].Column < cells[j].Column
+	})
+	return cells
+}
+
+// Returns the location of the event, if it has one.
+func eventLocation(event *Tally.Event) (tally.Location, bool) {
+	if event.Location == nil {
+		return tally.Location{}, false
+	}
+	return tally.Location{Latitude: event.Location.GetLat(), Longitude: event.Location.GetLon()}, true
+}
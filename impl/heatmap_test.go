@@ -0,0 +1,108 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/tallytest"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The square of the region fixtures, in cells of 0.035 degrees that none of the cabs is on the
+// edge of
+var testHeatmap = tally.HeatmapQuery{
+	Bounds:   geo.Box{South: 37.75, West: -122.45, North: 37.80, East: -122.39},
+	CellSize: 0.035,
+}
+
+// Returns the counts of the cells by key.
+func heatCounts(cells []tally.HeatCell) map[string]int {
+	counts := make(map[string]int)
+	for _, cell := range cells {
+		counts[cell.Key] = cell.Count
+	}
+	return counts
+}
+
+func testHeatmapService(test *testing.T, cabs tally.CabService, events tally.EventStore) {
+	statuses := []tally.CabStatus{tally.CabAvailable, tally.CabDispatched}
+	for i, cab := range tallytest.RegionCabs {
+		cab.Status = statuses[i%2]
+		if err := cabs.Upsert(cab); err != nil {
+			test.Fatal(err)
+		}
+	}
+	service := NewHeatmapService(cabs, events)
+
+	// Cabs 1, 2, 3, 6, 7 and 8 are in the box; 4, 5 and 9 are not
+	cells, err := service.Cabs(testHeatmap, "")
+	expected := map[string]int{"3650/1644": 3, "3650/1645": 2, "3651/1645": 1}
+	if err != nil || !reflect.DeepEqual(heatCounts(cells), expected) {
+		test.Error("Expecting", expected, "got", cells, err)
+	}
+	if len(cells) == 0 || math.Abs(cells[0].Bounds.South-37.75) > 1e-9 || math.Abs(cells[0].Bounds.West+122.46) > 1e-9 {
+		test.Error("Expecting the bounds of the cell", cells[0])
+	}
+	cells, err = service.Cabs(testHeatmap, tally.CabAvailable)
+	expected = map[string]int{"3650/1644": 2, "3651/1645": 1}
+	if err != nil || !reflect.DeepEqual(heatCounts(cells), expected) {
+		test.Error("Expecting", expected, "got", cells, err)
+	}
+
+	// The region of a wide box holds a cab just south of it, which is not counted
+	for _, cab := range []tally.Cab{{Id: 100, Latitude: 60.5, Longitude: 45}, {Id: 101, Latitude: 59.99, Longitude: 5}} {
+		if err := cabs.Upsert(cab); err != nil {
+			test.Fatal(err)
+		}
+	}
+	wide := tally.HeatmapQuery{Bounds: geo.Box{South: 60, West: 0, North: 70, East: 90}, CellSize: 1}
+	cells, err = service.Cabs(wide, "")
+	expected = map[string]int{"150/225": 1}
+	if err != nil || !reflect.DeepEqual(heatCounts(cells), expected) {
+		test.Error("Expecting", expected, "got", cells, err)
+	}
+	if _, err := service.Cabs(tally.HeatmapQuery{Bounds: testHeatmap.Bounds}, ""); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam without cells", err)
+	}
+
+	if err := events.Put(tallytest.Events(5, "test")); err != nil {
+		test.Fatal(err)
+	}
+	dc := tally.HeatmapQuery{Bounds: geo.Box{South: 38, West: -78, North: 39, East: -77}, Precision: 6}
+	filter := tally.EventQuery{Type: "test", From: time.Unix(1.4e9+1, 0), To: time.Unix(1.4e9+4, 0)}
+	cells, err = service.Events(dc, filter)
+	expected = map[string]int{"dqcjqc": 3}
+	if err != nil || !reflect.DeepEqual(heatCounts(cells), expected) {
+		test.Error("Expecting", expected, "got", cells, err)
+	}
+	cells, err = service.Events(dc, tally.EventQuery{Type: "other"})
+	if err != nil || len(cells) != 0 {
+		test.Error("Expecting no cells", cells, err)
+	}
+	if _, err := NewHeatmapService(cabs, nil).Events(dc, filter); err != tally.ErrorNotFound {
+		test.Error("Expecting ErrorNotFound without events", err)
+	}
+}
+
+func TestSimpleHeatmap(test *testing.T) {
+	testHeatmapService(test, NewSimpleCabService(), NewSimpleEventStore())
+}
+
+func TestMongoDbHeatmap(test *testing.T) {
+	needMongoDb(test)
+	cabs, err := NewMongoDbCabService(mongoUrl, "test", "heatmap")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer cabs.Close()
+	cabs.DeleteAll()
+	events, err := NewMongoDbEventStore(mongoUrl, "test", "heatmap_events")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer events.Close()
+	events.collection.RemoveAll(nil)
+	testHeatmapService(test, cabs, events)
+}
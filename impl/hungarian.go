@@ -0,0 +1,97 @@
+package impl
+
+import (
+	"math"
+)
+
+// Solves the assignment problem for the cost matrix using the Hungarian algorithm in O(n^2 m).
+// Rows are assigned to distinct columns minimizing the total cost.  Returns for each row the
+// assigned column, or -1 if the row is not assigned (more rows than columns).  The matrix may
+// be rectangular but all rows must have the same length.
+// See https://en.wikipedia.org/wiki/Hungarian_algorithm
+func hungarian(cost [][]float64) []int {
+	rows := len(cost)
+	if rows == 0 {
+		return []int{}
+	}
+	cols := len(cost[0])
+	if rows > cols {
+		// Solve the transpose so that there are at least as many columns as rows.
+		transposed := make([][]float64, cols)
+		for j := range transposed {
+			transposed[j] = make([]float64, rows)
+			for i := range cost {
+				transposed[j][i] = cost[i][j]
+			}
+		}
+		assigned := make([]int, rows)
+		for i := range assigned {
+			assigned[i] = -1
+		}
+		for j, i := range hungarian(transposed) {
+			if i >= 0 {
+				assigned[i] = j
+			}
+		}
+		return assigned
+	}
+
+	// Potentials u, v and matching p are 1-indexed; column 0 is a sentinel.
+	u := make([]float64, rows+1)
+	v := make([]float64, cols+1)
+	p := make([]int, cols+1) // p[j] is the row matched to column j
+	way := make([]int, cols+1)
+	for i := 1; i <= rows; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]float64, cols+1)
+		used := make([]bool, cols+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+		for {
+			used[j0] = true
+			i0, delta, j1 := p[j0], math.Inf(1), 0
+			for j := 1; j <= cols; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost[i0-1][j-1] - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j], way[j] = cur, j0
+				}
+				if minv[j] < delta {
+					delta, j1 = minv[j], j
+				}
+			}
+			for j := 0; j <= cols; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	assigned := make([]int, rows)
+	for i := range assigned {
+		assigned[i] = -1
+	}
+	for j := 1; j <= cols; j++ {
+		if p[j] > 0 {
+			assigned[p[j]-1] = j - 1
+		}
+	}
+	return assigned
+}
@@ -0,0 +1,75 @@
+package impl
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Finds the minimum total cost by trying all assignments of rows to columns.
+func bruteForce(cost [][]float64, row int, used []bool) float64 {
+	if row == len(cost) {
+		return 0
+	}
+	best := -1.
+	for j := range cost[row] {
+		if used[j] {
+			continue
+		}
+		used[j] = true
+		if c := cost[row][j] + bruteForce(cost, row+1, used); best < 0 || c < best {
+			best = c
+		}
+		used[j] = false
+	}
+	return best
+}
+
+func totalCost(cost [][]float64, assigned []int) (total float64) {
+	for i, j := range assigned {
+		if j >= 0 {
+			total += cost[i][j]
+		}
+	}
+	return
+}
+
+func TestHungarian(test *testing.T) {
+	cost := [][]float64{
+		[]float64{4, 1, 3},
+		[]float64{2, 0, 5},
+		[]float64{3, 2, 2},
+	}
+	assigned := hungarian(cost)
+	if totalCost(cost, assigned) != 5. {
+		test.Error("Expecting total cost 5", assigned)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for n := 1; n <= 6; n++ {
+		for m := n; m <= 7; m++ {
+			cost := make([][]float64, n)
+			for i := range cost {
+				cost[i] = make([]float64, m)
+				for j := range cost[i] {
+					cost[i][j] = float64(r.Intn(100))
+				}
+			}
+			expected := bruteForce(cost, 0, make([]bool, m))
+			if actual := totalCost(cost, hungarian(cost)); actual != expected {
+				test.Error("Expecting", expected, "got", actual, cost)
+			}
+		}
+	}
+}
+
+func TestHungarianMoreRowsThanColumns(test *testing.T) {
+	cost := [][]float64{
+		[]float64{5},
+		[]float64{1},
+		[]float64{3},
+	}
+	assigned := hungarian(cost)
+	if assigned[0] != -1 || assigned[1] != 0 || assigned[2] != -1 {
+		test.Error("Expecting only the cheapest row assigned", assigned)
+	}
+}
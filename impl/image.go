@@ -0,0 +1,292 @@
+package impl
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/proto"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+)
+
+// Longest sides in pixels of the thumbnails made of images larger, from the smallest
+var thumbnailSizes = []int{64, 256, 1024}
+
+// Most pixels of the images decoded, 50 megapixels.  Larger images are kept as they are.
+const maxImagePixels = 50 * 1000 * 1000
+
+// Event store reading the JPEG, PNG and GIF images of the events put for their width and height,
+// and making their thumbnails.  Events without a location or a time take those of the EXIF of
+// their first photo that has them.
+type imageEventStore struct {
+	tally.EventStore
+	contents tally.ContentStore
+	zones    tally.Zones
+}
+
+// Constructor method.  Thumbnails are stored in the contents and referenced, or kept inline if
+// nil.  Times taken without an offset are local to the event's time zone, or else its source's
+// in the zones.  Closing the store closes the events but not the contents.
+func NewImageEventStore(events tally.EventStore, contents tally.ContentStore, zones tally.Zones) *imageEventStore {
+	return &imageEventStore{
+		EventStore: events,
+		contents:   contents,
+		zones:      zones,
+	}
+}
+
+// Implements EventService.  The events put are not changed.  Contents that do not decode as
+// their mime type are kept as they are.
+func (s *imageEventStore) Put(events []Tally.Event) error {
+	stored := make([]Tally.Event, len(events))
+	for i := range events {
+		stored[i] = events[i]
+		attributes, photo, err := s.process(events[i].Attributes)
+		if err != nil {
+			return err
+		}
+		stored[i].Attributes = attributes
+		if photo != nil {
+			s.fill(&stored[i], photo)
+		}
+	}
+	return s.EventStore.Put(stored)
+}
+
+// Returns the attributes with their images, also in lists and maps, measured and given
+// thumbnails, and the EXIF of the first photo that has a location or a time.  Attributes changed
+// are copies.
+func (s *imageEventStore) process(attributes []*Tally.Attribute) ([]*Tally.Attribute, *exif, error) {
+	if len(attributes) == 0 {
+		return attributes, nil, nil
+	}
+	var photo *exif
+	result := make([]*Tally.Attribute, len(attributes))
+	for i, a := range attributes {
+		result[i] = a
+		switch {
+		case a.ContentValue != nil:
+			content, x, err := s.image(a.ContentValue)
+			if err != nil {
+				return nil, nil, err
+			}
+			if content != a.ContentValue {
+				processed := *a
+				processed.ContentValue = content
+				result[i] = &processed
+			}
+			if photo == nil {
+				photo = x
+			}
+		case len(a.ListValue) > 0 || len(a.MapValue) > 0:
+			list, x, err := s.process(a.ListValue)
+			if err != nil {
+				return nil, nil, err
+			}
+			entries, y, err := s.process(a.MapValue)
+			if err != nil {
+				return nil, nil, err
+			}
+			nested := *a
+			nested.ListValue, nested.MapValue = list, entries
+			result[i] = &nested
+			if photo == nil {
+				photo = x
+			}
+			if photo == nil {
+				photo = y
+			}
+		}
+	}
+	return result, photo, nil
+}
+
+// Returns a copy of the inline image content with its width, height and thumbnails, and its EXIF
+// if a JPEG that has a location or a time.  Returns the content itself if not an image, measured
+// already, larger than maxImagePixels or not decoding.
+func (s *imageEventStore) image(content *Tally.Content) (*Tally.Content, *exif, error) {
+	if content.Hash != nil || content.Width != nil {
+		return content, nil, nil
+	}
+	mimeType, _, _ := mime.ParseMediaType(content.GetMime())
+	var decode func(io.Reader) (image.Image, error)
+	var decodeConfig func(io.Reader) (image.Config, error)
+	switch mimeType {
+	case "image/jpeg":
+		decode, decodeConfig = jpeg.Decode, jpeg.DecodeConfig
+	case "image/png":
+		decode, decodeConfig = png.Decode, png.DecodeConfig
+	case "image/gif":
+		decode, decodeConfig = gif.Decode, gif.DecodeConfig
+	default:
+		return content, nil, nil
+	}
+
+	// The size declared is checked before decoding, as a small file may declare a huge image
+	config, err := decodeConfig(bytes.NewReader(content.Data))
+	if err != nil || int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return content, nil, nil
+	}
+	img, err := decode(bytes.NewReader(content.Data))
+	if err != nil {
+		return content, nil, nil
+	}
+
+	var photo *exif
+	orientation := 1
+	if x, ok := parseExif(content.Data); ok {
+		orientation = x.orientation
+		if x.hasLocation || x.original != "" || !x.gpsTime.IsZero() {
+			photo = &x
+		}
+	}
+	measured := *content
+	width, height := orientedSize(img.Bounds(), orientation)
+	measured.Width, measured.Height = proto.Int32(int32(width)), proto.Int32(int32(height))
+
+	// The largest thumbnail is scaled from the image, and the smaller ones from it in turn
+	measured.Thumbnails = nil
+	var larger image.Image
+	for k := len(thumbnailSizes) - 1; k >= 0; k-- {
+		if size := thumbnailSizes[k]; size < width || size < height {
+			if larger == nil {
+				larger = thumbnail(img, orientation, size)
+			} else {
+				larger = thumbnail(larger, 1, size)
+			}
+			encoded, err := s.encode(larger, mimeType == "image/jpeg")
+			if err != nil {
+				return nil, nil, err
+			}
+			measured.Thumbnails = append([]*Tally.Content{encoded}, measured.Thumbnails...)
+		}
+	}
+	return &measured, photo, nil
+}
+
+// Returns the content of the thumbnail, a JPEG if of a photo or else a PNG to keep transparency,
+// stored in the contents if any.
+func (s *imageEventStore) encode(thumb image.Image, asJpeg bool) (*Tally.Content, error) {
+	var buff bytes.Buffer
+	mimeType := "image/png"
+	if asJpeg {
+		mimeType = "image/jpeg"
+		if err := jpeg.Encode(&buff, thumb, &jpeg.Options{Quality: 85}); err != nil {
+			return nil, err
+		}
+	} else if err := png.Encode(&buff, thumb); err != nil {
+		return nil, err
+	}
+	bounds := thumb.Bounds()
+	content := &Tally.Content{
+		Mime:   proto.String(mimeType),
+		Data:   buff.Bytes(),
+		Width:  proto.Int32(int32(bounds.Dx())),
+		Height: proto.Int32(int32(bounds.Dy())),
+	}
+	if s.contents == nil {
+		return content, nil
+	}
+	hash, err := s.contents.Put(mimeType, content.Data)
+	if err != nil {
+		return nil, err
+	}
+	content.Hash, content.Size, content.Data = &hash, proto.Int64(int64(buff.Len())), []byte{}
+	return content, nil
+}
+
+// Sets the location and the time of the event from the EXIF of its photo, unless it has them.
+func (s *imageEventStore) fill(event *Tally.Event, photo *exif) {
+	if event.Location == nil && photo.hasLocation {
+		event.Location = &Tally.Location{
+			Lat:      proto.Float64(photo.latitude),
+			Lon:      proto.Float64(photo.longitude),
+			Altitude: photo.altitude,
+		}
+	}
+	if event.TimeNanos != nil || event.GetTimestamp() != 0 {
+		return
+	}
+	zone := s.zones.Of(event.GetSource())
+	if event.TimeZone != nil {
+		if z, err := tally.LoadZone(event.GetTimeZone()); err == nil {
+			zone = z
+		}
+	}
+	if t, ok := photo.taken(zone); ok {
+		tally.SetEventTime(event, t)
+	}
+}
+
+// Returns the width and height of the image as displayed, swapped if turned a quarter.
+func orientedSize(bounds image.Rectangle, orientation int) (int, int) {
+	if orientation >= 5 {
+		return bounds.Dy(), bounds.Dx()
+	}
+	return bounds.Dx(), bounds.Dy()
+}
+
+// Returns the image turned upright by the EXIF orientation and scaled down to fit within size by
+// size, each pixel the average of those it covers.
+func thumbnail(img image.Image, orientation, size int) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := orientedSize(bounds, orientation)
+	scale := float64(size) / float64(width)
+	if height > width {
+		scale = float64(size) / float64(height)
+	}
+	tw, th := int(float64(width)*scale+0.5), int(float64(height)*scale+0.5)
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	// Returns the pixel of the image at x, y as displayed
+	at := func(x, y int) (r, g, b, a uint32) {
+		switch orientation {
+		case 2:
+			x = width - 1 - x
+		case 3:
+			x, y = width-1-x, height-1-y
+		case 4:
+			y = height - 1 - y
+		case 5:
+			x, y = y, x
+		case 6:
+			x, y = y, width-1-x
+		case 7:
+			x, y = height-1-y, width-1-x
+		case 8:
+			x, y = height-1-y, x
+		}
+		return img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for ty := 0; ty < th; ty++ {
+		y0, y1 := ty*height/th, (ty+1)*height/th
+		for tx := 0; tx < tw; tx++ {
+			x0, x1 := tx*width/tw, (tx+1)*width/tw
+			var r, g, b, a uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb, pa := at(x, y)
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+				}
+			}
+			n := uint64((y1 - y0) * (x1 - x0))
+			i := thumb.PixOffset(tx, ty)
+			thumb.Pix[i] = uint8(r / n >> 8)
+			thumb.Pix[i+1] = uint8(g / n >> 8)
+			thumb.Pix[i+2] = uint8(b / n >> 8)
+			thumb.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return thumb
+}
@@ -0,0 +1,280 @@
+package impl
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/proto"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+// Field of an EXIF IFD, for building test photos
+type exifEntry struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	value []byte
+}
+
+func exifAscii(tag uint16, s string) exifEntry {
+	return exifEntry{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func exifShort(tag uint16, v uint16) exifEntry {
+	value := make([]byte, 2)
+	binary.BigEndian.PutUint16(value, v)
+	return exifEntry{tag, 3, 1, value}
+}
+
+func exifRationals(tag uint16, values ...uint32) exifEntry {
+	value := make([]byte, 8*len(values))
+	for k, v := range values {
+		binary.BigEndian.PutUint32(value[8*k:], v)
+		binary.BigEndian.PutUint32(value[8*k+4:], 1)
+	}
+	return exifEntry{tag, 5, uint32(len(values)), value}
+}
+
+// Returns the JPEG with an EXIF segment of the fields of the first IFD, the EXIF IFD and the GPS
+// IFD, big endian.
+func withExif(photo []byte, ifd0, sub, gps []exifEntry) []byte {
+	size := func(entries []exifEntry) int { return 2 + 12*len(entries) + 4 }
+	subAt := 8 + size(ifd0) + 24
+	gpsAt := subAt + size(sub)
+	ifd0 = append(ifd0, exifEntry{tagExifIfd, 4, 1, []byte{0, 0, byte(subAt >> 8), byte(subAt)}},
+		exifEntry{tagGpsIfd, 4, 1, []byte{0, 0, byte(gpsAt >> 8), byte(gpsAt)}})
+
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8}
+	values := []byte{}
+	valuesAt := gpsAt + size(gps)
+	for _, entries := range [][]exifEntry{ifd0, sub, gps} {
+		tiff = append(tiff, byte(len(entries)>>8), byte(len(entries)))
+		for _, e := range entries {
+			entry := make([]byte, 12)
+			binary.BigEndian.PutUint16(entry, e.tag)
+			binary.BigEndian.PutUint16(entry[2:], e.kind)
+			binary.BigEndian.PutUint32(entry[4:], e.count)
+			if len(e.value) <= 4 {
+				copy(entry[8:], e.value)
+			} else {
+				binary.BigEndian.PutUint32(entry[8:], uint32(valuesAt+len(values)))
+				values = append(values, e.value...)
+			}
+			tiff = append(tiff, entry...)
+		}
+		tiff = append(tiff, 0, 0, 0, 0)
+	}
+	tiff = append(tiff, values...)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	header := []byte{0xff, 0xd8, 0xff, 0xe1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}
+	return append(append(header, segment...), photo[2:]...)
+}
+
+// Returns the image of the size, its left half red and its right half blue.
+func halves(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	return img
+}
+
+// Returns a PNG of one pixel declaring the size in its header, to be decoded into that many.
+func declaringPng(width, height int) []byte {
+	var buff bytes.Buffer
+	png.Encode(&buff, image.NewGray(image.Rect(0, 0, 1, 1)))
+	data := buff.Bytes()
+	// The IHDR chunk follows the signature: its length, type, width, height and so on, and CRC
+	binary.BigEndian.PutUint32(data[16:], uint32(width))
+	binary.BigEndian.PutUint32(data[20:], uint32(height))
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+// Returns a photo taken in San Francisco, turned a quarter to be upright, without a GPS time.
+func sanFrancisco(test *testing.T) []byte {
+	var buff bytes.Buffer
+	if err := jpeg.Encode(&buff, halves(300, 200), nil); err != nil {
+		test.Fatal(err)
+	}
+	return withExif(buff.Bytes(),
+		[]exifEntry{exifShort(tagOrientation, 6), exifAscii(tagDateTime, "2014:06:01 00:00:00")},
+		[]exifEntry{exifAscii(tagDateTimeOriginal, "2014:06:02 09:30:00"),
+			exifAscii(tagOffsetTimeOriginal, "-07:00")},
+		[]exifEntry{exifAscii(tagGpsLatitudeRef, "N"), exifRationals(tagGpsLatitude, 37, 46, 12),
+			exifAscii(tagGpsLongitudeRef, "W"), exifRationals(tagGpsLongitude, 122, 25, 12),
+			{tagGpsAltitudeRef, 1, 1, []byte{0}}, exifRationals(tagGpsAltitude, 15)})
+}
+
+func TestExif(test *testing.T) {
+	photo := sanFrancisco(test)
+	x, ok := parseExif(photo)
+	if !ok || !x.hasLocation || math.Abs(x.latitude-37.77) > 1e-9 || math.Abs(x.longitude+122.42) > 1e-9 ||
+		x.altitude == nil || *x.altitude != 15 || x.orientation != 6 {
+		test.Fatal("Expecting the location and orientation", x, ok)
+	}
+	if taken, ok := x.taken(time.UTC); !ok || !taken.Equal(time.Date(2014, 6, 2, 16, 30, 0, 0, time.UTC)) {
+		test.Error("Expecting the time taken at its offset", taken, ok)
+	}
+
+	// The GPS time stamp is in UTC, and the time taken without an offset is local to the zone
+	plain := photo[exifEnd(photo):]
+	x, ok = parseExif(withExif(append([]byte{0xff, 0xd8}, plain...), nil, nil,
+		[]exifEntry{exifAscii(tagGpsLatitudeRef, "S"), exifRationals(tagGpsLatitude, 33, 52, 0),
+			exifAscii(tagGpsLongitudeRef, "E"), exifRationals(tagGpsLongitude, 151, 12, 36),
+			exifAscii(tagGpsDateStamp, "2014:06:02"), exifRationals(tagGpsTimeStamp, 23, 59, 30)}))
+	if taken, _ := x.taken(time.UTC); !ok || x.latitude > -33 || x.longitude < 151 ||
+		!taken.Equal(time.Date(2014, 6, 2, 23, 59, 30, 0, time.UTC)) {
+		test.Error("Expecting Sydney at the GPS time", x, ok)
+	}
+	zone, _ := tally.LoadZone("America/New_York")
+	x.gpsTime, x.original = time.Time{}, "2014:06:02 09:30:00"
+	if taken, ok := x.taken(zone); !ok || taken.UTC().Hour() != 13 {
+		test.Error("Expecting the local time in New York", taken, ok)
+	}
+
+	// Truncated segments are not read past their end
+	for n := 0; n < exifEnd(photo); n++ {
+		parseExif(photo[:n])
+	}
+	if _, ok := parseExif(plain); ok {
+		test.Error("Expecting no EXIF without a JPEG header")
+	}
+}
+
+// Returns the end of the EXIF segment of the photo.
+func exifEnd(photo []byte) int {
+	return 4 + int(binary.BigEndian.Uint16(photo[4:]))
+}
+
+func testImageEventStore(test *testing.T, contents tally.ContentStore) {
+	store := NewImageEventStore(NewSimpleEventStore(), contents, tally.Zones{})
+	defer store.Close()
+
+	var drawing bytes.Buffer
+	if err := png.Encode(&drawing, halves(100, 50)); err != nil {
+		test.Fatal(err)
+	}
+	content := func(mime string, data []byte) *Tally.Content {
+		return &Tally.Content{Mime: proto.String(mime), Data: data}
+	}
+	event := Tally.Event{
+		Type:   proto.String("journal"),
+		Source: proto.String("alice"),
+		Attributes: []*Tally.Attribute{
+			{Key: proto.String("photo"), ContentValue: content("image/jpeg", sanFrancisco(test))},
+			{Key: proto.String("more"), ListValue: []*Tally.Attribute{
+				{Key: proto.String(""), ContentValue: content("image/png", drawing.Bytes())},
+				{Key: proto.String(""), ContentValue: content("image/jpeg", []byte("not a photo"))},
+				{Key: proto.String(""), ContentValue: content("image/png", declaringPng(60000, 60000))},
+			}},
+		},
+	}
+	original := proto.Clone(&event)
+	if err := store.Put([]Tally.Event{event}); err != nil {
+		test.Fatal(err)
+	}
+	if !proto.Equal(&event, original) {
+		test.Error("Expecting the event put unchanged", event)
+	}
+
+	found, err := store.Find(tally.EventQuery{Source: "alice"})
+	if err != nil || len(found) != 1 {
+		test.Fatal("Expecting the event", found, err)
+	}
+	stored := &found[0]
+	if loc := stored.Location; loc == nil || math.Abs(loc.GetLat()-37.77) > 1e-9 || loc.GetAltitude() != 15 ||
+		!tally.EventTime(stored).Equal(time.Date(2014, 6, 2, 16, 30, 0, 0, time.UTC)) {
+		test.Error("Expecting the location and time of the photo", stored.Location, tally.EventTime(stored))
+	}
+
+	// The photo is upright, its left half on top
+	photo := stored.Attributes[0].ContentValue
+	if photo.GetWidth() != 200 || photo.GetHeight() != 300 || len(photo.Thumbnails) != 2 {
+		test.Fatal("Expecting the photo upright with 2 thumbnails", photo.GetWidth(), photo.GetHeight(),
+			len(photo.Thumbnails))
+	}
+	small, medium := photo.Thumbnails[0], photo.Thumbnails[1]
+	if small.GetWidth() != 43 || small.GetHeight() != 64 || medium.GetWidth() != 171 ||
+		medium.GetHeight() != 256 || small.GetMime() != "image/jpeg" {
+		test.Error("Expecting thumbnails of 64 and 256 pixels", small, medium)
+	}
+	data := small.Data
+	if contents != nil {
+		blob, err := contents.Open(small.GetHash())
+		if err != nil || len(small.Data) != 0 || tally.ContentSize(small) != blob.Size() {
+			test.Fatal("Expecting the thumbnail stored", small, err)
+		}
+		data, _ = ioutil.ReadAll(blob)
+		blob.Close()
+	}
+	thumb, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil || thumb.Bounds().Dx() != 43 {
+		test.Fatal("Expecting the thumbnail to decode", err)
+	}
+	if r, _, b, _ := thumb.At(21, 10).RGBA(); r < 0xc000 || b > 0x4000 {
+		test.Error("Expecting red on top", r, b)
+	}
+	if r, _, b, _ := thumb.At(21, 54).RGBA(); r > 0x4000 || b < 0xc000 {
+		test.Error("Expecting blue below", r, b)
+	}
+
+	// Images smaller than a thumbnail get none of that size, and contents not decoding are kept
+	more := stored.Attributes[1].ListValue
+	if drawing := more[0].ContentValue; drawing.GetWidth() != 100 || drawing.GetHeight() != 50 ||
+		len(drawing.Thumbnails) != 1 || drawing.Thumbnails[0].GetMime() != "image/png" ||
+		drawing.Thumbnails[0].GetHeight() != 32 {
+		test.Error("Expecting a PNG thumbnail of 64 pixels", drawing)
+	}
+	if !proto.Equal(more[1], original.(*Tally.Event).Attributes[1].ListValue[1]) {
+		test.Error("Expecting the broken photo kept", more[1])
+	}
+	if !proto.Equal(more[2], original.(*Tally.Event).Attributes[1].ListValue[2]) {
+		test.Error("Expecting the image of too many pixels kept undecoded", more[2].ContentValue.Width)
+	}
+
+	// The location and time of the event are kept
+	event.Id = proto.String("kept")
+	event.Location = &Tally.Location{Lat: proto.Float64(40.7), Lon: proto.Float64(-74)}
+	tally.SetEventTime(&event, time.Date(2014, 6, 3, 0, 0, 0, 0, time.UTC))
+	if err := store.Put([]Tally.Event{event}); err != nil {
+		test.Fatal(err)
+	}
+	found, err = store.Find(tally.EventQuery{Source: "alice", Id: "kept"})
+	if err != nil || len(found) != 1 || found[0].Location.GetLat() != 40.7 ||
+		!tally.EventTime(&found[0]).Equal(time.Date(2014, 6, 3, 0, 0, 0, 0, time.UTC)) {
+		test.Error("Expecting the location and time of the event", found, err)
+	}
+}
+
+func TestImageEventStore(test *testing.T) {
+	testImageEventStore(test, nil)
+
+	dir, err := ioutil.TempDir("", "content")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	contents, err := NewFileContentStore(dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+	testImageEventStore(test, contents)
+}
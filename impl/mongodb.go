@@ -1,30 +1,95 @@
 package impl
 
 import (
+	"errors"
 	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
+	"log"
+	"math"
+	"time"
 )
 
+// Radius of the sphere mongod measures distances on, in meters, longer than the mean radius of the
+// earth the other backends use by 0.11%
+const mongoEarthRadius = 6378.1 * 1000.
+
+// Most writes in a write command, as mongod refuses more
+const mgoMaxWriteBatch = 1000
+
 type MongoDbCabService struct {
 	Url, Db, Collection string
+	Expiry              tally.Expiry
+	Model               geo.Model // of the queries left at the default model, spherical if not set
 	db                  *mgo.Database
 	session             *mgo.Session
 	collection          *mgo.Collection
+	stop                chan bool
 }
 
 // Special struct that accounts for how mongo indexes spatial data.
 // Conversions to and from this struct are required to satisfy the service api.
 type mgo_record struct {
-	Id  tally.Id `bson:"_id"`
-	Loc []float64  `bson:"loc"`
+	Id       tally.Id  `bson:"_id"`
+	Loc      []float64 `bson:"loc"`
+	LastSeen time.Time `bson:"lastSeen"`
+	Status   string    `bson:"status,omitempty"`
+	Accuracy float64   `bson:"accuracy,omitempty"`
+	Altitude float64   `bson:"altitude,omitempty"`
+	Speed    float64   `bson:"speed,omitempty"`
+	Heading  float64   `bson:"heading,omitempty"`
+}
+
+// Result of the mongodb write commands, used for reporting per item errors of bulk operations.
+type mgo_write_result struct {
+	N           int `bson:"n"`
+	WriteErrors []struct {
+		Index  int    `bson:"index"`
+		Code   int    `bson:"code"`
+		ErrMsg string `bson:"errmsg"`
+	} `bson:"writeErrors"`
 }
 
 // Converts input Cab struct into a mongodb record
 func to_mgo(cab *tally.Cab) *mgo_record {
 	return &mgo_record{
-		Id:  cab.Id,
-		Loc: []float64{cab.Longitude, cab.Latitude},
+		Id:       cab.Id,
+		Loc:      []float64{cab.Longitude, cab.Latitude},
+		LastSeen: time.Now(),
+		Status:   string(cab.Status),
+		Accuracy: cab.Accuracy,
+		Altitude: cab.Altitude,
+		Speed:    cab.Speed,
+		Heading:  cab.Heading,
+	}
+}
+
+// Returns the update of a cab's record.  Only the fields present are set so that
+// a position update without a status keeps the cab's current status.  The accuracy, altitude,
+// speed and heading are of the fix, and always replaced.
+func to_mgo_update(cab *tally.Cab) bson.M {
+	r := to_mgo(cab)
+	set := bson.M{
+		"loc":      r.Loc,
+		"lastSeen": r.LastSeen,
+		"accuracy": r.Accuracy,
+		"altitude": r.Altitude,
+		"speed":    r.Speed,
+		"heading":  r.Heading,
+	}
+	if r.Status != "" {
+		set["status"] = r.Status
+	}
+	return bson.M{"$set": set}
+}
+
+// Returns the clauses of a query for the records at most as inaccurate, or without an accuracy
+// as those put before it was kept.
+func mgo_accurate(maxAccuracy float64) []interface{} {
+	return []interface{}{
+		bson.M{"accuracy": bson.M{"$exists": false}},
+		bson.M{"accuracy": bson.M{"$lte": maxAccuracy}},
 	}
 }
 
@@ -34,16 +99,30 @@ func from_mgo(r *mgo_record) tally.Cab {
 		Id:        r.Id,
 		Longitude: r.Loc[0],
 		Latitude:  r.Loc[1],
+		Status:    tally.CabStatus(r.Status),
+		Accuracy:  r.Accuracy,
+		Altitude:  r.Altitude,
+		Speed:     r.Speed,
+		Heading:   r.Heading,
 	}
 }
 
 // Constructor, returns an instance of the service backed by mongodb using a 2dsphere spatial index.
 // This also connects to the database and ensures that the spatial indexed is used.
 func NewMongoDbCabService(url, db, collection string) (service *MongoDbCabService, err error) {
+	return NewExpiringMongoDbCabService(url, db, collection, tally.Expiry{})
+}
+
+// Constructor, returns an instance of the mongodb service where cabs not updated within the
+// expiry TTL are hidden from queries.  A background reaper removes them and sends the offline
+// notifications, and a TTL index on the last seen time acts as a backstop when no reaper runs.
+func NewExpiringMongoDbCabService(url, db, collection string,
+	expiry tally.Expiry) (service *MongoDbCabService, err error) {
 	service = &MongoDbCabService{
 		Url:        url,
 		Db:         db,
 		Collection: collection,
+		Expiry:     expiry,
 	}
 
 	// Connect to db
@@ -54,24 +133,105 @@ func NewMongoDbCabService(url, db, collection string) (service *MongoDbCabServic
 	service.db = service.session.DB(service.Db)
 	service.collection = service.db.C(service.Collection)
 	service.ensure2dIndex()
+	if expiry.TTL > 0 {
+		service.stop = make(chan bool)
+		go service.runReaper(service.stop)
+	}
 	return
 }
 
 // Makes sure the index is maintained on the loc property
 func (s *MongoDbCabService) ensure2dIndex() {
-	// 2d spatial index on 'loc'
+	// 2dsphere spatial index on 'loc', required by $near on GeoJSON points
 	s.collection.EnsureIndex(mgo.Index{
-		Key:      []string{"loc"},
+		Key:      []string{"$2dsphere:loc"},
 		Unique:   false,
 		DropDups: false,
 		Name:     "2dsphere",
 	})
+	if s.Expiry.TTL > 0 {
+		// Mongo's TTL monitor only runs once a minute, so allow the reaper to get to
+		// the expired cabs first in order for the offline notifications to be sent.
+		s.collection.EnsureIndex(mgo.Index{
+			Key:         []string{"lastSeen"},
+			ExpireAfter: s.Expiry.TTL + time.Minute,
+			Name:        "lastSeen_ttl",
+		})
+	}
+}
+
+// Returns the selector that excludes the cabs not seen within the TTL, or nil if expiry is disabled.
+func (s *MongoDbCabService) fresh() bson.M {
+	if s.Expiry.TTL <= 0 {
+		return nil
+	}
+	return bson.M{"lastSeen": bson.M{"$gt": time.Now().Add(-s.Expiry.TTL)}}
+}
+
+// Background loop that removes expired cabs until the service is closed.
+func (s *MongoDbCabService) runReaper(stop <-chan bool) {
+	ticker := time.NewTicker(s.Expiry.ReapInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.reap(stop); err != nil {
+				log.Println("Warning: failed to reap expired cabs", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Removes the cabs not seen within the TTL and sends the offline notifications.
+// Each cab is removed only if it was not updated since it was found, so a cab that
+// reports again while being reaped stays.  Stops sending once the service is closed.
+func (s *MongoDbCabService) reap(stop <-chan bool) (err error) {
+	query := bson.M{"lastSeen": bson.M{"$lte": time.Now().Add(-s.Expiry.TTL)}}
+	itr := s.collection.Find(query).Iter()
+	stale := make([]mgo_record, 0)
+	cab := mgo_record{}
+	for itr.Next(&cab) {
+		stale = append(stale, cab)
+	}
+	if err = itr.Close(); err != nil {
+		return
+	}
+	for _, r := range stale {
+		switch err = s.collection.Remove(bson.M{"_id": r.Id, "lastSeen": r.LastSeen}); err {
+		case nil:
+			if s.Expiry.Offline != nil {
+				select {
+				case s.Expiry.Offline <- tally.CabOffline{Id: r.Id, LastSeen: r.LastSeen}:
+				case <-stop:
+					return
+				}
+			}
+		case mgo.ErrNotFound:
+			err = nil
+		default:
+			return
+		}
+	}
+	return
+}
+
+// Returns the query for the cab by id, if not expired.
+func (s *MongoDbCabService) freshId(id tally.Id) bson.M {
+	query := s.fresh()
+	if query == nil {
+		query = bson.M{}
+	}
+	query["_id"] = id
+	return query
 }
 
 // Implements CabService
 func (s *MongoDbCabService) Read(id tally.Id) (found tally.Cab, err error) {
 	result := mgo_record{}
-	err = s.collection.FindId(id).One(&result)
+	query := s.freshId(id)
+	err = s.collection.Find(query).One(&result)
 	switch err {
 	case mgo.ErrNotFound:
 		err = tally.ErrorNotFound
@@ -86,8 +246,82 @@ func (s *MongoDbCabService) Read(id tally.Id) (found tally.Cab, err error) {
 
 // Implements CabService
 func (s *MongoDbCabService) Upsert(cab tally.Cab) (err error) {
-	r := to_mgo(&cab)
-	_, err = s.collection.UpsertId(cab.Id, *r)
+	_, err = s.collection.UpsertId(cab.Id, to_mgo_update(&cab))
+	return
+}
+
+// Implements CabService.  Uses the update write command so the batch is sent in a round trip per
+// mgoMaxWriteBatch cabs, unordered so a failure of one cab does not stop the rest.
+func (s *MongoDbCabService) UpsertBatch(cabs []tally.Cab) (errs []error, err error) {
+	errs = make([]error, len(cabs))
+	for offset := 0; offset < len(cabs); offset += mgoMaxWriteBatch {
+		end := offset + mgoMaxWriteBatch
+		if end > len(cabs) {
+			end = len(cabs)
+		}
+		chunk := cabs[offset:end]
+		updates := make([]bson.M, len(chunk))
+		for i := range chunk {
+			updates[i] = bson.M{
+				"q":      bson.M{"_id": chunk[i].Id},
+				"u":      to_mgo_update(&chunk[i]),
+				"upsert": true,
+			}
+		}
+		result := mgo_write_result{}
+		err = s.db.Run(bson.D{
+			{Name: "update", Value: s.Collection},
+			{Name: "updates", Value: updates},
+			{Name: "ordered", Value: false},
+		}, &result)
+		if err != nil {
+			return
+		}
+		// Indexes of the errors are within the chunk
+		for _, we := range result.WriteErrors {
+			if we.Index >= 0 && we.Index < len(chunk) {
+				errs[offset+we.Index] = errors.New(we.ErrMsg)
+			}
+		}
+	}
+	return
+}
+
+// Implements CabService.  Loads all the cabs in one query by the list of ids.
+func (s *MongoDbCabService) ReadBatch(ids []tally.Id) (cabs []tally.Cab, errs []error, err error) {
+	cabs = make([]tally.Cab, len(ids))
+	errs = make([]error, len(ids))
+	query := s.fresh()
+	if query == nil {
+		query = bson.M{}
+	}
+	query["_id"] = bson.M{"$in": ids}
+
+	found := make(map[tally.Id]tally.Cab)
+	itr := s.collection.Find(query).Iter()
+	cab := mgo_record{}
+	for itr.Next(&cab) {
+		found[cab.Id] = from_mgo(&cab)
+	}
+	if err = itr.Close(); err != nil {
+		return
+	}
+	for i, id := range ids {
+		if c, exists := found[id]; exists {
+			cabs[i] = c
+		} else {
+			errs[i] = tally.ErrorNotFound
+		}
+	}
+	return
+}
+
+// Implements CabService.  Only the status is set, so concurrent position updates are kept.
+func (s *MongoDbCabService) SetStatus(id tally.Id, status tally.CabStatus) (err error) {
+	err = s.collection.Update(s.freshId(id), bson.M{"$set": bson.M{"status": string(status)}})
+	if err == mgo.ErrNotFound {
+		err = tally.ErrorNotFound
+	}
 	return
 }
 
@@ -96,9 +330,13 @@ func (s *MongoDbCabService) Query(q tally.GeoWithin) (cabs []tally.Cab, err erro
 	return s.QueryIndexed(q)
 }
 
-// Implements CabService
+// Implements CabService.  Deleting a cab that is not there is not an error, as with the
+// in-memory service.
 func (s *MongoDbCabService) Delete(id tally.Id) (err error) {
-	return s.collection.RemoveId(id)
+	if err = s.collection.RemoveId(id); err == mgo.ErrNotFound {
+		err = nil
+	}
+	return
 }
 
 // Implements CabService
@@ -110,25 +348,26 @@ func (s *MongoDbCabService) DeleteAll() (err error) {
 
 // Implements CabService
 func (s *MongoDbCabService) Close() {
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
 	s.session.Close()
 }
 
-// Uses the spatial index '2dsphere' for fast lookup of cabs by proximity.
+// Uses the spatial index '2dsphere' for fast lookup of cabs by proximity.  Mongo measures on a
+// sphere of its own radius, so the circle is widened to the model's spherical bound on that
+// sphere, and the cabs found are filtered and ordered by the model, as by the other backends.
 func (s *MongoDbCabService) QueryIndexed(q tally.GeoWithin) (cabs []tally.Cab, err error) {
-	tally.Sanitize(&q)
+	s.sanitize(&q)
+	return s.queryByModel(q, q.Model.SphericalBound(q.Unit.Meters(q.Radius)))
+}
+
+// Returns the cabs nearest first within the circle of the sanitized query, as mongo measures.
+func (s *MongoDbCabService) queryNear(q tally.GeoWithin) (cabs []tally.Cab, err error) {
 	cabs = make([]tally.Cab, 0)
 
-	distance := 0. // in meters, per mongo api
-	switch q.Unit {
-	case tally.Kilometers:
-		distance = q.Radius * 1000.
-	case tally.Meters:
-		distance = q.Radius
-	case tally.Miles:
-		distance = q.Radius * 1609.34
-	case tally.Feet:
-		distance = q.Radius * 0.3048
-	}
+	distance := q.Unit.Meters(q.Radius) // in meters, per mongo api
 	query := bson.M{
 		"loc": bson.M{
 			"$near": bson.M{
@@ -140,6 +379,12 @@ func (s *MongoDbCabService) QueryIndexed(q tally.GeoWithin) (cabs []tally.Cab, e
 			},
 		},
 	}
+	for k, v := range s.fresh() {
+		query[k] = v
+	}
+	if q.MaxAccuracy > 0 {
+		query["$or"] = mgo_accurate(q.MaxAccuracy)
+	}
 
 	itr := s.collection.Find(query).Limit(q.Limit).Iter()
 	if itr.Err() != nil {
@@ -158,14 +403,77 @@ func (s *MongoDbCabService) QueryIndexed(q tally.GeoWithin) (cabs []tally.Cab, e
 	return
 }
 
+// Implements CabService.  Polygons are matched by mongo, where the edges are geodesics rather than
+// straight in latitude and longitude as in the simple backend; the difference is negligible for
+// polygons the size of a city.  Corridors are matched by the circles enclosing their segments,
+// then filtered by the distance from the route.
+func (s *MongoDbCabService) QueryRegion(q tally.GeoRegion) (cabs []tally.Cab, err error) {
+	if err = q.Validate(); err != nil {
+		return
+	}
+	query := mgo_region("loc", q)
+	for k, v := range s.fresh() {
+		query[k] = v
+	}
+	if q.MaxAccuracy > 0 {
+		// The corridor's circles are an $or already
+		query = bson.M{"$and": []bson.M{query, bson.M{"$or": mgo_accurate(q.MaxAccuracy)}}}
+	}
+	itr := s.collection.Find(query).Iter()
+	found := make([]cabDistance, 0)
+	record := mgo_record{}
+	for itr.Next(&record) {
+		cab := from_mgo(&record)
+		if len(q.Route) == 0 {
+			found = append(found, cabDistance{cab, 0.})
+		} else if ok, distance := q.Contains(locationOfCab(cab)); ok {
+			found = append(found, cabDistance{cab, distance})
+		}
+	}
+	if err = itr.Close(); err != nil {
+		return
+	}
+	return inRegion(found, q), nil
+}
+
+// Sanitizes the query, and gives it the service's model unless it chose one.
+func (s *MongoDbCabService) sanitize(q *tally.GeoWithin) {
+	tally.Sanitize(q)
+	if q.Model == geo.DefaultModel {
+		q.Model = s.Model
+	}
+}
+
+// Returns the cabs within the query by its model, from those mongo finds within the great circle
+// distance in meters.  Mongo orders by the great circle distance, so only the queries by the
+// sphere can be limited by mongo.
+func (s *MongoDbCabService) queryByModel(q tally.GeoWithin, distance float64) (cabs []tally.Cab, err error) {
+	wide := q
+	wide.Radius, wide.Unit, wide.Limit = distance*mongoEarthRadius/geo.EarthRadius, tally.Meters, math.MaxInt32
+	if q.Model == geo.Spherical || q.Model == geo.DefaultModel {
+		wide.Limit = q.Limit
+	}
+	found, err := s.queryNear(wide)
+	if err != nil {
+		return
+	}
+	near := make([]cabDistance, 0, len(found))
+	for _, cab := range found {
+		if d := Distance(q.Center, locationOfCab(cab), q.Unit, q.Model); d <= q.Radius {
+			near = append(near, cabDistance{cab, d})
+		}
+	}
+	return nearest(near, q.Limit), nil
+}
+
 // Slow version where the spatial index isn't used.  This involves the scan of the entire collection
 // with calculation of haversine distance for each point.
 // Included here for testing.
 func (s *MongoDbCabService) QueryUnindexed(q tally.GeoWithin) (cabs []tally.Cab, err error) {
-	tally.Sanitize(&q)
+	s.sanitize(&q)
 	cabs = make([]tally.Cab, 0)
 
-	itr := s.collection.Find(nil).Iter()
+	itr := s.collection.Find(s.fresh()).Iter()
 	if itr.Err() != nil {
 		err = itr.Err()
 		return
@@ -174,11 +482,11 @@ func (s *MongoDbCabService) QueryUnindexed(q tally.GeoWithin) (cabs []tally.Cab,
 
 	cab := mgo_record{}
 	for itr.Next(&cab) {
-		distance := Haversine(q.Center, tally.Location{
+		distance := Distance(q.Center, tally.Location{
 			Latitude:  cab.Loc[1],
 			Longitude: cab.Loc[0],
-		}, q.Unit)
-		if distance <= q.Radius {
+		}, q.Unit, q.Model)
+		if distance <= q.Radius && from_mgo(&cab).AccurateTo(q.MaxAccuracy) {
 			cabs = append(cabs, from_mgo(&cab))
 		}
 		if len(cabs) == q.Limit {
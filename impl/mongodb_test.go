@@ -1,29 +1,53 @@
 package impl
 
 import (
+	"fmt"
 	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/mgotest"
+	"labix.org/v2/mgo"
+	"os"
 	"testing"
 )
 
 var (
-	mongodb, dbErr = NewMongoDbCabService("localhost", "test", "cabs")
+	mongoUrl       = testMongoUrl()
+	mongodb, dbErr = NewMongoDbCabService(mongoUrl, "test", "cabs")
 )
 
+// Returns the url of the mongodb in TALLY_MONGODB, or else of an in-process stand-in.
+func testMongoUrl() string {
+	if url := os.Getenv("TALLY_MONGODB"); url != "" {
+		return url
+	}
+	return mgotest.NewServer().URL()
+}
+
+// Skips the test if there is no mongodb to connect to.
+func needMongoDb(test *testing.T) {
+	if dbErr != nil {
+		test.Skip("MongoDb not available:", dbErr)
+	}
+}
+
 func TestMongoDbUpsert(test *testing.T) {
+	needMongoDb(test)
 	testUpsert(mongodb, test)
 }
 
 func TestMongoDbGet(test *testing.T) {
+	needMongoDb(test)
 	testGet(mongodb, test, cabs[0].Id, &cabs[0])
 	testGet(mongodb, test, cabs[1].Id, &cabs[1])
 }
 
 func TestMongoDbQuery(test *testing.T) {
+	needMongoDb(test)
 	testQuery(mongodb, test, locations[0], 1000., []tally.Cab{cabs[0]})
 	testQuery(mongodb, test, locations[0], 500., []tally.Cab{})
 }
 
 func TestMongoDbDelete(test *testing.T) {
+	needMongoDb(test)
 	testUpsert(mongodb, test) // make sure data is there
 	testQuery(mongodb, test, locationOf(cabs[1]), 1000., []tally.Cab{cabs[1]})
 
@@ -36,6 +60,7 @@ func TestMongoDbDelete(test *testing.T) {
 }
 
 func TestMongoDbDeleteAll(test *testing.T) {
+	needMongoDb(test)
 	testDeleteAll(mongodb, test)
 	testQuery(mongodb, test, locationOf(cabs[0]), 1000., []tally.Cab{})
 	testQuery(mongodb, test, locationOf(cabs[1]), 1000., []tally.Cab{})
@@ -44,3 +69,57 @@ func TestMongoDbDeleteAll(test *testing.T) {
 
 	testUpsert(mongodb, test)
 }
+
+func TestMongoDbBatch(test *testing.T) {
+	needMongoDb(test)
+	testBatch(mongodb, test)
+}
+
+// Batches longer than a write command takes are sent in chunks, with the errors of their cabs at
+// their index in the whole batch.
+func TestMongoDbLargeBatch(test *testing.T) {
+	needMongoDb(test)
+	service, err := NewMongoDbCabService(mongoUrl, "test", "batches")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer service.Close()
+	service.collection.DropCollection()
+	// Statuses are unique, for a cab of the same status as one before to fail
+	if err := service.collection.EnsureIndex(mgo.Index{Key: []string{"status"}, Unique: true}); err != nil {
+		test.Fatal(err)
+	}
+	batch := make([]tally.Cab, 2500)
+	for i := range batch {
+		batch[i] = tally.Cab{Id: tally.Id(i + 1), Latitude: 37.77, Longitude: -122.42, Status: tally.CabStatus(fmt.Sprint(i))}
+	}
+	batch[1500].Status = batch[10].Status
+	errs, err := service.UpsertBatch(batch)
+	if err != nil || len(errs) != len(batch) {
+		test.Fatal("Expecting an error per cab", len(errs), err)
+	}
+	for i, e := range errs {
+		if (e != nil) != (i == 1500) {
+			test.Error("Expecting only the cab at 1500 to fail", i, e)
+		}
+	}
+	if n, err := service.collection.Count(); err != nil || n != len(batch)-1 {
+		test.Error("Expecting the other cabs upserted", n, err)
+	}
+}
+
+func TestMongoDbRide(test *testing.T) {
+	needMongoDb(test)
+	service, err := NewMongoDbRideService(mongoUrl, "test", "rides", mongodb)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer service.Close()
+	testRideLifecycle(service, mongodb, test)
+}
+
+func TestMongoDbDistanceModels(test *testing.T) {
+	needMongoDb(test)
+	testDistanceModels(mongodb, &mongodb.Model, test)
+	testUpsert(mongodb, test)
+}
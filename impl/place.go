@@ -0,0 +1,320 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Storage of places and the stays of their sources.  Implementations only persist; the
+// detection is done by the service.
+type placeStore interface {
+	// Stores a new place, assigning its id.
+	insert(place *tally.Place) error
+
+	// Loads a place by id, or ErrorNotFound.
+	load(id tally.Id) (tally.Place, error)
+
+	save(place tally.Place) error
+	remove(id tally.Id) error
+
+	// Returns the places of the source in any order.
+	places(source string) ([]tally.Place, error)
+
+	// Replaces all the stays of the source.
+	saveStays(source string, stays []tally.Stay) error
+
+	// Returns the stays of the source at the place in time order.
+	stays(source string, place tally.Id) ([]tally.Stay, error)
+
+	// Returns the stays of the source overlapping the time range in time order.
+	staysBetween(source string, from, to time.Time) ([]tally.Stay, error)
+
+	close()
+}
+
+// Implementation of the PlaceService on top of a place store, detecting the stays from the
+// location events in an event store.
+type placeService struct {
+	lock   sync.Mutex
+	store  placeStore
+	events tally.EventStore
+	config tally.PlaceConfig
+}
+
+// Constructor method.  Returns a place service keeping the places in memory.
+func NewSimplePlaceService(events tally.EventStore, config tally.PlaceConfig) *placeService {
+	return newPlaceService(newSimplePlaceStore(), events, config)
+}
+
+func newPlaceService(store placeStore, events tally.EventStore, config tally.PlaceConfig) *placeService {
+	return &placeService{
+		store:  store,
+		events: events,
+		config: *tally.SanitizePlaces(&config),
+	}
+}
+
+// Implements PlaceService
+func (s *placeService) Detect(source string) ([]tally.Place, error) {
+	if source == "" {
+		return nil, tally.ErrorBadParam
+	}
+	events, err := s.events.Find(tally.EventQuery{Type: s.config.EventType, Source: source,
+		MaxAccuracy: s.config.MaxAccuracy})
+	if err != nil {
+		return nil, err
+	}
+	stays := detectStays(source, fixesOf(events), s.config)
+	locs := make([]tally.Location, len(stays))
+	for i, stay := range stays {
+		locs[i] = stay.Location
+	}
+	labels, clusters := dbscan(locs, s.config.ClusterRadius, s.config.MinVisits)
+
+	found := make([]tally.Place, clusters)
+	members := make([][]tally.Location, clusters)
+	for i, label := range labels {
+		if label < 0 {
+			continue
+		}
+		members[label] = append(members[label], stays[i].Location)
+		p := &found[label]
+		p.Visits++
+		p.Duration += stays[i].Duration()
+		if stays[i].Departed.After(p.LastVisit) {
+			p.LastVisit = stays[i].Departed
+		}
+	}
+	for i := range found {
+		found[i].Source = source
+		found[i].Location = meanLocation(members[i])
+		for _, loc := range members[i] {
+			if d := Haversine(found[i].Location, loc, tally.Meters); d > found[i].Radius {
+				found[i].Radius = d
+			}
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	known, err := s.store.places(source)
+	if err != nil {
+		return nil, err
+	}
+	// Match the most visited places first, each to the nearest known place close enough.
+	order := make([]int, clusters)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return found[order[i]].Visits > found[order[j]].Visits })
+	matched := make([]bool, len(known))
+	for _, i := range order {
+		p := &found[i]
+		best, nearest := -1, s.config.ClusterRadius
+		for k := range known {
+			if d := Haversine(p.Location, known[k].Location, tally.Meters); !matched[k] && d <= nearest {
+				best, nearest = k, d
+			}
+		}
+		if best >= 0 {
+			matched[best] = true
+			p.Id, p.Name = known[best].Id, known[best].Name
+			err = s.store.save(*p)
+		} else {
+			err = s.store.insert(p)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for k, p := range known {
+		switch {
+		case matched[k]:
+		case p.Name != "":
+			p.Visits, p.Duration = 0, 0
+			err = s.store.save(p)
+		default:
+			err = s.store.remove(p.Id)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, label := range labels {
+		if label >= 0 {
+			stays[i].Place = found[label].Id
+		}
+	}
+	if err = s.store.saveStays(source, stays); err != nil {
+		return nil, err
+	}
+	return s.places(source)
+}
+
+// Implements PlaceService
+func (s *placeService) Places(source string) ([]tally.Place, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.places(source)
+}
+
+func (s *placeService) places(source string) ([]tally.Place, error) {
+	places, err := s.store.places(source)
+	sort.SliceStable(places, func(i, j int) bool {
+		if places[i].Visits != places[j].Visits {
+			return places[i].Visits > places[j].Visits
+		}
+		return places[i].Id < places[j].Id
+	})
+	return places, err
+}
+
+// Implements PlaceService
+func (s *placeService) Read(id tally.Id) (tally.Place, error) {
+	return s.store.load(id)
+}
+
+// Implements PlaceService
+func (s *placeService) Name(id tally.Id, name string) (tally.Place, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	p, err := s.store.load(id)
+	if err != nil {
+		return p, err
+	}
+	p.Name = name
+	err = s.store.save(p)
+	return p, err
+}
+
+// Implements PlaceService
+func (s *placeService) Visits(id tally.Id) ([]tally.Stay, error) {
+	p, err := s.store.load(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.stays(p.Source, id)
+}
+
+// Implements PlaceService
+func (s *placeService) Stays(source string, from, to time.Time) ([]tally.Stay, error) {
+	if to.Before(from) {
+		return nil, tally.ErrorBadParam
+	}
+	return s.store.staysBetween(source, from, to)
+}
+
+// Implements PlaceService
+func (s *placeService) Close() {
+	s.store.close()
+}
+
+// In memory storage of places
+type simplePlaceStore struct {
+	lock     sync.RWMutex
+	byId     map[tally.Id]tally.Place
+	bySource map[string][]tally.Stay
+	lastId   tally.Id
+}
+
+func newSimplePlaceStore() *simplePlaceStore {
+	return &simplePlaceStore{
+		byId:     make(map[tally.Id]tally.Place),
+		bySource: make(map[string][]tally.Stay),
+	}
+}
+
+func (s *simplePlaceStore) insert(place *tally.Place) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastId++
+	place.Id = s.lastId
+	s.byId[place.Id] = *place
+	return nil
+}
+
+func (s *simplePlaceStore) load(id tally.Id) (tally.Place, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if p, exists := s.byId[id]; exists {
+		return p, nil
+	}
+	return tally.Place{}, tally.ErrorNotFound
+}
+
+func (s *simplePlaceStore) save(place tally.Place) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.byId[place.Id]; !exists {
+		return tally.ErrorNotFound
+	}
+	s.byId[place.Id] = place
+	return nil
+}
+
+func (s *simplePlaceStore) remove(id tally.Id) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.byId, id)
+	return nil
+}
+
+func (s *simplePlaceStore) places(source string) ([]tally.Place, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	places := make([]tally.Place, 0)
+	for _, p := range s.byId {
+		if p.Source == source {
+			places = append(places, p)
+		}
+	}
+	return places, nil
+}
+
+func (s *simplePlaceStore) saveStays(source string, stays []tally.Stay) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.bySource[source] = append([]tally.Stay(nil), stays...)
+	return nil
+}
+
+func (s *simplePlaceStore) stays(source string, place tally.Id) ([]tally.Stay, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	stays := make([]tally.Stay, 0)
+	for _, stay := range s.bySource[source] {
+		if stay.Place == place {
+			stays = append(stays, stay)
+		}
+	}
+	return stays, nil
+}
+
+func (s *simplePlaceStore) staysBetween(source string, from, to time.Time) ([]tally.Stay, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	stays := make([]tally.Stay, 0)
+	for _, stay := range s.bySource[source] {
+		if stay.Arrived.Before(to) && !stay.Departed.Before(from) {
+			stays = append(stays, stay)
+		}
+	}
+	return stays, nil
+}
+
+func (s *simplePlaceStore) close() {
+	// no op
+}
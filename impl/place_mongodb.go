@@ -0,0 +1,162 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"time"
+)
+
+// Storage of places and stays in mongodb collections.  Place ids are allocated from a counter
+// document in the same database.
+type mgoPlaceStore struct {
+	session   *mgo.Session
+	placeColl *mgo.Collection
+	stayColl  *mgo.Collection
+	counters  *mgo.Collection
+}
+
+// Record of a place in mongodb
+type mgo_place struct {
+	Id        tally.Id       `bson:"_id"`
+	Source    string         `bson:"source"`
+	Name      string         `bson:"name,omitempty"`
+	Location  tally.Location `bson:"location"`
+	Radius    float64        `bson:"radius"`
+	Visits    int            `bson:"visits"`
+	Duration  time.Duration  `bson:"duration"`
+	LastVisit time.Time      `bson:"lastVisit"`
+}
+
+// Record of a stay in mongodb
+type mgo_stay struct {
+	Source   string         `bson:"source"`
+	Location tally.Location `bson:"location"`
+	Arrived  time.Time      `bson:"arrived"`
+	Departed time.Time      `bson:"departed"`
+	Place    tally.Id       `bson:"place"`
+}
+
+// Constructor method.  Returns a place service storing the places and the stays in the
+// collections of mongodb, the stays in one named after the places.
+func NewMongoDbPlaceService(url, db, collection string, events tally.EventStore,
+	config tally.PlaceConfig) (service *placeService, err error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return
+	}
+	store := &mgoPlaceStore{
+		session:   session,
+		placeColl: session.DB(db).C(collection),
+		stayColl:  session.DB(db).C(collection + "_stays"),
+		counters:  session.DB(db).C("counters"),
+	}
+	store.placeColl.EnsureIndex(mgo.Index{
+		Key:  []string{"source"},
+		Name: "source",
+	})
+	store.stayColl.EnsureIndex(mgo.Index{
+		Key:  []string{"source", "place", "arrived"},
+		Name: "source_place_arrived",
+	})
+	return newPlaceService(store, events, config), nil
+}
+
+func (s *mgoPlaceStore) insert(place *tally.Place) (err error) {
+	counter := struct {
+		Seq tally.Id `bson:"seq"`
+	}{}
+	_, err = s.counters.FindId(s.placeColl.Name).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"seq": 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &counter)
+	if err != nil {
+		return
+	}
+	place.Id = counter.Seq
+	p := mgo_place(*place)
+	return s.placeColl.Insert(&p)
+}
+
+func (s *mgoPlaceStore) load(id tally.Id) (place tally.Place, err error) {
+	p := mgo_place{}
+	switch err = s.placeColl.FindId(id).One(&p); err {
+	case nil:
+		place = tally.Place(p)
+	case mgo.ErrNotFound:
+		err = tally.ErrorNotFound
+	}
+	return
+}
+
+func (s *mgoPlaceStore) save(place tally.Place) (err error) {
+	p := mgo_place(place)
+	if err = s.placeColl.UpdateId(place.Id, &p); err == mgo.ErrNotFound {
+		err = tally.ErrorNotFound
+	}
+	return
+}
+
+func (s *mgoPlaceStore) remove(id tally.Id) (err error) {
+	if err = s.placeColl.RemoveId(id); err == mgo.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+func (s *mgoPlaceStore) places(source string) (places []tally.Place, err error) {
+	found := []mgo_place{}
+	if err = s.placeColl.Find(bson.M{"source": source}).All(&found); err != nil {
+		return
+	}
+	places = make([]tally.Place, len(found))
+	for i, p := range found {
+		places[i] = tally.Place(p)
+	}
+	return
+}
+
+func (s *mgoPlaceStore) saveStays(source string, stays []tally.Stay) (err error) {
+	if _, err = s.stayColl.RemoveAll(bson.M{"source": source}); err != nil {
+		return
+	}
+	if len(stays) == 0 {
+		return
+	}
+	docs := make([]interface{}, len(stays))
+	for i, stay := range stays {
+		docs[i] = mgo_stay(stay)
+	}
+	return s.stayColl.Insert(docs...)
+}
+
+func (s *mgoPlaceStore) stays(source string, place tally.Id) (stays []tally.Stay, err error) {
+	found := []mgo_stay{}
+	err = s.stayColl.Find(bson.M{"source": source, "place": place}).Sort("arrived").All(&found)
+	if err != nil {
+		return
+	}
+	stays = make([]tally.Stay, len(found))
+	for i, stay := range found {
+		stays[i] = tally.Stay(stay)
+	}
+	return
+}
+
+func (s *mgoPlaceStore) staysBetween(source string, from, to time.Time) (stays []tally.Stay, err error) {
+	found := []mgo_stay{}
+	query := bson.M{"source": source, "arrived": bson.M{"$lt": to}, "departed": bson.M{"$gte": from}}
+	if err = s.stayColl.Find(query).Sort("arrived").All(&found); err != nil {
+		return
+	}
+	stays = make([]tally.Stay, len(found))
+	for i, stay := range found {
+		stays[i] = tally.Stay(stay)
+	}
+	return
+}
+
+func (s *mgoPlaceStore) close() {
+	s.session.Close()
+}
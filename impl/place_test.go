@@ -0,0 +1,189 @@
+package impl
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/proto"
+	"testing"
+	"time"
+)
+
+var (
+	home   = tally.Location{Latitude: 37.77, Longitude: -122.42}
+	office = tally.Location{Latitude: 37.79, Longitude: -122.40}
+	cafe   = tally.Location{Latitude: 37.78, Longitude: -122.43}
+)
+
+// Time at a location, from start to end
+type visit struct {
+	at         tally.Location
+	start, end time.Duration
+}
+
+// Returns the location events of a source every 5 minutes over three days: nights at home, days
+// at the office, and once a stop at a cafe on the way home.  Fixes jitter by about 20 meters,
+// and the source moves in a straight line between visits.
+func placeEvents(source string) []Tally.Event {
+	day := 24 * time.Hour
+	visits := []visit{}
+	for d := time.Duration(0); d < 3; d++ {
+		visits = append(visits, visit{home, d * day, d*day + 8*time.Hour})
+		visits = append(visits, visit{office, d*day + 9*time.Hour, d*day + 17*time.Hour})
+		if d == 0 {
+			visits = append(visits, visit{cafe, 17*time.Hour + 30*time.Minute, 18 * time.Hour})
+		}
+		visits = append(visits, visit{home, d*day + 19*time.Hour, d*day + 24*time.Hour - time.Minute})
+	}
+	start := time.Date(2014, 6, 2, 0, 0, 0, 0, time.UTC)
+	jitter := []float64{0, 0.0002, -0.0001, 0.0001, -0.0002}
+	events := make([]Tally.Event, 0)
+	add := func(t time.Duration, loc tally.Location) {
+		j := jitter[len(events)%len(jitter)]
+		events = append(events, Tally.Event{
+			Timestamp: proto.Float64(float64(start.Add(t).Unix())),
+			Type:      proto.String("location"),
+			Source:    proto.String(source),
+			Location:  &Tally.Location{Lat: proto.Float64(loc.Latitude + j), Lon: proto.Float64(loc.Longitude - j)},
+		})
+	}
+	step := 5 * time.Minute
+	for i, v := range visits {
+		for t := v.start; t <= v.end; t += step {
+			add(t, v.at)
+		}
+		if i+1 < len(visits) {
+			next := visits[i+1]
+			for t := v.end + step; t < next.start; t += step {
+				f := float64(t-v.end) / float64(next.start-v.end)
+				add(t, tally.Location{
+					Latitude:  v.at.Latitude + f*(next.at.Latitude-v.at.Latitude),
+					Longitude: v.at.Longitude + f*(next.at.Longitude-v.at.Longitude),
+				})
+			}
+		}
+	}
+	return events
+}
+
+// Returns the events within 500 meters of the location.
+func eventsNear(events []Tally.Event, loc tally.Location) []Tally.Event {
+	near := make([]Tally.Event, 0)
+	for i := range events {
+		if at, _ := eventLocation(&events[i]); Haversine(at, loc, tally.Meters) < 500 {
+			near = append(near, events[i])
+		}
+	}
+	return near
+}
+
+func detectPlaces(test *testing.T, service tally.PlaceService, source string, events []Tally.Event,
+	store tally.EventStore) []tally.Place {
+	if err := store.Put(events); err != nil {
+		test.Fatal(err)
+	}
+	places, err := service.Detect(source)
+	if err != nil {
+		test.Fatal(err)
+	}
+	return places
+}
+
+func testPlaceService(test *testing.T, service *placeService, newEvents func() tally.EventStore) {
+	if _, err := service.Detect(""); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam without source", err)
+	}
+
+	// Home has the first stay, the three evenings; the cafe is visited once only
+	events := placeEvents("alice")
+	places := detectPlaces(test, service, "alice", events, service.events)
+	if len(places) != 2 || places[0].Visits != 4 || places[1].Visits != 3 {
+		test.Fatal("Expecting home and office", places)
+	}
+	atHome, atOffice := places[0], places[1]
+	if d := Haversine(atHome.Location, home, tally.Meters); d > 20 || atHome.Radius > 50 {
+		test.Error("Expecting home", atHome, d)
+	}
+	if d := Haversine(atOffice.Location, office, tally.Meters); d > 20 || atOffice.Duration != 24*time.Hour {
+		test.Error("Expecting 3 days at the office", atOffice, d)
+	}
+	visits, err := service.Visits(atOffice.Id)
+	if err != nil || len(visits) != 3 || !visits[0].Arrived.Before(visits[1].Arrived) ||
+		visits[2].Duration() != 8*time.Hour || !visits[2].Departed.Equal(atOffice.LastVisit) {
+		test.Error("Expecting the office visits in order", visits, err)
+	}
+	morning := time.Date(2014, 6, 3, 0, 0, 0, 0, time.UTC)
+	stays, err := service.Stays("alice", morning, morning.Add(12*time.Hour))
+	if err != nil || len(stays) != 2 || stays[0].Place != atHome.Id || stays[1].Place != atOffice.Id ||
+		!stays[0].Arrived.Before(morning) {
+		test.Error("Expecting the night at home and the morning at the office", stays, err)
+	}
+	if places, err := service.Places("bob"); err != nil || len(places) != 0 {
+		test.Error("Expecting no places of bob", places, err)
+	}
+
+	named, err := service.Name(atHome.Id, "home")
+	if err != nil || named.Name != "home" {
+		test.Error("Expecting named", named, err)
+	}
+	if _, err := service.Name(999, "nowhere"); err != tally.ErrorNotFound {
+		test.Error("Expecting ErrorNotFound", err)
+	}
+
+	// Detecting again keeps the ids and the name
+	places, err = service.Detect("alice")
+	if err != nil || len(places) != 2 || places[0].Id != atHome.Id || places[0].Name != "home" ||
+		places[1].Id != atOffice.Id {
+		test.Error("Expecting the same places", places, err)
+	}
+
+	// The named home is kept without visits while only the office is seen
+	offices := newPlaceService(service.store, newEvents(), service.config)
+	places = detectPlaces(test, offices, "alice", eventsNear(events, office), offices.events)
+	if len(places) != 2 || places[0].Id != atOffice.Id || places[1].Name != "home" || places[1].Visits != 0 {
+		test.Error("Expecting the office and home without visits", places)
+	}
+
+	// While the unnamed office is removed when only home is seen
+	homes := newPlaceService(service.store, newEvents(), service.config)
+	places = detectPlaces(test, homes, "alice", eventsNear(events, home), homes.events)
+	if len(places) != 1 || places[0].Id != atHome.Id || places[0].Visits != 4 {
+		test.Error("Expecting home only", places)
+	}
+	if _, err := service.Read(atOffice.Id); err != tally.ErrorNotFound {
+		test.Error("Expecting the office removed", err)
+	}
+	if visits, err := service.Visits(atHome.Id); err != nil || len(visits) != 4 {
+		test.Error("Expecting the home visits", visits, err)
+	}
+}
+
+func TestSimplePlaceService(test *testing.T) {
+	newEvents := func() tally.EventStore { return NewSimpleEventStore() }
+	service := NewSimplePlaceService(newEvents(), tally.PlaceConfig{EventType: "location"})
+	defer service.Close()
+	testPlaceService(test, service, newEvents)
+}
+
+func TestMongoDbPlaceService(test *testing.T) {
+	needMongoDb(test)
+	collections := 0
+	newEvents := func() tally.EventStore {
+		collections++
+		events, err := NewMongoDbEventStore(mongoUrl, "test", "place_events"+string('0'+rune(collections)))
+		if err != nil {
+			test.Fatal(err)
+		}
+		events.collection.RemoveAll(nil)
+		return events
+	}
+	service, err := NewMongoDbPlaceService(mongoUrl, "test", "places", newEvents(),
+		tally.PlaceConfig{EventType: "location"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer service.Close()
+	store := service.store.(*mgoPlaceStore)
+	store.placeColl.RemoveAll(nil)
+	store.stayColl.RemoveAll(nil)
+	testPlaceService(test, service, newEvents)
+}
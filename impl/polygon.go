@@ -0,0 +1,21 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+)
+
+// Returns true if the location is inside the polygon, a ring of vertices in order, by the rule
+// of geo.Ring.Contains.
+func inPolygon(loc tally.Location, polygon []tally.Location) bool {
+	return ringOf(polygon).Contains(loc.Latitude, loc.Longitude)
+}
+
+// Returns the ring of the polygon's vertices.
+func ringOf(polygon []tally.Location) geo.Ring {
+	ring := make(geo.Ring, len(polygon))
+	for i, p := range polygon {
+		ring[i] = geo.Position{p.Longitude, p.Latitude}
+	}
+	return ring
+}
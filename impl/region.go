@@ -0,0 +1,111 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/proto"
+	"labix.org/v2/mgo/bson"
+	"sort"
+)
+
+// Returns the cabs found in the region in its order: nearest the route first for a corridor, or
+// else by id.  Returns all of them if the limit is zero.
+func inRegion(found []cabDistance, q tally.GeoRegion) []tally.Cab {
+	if len(q.Route) == 0 {
+		sort.Slice(found, func(i, j int) bool { return found[i].cab.Id < found[j].cab.Id })
+	}
+	limit := q.Limit
+	if limit == 0 {
+		limit = len(found)
+	}
+	return nearest(found, limit)
+}
+
+// Returns true if the event matches the id, type, source, tags, time range and accuracy of the
+// query.
+func matchesEvent(q tally.EventQuery, event *Tally.Event) bool {
+	if q.Id != "" && q.Id != event.GetId() || q.Type != "" && q.Type != event.GetType() ||
+		q.Source != "" && q.Source != event.GetSource() {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !hasTag(event, tag) {
+			return false
+		}
+	}
+	if q.MaxAccuracy > 0 && event.Location.GetAccuracy() > q.MaxAccuracy {
+		return false
+	}
+	t := eventTime(event)
+	return (q.From.IsZero() || !t.Before(q.From) || tally.EventEnd(event).After(q.From)) &&
+		(q.To.IsZero() || t.Before(q.To))
+}
+
+func hasTag(event *Tally.Event, tag string) bool {
+	for _, t := range event.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the event's location is within the circle or region of the query, if any.
+func eventWithin(q tally.EventQuery, event *Tally.Event) bool {
+	if q.Within == nil && q.Region == nil {
+		return true
+	}
+	loc, ok := eventLocation(event)
+	if !ok {
+		return false
+	}
+	if q.Within != nil {
+		w := *q.Within
+		tally.Sanitize(&w)
+		return Distance(w.Center, loc, w.Unit, w.Model) <= w.Radius
+	}
+	ok, _ = q.Region.Contains(loc)
+	return ok
+}
+
+// Returns the GeoJSON of the polygons with their rings closed, as mongo requires.
+func mgo_multipolygon(polygons geo.MultiPolygon) bson.M {
+	closed := make([][][][2]float64, len(polygons))
+	for i, p := range polygons {
+		closed[i] = make([][][2]float64, len(p))
+		for j, ring := range p {
+			closed[i][j] = make([][2]float64, 0, len(ring)+1)
+			for _, position := range ring {
+				closed[i][j] = append(closed[i][j], position)
+			}
+			if ring[0] != ring[len(ring)-1] {
+				closed[i][j] = append(closed[i][j], ring[0])
+			}
+		}
+	}
+	return bson.M{"type": "MultiPolygon", "coordinates": closed}
+}
+
+// Returns the mongo selector of the locations in the field that may be within the region: within
+// the polygons, or within the circles enclosing the segments of the corridor.  The corridor's
+// matches must be filtered by their distance from the route.
+func mgo_region(field string, q tally.GeoRegion) bson.M {
+	if len(q.Route) == 0 {
+		return bson.M{field: bson.M{"$geoWithin": bson.M{"$geometry": mgo_multipolygon(q.Polygons)}}}
+	}
+	distance := q.Unit.Meters(q.Distance)
+	circles := make([]interface{}, 0, len(q.Route))
+	for i := range q.Route {
+		lat, lon, radius := q.Route[0][1], q.Route[0][0], distance
+		if i > 0 {
+			lat, lon, radius = geo.SegmentCircle(q.Route[i-1], q.Route[i], distance)
+		} else if len(q.Route) > 1 {
+			continue
+		}
+		// In radians, widened a little for the matches on the edge not to be lost to rounding
+		circles = append(circles, bson.M{field: bson.M{"$geoWithin": bson.M{
+			"$centerSphere": []interface{}{[]float64{lon, lat}, radius * 1.001 / geo.EarthRadius},
+		}}})
+	}
+	return bson.M{"$or": circles}
+}
@@ -0,0 +1,177 @@
+package impl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gyokuro/tally"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Implementation of the CabService interface that calls the http api of another tally server,
+// e.g. the server of another city's shard.
+type remoteCabService struct {
+	url    string
+	client *http.Client
+}
+
+// Constructor method.  Returns a service calling the server at the base url, e.g. http://host:8080
+func NewRemoteCabService(baseUrl string) *remoteCabService {
+	return &remoteCabService{
+		url:    strings.TrimSuffix(baseUrl, "/"),
+		client: &http.Client{},
+	}
+}
+
+// Sends the request and decodes the json response into result, if not nil.  Errors from the
+// server are mapped back to the service errors by the http status.
+func (s *remoteCabService) call(method, path string, body interface{}, result interface{}) (err error) {
+	var reader *bytes.Reader
+	if body != nil {
+		buff, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(buff)
+	} else {
+		reader = bytes.NewReader([]byte{})
+	}
+	req, err := http.NewRequest(method, s.url+path, reader)
+	if err != nil {
+		return
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	buff, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return tally.ErrorNotFound
+	case http.StatusBadRequest:
+		return tally.ErrorBadParam
+	case http.StatusConflict:
+		return tally.ErrorInvalidState
+	default:
+		return errors.New(strings.TrimSpace(string(buff)))
+	}
+	if result != nil {
+		err = json.Unmarshal(buff, result)
+	}
+	return
+}
+
+// Returns the error of a batch item
+func batchError(item tally.BatchItem) error {
+	switch item.Status {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return tally.ErrorNotFound
+	case http.StatusBadRequest:
+		return tally.ErrorBadParam
+	default:
+		return errors.New(item.Error)
+	}
+}
+
+// Implements CabService
+func (s *remoteCabService) Read(id tally.Id) (cab tally.Cab, err error) {
+	err = s.call("GET", fmt.Sprintf("/cabs/%d", id), nil, &cab)
+	return
+}
+
+// Implements CabService
+func (s *remoteCabService) Upsert(cab tally.Cab) error {
+	return s.call("PUT", fmt.Sprintf("/cabs/%d", cab.Id), cab, nil)
+}
+
+// Implements CabService
+func (s *remoteCabService) SetStatus(id tally.Id, status tally.CabStatus) error {
+	return s.call("PUT", fmt.Sprintf("/cabs/%d/status", id), map[string]tally.CabStatus{"status": status}, nil)
+}
+
+// Implements CabService
+func (s *remoteCabService) UpsertBatch(cabs []tally.Cab) (errs []error, err error) {
+	items := []tally.BatchItem{}
+	if err = s.call("POST", "/cabs", cabs, &items); err != nil {
+		return
+	}
+	if len(items) != len(cabs) {
+		return nil, errors.New("Batch response mismatch")
+	}
+	errs = make([]error, len(items))
+	for i, item := range items {
+		errs[i] = batchError(item)
+	}
+	return
+}
+
+// Implements CabService
+func (s *remoteCabService) ReadBatch(ids []tally.Id) (cabs []tally.Cab, errs []error, err error) {
+	list := make([]string, len(ids))
+	for i, id := range ids {
+		list[i] = fmt.Sprintf("%d", id)
+	}
+	items := []tally.BatchItem{}
+	if err = s.call("GET", "/cabs?ids="+url.QueryEscape(strings.Join(list, ",")), nil, &items); err != nil {
+		return
+	}
+	if len(items) != len(ids) {
+		return nil, nil, errors.New("Batch response mismatch")
+	}
+	cabs = make([]tally.Cab, len(items))
+	errs = make([]error, len(items))
+	for i, item := range items {
+		if errs[i] = batchError(item); item.Cab != nil {
+			cabs[i] = *item.Cab
+		}
+	}
+	return
+}
+
+// Implements CabService
+func (s *remoteCabService) Delete(id tally.Id) error {
+	return s.call("DELETE", fmt.Sprintf("/cabs/%d", id), nil, nil)
+}
+
+// Implements CabService
+func (s *remoteCabService) Query(q tally.GeoWithin) (cabs []tally.Cab, err error) {
+	tally.Sanitize(&q)
+	cabs = make([]tally.Cab, 0)
+	path := fmt.Sprintf("/cabs?latitude=%v&longitude=%v&radius=%v&limit=%d&model=%v&maxAccuracy=%v",
+		q.Center.Latitude, q.Center.Longitude, q.Unit.Meters(q.Radius), q.Limit, q.Model, q.MaxAccuracy)
+	err = s.call("GET", path, nil, &cabs)
+	return
+}
+
+// Implements CabService
+func (s *remoteCabService) QueryRegion(q tally.GeoRegion) (cabs []tally.Cab, err error) {
+	if err = q.Validate(); err != nil {
+		return
+	}
+	cabs = make([]tally.Cab, 0)
+	err = s.call("POST", "/cabs/within", q, &cabs)
+	return
+}
+
+// Implements CabService
+func (s *remoteCabService) DeleteAll() error {
+	return s.call("DELETE", "/cabs", nil, nil)
+}
+
+// Implements CabService
+func (s *remoteCabService) Close() {
+	// no op
+}
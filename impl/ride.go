@@ -0,0 +1,285 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Storage of rides used by the ride service.  Implementations only persist; the validation of
+// state transitions and the updates of the cabs are done by the service.
+type rideStore interface {
+	// Stores a new ride, assigning its id.
+	insert(ride *tally.Ride) error
+
+	// Loads a ride by id, or ErrorNotFound.
+	load(id tally.Id) (tally.Ride, error)
+
+	// Saves the ride only if it is still in the given state, otherwise ErrorInvalidState.
+	save(ride tally.Ride, from tally.RideState) error
+
+	// Returns the id of the ride the cab is assigned to or picked up for, or 0 if none.
+	engaged(cab tally.Id) (tally.Id, error)
+
+	remove(id tally.Id) error
+	close()
+}
+
+// Implementation of the RideService on top of a ride store.  Transitions keep the status of
+// the ride's cab in sync in the CabService.
+type rideService struct {
+	lock  sync.Mutex
+	store rideStore
+	cabs  tally.CabService
+	now   func() time.Time
+}
+
+// Constructor method.  Returns a ride service keeping the rides in memory.
+func NewSimpleRideService(cabs tally.CabService) *rideService {
+	return newRideService(newSimpleRideStore(), cabs)
+}
+
+func newRideService(store rideStore, cabs tally.CabService) *rideService {
+	return &rideService{
+		store: store,
+		cabs:  cabs,
+		now:   time.Now,
+	}
+}
+
+// Implements RideService
+func (s *rideService) Create(ride tally.Ride) (tally.Ride, error) {
+	r := tally.Ride{
+		Rider:     ride.Rider,
+		Origin:    ride.Origin,
+		State:     tally.RideRequested,
+		Requested: s.now(),
+	}
+	err := s.store.insert(&r)
+	return r, err
+}
+
+// Implements RideService
+func (s *rideService) Read(id tally.Id) (tally.Ride, error) {
+	return s.store.load(id)
+}
+
+// Implements RideService
+func (s *rideService) Update(ride tally.Ride) (tally.Ride, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, err := s.store.load(ride.Id)
+	if err != nil {
+		return r, err
+	}
+	if r.State != tally.RideRequested {
+		return r, tally.ErrorInvalidState
+	}
+	r.Rider = ride.Rider
+	r.Origin = ride.Origin
+	err = s.store.save(r, tally.RideRequested)
+	return r, err
+}
+
+// Implements RideService
+func (s *rideService) Delete(id tally.Id) error {
+	return s.store.remove(id)
+}
+
+// Implements RideService
+func (s *rideService) Transition(id tally.Id, t tally.RideTransition) (tally.Ride, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, err := s.store.load(id)
+	if err != nil {
+		return r, err
+	}
+	from := r.State
+	if !from.CanTransition(t.State) {
+		return r, tally.ErrorInvalidState
+	}
+
+	now := s.now()
+	switch t.State {
+	case tally.RideAssigned:
+		if err = s.assignable(t.Cab); err != nil {
+			return r, err
+		}
+		r.Cab = t.Cab
+		r.Assigned = &now
+	case tally.RidePickedUp:
+		var accuracy float64
+		if r.Pickup, accuracy, err = s.locate(r.Cab, t.Location); err != nil {
+			return r, err
+		}
+		r.PickedUp = &now
+		r.Track = append(r.Track, tally.TrackPoint{Location: *r.Pickup, Time: now, Accuracy: accuracy})
+	case tally.RideCompleted:
+		var accuracy float64
+		if r.Dropoff, accuracy, err = s.locate(r.Cab, t.Location); err != nil {
+			return r, err
+		}
+		r.Completed = &now
+		r.Track = append(r.Track, tally.TrackPoint{Location: *r.Dropoff, Time: now, Accuracy: accuracy})
+	case tally.RideCancelled:
+		r.Cancelled = &now
+	}
+	r.State = t.State
+
+	// The ride is saved first, so the cab is not changed if another transition got there first
+	if err = s.store.save(r, from); err != nil {
+		return r, err
+	}
+	if r.Cab != 0 {
+		if err := s.cabs.SetStatus(r.Cab, t.State.CabStatus()); err != nil {
+			log.Println("Warning: ride", r.Id, "is", r.State, "but the status of cab", r.Cab, "was not set", err)
+		}
+	}
+	return r, nil
+}
+
+// Returns nil if the cab can be assigned a ride: it is known, and neither on another ride,
+// occupied nor off duty.  A cab dispatched to a pickup by the dispatch service can be assigned.
+// Caller must hold the lock.
+func (s *rideService) assignable(id tally.Id) error {
+	if id == 0 {
+		return tally.ErrorBadParam
+	}
+	cab, err := s.cabs.Read(id)
+	if err == tally.ErrorNotFound {
+		return tally.ErrorBadParam
+	} else if err != nil {
+		return err
+	}
+	if cab.Status == tally.CabOccupied || cab.Status == tally.CabOffDuty {
+		return tally.ErrorInvalidState
+	}
+	if ride, err := s.store.engaged(id); err != nil {
+		return err
+	} else if ride != 0 {
+		return tally.ErrorInvalidState
+	}
+	return nil
+}
+
+// Implements RideService
+func (s *rideService) Track(id tally.Id, points []tally.TrackPoint) (tally.Ride, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, err := s.store.load(id)
+	if err != nil {
+		return r, err
+	}
+	if r.State != tally.RidePickedUp {
+		return r, tally.ErrorInvalidState
+	}
+	r.Track = append(r.Track, points...)
+	sort.Stable(byTime(r.Track))
+	err = s.store.save(r, r.State)
+	return r, err
+}
+
+// Implements RideService
+func (s *rideService) Close() {
+	s.store.close()
+}
+
+// Returns the given location, or the current position of the cab if not given and the accuracy
+// of its fix.
+func (s *rideService) locate(id tally.Id, at *tally.Location) (*tally.Location, float64, error) {
+	if at != nil {
+		loc := *at
+		return &loc, 0, nil
+	}
+	cab, err := s.cabs.Read(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	loc := locationOfCab(cab)
+	return &loc, cab.Accuracy, nil
+}
+
+// In memory storage of rides
+type simpleRideStore struct {
+	lock   sync.RWMutex
+	rides  map[tally.Id]tally.Ride
+	lastId tally.Id
+}
+
+func newSimpleRideStore() *simpleRideStore {
+	return &simpleRideStore{
+		rides: make(map[tally.Id]tally.Ride),
+	}
+}
+
+func (s *simpleRideStore) insert(ride *tally.Ride) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastId++
+	ride.Id = s.lastId
+	s.rides[ride.Id] = *ride
+	return nil
+}
+
+func (s *simpleRideStore) load(id tally.Id) (tally.Ride, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if r, exists := s.rides[id]; exists {
+		// Copy the track so the caller can append to it without changing the stored ride
+		r.Track = append([]tally.TrackPoint(nil), r.Track...)
+		return r, nil
+	}
+	return tally.Ride{}, tally.ErrorNotFound
+}
+
+func (s *simpleRideStore) save(ride tally.Ride, from tally.RideState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, exists := s.rides[ride.Id]
+	if !exists {
+		return tally.ErrorNotFound
+	}
+	if r.State != from {
+		return tally.ErrorInvalidState
+	}
+	s.rides[ride.Id] = ride
+	return nil
+}
+
+func (s *simpleRideStore) engaged(cab tally.Id) (tally.Id, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for id, r := range s.rides {
+		if r.Cab == cab && (r.State == tally.RideAssigned || r.State == tally.RidePickedUp) {
+			return id, nil
+		}
+	}
+	return 0, nil
+}
+
+func (s *simpleRideStore) remove(id tally.Id) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.rides, id)
+	return nil
+}
+
+func (s *simpleRideStore) close() {
+	// no op
+}
+
+type byTime []tally.TrackPoint
+
+func (s byTime) Len() int           { return len(s) }
+func (s byTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTime) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
@@ -0,0 +1,114 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"time"
+)
+
+// Storage of rides in a mongodb collection.  Ride ids are allocated from a counter document
+// in the same database.
+type mgoRideStore struct {
+	session    *mgo.Session
+	collection *mgo.Collection
+	counters   *mgo.Collection
+}
+
+// Record of a ride in mongodb
+type mgo_ride struct {
+	Id        tally.Id           `bson:"_id"`
+	Rider     string             `bson:"rider"`
+	Cab       tally.Id           `bson:"cab,omitempty"`
+	State     tally.RideState    `bson:"state"`
+	Origin    tally.Location     `bson:"origin"`
+	Pickup    *tally.Location    `bson:"pickup,omitempty"`
+	Dropoff   *tally.Location    `bson:"dropoff,omitempty"`
+	Requested time.Time          `bson:"requested"`
+	Assigned  *time.Time         `bson:"assigned,omitempty"`
+	PickedUp  *time.Time         `bson:"pickedUp,omitempty"`
+	Completed *time.Time         `bson:"completed,omitempty"`
+	Cancelled *time.Time         `bson:"cancelled,omitempty"`
+	Track     []tally.TrackPoint `bson:"track,omitempty"`
+}
+
+// Constructor method.  Returns a ride service storing the rides in mongodb.
+func NewMongoDbRideService(url, db, collection string, cabs tally.CabService) (service *rideService, err error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return
+	}
+	store := &mgoRideStore{
+		session:    session,
+		collection: session.DB(db).C(collection),
+		counters:   session.DB(db).C("counters"),
+	}
+	store.collection.EnsureIndex(mgo.Index{
+		Key:  []string{"cab", "state"},
+		Name: "cab_state",
+	})
+	return newRideService(store, cabs), nil
+}
+
+func (s *mgoRideStore) insert(ride *tally.Ride) (err error) {
+	counter := struct {
+		Seq tally.Id `bson:"seq"`
+	}{}
+	_, err = s.counters.FindId(s.collection.Name).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"seq": 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &counter)
+	if err != nil {
+		return
+	}
+	ride.Id = counter.Seq
+	r := mgo_ride(*ride)
+	return s.collection.Insert(&r)
+}
+
+func (s *mgoRideStore) load(id tally.Id) (ride tally.Ride, err error) {
+	r := mgo_ride{}
+	switch err = s.collection.FindId(id).One(&r); err {
+	case nil:
+		ride = tally.Ride(r)
+	case mgo.ErrNotFound:
+		err = tally.ErrorNotFound
+	}
+	return
+}
+
+func (s *mgoRideStore) save(ride tally.Ride, from tally.RideState) (err error) {
+	r := mgo_ride(ride)
+	err = s.collection.Update(bson.M{"_id": ride.Id, "state": from}, &r)
+	if err == mgo.ErrNotFound {
+		// Either deleted, or changed by someone else since it was loaded.
+		if _, err = s.load(ride.Id); err == nil {
+			err = tally.ErrorInvalidState
+		}
+	}
+	return
+}
+
+func (s *mgoRideStore) engaged(cab tally.Id) (id tally.Id, err error) {
+	r := mgo_ride{}
+	query := bson.M{"cab": cab, "state": bson.M{"$in": []tally.RideState{tally.RideAssigned, tally.RidePickedUp}}}
+	switch err = s.collection.Find(query).Select(bson.M{"_id": 1}).One(&r); err {
+	case nil:
+		id = r.Id
+	case mgo.ErrNotFound:
+		err = nil
+	}
+	return
+}
+
+func (s *mgoRideStore) remove(id tally.Id) (err error) {
+	if err = s.collection.RemoveId(id); err == mgo.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+func (s *mgoRideStore) close() {
+	s.session.Close()
+}
@@ -0,0 +1,170 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"testing"
+	"time"
+)
+
+func transition(test *testing.T, service tally.RideService, id tally.Id,
+	t tally.RideTransition, expected error) tally.Ride {
+	ride, err := service.Transition(id, t)
+	if err != expected {
+		test.Error("Expecting", expected, "got", err, "for", t)
+	}
+	return ride
+}
+
+func testRideLifecycle(service tally.RideService, cabService tally.CabService, test *testing.T) {
+	testUpsert(cabService, test)
+
+	ride, err := service.Create(tally.Ride{Rider: "rider", Origin: locations[0]})
+	if err != nil || ride.Id == 0 || ride.State != tally.RideRequested {
+		test.Error("Expecting requested ride", ride, err)
+	}
+	if ride, err = service.Update(tally.Ride{Id: ride.Id, Rider: "rider2", Origin: locations[0]}); err != nil {
+		test.Error("Got error", err)
+	}
+
+	// Can't pick up before assigned, and can't assign without a cab
+	transition(test, service, ride.Id, tally.RideTransition{State: tally.RidePickedUp}, tally.ErrorInvalidState)
+	transition(test, service, ride.Id, tally.RideTransition{State: tally.RideAssigned}, tally.ErrorBadParam)
+
+	ride = transition(test, service, ride.Id,
+		tally.RideTransition{State: tally.RideAssigned, Cab: cabs[0].Id}, nil)
+	if ride.State != tally.RideAssigned || ride.Assigned == nil {
+		test.Error("Expecting assigned", ride)
+	}
+	if cab, _ := cabService.Read(cabs[0].Id); cab.Status != tally.CabDispatched {
+		test.Error("Expecting cab dispatched", cab)
+	}
+	if _, err = service.Update(ride); err != tally.ErrorInvalidState {
+		test.Error("Expecting update to fail once assigned", err)
+	}
+
+	// Another ride can't take the cab, nor a cab not found
+	other, err := service.Create(tally.Ride{Rider: "other", Origin: locations[0]})
+	if err != nil {
+		test.Fatal(err)
+	}
+	transition(test, service, other.Id, tally.RideTransition{State: tally.RideAssigned, Cab: cabs[0].Id},
+		tally.ErrorInvalidState)
+	transition(test, service, other.Id, tally.RideTransition{State: tally.RideAssigned, Cab: 999}, tally.ErrorBadParam)
+
+	// Picked up where the cab is
+	ride = transition(test, service, ride.Id, tally.RideTransition{State: tally.RidePickedUp}, nil)
+	if ride.Pickup == nil || *ride.Pickup != locationOf(cabs[0]) || ride.PickedUp == nil {
+		test.Error("Expecting picked up at cab", ride)
+	}
+	if cab, _ := cabService.Read(cabs[0].Id); cab.Status != tally.CabOccupied {
+		test.Error("Expecting cab occupied", cab)
+	}
+	transition(test, service, ride.Id, tally.RideTransition{State: tally.RideCancelled}, tally.ErrorInvalidState)
+
+	// Track while in progress
+	midway := tally.TrackPoint{Location: locationOf(cabs[1]), Time: ride.PickedUp.Add(time.Minute)}
+	if ride, err = service.Track(ride.Id, []tally.TrackPoint{midway}); err != nil || len(ride.Track) != 2 {
+		test.Error("Expecting track", ride, err)
+	}
+
+	// Dropped off at the given location
+	ride = transition(test, service, ride.Id,
+		tally.RideTransition{State: tally.RideCompleted, Location: &locations[0]}, nil)
+	if ride.Dropoff == nil || *ride.Dropoff != locations[0] || ride.Completed == nil {
+		test.Error("Expecting dropped off", ride)
+	}
+	if len(ride.Track) != 3 || ride.Track[1].Location != midway.Location || ride.Track[2].Location != locations[0] {
+		test.Error("Expecting track from pick up to drop off", ride.Track)
+	}
+	if _, err = service.Track(ride.Id, []tally.TrackPoint{midway}); err != tally.ErrorInvalidState {
+		test.Error("Expecting no tracking once completed", err)
+	}
+	if cab, _ := cabService.Read(cabs[0].Id); cab.Status != tally.CabAvailable {
+		test.Error("Expecting cab available", cab)
+	}
+	if other = transition(test, service, other.Id,
+		tally.RideTransition{State: tally.RideAssigned, Cab: cabs[0].Id}, nil); other.Cab != cabs[0].Id {
+		test.Error("Expecting the cab assigned once available", other)
+	}
+
+	found, err := service.Read(ride.Id)
+	if err != nil || found.State != tally.RideCompleted || found.Rider != "rider2" || *found.Dropoff != locations[0] {
+		test.Error("Expecting stored ride", found, err)
+	}
+
+	if err = service.Delete(ride.Id); err != nil {
+		test.Error("Got error", err)
+	}
+	if _, err = service.Read(ride.Id); err != tally.ErrorNotFound {
+		test.Error("Nothing found should always return ErrorNotFound", err)
+	}
+}
+
+func TestSimpleRide(test *testing.T) {
+	cabService := NewSimpleCabService()
+	testRideLifecycle(NewSimpleRideService(cabService), cabService, test)
+}
+
+// Ride store running a concurrent change right before each save
+type racingRideStore struct {
+	rideStore
+	before func()
+}
+
+func (s *racingRideStore) save(ride tally.Ride, from tally.RideState) error {
+	if s.before != nil {
+		s.before()
+	}
+	return s.rideStore.save(ride, from)
+}
+
+func TestRideCabGone(test *testing.T) {
+	cabService := NewSimpleCabService()
+	testUpsert(cabService, test)
+	service := NewSimpleRideService(cabService)
+
+	ride, err := service.Create(tally.Ride{Rider: "rider", Origin: locations[0]})
+	if err != nil {
+		test.Fatal(err)
+	}
+	transition(test, service, ride.Id, tally.RideTransition{State: tally.RideAssigned, Cab: cabs[0].Id}, nil)
+
+	// The cab expires, but the ride is cancelled all the same
+	cabService.Delete(cabs[0].Id)
+	if ride = transition(test, service, ride.Id, tally.RideTransition{State: tally.RideCancelled}, nil); ride.State != tally.RideCancelled {
+		test.Error("Expecting cancelled", ride)
+	}
+	if found, _ := service.Read(ride.Id); found.State != tally.RideCancelled {
+		test.Error("Expecting cancelled ride stored", found)
+	}
+}
+
+func TestRideTransitionRace(test *testing.T) {
+	cabService := NewSimpleCabService()
+	testUpsert(cabService, test)
+	store := &racingRideStore{rideStore: newSimpleRideStore()}
+	service := newRideService(store, cabService)
+
+	ride, err := service.Create(tally.Ride{Rider: "rider", Origin: locations[0]})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// The ride is cancelled elsewhere while being assigned
+	store.before = func() {
+		cancelled := ride
+		cancelled.State = tally.RideCancelled
+		store.before = nil
+		if err := store.save(cancelled, tally.RideRequested); err != nil {
+			test.Fatal(err)
+		}
+	}
+	transition(test, service, ride.Id, tally.RideTransition{State: tally.RideAssigned, Cab: cabs[0].Id},
+		tally.ErrorInvalidState)
+	if cab, _ := cabService.Read(cabs[0].Id); !cab.Available() {
+		test.Error("Expecting cab left available", cab)
+	}
+	if found, _ := service.Read(ride.Id); found.State != tally.RideCancelled || found.Cab != 0 {
+		test.Error("Expecting cancelled ride", found)
+	}
+}
@@ -0,0 +1,437 @@
+package impl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"io/ioutil"
+	"math"
+	"sync"
+)
+
+// A shard of the cabs in a city.  Cabs located within the polygon are stored in the shard's
+// service.  A shard without a polygon takes the cabs that are not in any other shard.  A polygon
+// spanning more than 180 degrees of longitude is taken to cross the antimeridian.
+type Shard struct {
+	Name    string
+	Polygon []tally.Location
+	Service tally.CabService
+}
+
+// Configuration of a shard, as loaded from the shard map file
+type ShardConfig struct {
+	Name    string           `json:"name"`
+	Polygon []tally.Location `json:"polygon"`
+	Backend struct {
+		Type       string `json:"type"` // simple, mongo or remote
+		Url        string `json:"url"`
+		Db         string `json:"db"`
+		Collection string `json:"collection"`
+	} `json:"backend"`
+}
+
+// Implementation of the CabService that routes the cabs to per city shards by location.
+// Queries fan out to all shards whose bounds the query circle overlaps, and the results are
+// merged by distance.  A cab that crosses a boundary is moved to the new shard, keeping its status.
+type shardedCabService struct {
+	lock     sync.RWMutex
+	shards   []Shard
+	bounds   []geo.Box        // of each shard's polygon
+	cabShard map[tally.Id]int // shard each cab was last stored in
+	stop     chan bool
+}
+
+// Constructor method.  Returns the service routing over the shards.  The shards are matched in
+// order, so the shard without a polygon, if any, should be last.
+func NewShardedCabService(shards []Shard) *shardedCabService {
+	s := &shardedCabService{
+		shards:   shards,
+		bounds:   make([]geo.Box, len(shards)),
+		cabShard: make(map[tally.Id]int),
+		stop:     make(chan bool),
+	}
+	for i, shard := range shards {
+		s.bounds[i] = polygonBounds(shard.Polygon)
+	}
+	return s
+}
+
+// Loads the shard map from the json config file, a list of ShardConfig, and connects to
+// the backends.  The expiry applies to the simple and mongo backends, whose offline
+// notifications are passed on to the expiry's channel once the router forgot the cabs.
+func LoadShardedCabService(path string, expiry tally.Expiry) (service *shardedCabService, err error) {
+	buff, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	configs := []ShardConfig{}
+	if err = json.Unmarshal(buff, &configs); err != nil {
+		return
+	}
+	shards := make([]Shard, len(configs))
+	offline := make([]chan tally.CabOffline, len(configs))
+	for i, c := range configs {
+		shards[i] = Shard{Name: c.Name, Polygon: c.Polygon}
+		shardExpiry := expiry
+		if expiry.TTL > 0 {
+			offline[i] = make(chan tally.CabOffline)
+			shardExpiry.Offline = offline[i]
+		}
+		switch c.Backend.Type {
+		case "simple", "":
+			shards[i].Service = NewExpiringSimpleCabService(shardExpiry)
+		case "mongo":
+			shards[i].Service, err = NewExpiringMongoDbCabService(c.Backend.Url, c.Backend.Db, c.Backend.Collection, shardExpiry)
+		case "remote":
+			shards[i].Service = NewRemoteCabService(c.Backend.Url)
+		default:
+			err = errors.New("Unknown backend type: " + c.Backend.Type)
+		}
+		if err != nil {
+			for _, shard := range shards[:i] {
+				shard.Service.Close()
+			}
+			return nil, fmt.Errorf("Shard %s: %v", c.Name, err)
+		}
+	}
+	service = NewShardedCabService(shards)
+	for i, ch := range offline {
+		if ch != nil {
+			go service.runOffline(i, ch, expiry.Offline, service.stop)
+		}
+	}
+	return
+}
+
+// Forgets the cabs the shard reports offline, and passes the notifications on to the channel if
+// any, until the service is closed.
+func (s *shardedCabService) runOffline(i int, in <-chan tally.CabOffline, out chan<- tally.CabOffline,
+	stop <-chan bool) {
+	for {
+		select {
+		case o := <-in:
+			s.forget(o.Id, i)
+			if out == nil {
+				continue
+			}
+			select {
+			case out <- o:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Forgets the shard of the cab if it is still the shard's, e.g. once the shard expired it.
+func (s *shardedCabService) forget(id tally.Id, shard int) {
+	s.lock.Lock()
+	if i, known := s.cabShard[id]; known && i == shard {
+		delete(s.cabShard, id)
+	}
+	s.lock.Unlock()
+}
+
+// Returns the bounding box of the polygon, or the whole earth if there is no polygon.  A polygon
+// spanning more than 180 degrees of longitude is taken to cross the antimeridian, from its
+// westernmost vertex east of the prime meridian to its easternmost vertex west of it.
+func polygonBounds(polygon []tally.Location) geo.Box {
+	if len(polygon) == 0 {
+		return geo.World
+	}
+	b := ringOf(polygon).Bounds()
+	if b.East-b.West > 180. {
+		b.West, b.East = 180., -180.
+		for _, p := range polygon {
+			if p.Longitude >= 0. {
+				b.West = math.Min(b.West, p.Longitude)
+			} else {
+				b.East = math.Max(b.East, p.Longitude)
+			}
+		}
+	}
+	return b
+}
+
+// Returns the index of the shard for the location, or -1 if none.
+func (s *shardedCabService) shardOf(loc tally.Location) int {
+	for i, shard := range s.shards {
+		if len(shard.Polygon) == 0 {
+			return i
+		}
+		if !s.bounds[i].CrossesAntimeridian() {
+			if inPolygon(loc, shard.Polygon) {
+				return i
+			}
+			continue
+		}
+		// Longitudes west of the prime meridian are taken past 180 for the ring not to wrap
+		ring := ringOf(shard.Polygon)
+		for k := range ring {
+			ring[k][0] = math.Mod(ring[k][0]+360., 360.)
+		}
+		if ring.Contains(loc.Latitude, math.Mod(loc.Longitude+360., 360.)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Implements CabService.  A cab no longer in its shard, e.g. expired, is forgotten.
+func (s *shardedCabService) Read(id tally.Id) (cab tally.Cab, err error) {
+	s.lock.RLock()
+	i, known := s.cabShard[id]
+	s.lock.RUnlock()
+
+	if known {
+		if cab, err = s.shards[i].Service.Read(id); err == tally.ErrorNotFound {
+			s.forget(id, i)
+		}
+		return
+	}
+	for _, shard := range s.shards {
+		if cab, err = shard.Service.Read(id); err != tally.ErrorNotFound {
+			return
+		}
+	}
+	return
+}
+
+// Implements CabService.  If the cab moved out of the shard it was in, it is removed from there.
+func (s *shardedCabService) Upsert(cab tally.Cab) (err error) {
+	i := s.shardOf(locationOfCab(cab))
+	if i < 0 {
+		return tally.ErrorBadParam
+	}
+	s.keepStatus(&cab, i)
+	if err = s.shards[i].Service.Upsert(cab); err != nil {
+		return
+	}
+	return s.moved(cab.Id, i)
+}
+
+// Implements CabService.  The status is set in the shard of the cab, which is forgotten if no
+// longer there.
+func (s *shardedCabService) SetStatus(id tally.Id, status tally.CabStatus) (err error) {
+	s.lock.RLock()
+	i, known := s.cabShard[id]
+	s.lock.RUnlock()
+
+	if known {
+		if err = s.shards[i].Service.SetStatus(id, status); err == tally.ErrorNotFound {
+			s.forget(id, i)
+		}
+		return
+	}
+	for _, shard := range s.shards {
+		if err = shard.Service.SetStatus(id, status); err != tally.ErrorNotFound {
+			return
+		}
+	}
+	return
+}
+
+// Sets the status of the cab without one to that it has in the shard it was in, if it moves to
+// another shard, as the new shard has no record of it.  A cab not seen since start up is looked
+// for in all other shards.
+func (s *shardedCabService) keepStatus(cab *tally.Cab, to int) {
+	if cab.Status != "" {
+		return
+	}
+	s.lock.RLock()
+	from, known := s.cabShard[cab.Id]
+	s.lock.RUnlock()
+
+	for j, shard := range s.shards {
+		if j != to && (!known || j == from) {
+			if old, err := shard.Service.Read(cab.Id); err == nil {
+				cab.Status = old.Status
+				return
+			}
+		}
+	}
+}
+
+// Records the shard of the cab and removes it from the shard it was in before.  A cab not seen
+// since start up is removed from all other shards, since it may have been stored before.
+func (s *shardedCabService) moved(id tally.Id, to int) (err error) {
+	s.lock.Lock()
+	from, known := s.cabShard[id]
+	s.cabShard[id] = to
+	s.lock.Unlock()
+
+	if known && from == to {
+		return nil
+	}
+	for j, shard := range s.shards {
+		if j != to && (!known || j == from) {
+			if err1 := shard.Service.Delete(id); err == nil && err1 != nil && err1 != tally.ErrorNotFound {
+				err = err1
+			}
+		}
+	}
+	return
+}
+
+// Implements CabService.  The cabs are grouped by shard so each shard gets one batch.
+func (s *shardedCabService) UpsertBatch(cabs []tally.Cab) (errs []error, err error) {
+	errs = make([]error, len(cabs))
+	groups := make(map[int][]int)
+	for k, cab := range cabs {
+		if i := s.shardOf(locationOfCab(cab)); i < 0 {
+			errs[k] = tally.ErrorBadParam
+		} else {
+			groups[i] = append(groups[i], k)
+		}
+	}
+	for i, group := range groups {
+		batch := make([]tally.Cab, len(group))
+		for j, k := range group {
+			batch[j] = cabs[k]
+			s.keepStatus(&batch[j], i)
+		}
+		shardErrs, err := s.shards[i].Service.UpsertBatch(batch)
+		for j, k := range group {
+			if err != nil {
+				errs[k] = err
+			} else if errs[k] = shardErrs[j]; errs[k] == nil {
+				errs[k] = s.moved(cabs[k].Id, i)
+			}
+		}
+	}
+	return
+}
+
+// Implements CabService
+func (s *shardedCabService) ReadBatch(ids []tally.Id) (cabs []tally.Cab, errs []error, err error) {
+	cabs = make([]tally.Cab, len(ids))
+	errs = make([]error, len(ids))
+	for k, id := range ids {
+		cabs[k], errs[k] = s.Read(id)
+	}
+	return
+}
+
+// Implements CabService
+func (s *shardedCabService) Delete(id tally.Id) (err error) {
+	s.lock.Lock()
+	i, known := s.cabShard[id]
+	delete(s.cabShard, id)
+	s.lock.Unlock()
+
+	if known {
+		return s.shards[i].Service.Delete(id)
+	}
+	for _, shard := range s.shards {
+		if err1 := shard.Service.Delete(id); err == nil && err1 != nil {
+			err = err1
+		}
+	}
+	return
+}
+
+// Calls the shards whose bounds overlap any of the boxes in parallel, and returns all the cabs
+// they found.
+func (s *shardedCabService) fanOut(boxes []geo.Box,
+	call func(tally.CabService) ([]tally.Cab, error)) (cabs []tally.Cab, err error) {
+	type result struct {
+		cabs []tally.Cab
+		err  error
+	}
+	results := make(chan result)
+	n := 0
+	for i, shard := range s.shards {
+		overlaps := false
+		for _, b := range boxes {
+			overlaps = overlaps || b.Intersects(s.bounds[i])
+		}
+		if !overlaps {
+			continue
+		}
+		n++
+		go func(service tally.CabService) {
+			found, err := call(service)
+			results <- result{found, err}
+		}(shard.Service)
+	}
+
+	cabs = make([]tally.Cab, 0)
+	for ; n > 0; n-- {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		cabs = append(cabs, r.cabs...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Implements CabService.  Queries the shards overlapping the circle in parallel and merges
+// the nearest cabs.
+func (s *shardedCabService) Query(q tally.GeoWithin) (cabs []tally.Cab, err error) {
+	tally.Sanitize(&q)
+	all, err := s.fanOut([]geo.Box{q.Bounds()}, func(service tally.CabService) ([]tally.Cab, error) {
+		return service.Query(q)
+	})
+	if err != nil {
+		return
+	}
+	found := make([]cabDistance, len(all))
+	for i, cab := range all {
+		found[i] = cabDistance{cab, Distance(q.Center, locationOfCab(cab), q.Unit, q.Model)}
+	}
+	return nearest(found, q.Limit), nil
+}
+
+// Implements CabService.  Queries the shards overlapping the region in parallel and merges
+// the cabs in the region's order.
+func (s *shardedCabService) QueryRegion(q tally.GeoRegion) (cabs []tally.Cab, err error) {
+	if err = q.Validate(); err != nil {
+		return
+	}
+	all, err := s.fanOut(q.Bounds(), func(service tally.CabService) ([]tally.Cab, error) {
+		return service.QueryRegion(q)
+	})
+	if err != nil {
+		return
+	}
+	found := make([]cabDistance, len(all))
+	for i, cab := range all {
+		_, distance := q.Contains(locationOfCab(cab))
+		found[i] = cabDistance{cab, distance}
+	}
+	return inRegion(found, q), nil
+}
+
+// Implements CabService
+func (s *shardedCabService) DeleteAll() (err error) {
+	s.lock.Lock()
+	s.cabShard = make(map[tally.Id]int)
+	s.lock.Unlock()
+
+	for _, shard := range s.shards {
+		if err1 := shard.Service.DeleteAll(); err == nil && err1 != nil {
+			err = err1
+		}
+	}
+	return
+}
+
+// Implements CabService
+func (s *shardedCabService) Close() {
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	for _, shard := range s.shards {
+		shard.Service.Close()
+	}
+}
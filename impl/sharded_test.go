@@ -0,0 +1,167 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"net/http/httptest"
+	"testing"
+)
+
+// Two shards split at longitude -74: west is in memory, east is served by a remote tally server.
+func newTestShards() (sharded *shardedCabService, west, east tally.CabService, server *httptest.Server) {
+	west = NewSimpleCabService()
+	east = NewSimpleCabService()
+	server = httptest.NewServer(tally.HttpServer(east).Handler)
+	sharded = NewShardedCabService([]Shard{
+		Shard{
+			Name: "west",
+			Polygon: []tally.Location{
+				tally.Location{Latitude: 40., Longitude: -75.},
+				tally.Location{Latitude: 40., Longitude: -74.},
+				tally.Location{Latitude: 41., Longitude: -74.},
+				tally.Location{Latitude: 41., Longitude: -75.},
+			},
+			Service: west,
+		},
+		Shard{
+			Name: "east",
+			Polygon: []tally.Location{
+				tally.Location{Latitude: 40., Longitude: -74.},
+				tally.Location{Latitude: 40., Longitude: -73.},
+				tally.Location{Latitude: 41., Longitude: -73.},
+				tally.Location{Latitude: 41., Longitude: -74.},
+			},
+			Service: NewRemoteCabService(server.URL),
+		},
+	})
+	return
+}
+
+func TestShardedRouting(test *testing.T) {
+	sharded, west, east, server := newTestShards()
+	defer server.Close()
+
+	w := tally.Cab{Id: 1, Latitude: 40.5, Longitude: -74.001}
+	e := tally.Cab{Id: 2, Latitude: 40.5, Longitude: -73.998}
+	if errs, err := sharded.UpsertBatch([]tally.Cab{w, e, tally.Cab{Id: 3}}); err != nil ||
+		errs[0] != nil || errs[1] != nil || errs[2] != tally.ErrorBadParam {
+		test.Error("Expecting cab outside all shards to fail", errs, err)
+	}
+	testGet(west, test, w.Id, &w)
+	testGet(east, test, e.Id, &e)
+	testGet(sharded, test, e.Id, &e)
+
+	// Query straddling the border merges both shards, nearest first
+	center := tally.Location{Latitude: 40.5, Longitude: -73.9995}
+	testQuery(sharded, test, center, 500., []tally.Cab{e, w})
+	cabs, _ := sharded.Query(tally.GeoWithin{Center: center, Radius: 500., Limit: 1})
+	if len(cabs) != 1 || cabs[0] != e {
+		test.Error("Expecting only the nearest", cabs)
+	}
+
+	// Crossing the border moves the cab to the other shard
+	w.Longitude = -73.99
+	if err := sharded.Upsert(w); err != nil {
+		test.Error("Got error", err)
+	}
+	testGet(west, test, w.Id, nil)
+	testGet(east, test, w.Id, &w)
+
+	testDeleteAll(sharded, test)
+	testGet(sharded, test, w.Id, nil)
+	testGet(sharded, test, e.Id, nil)
+}
+
+func TestPolygonBounds(test *testing.T) {
+	fiji := []tally.Location{
+		tally.Location{Latitude: -19., Longitude: 177.},
+		tally.Location{Latitude: -19., Longitude: -179.},
+		tally.Location{Latitude: -16., Longitude: -179.},
+		tally.Location{Latitude: -16., Longitude: 177.},
+	}
+	b := polygonBounds(fiji)
+	if b != (geo.Box{South: -19., West: 177., North: -16., East: -179.}) || !b.Contains(-17., 179.9) ||
+		b.Contains(-17., 0.) {
+		test.Error("Expecting the box across the antimeridian", b)
+	}
+	if b := polygonBounds(fiji[:1]); b != (geo.Box{South: -19., West: 177., North: -19., East: 177.}) {
+		test.Error("Expecting the box of the vertex", b)
+	}
+	if b := polygonBounds(nil); b != geo.World {
+		test.Error("Expecting the world", b)
+	}
+
+	// Cabs on either side of the antimeridian are routed to the shard, and found by its bounds
+	islands, rest := NewSimpleCabService(), NewSimpleCabService()
+	sharded := NewShardedCabService([]Shard{
+		Shard{Name: "fiji", Polygon: fiji, Service: islands},
+		Shard{Name: "rest", Service: rest},
+	})
+	for id, lon := range map[tally.Id]float64{1: 179.9, 2: -179.5, 3: 0.} {
+		if err := sharded.Upsert(tally.Cab{Id: tally.Id(id), Latitude: -17., Longitude: lon}); err != nil {
+			test.Fatal(err)
+		}
+	}
+	center := tally.Location{Latitude: -17., Longitude: 180.}
+	if cabs, _ := islands.Query(tally.GeoWithin{Center: center, Radius: 100e3}); len(cabs) != 2 {
+		test.Error("Expecting the cabs around the antimeridian in the shard", cabs)
+	}
+	box := geo.Box{South: -18., West: 179., North: -16.5, East: -179.}
+	cabs, err := sharded.QueryRegion(tally.HeatmapQuery{Bounds: box}.Region())
+	if err != nil || len(cabs) != 2 {
+		test.Error("Expecting the cabs across the antimeridian", cabs, err)
+	}
+}
+
+func TestShardedForget(test *testing.T) {
+	sharded, west, _, server := newTestShards()
+	defer server.Close()
+	defer sharded.Close()
+
+	// A cab gone from its shard is forgotten once read
+	w := tally.Cab{Id: 1, Latitude: 40.5, Longitude: -74.001}
+	if err := sharded.Upsert(w); err != nil {
+		test.Fatal(err)
+	}
+	known := func() bool {
+		sharded.lock.RLock()
+		defer sharded.lock.RUnlock()
+		_, known := sharded.cabShard[w.Id]
+		return known
+	}
+	west.Delete(w.Id)
+	testGet(sharded, test, w.Id, nil)
+	if known() {
+		test.Error("Expecting the cab forgotten once not found")
+	}
+
+	// Offline notifications of a shard forget its cabs and are passed on
+	if err := sharded.Upsert(w); err != nil {
+		test.Fatal(err)
+	}
+	out := make(chan tally.CabOffline)
+	for i, forgotten := range []bool{false, true} {
+		in := make(chan tally.CabOffline)
+		go sharded.runOffline(1-i, in, out, sharded.stop)
+		in <- tally.CabOffline{Id: w.Id}
+		if o := <-out; o.Id != w.Id {
+			test.Error("Expecting the notification passed on", o)
+		}
+		if known() == forgotten {
+			test.Error("Expecting the cab forgotten only by its shard", i)
+		}
+	}
+}
+
+func TestRemote(test *testing.T) {
+	server := httptest.NewServer(tally.HttpServer(NewSimpleCabService()).Handler)
+	defer server.Close()
+	remote := NewRemoteCabService(server.URL)
+
+	testUpsert(remote, test)
+	testGet(remote, test, cabs[0].Id, &cabs[0])
+	testQuery(remote, test, locations[0], 1000., []tally.Cab{cabs[0]})
+	testBatch(remote, test)
+	testDelete(remote, test, cabs[1].Id)
+	testGet(remote, test, cabs[1].Id, nil)
+}
@@ -2,70 +2,274 @@ package impl
 
 import (
 	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"sort"
+	"sync"
+	"time"
 )
 
 // Simple implementation of the CabService interface
 // This implementation uses a hashmap and does a O(N) scan of all entries
-// when computing the nearest neighbor.
+// when computing the nearest neighbor.  Query results are sorted nearest first.
 type simpleCabService struct {
-	cabs map[tally.Id]tally.Cab
+	lock     sync.RWMutex
+	cabs     map[tally.Id]tally.Cab
+	lastSeen map[tally.Id]time.Time
+
+	// Expiry of cabs that stopped reporting.  The wheel is nil if expiry is disabled.
+	expiry tally.Expiry
+	wheel  *timeWheel
+	next   time.Time // when the wheel should advance next
+	stop   chan bool
+	now    func() time.Time
+
+	// Model of the queries left at the default model, spherical if not set
+	Model geo.Model
 }
 
 // Constructor method.  Returns an instance of the simple service
 func NewSimpleCabService() *simpleCabService {
-	return &simpleCabService{
-		cabs: make(map[tally.Id]tally.Cab),
+	return NewExpiringSimpleCabService(tally.Expiry{})
+}
+
+// Constructor method.  Returns an instance of the simple service where cabs not updated within
+// the expiry TTL are hidden from queries and removed by a background reaper using a time wheel.
+func NewExpiringSimpleCabService(expiry tally.Expiry) *simpleCabService {
+	s := &simpleCabService{
+		cabs:     make(map[tally.Id]tally.Cab),
+		lastSeen: make(map[tally.Id]time.Time),
+		expiry:   expiry,
+		now:      time.Now,
+	}
+	if expiry.TTL > 0 {
+		s.wheel = newTimeWheel(expiry.TTL, expiry.ReapInterval())
+		s.next = s.now().Add(s.wheel.tick)
+		s.stop = make(chan bool)
+		go s.runReaper(s.stop)
 	}
+	return s
 }
 
 // Implements CabService
 func (s *simpleCabService) Read(id tally.Id) (result tally.Cab, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
 	var exists bool
-	if result, exists = s.cabs[id]; exists {
+	if result, exists = s.cabs[id]; exists && !s.expired(id, s.now()) {
 		return
 	}
+	result = tally.Cab{}
 	err = tally.ErrorNotFound
 	return
 }
 
 // Implements CabService
 func (s *simpleCabService) Upsert(cab tally.Cab) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if old, exists := s.cabs[cab.Id]; exists && cab.Status == "" {
+		cab.Status = old.Status
+	}
 	s.cabs[cab.Id] = cab
+	s.lastSeen[cab.Id] = s.now()
+	if s.wheel != nil {
+		s.wheel.schedule(cab.Id, s.expiry.TTL)
+	}
 	return nil
 }
 
+// Implements CabService
+func (s *simpleCabService) SetStatus(id tally.Id, status tally.CabStatus) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cab, exists := s.cabs[id]
+	if !exists || s.expired(id, s.now()) {
+		return tally.ErrorNotFound
+	}
+	cab.Status = status
+	s.cabs[id] = cab
+	return nil
+}
+
+// Implements CabService
+func (s *simpleCabService) UpsertBatch(cabs []tally.Cab) (errs []error, err error) {
+	errs = make([]error, len(cabs))
+	for i, cab := range cabs {
+		errs[i] = s.Upsert(cab)
+	}
+	return
+}
+
+// Implements CabService
+func (s *simpleCabService) ReadBatch(ids []tally.Id) (cabs []tally.Cab, errs []error, err error) {
+	cabs = make([]tally.Cab, len(ids))
+	errs = make([]error, len(ids))
+	for i, id := range ids {
+		cabs[i], errs[i] = s.Read(id)
+	}
+	return
+}
+
 // Implements CabService
 func (s *simpleCabService) Delete(id tally.Id) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	delete(s.cabs, id)
+	delete(s.lastSeen, id)
+	if s.wheel != nil {
+		s.wheel.remove(id)
+	}
 	return nil
 }
 
 // Implements CabService
 func (s *simpleCabService) Query(q tally.GeoWithin) (cabs []tally.Cab, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
 	tally.Sanitize(&q)
-	cabs = make([]tally.Cab, 0)
-	for _, cab := range s.cabs {
-		distance := Haversine(q.Center, tally.Location{
+	if q.Model == geo.DefaultModel {
+		q.Model = s.Model
+	}
+	found := make([]cabDistance, 0)
+	now := s.now()
+	for id, cab := range s.cabs {
+		if s.expired(id, now) || !cab.AccurateTo(q.MaxAccuracy) {
+			continue
+		}
+		distance := Distance(q.Center, tally.Location{
 			Latitude:  cab.Latitude,
 			Longitude: cab.Longitude,
-		}, q.Unit)
+		}, q.Unit, q.Model)
 		if distance <= q.Radius {
-			cabs = append(cabs, cab)
+			found = append(found, cabDistance{cab, distance})
 		}
-		if len(cabs) == q.Limit {
-			return
+	}
+	return nearest(found, q.Limit), nil
+}
+
+// Implements CabService
+func (s *simpleCabService) QueryRegion(q tally.GeoRegion) (cabs []tally.Cab, err error) {
+	if err = q.Validate(); err != nil {
+		return
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	found := make([]cabDistance, 0)
+	now := s.now()
+	for id, cab := range s.cabs {
+		if s.expired(id, now) || !cab.AccurateTo(q.MaxAccuracy) {
+			continue
+		}
+		if ok, distance := q.Contains(locationOfCab(cab)); ok {
+			found = append(found, cabDistance{cab, distance})
 		}
 	}
-	return
+	return inRegion(found, q), nil
+}
+
+// A cab found by a query and its distance from the center
+type cabDistance struct {
+	cab      tally.Cab
+	distance float64
+}
+
+type byCabDistance []cabDistance
+
+func (s byCabDistance) Len() int           { return len(s) }
+func (s byCabDistance) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byCabDistance) Less(i, j int) bool { return s[i].distance < s[j].distance }
+
+// Returns up to limit cabs, nearest first.
+func nearest(found []cabDistance, limit int) []tally.Cab {
+	sort.Stable(byCabDistance(found))
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	cabs := make([]tally.Cab, len(found))
+	for i, f := range found {
+		cabs[i] = f.cab
+	}
+	return cabs
 }
 
 // Implements CabService
 func (s *simpleCabService) DeleteAll() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	s.cabs = make(map[tally.Id]tally.Cab)
+	s.lastSeen = make(map[tally.Id]time.Time)
+	if s.wheel != nil {
+		s.wheel.clear()
+	}
 	return
 }
 
 // Implements CabService
 func (s *simpleCabService) Close() {
-	// no op
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// Returns true if the cab has not been seen within the TTL.  Caller must hold the lock.
+func (s *simpleCabService) expired(id tally.Id, now time.Time) bool {
+	if s.expiry.TTL <= 0 {
+		return false
+	}
+	return now.Sub(s.lastSeen[id]) >= s.expiry.TTL
+}
+
+// Background loop that advances the time wheel on each tick until the service is closed.
+func (s *simpleCabService) runReaper(stop <-chan bool) {
+	ticker := time.NewTicker(s.wheel.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.reap(stop)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Removes the cabs whose slots on the time wheel are due and sends the offline notifications,
+// until the service is closed.
+func (s *simpleCabService) reap(stop <-chan bool) {
+	offline := make([]tally.CabOffline, 0)
+
+	s.lock.Lock()
+	now := s.now()
+	for !s.next.After(now) {
+		for _, id := range s.wheel.advance() {
+			if !s.expired(id, now) {
+				// Wheel fired early due to tick rounding; check again on the next tick.
+				s.wheel.schedule(id, s.wheel.tick)
+				continue
+			}
+			offline = append(offline, tally.CabOffline{Id: id, LastSeen: s.lastSeen[id]})
+			delete(s.cabs, id)
+			delete(s.lastSeen, id)
+		}
+		s.next = s.next.Add(s.wheel.tick)
+	}
+	s.lock.Unlock()
+
+	if s.expiry.Offline != nil {
+		for _, o := range offline {
+			select {
+			case s.expiry.Offline <- o:
+			case <-stop:
+				return
+			}
+		}
+	}
 }
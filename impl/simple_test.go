@@ -2,7 +2,9 @@ package impl
 
 import (
 	"github.com/gyokuro/tally"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -42,3 +44,79 @@ func TestSimpleDeleteAll(test *testing.T) {
 	testGet(simple, test, cabs[0].Id, nil)
 	testGet(simple, test, cabs[1].Id, nil)
 }
+
+// Clock of the tests, advanced by them and read by the services and their reapers
+type testClock struct {
+	lock sync.Mutex
+	at   time.Time
+}
+
+func (c *testClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.at
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.at = c.at.Add(d)
+}
+
+func TestSimpleExpiry(test *testing.T) {
+	offline := make(chan tally.CabOffline, len(cabs))
+	// The reaper's own ticks are too far apart to come during the test, which reaps itself
+	service := NewExpiringSimpleCabService(tally.Expiry{
+		TTL:     time.Minute,
+		Reap:    10 * time.Second,
+		Offline: offline,
+	})
+	defer service.Close()
+	clock := &testClock{at: time.Now()}
+	service.lock.Lock()
+	service.now, service.next = clock.now, clock.now().Add(service.wheel.tick)
+	service.lock.Unlock()
+
+	testUpsert(service, test)
+	testQuery(service, test, locations[0], 1000., []tally.Cab{cabs[0]})
+
+	// Keep cabs[1] alive while cabs[0] goes stale
+	clock.advance(40 * time.Second)
+	service.Upsert(cabs[1])
+	clock.advance(30 * time.Second)
+
+	testQuery(service, test, locations[0], 1000., []tally.Cab{})
+	testGet(service, test, cabs[0].Id, nil)
+	testGet(service, test, cabs[1].Id, &cabs[1])
+
+	reaped := func(expected tally.Id) {
+		service.reap(service.stop)
+		select {
+		case o := <-offline:
+			if o.Id != expected {
+				test.Error("Expecting offline", expected, "got", o.Id)
+			}
+		default:
+			test.Error("Expecting offline notification of", expected)
+		}
+		select {
+		case o := <-offline:
+			test.Error("Not expecting cab to go offline", o.Id)
+		default:
+		}
+		service.lock.RLock()
+		defer service.lock.RUnlock()
+		if _, exists := service.cabs[expected]; exists {
+			test.Error("Expecting stale cab to be reaped", expected)
+		}
+	}
+	reaped(cabs[0].Id)
+
+	// Then cabs[1] once it is a minute late too
+	clock.advance(30 * time.Second)
+	reaped(cabs[1].Id)
+}
+
+func TestSimpleBatch(test *testing.T) {
+	testBatch(simple, test)
+}
@@ -0,0 +1,181 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/proto"
+	"sort"
+	"time"
+)
+
+// Implementation of the TimelineService, merging the events of a source with its stays and trips
+// as last detected.
+type timelineService struct {
+	events tally.EventStore
+	places tally.PlaceService
+	trips  tally.TripService
+}
+
+// Constructor method.
+func NewTimelineService(events tally.EventStore, places tally.PlaceService, trips tally.TripService) *timelineService {
+	return &timelineService{
+		events: events,
+		places: places,
+		trips:  trips,
+	}
+}
+
+// Implements TimelineService.  Events with only a location are the fixes the stays and trips are
+// detected from, and left out; trip events are given as trips.
+func (s *timelineService) Day(source string, date time.Time) (tally.Timeline, error) {
+	zone := date.Location()
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, zone)
+	day := tally.Timeline{
+		Source:   source,
+		TimeZone: zone.String(),
+		Start:    start,
+		End:      start.AddDate(0, 0, 1),
+		Entries:  make([]tally.TimelineEntry, 0),
+	}
+	if source == "" {
+		return day, tally.ErrorBadParam
+	}
+
+	events, err := s.events.Find(tally.EventQuery{Source: source, From: day.Start, To: day.End})
+	if err != nil {
+		return day, err
+	}
+	for i := range events {
+		event := &events[i]
+		if event.GetType() == tally.TripEventType || len(event.Attributes) == 0 && event.Location != nil {
+			continue
+		}
+		entry := tally.TimelineEntry{
+			Kind:       tally.TimelineEvent,
+			Start:      eventTime(event).In(zone),
+			End:        tally.EventEnd(event).In(zone),
+			Id:         event.GetId(),
+			Type:       event.GetType(),
+			Context:    event.GetContext(),
+			Tags:       event.Tags,
+			Attributes: summarize(event.Attributes),
+		}
+		if loc, ok := eventLocation(event); ok {
+			entry.Location = &loc
+		}
+		day.Entries = append(day.Entries, entry)
+		day.Events++
+	}
+
+	stays, err := s.places.Stays(source, day.Start, day.End)
+	if err != nil {
+		return day, err
+	}
+	for i := range stays {
+		entry := tally.TimelineEntry{
+			Kind:     tally.TimelineStay,
+			Start:    stays[i].Arrived.In(zone),
+			End:      stays[i].Departed.In(zone),
+			Location: &stays[i].Location,
+		}
+		if stays[i].Place != 0 {
+			place, err := s.places.Read(stays[i].Place)
+			switch err {
+			case nil:
+				entry.Place = &place
+			case tally.ErrorNotFound: // removed since
+			default:
+				return day, err
+			}
+		}
+		day.Entries = append(day.Entries, entry)
+	}
+
+	trips, err := s.trips.Trips(tally.TripQuery{Source: source, From: day.Start, To: day.End})
+	if err != nil {
+		return day, err
+	}
+	for i := range trips {
+		trip := &trips[i]
+		trip.Departed, trip.Arrived = trip.Departed.In(zone), trip.Arrived.In(zone)
+		day.Entries = append(day.Entries, tally.TimelineEntry{
+			Kind:  tally.TimelineTrip,
+			Start: trip.Departed,
+			End:   trip.Arrived,
+			Trip:  trip,
+		})
+		if trip.Departed.Before(day.Start) {
+			continue // totalled the day before
+		}
+		day.Trips++
+		day.Distance += trip.Distance
+		day.Travel += trip.Duration()
+	}
+
+	sort.SliceStable(day.Entries, func(i, j int) bool {
+		return day.Entries[i].Start.Before(day.Entries[j].Start)
+	})
+	return day, nil
+}
+
+// Returns the values of the attributes by key, and the summaries of contents.
+func summarize(attributes []*Tally.Attribute) map[string]interface{} {
+	if len(attributes) == 0 {
+		return nil
+	}
+	summary := make(map[string]interface{}, len(attributes))
+	for _, a := range attributes {
+		if value := summaryOf(a); value != nil {
+			summary[a.GetKey()] = value
+		}
+	}
+	return summary
+}
+
+// Returns the value of the attribute, the elements of lists and the entries of maps summarized in
+// turn, or nil if it has none.
+func summaryOf(a *Tally.Attribute) interface{} {
+	switch {
+	case a.StringValue != nil:
+		return a.GetStringValue()
+	case a.IntValue != nil:
+		return a.GetIntValue()
+	case a.DoubleValue != nil:
+		return a.GetDoubleValue()
+	case a.BoolValue != nil:
+		return a.GetBoolValue()
+	case a.ContentValue != nil:
+		return contentSummary(a.ContentValue)
+	case len(a.ListValue) > 0:
+		list := make([]interface{}, len(a.ListValue))
+		for i, element := range a.ListValue {
+			list[i] = summaryOf(element)
+		}
+		return list
+	case len(a.MapValue) > 0:
+		return summarize(a.MapValue)
+	}
+	return nil
+}
+
+// Returns the mime type and size of the content, the hash if stored out of line, and the width,
+// height and thumbnails of images, for their previews.
+func contentSummary(content *Tally.Content) map[string]interface{} {
+	summary := map[string]interface{}{
+		"mime": content.GetMime(),
+		"size": int(tally.ContentSize(content)),
+	}
+	if content.Hash != nil {
+		summary["hash"] = content.GetHash()
+	}
+	if content.Width != nil {
+		summary["width"], summary["height"] = int(content.GetWidth()), int(content.GetHeight())
+	}
+	if len(content.Thumbnails) > 0 {
+		thumbnails := make([]interface{}, len(content.Thumbnails))
+		for i, thumb := range content.Thumbnails {
+			thumbnails[i] = contentSummary(thumb)
+		}
+		summary["thumbnails"] = thumbnails
+	}
+	return summary
+}
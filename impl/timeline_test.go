@@ -0,0 +1,97 @@
+package impl
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/proto"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimeline(test *testing.T) {
+	start := time.Date(2014, 6, 2, 0, 0, 0, 0, time.UTC)
+	it := twoDays(start)
+	note := Tally.Event{
+		Timestamp:     proto.Float64(float64(start.Add(15 * time.Hour).Unix())),
+		DurationNanos: proto.Int64(int64(15 * time.Minute)),
+		Id:            proto.String("standup-1"),
+		Type:          proto.String("note"),
+		Source:        proto.String("alice"),
+		Tags:          []string{"work"},
+		Location:      &Tally.Location{Lat: proto.Float64(office.Latitude), Lon: proto.Float64(office.Longitude)},
+		Attributes: []*Tally.Attribute{
+			{Key: proto.String("text"), StringValue: proto.String("standup")},
+			{Key: proto.String("photo"), ContentValue: &Tally.Content{Mime: proto.String("image/png"), Data: []byte{1, 2, 3}}},
+			{Key: proto.String("people"), ListValue: []*Tally.Attribute{
+				{Key: proto.String(""), StringValue: proto.String("bob")},
+				{Key: proto.String(""), StringValue: proto.String("carol")}}},
+			{Key: proto.String("votes"), MapValue: []*Tally.Attribute{
+				{Key: proto.String("yes"), IntValue: proto.Int64(2)}}},
+		},
+	}
+	events := NewSimpleEventStore()
+	if err := events.Put(append(it.events, note)); err != nil {
+		test.Fatal(err)
+	}
+	config := tally.PlaceConfig{EventType: "location"}
+	places := NewSimplePlaceService(events, config)
+	trips := NewTripService(events, places, config)
+	if _, err := places.Detect("alice"); err != nil {
+		test.Fatal(err)
+	}
+	if _, err := trips.Detect("alice"); err != nil {
+		test.Fatal(err)
+	}
+	service := NewTimelineService(events, places, trips)
+
+	// The first day in Los Angeles is from 7:00 UTC, after the walk to the cafe and before the
+	// drive to the office on the second day
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		test.Fatal(err)
+	}
+	day, err := service.Day("alice", time.Date(2014, 6, 2, 15, 0, 0, 0, la))
+	if err != nil {
+		test.Fatal(err)
+	}
+	kinds := []tally.TimelineKind{}
+	for _, entry := range day.Entries {
+		kinds = append(kinds, entry.Kind)
+	}
+	expected := []tally.TimelineKind{tally.TimelineStay, tally.TimelineTrip, tally.TimelineStay, tally.TimelineTrip,
+		tally.TimelineStay, tally.TimelineEvent, tally.TimelineTrip, tally.TimelineStay}
+	if !reflect.DeepEqual(kinds, expected) {
+		test.Fatal("Expecting", expected, "got", kinds)
+	}
+	if !day.Start.Equal(start.Add(7*time.Hour)) || day.End.Sub(day.Start) != 24*time.Hour ||
+		day.TimeZone != "America/Los_Angeles" || day.Entries[1].Start.Location() != la {
+		test.Error("Expecting the day in Los Angeles", day.Start, day.End, day.TimeZone)
+	}
+	if day.Events != 1 || day.Trips != 3 || day.Entries[1].Trip.Mode != tally.ModeWalk ||
+		day.Distance != day.Entries[1].Trip.Distance+day.Entries[3].Trip.Distance+day.Entries[6].Trip.Distance {
+		test.Error("Expecting the totals of the trips", day)
+	}
+	if day.Entries[0].Place == nil || day.Entries[2].Place != nil {
+		test.Error("Expecting home, and the cafe not a place", day.Entries[0], day.Entries[2])
+	}
+	note1 := day.Entries[5]
+	if note1.Id != "standup-1" || !reflect.DeepEqual(note1.Tags, []string{"work"}) || note1.End.Sub(note1.Start) != 15*time.Minute {
+		test.Error("Expecting the note of 15 minutes", note1)
+	}
+	summary := note1.Attributes
+	if summary["text"] != "standup" || !reflect.DeepEqual(summary["photo"], map[string]interface{}{"mime": "image/png", "size": 3}) ||
+		!reflect.DeepEqual(summary["people"], []interface{}{"bob", "carol"}) ||
+		!reflect.DeepEqual(summary["votes"], map[string]interface{}{"yes": int64(2)}) {
+		test.Error("Expecting the attributes summarized", summary)
+	}
+
+	// Days across daylight saving changes are not 24 hours
+	if day, err = service.Day("alice", time.Date(2014, 11, 2, 12, 0, 0, 0, la)); err != nil || day.End.Sub(day.Start) != 25*time.Hour ||
+		len(day.Entries) != 0 {
+		test.Error("Expecting an empty day of 25 hours", day, err)
+	}
+	if _, err := service.Day("", start); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam without source", err)
+	}
+}
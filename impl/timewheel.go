@@ -0,0 +1,79 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"time"
+)
+
+// Hashed time wheel for expiring cabs in memory.  Each slot covers one tick and holds the
+// ids that are due to expire when the wheel advances to that slot.  Since every cab is
+// scheduled with the same TTL, the wheel only needs enough slots to span the TTL, and
+// rescheduling on each update is O(1).
+type timeWheel struct {
+	tick  time.Duration
+	slots []map[tally.Id]bool
+	slot  map[tally.Id]int // which slot each id is currently in
+	pos   int
+}
+
+// Constructor.  Returns a wheel that can schedule expirations up to ttl ahead.
+func newTimeWheel(ttl, tick time.Duration) *timeWheel {
+	if tick <= 0 {
+		tick = ttl
+	}
+	n := int((ttl+tick-1)/tick) + 1
+	w := &timeWheel{
+		tick:  tick,
+		slots: make([]map[tally.Id]bool, n),
+		slot:  make(map[tally.Id]int),
+	}
+	for i := range w.slots {
+		w.slots[i] = make(map[tally.Id]bool)
+	}
+	return w
+}
+
+// Schedules the id to expire after the given duration, replacing any earlier schedule.
+// The expiration is rounded up to the next tick so it never fires early.
+func (w *timeWheel) schedule(id tally.Id, after time.Duration) {
+	w.remove(id)
+	ticks := int((after + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	if ticks >= len(w.slots) {
+		ticks = len(w.slots) - 1
+	}
+	i := (w.pos + ticks) % len(w.slots)
+	w.slots[i][id] = true
+	w.slot[id] = i
+}
+
+// Removes the id from the wheel, if scheduled.
+func (w *timeWheel) remove(id tally.Id) {
+	if i, exists := w.slot[id]; exists {
+		delete(w.slots[i], id)
+		delete(w.slot, id)
+	}
+}
+
+// Removes all scheduled ids.
+func (w *timeWheel) clear() {
+	for i := range w.slots {
+		w.slots[i] = make(map[tally.Id]bool)
+	}
+	w.slot = make(map[tally.Id]int)
+}
+
+// Advances the wheel by one tick and returns the ids that expired.
+func (w *timeWheel) advance() (expired []tally.Id) {
+	w.pos = (w.pos + 1) % len(w.slots)
+	for id := range w.slots[w.pos] {
+		expired = append(expired, id)
+		delete(w.slot, id)
+	}
+	if len(expired) > 0 {
+		w.slots[w.pos] = make(map[tally.Id]bool)
+	}
+	return
+}
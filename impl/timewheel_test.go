@@ -0,0 +1,51 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"testing"
+	"time"
+)
+
+func TestTimeWheel(test *testing.T) {
+	w := newTimeWheel(time.Second, 250*time.Millisecond)
+
+	w.schedule(tally.Id(1), time.Second)
+	w.schedule(tally.Id(2), 500*time.Millisecond)
+	w.schedule(tally.Id(3), time.Second)
+	w.remove(tally.Id(3))
+
+	expired := make([]tally.Id, 0)
+	for i := 1; i <= 4; i++ {
+		for _, id := range w.advance() {
+			if id == tally.Id(1) {
+				// Reschedule, as if updated
+				w.schedule(id, time.Second)
+			}
+			expired = append(expired, id)
+		}
+		switch i {
+		case 2:
+			if len(expired) != 1 || expired[0] != tally.Id(2) {
+				test.Error("Expecting 2 to expire after 2 ticks", expired)
+			}
+		case 3:
+			if len(expired) != 1 {
+				test.Error("Not expecting more expirations", expired)
+			}
+		case 4:
+			if len(expired) != 2 || expired[1] != tally.Id(1) {
+				test.Error("Expecting 1 to expire after 4 ticks", expired)
+			}
+		}
+	}
+
+	// Rescheduled, so it expires again 4 ticks later.
+	for i := 0; i < 3; i++ {
+		if len(w.advance()) != 0 {
+			test.Error("Not expecting expirations")
+		}
+	}
+	if e := w.advance(); len(e) != 1 || e[0] != tally.Id(1) {
+		test.Error("Expecting 1 to expire again", e)
+	}
+}
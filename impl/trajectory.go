@@ -0,0 +1,162 @@
+package impl
+
+import (
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/proto"
+	"math"
+	"time"
+)
+
+// Accuracy in meters of a good fix outdoors, which fixes without an accuracy are taken to have
+const nominalAccuracy = 10.
+
+// Position of a source at a point in time, from a location event, and its accuracy in meters
+type fix struct {
+	time     time.Time
+	loc      tally.Location
+	accuracy float64
+}
+
+// Returns the weight of the fix in a mean, by the inverse of its variance.
+func (f fix) weight() float64 {
+	return 1 / math.Pow(math.Max(f.accuracy, nominalAccuracy), 2)
+}
+
+// Returns true if the fix is further from the last than the accuracy of either.
+func (f fix) movedFrom(last fix) bool {
+	return Haversine(last.loc, f.loc, tally.Meters) > math.Max(last.accuracy, f.accuracy)
+}
+
+// Returns the fixes of the events with a location, which must be in time order.  Trip events are
+// derived from fixes and skipped.
+func fixesOf(events []Tally.Event) []fix {
+	fixes := make([]fix, 0, len(events))
+	for i := range events {
+		if events[i].GetType() == tally.TripEventType {
+			continue
+		}
+		if loc, ok := eventLocation(&events[i]); ok {
+			fixes = append(fixes, fix{eventTime(&events[i]), loc, events[i].Location.GetAccuracy()})
+		}
+	}
+	return fixes
+}
+
+// Returns the mean of the locations.  Fine for locations close together, away from the
+// antimeridian.
+func meanLocation(locs []tally.Location) tally.Location {
+	mean := tally.Location{}
+	for _, loc := range locs {
+		mean.Latitude += loc.Latitude / float64(len(locs))
+		mean.Longitude += loc.Longitude / float64(len(locs))
+	}
+	return mean
+}
+
+// Returns the mean of the locations of the fixes, weighted by their accuracy.
+func weightedMean(fixes []fix) tally.Location {
+	mean, total := tally.Location{}, 0.
+	for _, f := range fixes {
+		w := f.weight()
+		mean.Latitude += w * f.loc.Latitude
+		mean.Longitude += w * f.loc.Longitude
+		total += w
+	}
+	mean.Latitude /= total
+	mean.Longitude /= total
+	return mean
+}
+
+// Returns the runs of fixes that are stays, from i to j excluded: runs at least MinStay long, all
+// within StayRadius of the first give or take their accuracy, and without gaps longer than
+// MaxGap.  An inaccurate fix further away does not end a stay unless it is surely outside.
+func stayRuns(fixes []fix, c tally.PlaceConfig) [][2]int {
+	runs := make([][2]int, 0)
+	for i := 0; i < len(fixes); {
+		j := i + 1
+		for j < len(fixes) && Haversine(fixes[i].loc, fixes[j].loc, tally.Meters) <= c.StayRadius+fixes[j].accuracy &&
+			fixes[j].time.Sub(fixes[j-1].time) <= c.MaxGap {
+			j++
+		}
+		if fixes[j-1].time.Sub(fixes[i].time) < c.MinStay {
+			i++
+			continue
+		}
+		runs = append(runs, [2]int{i, j})
+		i = j
+	}
+	return runs
+}
+
+// Returns the stays in the fixes, located at the mean of their fixes weighted by accuracy.
+func detectStays(source string, fixes []fix, c tally.PlaceConfig) []tally.Stay {
+	runs := stayRuns(fixes, c)
+	stays := make([]tally.Stay, len(runs))
+	for k, run := range runs {
+		stays[k] = tally.Stay{
+			Source:   source,
+			Location: weightedMean(fixes[run[0]:run[1]]),
+			Arrived:  fixes[run[0]].time,
+			Departed: fixes[run[1]-1].time,
+		}
+	}
+	return stays
+}
+
+// Returns the fixes of the path that moved further than the accuracy of the fix before, and the
+// ends, for the jitter of inaccurate fixes not to add up to distance travelled.
+func steadyPath(path []fix) []fix {
+	steady := []fix{path[0]}
+	for i := 1; i < len(path); i++ {
+		if i == len(path)-1 || path[i].movedFrom(steady[len(steady)-1]) {
+			steady = append(steady, path[i])
+		}
+	}
+	return steady
+}
+
+// Clusters the locations by DBSCAN: a cluster has at least minPoints locations, each within eps
+// meters of another in the cluster, which has minPoints within eps.  Returns the cluster of each
+// location, from 0, or -1 for the noise that is in none.
+func dbscan(locs []tally.Location, eps float64, minPoints int) (labels []int, clusters int) {
+	const unvisited, noise = -2, -1
+	labels = make([]int, len(locs))
+	for i := range labels {
+		labels[i] = unvisited
+	}
+	neighbors := func(i int) []int {
+		found := make([]int, 0)
+		for j := range locs {
+			if Haversine(locs[i], locs[j], tally.Meters) <= eps {
+				found = append(found, j)
+			}
+		}
+		return found
+	}
+	for i := range locs {
+		if labels[i] != unvisited {
+			continue
+		}
+		seeds := neighbors(i)
+		if len(seeds) < minPoints {
+			labels[i] = noise
+			continue
+		}
+		labels[i] = clusters
+		for k := 0; k < len(seeds); k++ {
+			j := seeds[k]
+			if labels[j] == noise {
+				labels[j] = clusters // border point
+			}
+			if labels[j] != unvisited {
+				continue
+			}
+			labels[j] = clusters
+			if more := neighbors(j); len(more) >= minPoints {
+				seeds = append(seeds, more...)
+			}
+		}
+		clusters++
+	}
+	return
+}
@@ -0,0 +1,268 @@
+package impl
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/proto"
+	"sort"
+	"time"
+)
+
+// Thresholds of the travel modes, in meters per second.  Most of a trip, by time, is slower than
+// the walking or cycling speed for the trip to be a walk or a ride; transit stops regularly.
+const (
+	walkSpeed    = 2.5 // 9 km/h
+	bikeSpeed    = 7.  // 25 km/h
+	flightSpeed  = 50. // 180 km/h on average, from gate to gate
+	stoppedSpeed = 1.
+
+	// Share of the time the speed profile is measured at
+	modePercentile = 0.85
+
+	// Transit stops at least as often, and for at least the share of the time
+	transitStops   = 3
+	transitStopped = 0.2
+)
+
+// Implementation of the TripService, deriving the trips from the location events in an event
+// store and keeping them there as events of the TripEventType.
+type tripService struct {
+	events tally.EventStore
+	places tally.PlaceService
+	config tally.PlaceConfig
+}
+
+// Constructor method.  The stays between trips are detected as by the place service with the
+// config.  Trips starting or ending at the places of the source, if any, are given their ids.
+func NewTripService(events tally.EventStore, places tally.PlaceService, config tally.PlaceConfig) *tripService {
+	return &tripService{
+		events: events,
+		places: places,
+		config: *tally.SanitizePlaces(&config),
+	}
+}
+
+// Implements TripService
+func (s *tripService) Detect(source string) ([]tally.Trip, error) {
+	if source == "" {
+		return nil, tally.ErrorBadParam
+	}
+	events, err := s.events.Find(tally.EventQuery{Type: s.config.EventType, Source: source,
+		MaxAccuracy: s.config.MaxAccuracy})
+	if err != nil {
+		return nil, err
+	}
+	known := []tally.Place{}
+	if s.places != nil {
+		if known, err = s.places.Places(source); err != nil {
+			return nil, err
+		}
+	}
+	fixes := fixesOf(events)
+	runs := stayRuns(fixes, s.config)
+	trips := make([]tally.Trip, 0)
+	for k := 1; k < len(runs); k++ {
+		trip := measureTrip(source, fixes[runs[k-1][1]-1:runs[k][0]+1])
+		if trip.Distance < s.config.StayRadius {
+			continue // a stay broken by a gap
+		}
+		trip.FromPlace = placeAt(known, trip.Origin, s.config.StayRadius)
+		trip.ToPlace = placeAt(known, trip.Destination, s.config.StayRadius)
+		trips = append(trips, trip)
+	}
+
+	derived := make([]Tally.Event, len(trips))
+	for i, trip := range trips {
+		derived[i] = tripEvent(trip)
+	}
+	if _, err = s.events.Remove(tally.EventQuery{Type: tally.TripEventType, Source: source}); err != nil {
+		return nil, err
+	}
+	return trips, s.events.Put(derived)
+}
+
+// Implements TripService
+func (s *tripService) Trips(q tally.TripQuery) ([]tally.Trip, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	events, err := s.events.Find(tally.EventQuery{Type: tally.TripEventType, Source: q.Source, From: q.From, To: q.To})
+	if err != nil {
+		return nil, err
+	}
+	trips := make([]tally.Trip, 0)
+	for i := range events {
+		if trip := tripOf(&events[i]); q.Matches(trip) {
+			trips = append(trips, trip)
+		}
+	}
+	return trips, nil
+}
+
+// Implements TripService
+func (s *tripService) Tally(q tally.TripQuery) ([]tally.TripTally, error) {
+	trips, err := s.Trips(q)
+	if err != nil {
+		return nil, err
+	}
+	starts := []time.Time{q.From}
+	if q.Period != "" {
+		starts = tally.Buckets(q.From, q.To, q.Period)
+	}
+	tallies := make([]tally.TripTally, len(starts))
+	for i, start := range starts {
+		tallies[i].Start = start
+	}
+	for _, trip := range trips {
+		if trip.Departed.Before(q.From) {
+			continue // under way at the start, and tallied before
+		}
+		i := 0
+		if q.Period != "" {
+			i = tally.BucketOf(starts, trip.Departed)
+		}
+		tallies[i].Trips++
+		tallies[i].Distance += trip.Distance
+		tallies[i].Duration += trip.Duration()
+	}
+	return tallies, nil
+}
+
+// Returns the trip along the fixes, from the last fix of a stay to the first of the next.  The
+// distance and peak speed leave out the moves within the accuracy of the fixes.
+func measureTrip(source string, path []fix) tally.Trip {
+	first, last := path[0], path[len(path)-1]
+	trip := tally.Trip{
+		Source:      source,
+		Origin:      first.loc,
+		Destination: last.loc,
+		Departed:    first.time,
+		Arrived:     last.time,
+	}
+	steady := steadyPath(path)
+	for i := 1; i < len(steady); i++ {
+		d := Haversine(steady[i-1].loc, steady[i].loc, tally.Meters)
+		trip.Distance += d
+		if dt := steady[i].time.Sub(steady[i-1].time).Seconds(); dt > 0 && d/dt > trip.PeakSpeed {
+			trip.PeakSpeed = d / dt
+		}
+	}
+	if seconds := trip.Duration().Seconds(); seconds > 0 {
+		trip.AverageSpeed = trip.Distance / seconds
+	}
+	trip.Mode = travelMode(path, trip.AverageSpeed)
+	return trip
+}
+
+// Guesses the mode of travel from the speed profile of the path: flights by the average speed
+// over the gap without fixes, walks and rides by the speed of most of the time, and transit by
+// its regular stops.
+func travelMode(path []fix, average float64) tally.TravelMode {
+	if average >= flightSpeed {
+		return tally.ModeFlight
+	}
+	type segment struct{ speed, seconds float64 }
+	segments := make([]segment, 0, len(path))
+	total, stopped, stops := 0., 0., 0
+	moving := true
+	for i := 1; i < len(path); i++ {
+		dt := path[i].time.Sub(path[i-1].time).Seconds()
+		if dt <= 0 {
+			continue
+		}
+		speed := Haversine(path[i-1].loc, path[i].loc, tally.Meters) / dt
+		segments = append(segments, segment{speed, dt})
+		total += dt
+		if speed < stoppedSpeed {
+			stopped += dt
+			if moving {
+				stops++
+			}
+		}
+		moving = speed >= stoppedSpeed
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].speed < segments[j].speed })
+	profile, elapsed := 0., 0.
+	for _, s := range segments {
+		if profile = s.speed; elapsed+s.seconds >= modePercentile*total {
+			break
+		}
+		elapsed += s.seconds
+	}
+	switch {
+	case profile <= walkSpeed:
+		return tally.ModeWalk
+	case profile <= bikeSpeed:
+		return tally.ModeBike
+	case stops >= transitStops && stopped >= transitStopped*total:
+		return tally.ModeTransit
+	}
+	return tally.ModeDrive
+}
+
+// Returns the id of the nearest place whose radius, widened by the margin, reaches the location,
+// or 0 if none.
+func placeAt(places []tally.Place, loc tally.Location, margin float64) (id tally.Id) {
+	nearest := 0.
+	for _, p := range places {
+		if d := Haversine(p.Location, loc, tally.Meters); d <= p.Radius+margin && (id == 0 || d < nearest) {
+			id, nearest = p.Id, d
+		}
+	}
+	return
+}
+
+// Returns the event derived from the trip: of the TripEventType, at the origin from departure to
+// arrival.
+func tripEvent(t tally.Trip) Tally.Event {
+	attributes := []*Tally.Attribute{
+		{Key: proto.String("mode"), StringValue: proto.String(string(t.Mode))},
+		{Key: proto.String("destination_lat"), DoubleValue: proto.Float64(t.Destination.Latitude)},
+		{Key: proto.String("destination_lon"), DoubleValue: proto.Float64(t.Destination.Longitude)},
+		{Key: proto.String("distance"), DoubleValue: proto.Float64(t.Distance)},
+		{Key: proto.String("average_speed"), DoubleValue: proto.Float64(t.AverageSpeed)},
+		{Key: proto.String("peak_speed"), DoubleValue: proto.Float64(t.PeakSpeed)},
+	}
+	if t.FromPlace != 0 {
+		attributes = append(attributes, &Tally.Attribute{Key: proto.String("from_place"), IntValue: proto.Int64(int64(t.FromPlace))})
+	}
+	if t.ToPlace != 0 {
+		attributes = append(attributes, &Tally.Attribute{Key: proto.String("to_place"), IntValue: proto.Int64(int64(t.ToPlace))})
+	}
+	event := Tally.Event{
+		Type:          proto.String(tally.TripEventType),
+		Source:        proto.String(t.Source),
+		Location:      &Tally.Location{Lat: proto.Float64(t.Origin.Latitude), Lon: proto.Float64(t.Origin.Longitude)},
+		Attributes:    attributes,
+		DurationNanos: proto.Int64(int64(t.Duration())),
+	}
+	tally.SetEventTime(&event, t.Departed)
+	return event
+}
+
+// Returns the trip of an event derived by tripEvent.
+func tripOf(event *Tally.Event) tally.Trip {
+	trip := tally.Trip{Source: event.GetSource(), Departed: eventTime(event), Arrived: tally.EventEnd(event)}
+	trip.Origin, _ = eventLocation(event)
+	for _, a := range event.Attributes {
+		switch a.GetKey() {
+		case "mode":
+			trip.Mode = tally.TravelMode(a.GetStringValue())
+		case "destination_lat":
+			trip.Destination.Latitude = a.GetDoubleValue()
+		case "destination_lon":
+			trip.Destination.Longitude = a.GetDoubleValue()
+		case "distance":
+			trip.Distance = a.GetDoubleValue()
+		case "average_speed":
+			trip.AverageSpeed = a.GetDoubleValue()
+		case "peak_speed":
+			trip.PeakSpeed = a.GetDoubleValue()
+		case "from_place":
+			trip.FromPlace = tally.Id(a.GetIntValue())
+		case "to_place":
+			trip.ToPlace = tally.Id(a.GetIntValue())
+		}
+	}
+	return trip
+}
@@ -0,0 +1,224 @@
+package impl
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/proto"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Builder of the location events of a source, with a fix every minute
+type itinerary struct {
+	source string
+	start  time.Time
+	now    time.Time
+	at     tally.Location
+	events []Tally.Event
+}
+
+func (it *itinerary) fix() {
+	it.events = append(it.events, Tally.Event{
+		Timestamp: proto.Float64(float64(it.now.Unix())),
+		Type:      proto.String("location"),
+		Source:    proto.String(it.source),
+		Location:  &Tally.Location{Lat: proto.Float64(it.at.Latitude), Lon: proto.Float64(it.at.Longitude)},
+	})
+}
+
+// Adds a fix half a minute later, off by the meters north and of the accuracy, e.g. indoors.
+func (it *itinerary) noisy(north, accuracy float64) {
+	it.fix()
+	event := &it.events[len(it.events)-1]
+	tally.SetEventTime(event, it.now.Add(30*time.Second))
+	event.Location.Lat = proto.Float64(it.at.Latitude + north/111195)
+	event.Location.Accuracy = proto.Float64(accuracy)
+}
+
+// Stays until the time after the start.
+func (it *itinerary) stay(until time.Duration) {
+	for it.now.Before(it.start.Add(until)) {
+		it.now = it.now.Add(time.Minute)
+		it.fix()
+	}
+}
+
+// Travels in a straight line at the speed, in meters per second, stopping for a minute after
+// every minute moving if stopping.
+func (it *itinerary) travel(to tally.Location, speed float64, stopping bool) {
+	from := it.at
+	steps := int(math.Ceil(Haversine(from, to, tally.Meters) / (speed * 60)))
+	for k := 1; k <= steps; k++ {
+		f := float64(k) / float64(steps)
+		it.at = tally.Location{
+			Latitude:  from.Latitude + f*(to.Latitude-from.Latitude),
+			Longitude: from.Longitude + f*(to.Longitude-from.Longitude),
+		}
+		it.now = it.now.Add(time.Minute)
+		it.fix()
+		if stopping && k < steps {
+			it.now = it.now.Add(time.Minute)
+			it.fix()
+		}
+	}
+}
+
+// Flies to the location without fixes on the way.
+func (it *itinerary) fly(to tally.Location, duration time.Duration) {
+	it.now, it.at = it.now.Add(duration), to
+	it.fix()
+}
+
+func modesOf(trips []tally.Trip) []tally.TravelMode {
+	modes := make([]tally.TravelMode, len(trips))
+	for i, trip := range trips {
+		modes[i] = trip.Mode
+	}
+	return modes
+}
+
+// Returns the itinerary of two days from the start: walking to the cafe, cycling to the office
+// and taking transit home on the first, driving to and from the office and flying to Los Angeles
+// on the second.
+func twoDays(start time.Time) *itinerary {
+	it := &itinerary{source: "alice", start: start, now: start, at: home}
+	it.fix()
+	it.stay(8 * time.Hour)
+	it.travel(cafe, 1.3, false)
+	it.stay(8*time.Hour + 50*time.Minute)
+	it.travel(office, 5, false)
+	it.stay(17 * time.Hour)
+	it.travel(home, 9, true)
+	it.stay(32 * time.Hour)
+	it.travel(office, 12, false)
+	it.stay(41 * time.Hour)
+	it.travel(home, 12, false)
+	it.stay(44 * time.Hour)
+	it.fly(tally.Location{Latitude: 34.05, Longitude: -118.25}, 2*time.Hour)
+	it.stay(48 * time.Hour)
+	return it
+}
+
+func TestTripService(test *testing.T) {
+	start := time.Date(2014, 6, 2, 0, 0, 0, 0, time.UTC)
+	it := twoDays(start)
+	events := NewSimpleEventStore()
+	if err := events.Put(it.events); err != nil {
+		test.Fatal(err)
+	}
+	config := tally.PlaceConfig{EventType: "location"}
+	places := NewSimplePlaceService(events, config)
+	known, err := places.Detect("alice")
+	if err != nil || len(known) != 2 {
+		test.Fatal("Expecting home and office", known, err)
+	}
+	atHome, atOffice := known[0].Id, known[1].Id
+
+	service := NewTripService(events, places, config)
+	if _, err := service.Detect(""); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam without source", err)
+	}
+	trips, err := service.Detect("alice")
+	expected := []tally.TravelMode{tally.ModeWalk, tally.ModeBike, tally.ModeTransit, tally.ModeDrive,
+		tally.ModeDrive, tally.ModeFlight}
+	if err != nil || !reflect.DeepEqual(modesOf(trips), expected) {
+		test.Fatal("Expecting", expected, "got", modesOf(trips), err)
+	}
+	walk := trips[0]
+	if walk.FromPlace != atHome || walk.ToPlace != 0 || walk.Distance < 1200 || walk.Distance > 1450 ||
+		math.Abs(walk.AverageSpeed-1.3) > 0.1 || walk.PeakSpeed < walk.AverageSpeed {
+		test.Error("Expecting a walk from home to the cafe", walk)
+	}
+	if trips[2].FromPlace != atOffice || trips[2].ToPlace != atHome || trips[5].AverageSpeed < 50 {
+		test.Error("Expecting the places and the speed of the flight", trips)
+	}
+
+	// Detecting again replaces the trip events
+	if _, err := service.Detect("alice"); err != nil {
+		test.Fatal(err)
+	}
+	found, err := service.Trips(tally.TripQuery{Source: "alice"})
+	if err != nil || len(found) != 6 || found[0] != walk {
+		test.Error("Expecting the trips stored once", found, err)
+	}
+	found, err = service.Trips(tally.TripQuery{Source: "alice", Mode: tally.ModeDrive})
+	if err != nil || len(found) != 2 || found[0].Departed.Before(start.Add(24*time.Hour)) {
+		test.Error("Expecting the drives of the second day", found, err)
+	}
+	underway := tally.TripQuery{Source: "alice", From: walk.Departed.Add(time.Minute), To: trips[1].Arrived}
+	found, err = service.Trips(underway)
+	if err != nil || len(found) != 2 || found[0] != walk {
+		test.Error("Expecting the walk under way and the ride", found, err)
+	}
+	if tallies, err := service.Tally(underway); err != nil || len(tallies) != 1 || tallies[0].Trips != 1 {
+		test.Error("Expecting the ride tallied only", tallies, err)
+	}
+
+	// Commutes by day, and the meters walked
+	commutes := tally.TripQuery{Source: "alice", Places: []tally.Id{atHome, atOffice},
+		From: start, To: start.Add(48 * time.Hour), Period: tally.PeriodDay}
+	tallies, err := service.Tally(commutes)
+	if err != nil || len(tallies) != 2 || tallies[0].Trips != 1 || tallies[1].Trips != 2 ||
+		!tallies[1].Start.Equal(start.Add(24*time.Hour)) || tallies[1].Duration != trips[3].Duration()+trips[4].Duration() {
+		test.Error("Expecting the commutes of each day", tallies, err)
+	}
+	tallies, err = service.Tally(tally.TripQuery{Source: "alice", Mode: tally.ModeWalk})
+	if err != nil || len(tallies) != 1 || tallies[0].Trips != 1 || tallies[0].Distance != walk.Distance {
+		test.Error("Expecting the walk", tallies, err)
+	}
+	if _, err := service.Tally(tally.TripQuery{Source: "alice", Period: tally.PeriodDay}); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam for periods without a range", err)
+	}
+	year := tally.TripQuery{Source: "alice", From: start, To: start.AddDate(1, 0, 0), Period: "1ns"}
+	if _, err := service.Tally(year); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam for periods other than calendar ones", err)
+	}
+
+	// The trip events are not taken for fixes when detecting from all the events
+	again, err := NewSimplePlaceService(events, tally.PlaceConfig{}).Detect("alice")
+	if err != nil || len(again) != 2 || again[0].Location != known[0].Location || again[0].Visits != known[0].Visits {
+		test.Error("Expecting the same places", again, known, err)
+	}
+}
+
+func TestNoisyFixes(test *testing.T) {
+	start := time.Date(2014, 6, 2, 0, 0, 0, 0, time.UTC)
+	it := &itinerary{source: "alice", start: start, now: start, at: home}
+	it.fix()
+	for k := 1; k <= 6; k++ {
+		it.stay(time.Duration(k) * 10 * time.Minute)
+		it.noisy(150, 120) // within the stay radius give or take the accuracy
+		it.noisy(1000, 800)
+	}
+	it.travel(office, 12, false)
+	it.stay(2 * time.Hour)
+	it.noisy(-400, 500)
+	it.stay(3 * time.Hour)
+	events := NewSimpleEventStore()
+	if err := events.Put(it.events); err != nil {
+		test.Fatal(err)
+	}
+	config := tally.PlaceConfig{EventType: "location", MinVisits: 1}
+	trips, err := NewTripService(events, NewSimplePlaceService(events, config), config).Detect("alice")
+	if err != nil || len(trips) != 1 || trips[0].Mode != tally.ModeDrive {
+		test.Fatal("Expecting the drive only", trips, err)
+	}
+	stays := detectStays("alice", fixesOf(it.events[:60]), *tally.SanitizePlaces(&config))
+	if len(stays) != 1 || Haversine(stays[0].Location, home, tally.Meters) > 5 {
+		test.Error("Expecting the stay at home, weighted by accuracy", stays)
+	}
+
+	// Jitter within the accuracy of the fixes adds no distance
+	path := []fix{}
+	for i := 0; i < 10; i++ {
+		at := home
+		at.Latitude += float64(i%2) * 30 / 111195
+		path = append(path, fix{start.Add(time.Duration(i) * time.Minute), at, 50})
+	}
+	path = append(path, fix{start.Add(time.Hour), cafe, 10})
+	if trip := measureTrip("alice", path); math.Abs(trip.Distance-Haversine(home, cafe, tally.Meters)) > 31 {
+		test.Error("Expecting the distance from home to the cafe", trip.Distance)
+	}
+}
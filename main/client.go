@@ -1,9 +1,11 @@
 package main
 
 import (
+	"code.google.com/p/goprotobuf/proto"
 	"encoding/json"
 	"flag"
 	"github.com/golang/glog"
+	"github.com/gyokuro/tally"
 	"github.com/gyokuro/tally/proto"
 	"math"
 	"strconv"
@@ -12,56 +14,110 @@ import (
 )
 
 var (
-	timestamp  = flag.String("timestamp", "", "Event timestamp")
+	timestamp  = flag.String("timestamp", "", "Event timestamp, RFC 3339 or seconds since the epoch; now if empty")
+	timeZone   = flag.String("tz", "", "Event IANA time zone, e.g. America/New_York")
+	duration   = flag.Duration("duration", 0, "Event duration, e.g. 30m; an instant if zero")
+	id         = flag.String("id", "", "Event id, replacing the stored event of the source with it")
+	tags       = flag.String("tags", "", "Event tags, comma separated")
 	eventType  = flag.String("type", "event", "Event type")
 	context    = flag.String("context", "", "Event context")
 	source     = flag.String("source", "", "Event source")
 	lat        = flag.Float64("lat", 0., "Event location:latitude")
 	lon        = flag.Float64("lon", 0., "Event location:longitude")
-	attributes = flag.String("attributes", "", "Event attributes, {key=value;}+")
+	accuracy   = flag.Float64("accuracy", 0., "Event location:accuracy in meters; unknown if zero")
+	altitude   = flag.Float64("altitude", 0., "Event location:altitude in meters")
+	attributes = flag.String("attributes", "", "Event attributes, {key:value;}+, lists as [value,value]")
 )
 
-var nanoseconds = math.Pow10(9)
-
-func unix_timestamp(secs float64) string {
-	t := time.Unix(int64(secs/nanoseconds), int64(secs*nanoseconds))
-	return t.Format(time.RFC3339Nano)
+// Formats the time of the event in RFC 3339 with nanoseconds, in its time zone if it has one.
+func unix_timestamp(event *Tally.Event) string {
+	return tally.Zones{}.LocalTime(event).Format(time.RFC3339Nano)
 }
 
-func to_seconds(nanos int64) float64 {
-	return float64(nanos) / nanoseconds
+// Parses the time in RFC 3339, or in seconds since the epoch.
+func parse_timestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	seconds, fraction := math.Modf(secs)
+	return time.Unix(int64(seconds), int64(fraction*1e9)), nil
 }
 
 func to_geojson(loc *Tally.Location) []float64 {
+	if loc.Altitude != nil {
+		return []float64{*loc.Lon, *loc.Lat, *loc.Altitude}
+	}
 	return []float64{*loc.Lon, *loc.Lat}
 }
 
+// Returns the json value of the attribute, with lists as arrays and maps as objects, or nil.
+func json_value(attr *Tally.Attribute) interface{} {
+	if attr.BoolValue != nil {
+		return attr.BoolValue
+	} else if attr.IntValue != nil {
+		return attr.IntValue
+	} else if attr.DoubleValue != nil {
+		return attr.DoubleValue
+	} else if attr.StringValue != nil {
+		return attr.StringValue
+	} else if len(attr.ListValue) > 0 {
+		list := make([]interface{}, len(attr.ListValue))
+		for i, element := range attr.ListValue {
+			list[i] = json_value(element)
+		}
+		return list
+	} else if len(attr.MapValue) > 0 {
+		object := map[string]interface{}{}
+		for _, entry := range attr.MapValue {
+			object[entry.GetKey()] = json_value(entry)
+		}
+		return object
+	}
+	return nil
+}
+
 func format_json(event *Tally.Event) (bytes []byte, err error) {
 	payload := map[string]interface{}{
-		"@timestamp": unix_timestamp(*event.Timestamp),
+		"@timestamp": unix_timestamp(event),
+		"@timezone":  event.TimeZone,
+		"@id":        event.Id,
 		"@type":      event.Type,
 		"@source":    event.Source,
 		"@context":   event.Context,
+		"@tags":      event.Tags,
 		"@location":  to_geojson(event.Location),
+		"@accuracy":  event.Location.Accuracy,
+	}
+	if event.DurationNanos != nil {
+		payload["@end"] = tally.Zones{}.LocalTime(event).Add(time.Duration(event.GetDurationNanos())).Format(time.RFC3339Nano)
 	}
 	for _, attr := range event.Attributes {
-		if attr.BoolValue != nil {
-			payload[*attr.Key] = attr.BoolValue
-		} else if attr.IntValue != nil {
-			payload[*attr.Key] = attr.IntValue
-		} else if attr.DoubleValue != nil {
-			payload[*attr.Key] = attr.DoubleValue
-		} else if attr.StringValue != nil {
-			payload[*attr.Key] = attr.StringValue
+		if value := json_value(attr); value != nil {
+			payload[*attr.Key] = value
 		}
 	}
 	return json.Marshal(payload)
 }
 
+// Parses the value of an attribute as a number, bool or string, or as a list of them in brackets,
+// e.g. [a,b].  Commas elsewhere are kept in strings.
 func parse_attribute(key string, value string) *Tally.Attribute {
 	attr := Tally.Attribute{
 		Key: &key,
 	}
+	if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+		attr.ListValue = []*Tally.Attribute{}
+		if elements := strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"); elements != "" {
+			for _, element := range strings.Split(elements, ",") {
+				attr.ListValue = append(attr.ListValue, parse_attribute("", element))
+			}
+		}
+		return &attr
+	}
 	if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
 		attr.DoubleValue = &floatValue
 	} else if intValue, err2 := strconv.ParseInt(value, 10, 64); err2 == nil {
@@ -87,9 +143,34 @@ func main() {
 		},
 	}
 
-	if *timestamp == "" {
-		now := to_seconds(time.Now().UnixNano())
-		event.Timestamp = &now
+	at := time.Now()
+	if *timestamp != "" {
+		var err error
+		if at, err = parse_timestamp(*timestamp); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	tally.SetEventTime(&event, at)
+	if *timeZone != "" {
+		if _, err := tally.LoadZone(*timeZone); err != nil {
+			glog.Fatal(err)
+		}
+		event.TimeZone = timeZone
+	}
+	if *accuracy > 0 {
+		event.Location.Accuracy = accuracy
+	}
+	if *altitude != 0 {
+		event.Location.Altitude = altitude
+	}
+	if *duration > 0 {
+		event.DurationNanos = proto.Int64(int64(*duration))
+	}
+	if *id != "" {
+		event.Id = id
+	}
+	if *tags != "" {
+		event.Tags = strings.Split(*tags, ",")
 	}
 
 	for i, p := range strings.Split(*attributes, ";") {
@@ -0,0 +1,278 @@
+// Fleet simulator and load generator.  Moves cabs around a city center, pushing their locations
+// at a target rate while riders query for nearby cabs, and reports the throughput and latency
+// percentiles of both.  Drives a tally server over http, or a backend in process, e.g.
+//
+//	go run main/simulate.go -url http://localhost:8080 -cabs 5000 -rate 2000 -qps 200
+//	go run main/simulate.go -backend mongo -dbUrl localhost -duration 1m
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/impl"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Flags from the command line
+var (
+	serverUrl   = flag.String("url", "", "Tally server url, e.g. http://localhost:8080; empty to drive -backend in process")
+	backend     = flag.String("backend", "simple", "Backend run in process without -url: simple or mongo")
+	mongoUrl    = flag.String("dbUrl", "localhost", "MongoDb url of the mongo backend")
+	numCabs     = flag.Int("cabs", 1000, "Number of cabs")
+	centerLat   = flag.Float64("lat", 37.7749, "Latitude of the city center")
+	centerLon   = flag.Float64("lon", -122.4194, "Longitude of the city center")
+	cityRadius  = flag.Float64("radius", 10000, "Radius of the city in meters")
+	pathKind    = flag.String("path", "walk", "Paths of the cabs: walk (random walk) or waypoint")
+	speed       = flag.Float64("speed", 10, "Speed of the cabs in meters per second")
+	updateRate  = flag.Float64("rate", 1000, "Target location updates per second")
+	batchSize   = flag.Int("batch", 1, "Updates sent per call; more than 1 uses UpsertBatch")
+	queryRate   = flag.Float64("qps", 100, "Target rider queries per second")
+	queryRadius = flag.Float64("queryRadius", 1000, "Radius of the rider queries in meters")
+	queryLimit  = flag.Int("limit", 8, "Max cabs returned per rider query")
+	workers     = flag.Int("workers", 8, "Concurrent callers for each of updates and queries")
+	duration    = flag.Duration("duration", 30*time.Second, "Duration of the run")
+	reportEvery = flag.Duration("report", 5*time.Second, "Interval of the progress reports")
+)
+
+// A simulated cab, moving from its last location at the time of its last update
+type simCab struct {
+	tally.Cab
+	heading  float64 // radians clockwise from north
+	waypoint tally.Location
+	moved    time.Time
+}
+
+// Returns a random location uniformly within the radius in meters of the center.
+func randomLocation(r *rand.Rand, center tally.Location, radius float64) tally.Location {
+	d, bearing := radius*math.Sqrt(r.Float64()), 2*math.Pi*r.Float64()
+	return offset(center, d, bearing)
+}
+
+// Returns the location the distance in meters away on the bearing in radians.
+func offset(from tally.Location, d, bearing float64) tally.Location {
+	lat, lon := geo.Destination(from.Latitude, from.Longitude, bearing*180./math.Pi, d)
+	return tally.Location{Latitude: lat, Longitude: lon}
+}
+
+// Returns the distance in meters and the bearing in radians from one location to the other.
+func towards(from, to tally.Location) (d, bearing float64) {
+	return geo.Haversine(from.Latitude, from.Longitude, to.Latitude, to.Longitude),
+		geo.Bearing(from.Latitude, from.Longitude, to.Latitude, to.Longitude) * math.Pi / 180.
+}
+
+// Moves the cab along its path by the time since it last moved.
+func (c *simCab) move(r *rand.Rand, center tally.Location, now time.Time) {
+	step := *speed * now.Sub(c.moved).Seconds()
+	c.moved = now
+	at := tally.Location{Latitude: c.Latitude, Longitude: c.Longitude}
+	switch *pathKind {
+	case "waypoint":
+		d, bearing := towards(at, c.waypoint)
+		if d <= step {
+			at, c.waypoint = c.waypoint, randomLocation(r, center, *cityRadius)
+		} else {
+			at = offset(at, step, bearing)
+		}
+	default:
+		// Wander, turning back towards the center when out of the city
+		c.heading += (r.Float64() - 0.5) * math.Pi / 4
+		if d, bearing := towards(at, center); d > *cityRadius {
+			c.heading = bearing
+		}
+		at = offset(at, step, c.heading)
+	}
+	c.Latitude, c.Longitude = at.Latitude, at.Longitude
+}
+
+// Latencies and errors of one kind of call
+type recorder struct {
+	lock      sync.Mutex
+	name      string
+	latencies []time.Duration
+	errors    int
+	lastError error
+}
+
+func (r *recorder) record(start time.Time, calls int, err error) {
+	elapsed := time.Since(start)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := 0; i < calls; i++ {
+		r.latencies = append(r.latencies, elapsed)
+	}
+	if err != nil {
+		r.errors += calls
+		r.lastError = err
+	}
+}
+
+// Returns the summary of the calls recorded since the start, in the elapsed time.
+func (r *recorder) summary(elapsed time.Duration) string {
+	r.lock.Lock()
+	latencies := append([]time.Duration{}, r.latencies...)
+	errors, lastError := r.errors, r.lastError
+	r.lock.Unlock()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	s := fmt.Sprintf("%-7s %8d calls %9.1f/s  p50 %-10v p90 %-10v p99 %-10v max %-10v errors %d",
+		r.name, len(latencies), float64(len(latencies))/elapsed.Seconds(),
+		percentile(.5), percentile(.9), percentile(.99), percentile(1), errors)
+	if lastError != nil {
+		s += fmt.Sprint(" (last: ", lastError, ")")
+	}
+	return s
+}
+
+// Runs the calls at the target rate per second until the deadline, spread over the workers.
+// Each worker paces itself against its schedule, so a slow call is caught up on afterwards.
+func paced(rate float64, deadline time.Time, call func(worker int, r *rand.Rand)) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	if rate <= 0 {
+		return wg
+	}
+	interval := time.Duration(float64(time.Second) * float64(*workers) / rate)
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(w)))
+			next := time.Now().Add(time.Duration(r.Int63n(int64(interval) + 1)))
+			for next.Before(deadline) {
+				if wait := time.Until(next); wait > 0 {
+					time.Sleep(wait)
+				}
+				call(w, r)
+				next = next.Add(interval)
+			}
+		}(w)
+	}
+	return wg
+}
+
+func connect() (service tally.CabService, err error) {
+	switch {
+	case *serverUrl != "":
+		log.Println("Driving tally server at", *serverUrl)
+		return impl.NewRemoteCabService(*serverUrl), nil
+	case *backend == "mongo":
+		log.Println("Driving mongodb backend in process at", *mongoUrl)
+		return impl.NewMongoDbCabService(*mongoUrl, "tally_simulation", "cabs")
+	case *backend == "simple":
+		log.Println("Driving simple backend in process")
+		return impl.NewSimpleCabService(), nil
+	}
+	return nil, fmt.Errorf("Unknown backend: %s", *backend)
+}
+
+func main() {
+	flag.Parse()
+
+	service, err := connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer service.Close()
+
+	// Place the fleet, with the cabs split among the update workers
+	center := tally.Location{Latitude: *centerLat, Longitude: *centerLon}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	now := time.Now()
+	fleet := make([][]*simCab, *workers)
+	initial := make([]tally.Cab, *numCabs)
+	for i := range initial {
+		at := randomLocation(r, center, *cityRadius)
+		c := &simCab{
+			Cab:      tally.Cab{Id: tally.Id(i + 1), Latitude: at.Latitude, Longitude: at.Longitude},
+			heading:  2 * math.Pi * r.Float64(),
+			waypoint: randomLocation(r, center, *cityRadius),
+			moved:    now,
+		}
+		fleet[i%*workers] = append(fleet[i%*workers], c)
+		initial[i] = c.Cab
+	}
+	if _, err = service.UpsertBatch(initial); err != nil {
+		log.Fatal("Cannot place the fleet: ", err)
+	}
+	log.Println("Placed", *numCabs, "cabs within", *cityRadius, "meters of", center.Latitude, center.Longitude)
+
+	updates := &recorder{name: "update"}
+	queries := &recorder{name: "query"}
+	start := time.Now()
+	deadline := start.Add(*duration)
+
+	// Each update call moves the next cabs of the worker's share
+	next := make([]int, *workers)
+	updating := paced(*updateRate/float64(*batchSize), deadline, func(w int, r *rand.Rand) {
+		share := fleet[w]
+		if len(share) == 0 {
+			return
+		}
+		batch := make([]tally.Cab, 0, *batchSize)
+		for len(batch) < *batchSize && len(batch) < len(share) {
+			c := share[next[w]%len(share)]
+			next[w]++
+			c.move(r, center, time.Now())
+			batch = append(batch, c.Cab)
+		}
+		t := time.Now()
+		if len(batch) == 1 {
+			updates.record(t, 1, service.Upsert(batch[0]))
+			return
+		}
+		errs, err := service.UpsertBatch(batch)
+		for _, e := range errs {
+			if e != nil && err == nil {
+				err = e
+			}
+		}
+		updates.record(t, len(batch), err)
+	})
+	querying := paced(*queryRate, deadline, func(w int, r *rand.Rand) {
+		q := tally.GeoWithin{
+			Center: randomLocation(r, center, *cityRadius),
+			Radius: *queryRadius,
+			Unit:   tally.Meters,
+			Limit:  *queryLimit,
+		}
+		t := time.Now()
+		_, err := service.Query(q)
+		queries.record(t, 1, err)
+	})
+
+	done := make(chan bool)
+	go func() {
+		updating.Wait()
+		querying.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(*reportEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			elapsed := time.Since(start)
+			log.Println(updates.summary(elapsed))
+			log.Println(queries.summary(elapsed))
+		case <-done:
+			elapsed := time.Since(start)
+			fmt.Printf("Simulated %d cabs for %v, %s paths at %v m/s\n", *numCabs, elapsed.Round(time.Millisecond),
+				*pathKind, *speed)
+			fmt.Println(updates.summary(elapsed))
+			fmt.Println(queries.summary(elapsed))
+			return
+		}
+	}
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
 	"github.com/gyokuro/tally/impl"
+	"github.com/gyokuro/tally/resp"
+	"github.com/gyokuro/tally/tiles"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 )
 
 // Flags from the command line
@@ -20,6 +26,19 @@ var (
 	mongoUrl             = flag.String("dbUrl", "localhost", "MongoDb url")
 	mongoDbName          = flag.String("dbName", "tally", "MongoDb database name")
 	mongoCollection      = flag.String("dbColl", "cabs", "MongoDb collection name")
+	eventCollection      = flag.String("eventColl", "events", "MongoDb collection name of the events")
+	placeEventType       = flag.String("placeEvents", "", "Type of the location events places are detected from, all if empty")
+	contentDir           = flag.String("contentDir", "", "Directory of the content blobs, instead of GridFS; kept inline without mongo if empty")
+	contentThreshold     = flag.Int("contentThreshold", 64<<10, "Size in bytes above which contents are stored out of line")
+	cabTTL               = flag.Duration("ttl", 0, "Expire cabs not updated within this duration, 0 to disable")
+	distanceModel        = flag.String("model", "spherical", "Distance model of the cab queries that do not choose one: spherical, ellipsoidal or equirectangular")
+	matchOptimal         = flag.Bool("optimal", false, "True to dispatch by optimal instead of greedy matching")
+	matchWindow          = flag.Duration("window", 2*time.Second, "Dispatch matching window")
+	tariffFile           = flag.String("tariff", "", "Tariff config (json) for computing fares")
+	zonesFile            = flag.String("zones", "", "IANA time zones of the sources (json), e.g. {\"alice\": \"Europe/Paris\"}")
+	shardsFile           = flag.String("shards", "", "Shard map config (json) for routing cabs to per city backends")
+	respPort             = flag.Int("resp", 0, "Redis protocol (geo commands) port, 0 to disable")
+	respKey              = flag.String("respKey", "cabs", "Redis key of the geo set of the cabs")
 	currentWorkingDir, _ = os.Getwd()
 )
 
@@ -53,20 +72,147 @@ func main() {
 	shutdownc := make(chan io.Closer, 1)
 	go tally.HandleSignals(shutdownc)
 
+	// Cabs that stop reporting are expired and logged as offline
+	offline := make(chan tally.CabOffline, 64)
+	expiry := tally.Expiry{TTL: *cabTTL, Offline: offline}
+	go func() {
+		for o := range offline {
+			log.Println("Cab offline:", o.Id, "last seen", o.LastSeen.Format(time.RFC3339))
+		}
+	}()
+
+	model, err := geo.ParseModel(*distanceModel)
+	if err != nil {
+		panic(err)
+	}
+
 	// Uses the mongodb as backend datastore.
 	var service tally.CabService
-	if *noMongo {
-		service = impl.NewSimpleCabService()
+	if *shardsFile != "" {
+		var err error
+		service, err = impl.LoadShardedCabService(*shardsFile, expiry)
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Sharding cabs by", *shardsFile)
+	} else if *noMongo {
+		simple := impl.NewExpiringSimpleCabService(expiry)
+		simple.Model = model
+		service = simple
 		log.Println("Runing without MongoDb. Using simple / in memory service.")
+	} else {
+		mongo, err := impl.NewExpiringMongoDbCabService(*mongoUrl, *mongoDbName, *mongoCollection, expiry)
+		if err != nil {
+			panic(err)
+		}
+		mongo.Model = model
+		service = mongo
+	}
+
+	// Rides, stored along with the cabs
+	var rides tally.RideService
+	if *noMongo {
+		rides = impl.NewSimpleRideService(service)
+	} else {
+		var err error
+		rides, err = impl.NewMongoDbRideService(*mongoUrl, *mongoDbName, "rides", service)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Fares of the rides by the tariff config
+	tariff := tally.Tariff{}
+	if *tariffFile != "" {
+		if buff, err := ioutil.ReadFile(*tariffFile); err != nil {
+			panic(err)
+		} else if err = json.Unmarshal(buff, &tariff); err != nil {
+			panic(err)
+		}
+	}
+	fares, err := impl.NewFareCalculator(tariff)
+	if err != nil {
+		panic(err)
+	}
+
+	// Events, kept for the heatmaps
+	var events tally.EventStore
+	if *noMongo {
+		events = impl.NewSimpleEventStore()
 	} else {
 		var err error
-		service, err = impl.NewMongoDbCabService(*mongoUrl, *mongoDbName, *mongoCollection)
+		events, err = impl.NewMongoDbEventStore(*mongoUrl, *mongoDbName, *eventCollection)
 		if err != nil {
 			panic(err)
 		}
 	}
 
-	httpServer := tally.HttpServer(service)
+	// Contents of the events stored out of line, e.g. photos
+	var contents tally.ContentStore
+	if *contentDir != "" {
+		var err error
+		if contents, err = impl.NewFileContentStore(*contentDir); err != nil {
+			panic(err)
+		}
+	} else if !*noMongo {
+		var err error
+		if contents, err = impl.NewMongoDbContentStore(*mongoUrl, *mongoDbName, "content"); err != nil {
+			panic(err)
+		}
+	}
+	if contents != nil {
+		events = impl.NewContentEventStore(events, contents, *contentThreshold)
+	}
+
+	// Time zones of the sources, for their local days
+	zones := tally.Zones{}
+	if *zonesFile != "" {
+		if buff, err := ioutil.ReadFile(*zonesFile); err != nil {
+			panic(err)
+		} else if err = json.Unmarshal(buff, &zones); err != nil {
+			panic(err)
+		}
+	}
+	if err := zones.Validate(); err != nil {
+		panic(err)
+	}
+
+	// Photos measured and given thumbnails, and their EXIF location and time filled in
+	events = impl.NewImageEventStore(events, contents, zones)
+
+	// Places of the sources, detected from their location events
+	placeConfig := tally.PlaceConfig{EventType: *placeEventType}
+	var places tally.PlaceService
+	if *noMongo {
+		places = impl.NewSimplePlaceService(events, placeConfig)
+	} else {
+		var err error
+		places, err = impl.NewMongoDbPlaceService(*mongoUrl, *mongoDbName, "places", events, placeConfig)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Trips between the stays, kept as derived events
+	trips := impl.NewTripService(events, places, placeConfig)
+
+	// Dispatch service matching riders to cabs
+	dispatchConfig := tally.DispatchConfig{Window: *matchWindow}
+	if *matchOptimal {
+		dispatchConfig.Strategy = tally.MatchOptimal
+	}
+	dispatch := impl.NewDispatchService(service, dispatchConfig)
+
+	routes := []tally.Routes{tally.DispatchRoutes(dispatch), tally.RideRoutes(rides),
+		tally.FareRoutes(rides, fares), tally.EventRoutes(events),
+		tally.HeatmapRoutes(impl.NewHeatmapService(service, events)),
+		tally.EventTallyRoutes(events, zones), tally.PlaceRoutes(places), tally.TripRoutes(trips, zones),
+		tally.TimelineRoutes(impl.NewTimelineService(events, places, trips), zones),
+		tiles.Routes(tiles.Source{Cabs: service, Events: events})}
+	if contents != nil {
+		routes = append(routes, tally.ContentRoutes(contents))
+	}
+	httpServer := tally.HttpServer(service, routes...)
 	httpServer.Addr = ":" + strconv.Itoa(*httpPort)
 
 	// Run the http server in a separate go routine
@@ -76,6 +222,18 @@ func main() {
 	done := tally.RunServer(httpServer, httpDone)
 	log.Println("Server listening on", *httpPort)
 
+	// Redis geo commands, for clients already using redis
+	var respServer *resp.Server
+	if *respPort > 0 {
+		respServer = resp.NewServer(service, *respKey)
+		go func() {
+			if err := respServer.ListenAndServe(":" + strconv.Itoa(*respPort)); err != nil {
+				log.Println("Warning: redis protocol server stops due to error", err)
+			}
+		}()
+		log.Println("Redis protocol server listening on", *respPort)
+	}
+
 	// Start the UI server
 	startWebUi(*webappPort)
 	log.Println("Web UI Server listening on", *webappPort)
@@ -84,6 +242,16 @@ func main() {
 	shutdownc <- tally.ShutdownSequence{
 		tally.ShutdownHook(func() error {
 			// Clean up database connections
+			if respServer != nil {
+				respServer.Close()
+			}
+			dispatch.Close()
+			rides.Close()
+			places.Close()
+			events.Close()
+			if contents != nil {
+				contents.Close()
+			}
 			service.Close()
 			return nil
 		}),
@@ -0,0 +1,298 @@
+package mgotest
+
+import (
+	"labix.org/v2/mgo/bson"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Runs the pipeline of an aggregate command, replying with the result inline as mongod did before
+// cursors.  Only the stages $match, $project, $group and $sort are known, with the expressions and
+// accumulators the backends use.
+func (s *Server) aggregate(ns string, args bson.M) bson.M {
+	stages, _ := args["pipeline"].([]interface{})
+	docs, err := s.find(ns, bson.M{}, nil)
+	if err != nil {
+		return failed(err)
+	}
+	for _, stage := range stages {
+		spec, _ := stage.(bson.M)
+		if len(spec) != 1 {
+			return failed(errorf(40323, "a pipeline stage specification must contain exactly one field"))
+		}
+		for name, arg := range spec {
+			if docs, err = runStage(docs, name, arg); err != nil {
+				return failed(err)
+			}
+		}
+	}
+	result := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		result[i] = doc
+	}
+	return bson.M{"result": result, "ok": 1}
+}
+
+// Returns the documents through the stage.
+func runStage(docs []bson.M, name string, arg interface{}) ([]bson.M, error) {
+	spec, _ := arg.(bson.M)
+	out := make([]bson.M, 0, len(docs))
+	switch name {
+	case "$match":
+		for _, doc := range docs {
+			ok, err := matches(doc, spec)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out = append(out, doc)
+			}
+		}
+	case "$project":
+		for _, doc := range docs {
+			projected := bson.M{"_id": doc["_id"]}
+			for field, e := range spec {
+				if n, isNumber := number(e); isNumber || e == true {
+					if field == "_id" && !truthy(n) && isNumber {
+						delete(projected, "_id")
+					} else if v := lookup(doc, field); v != nil {
+						projected[field] = v
+					}
+					continue
+				}
+				v, err := evaluate(doc, e)
+				if err != nil {
+					return nil, err
+				}
+				projected[field] = v
+			}
+			out = append(out, projected)
+		}
+	case "$group":
+		return group(docs, spec)
+	case "$sort":
+		var order bson.D
+		raw, _ := bson.Marshal(spec)
+		bson.Unmarshal(raw, &order)
+		out = append(out, docs...)
+		sort.SliceStable(out, func(i, j int) bool {
+			for _, e := range order {
+				c := compareOrder(lookup(out[i], e.Name), lookup(out[j], e.Name))
+				if n, _ := number(e.Value); n < 0 {
+					c = -c
+				}
+				if c != 0 {
+					return c < 0
+				}
+			}
+			return false
+		})
+	default:
+		return nil, errorf(16436, "Unrecognized pipeline stage name: '%s'", name)
+	}
+	return out, nil
+}
+
+// Returns the documents grouped by the value of _id, with the accumulated fields.
+func group(docs []bson.M, spec bson.M) ([]bson.M, error) {
+	type accumulation struct {
+		doc    bson.M
+		counts map[string]int
+	}
+	groups := make([]*accumulation, 0)
+	for _, doc := range docs {
+		id, err := evaluate(doc, spec["_id"])
+		if err != nil {
+			return nil, err
+		}
+		var g *accumulation
+		for _, other := range groups {
+			if equalValue(other.doc["_id"], id) {
+				g = other
+				break
+			}
+		}
+		if g == nil {
+			g = &accumulation{bson.M{"_id": id}, make(map[string]int)}
+			groups = append(groups, g)
+		}
+		for field, acc := range spec {
+			if field == "_id" {
+				continue
+			}
+			ops, _ := acc.(bson.M)
+			for op, e := range ops {
+				v, err := evaluate(doc, e)
+				if err != nil {
+					return nil, err
+				}
+				n, isNumber := number(v)
+				switch op {
+				case "$sum", "$avg":
+					if !isNumber {
+						continue
+					}
+					sum, _ := number(g.doc[field])
+					g.doc[field] = sum + n
+					g.counts[field]++
+				default:
+					return nil, errorf(15952, "unknown group operator '%s'", op)
+				}
+			}
+		}
+	}
+	out := make([]bson.M, len(groups))
+	for i, g := range groups {
+		for field, acc := range spec {
+			ops, _ := acc.(bson.M)
+			if _, avg := ops["$avg"]; avg && g.counts[field] > 0 {
+				g.doc[field] = g.doc[field].(float64) / float64(g.counts[field])
+			} else if _, sum := ops["$sum"]; sum && g.doc[field] == nil {
+				g.doc[field] = 0.
+			}
+		}
+		out[i] = g.doc
+	}
+	return out, nil
+}
+
+// Returns true if the values are equal, documents field by field whatever their order.
+func equalValue(a, b interface{}) bool {
+	x, isDoc := a.(bson.M)
+	y, bothDocs := b.(bson.M)
+	if !isDoc || !bothDocs {
+		return equal(a, b)
+	}
+	if len(x) != len(y) {
+		return false
+	}
+	for k, v := range x {
+		if !equalValue(v, y[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the value of the aggregation expression on the document: a field path, a document of
+// expressions, an operator or a literal.
+func evaluate(doc bson.M, e interface{}) (interface{}, error) {
+	switch v := e.(type) {
+	case string:
+		if strings.HasPrefix(v, "$") {
+			return lookup(doc, v[1:]), nil
+		}
+		return v, nil
+	case bson.M:
+		if len(v) == 1 {
+			for op, arg := range v {
+				if strings.HasPrefix(op, "$") {
+					return operate(doc, op, arg)
+				}
+			}
+		}
+		result := bson.M{}
+		for field, sub := range v {
+			value, err := evaluate(doc, sub)
+			if err != nil {
+				return nil, err
+			}
+			result[field] = value
+		}
+		return result, nil
+	}
+	return e, nil
+}
+
+// Returns the value of the operator on its arguments.
+func operate(doc bson.M, op string, arg interface{}) (interface{}, error) {
+	list, isList := arg.([]interface{})
+	if !isList {
+		list = []interface{}{arg}
+	}
+	args := make([]interface{}, len(list))
+	for i, a := range list {
+		v, err := evaluate(doc, a)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	numbers := make([]float64, len(args))
+	allNumbers := true
+	for i, a := range args {
+		var ok bool
+		if numbers[i], ok = number(a); !ok {
+			allNumbers = false
+		}
+	}
+
+	switch op {
+	case "$cond":
+		if len(args) != 3 {
+			return nil, errorf(16020, "Expression $cond takes exactly 3 arguments")
+		}
+		if truthy(args[0]) {
+			return args[1], nil
+		}
+		return args[2], nil
+	case "$lt", "$lte", "$gt", "$gte", "$eq", "$ne":
+		if len(args) != 2 {
+			return nil, errorf(16020, "Expression %s takes exactly 2 arguments", op)
+		}
+		c := compareOrder(args[0], args[1])
+		return map[string]bool{
+			"$lt": c < 0, "$lte": c <= 0, "$gt": c > 0, "$gte": c >= 0, "$eq": c == 0, "$ne": c != 0,
+		}[op], nil
+	case "$arrayElemAt":
+		array, isArray := args[0].([]interface{})
+		if len(args) != 2 || args[0] != nil && !isArray {
+			return nil, errorf(28689, "$arrayElemAt's first argument must be an array")
+		}
+		i, _ := number(args[1])
+		if int(i) < 0 || int(i) >= len(array) {
+			return nil, nil
+		}
+		return array[int(i)], nil
+	}
+
+	switch op {
+	case "$add", "$multiply", "$subtract", "$divide", "$floor":
+		if !allNumbers {
+			return nil, nil
+		}
+	default:
+		return nil, errorf(15999, "Unrecognized expression '%s'", op)
+	}
+	switch op {
+	case "$add", "$multiply":
+		result := 0.
+		if op == "$multiply" {
+			result = 1.
+		}
+		for _, n := range numbers {
+			if op == "$add" {
+				result += n
+			} else {
+				result *= n
+			}
+		}
+		return result, nil
+	case "$subtract", "$divide":
+		if len(numbers) != 2 {
+			return nil, errorf(16020, "Expression %s takes exactly 2 arguments", op)
+		}
+		if op == "$subtract" {
+			return numbers[0] - numbers[1], nil
+		}
+		if numbers[1] == 0 {
+			return nil, errorf(16608, "can't $divide by zero")
+		}
+		return numbers[0] / numbers[1], nil
+	}
+	if len(numbers) != 1 {
+		return nil, errorf(16020, "Expression $floor takes exactly 1 argument")
+	}
+	return math.Floor(numbers[0]), nil
+}
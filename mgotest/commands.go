@@ -0,0 +1,254 @@
+package mgotest
+
+import (
+	"labix.org/v2/mgo/bson"
+	"strings"
+)
+
+// Runs a command, a query on the $cmd collection, and returns its reply document.  Only the
+// commands the driver and the backends use are known; others fail like unknown commands do.
+func (s *Server) command(db string, raw []byte, last *lastError) bson.M {
+	var ordered bson.D
+	args := bson.M{}
+	if err := bson.Unmarshal(raw, &ordered); err != nil || len(ordered) == 0 {
+		return failed(errorf(2, "bad command"))
+	}
+	bson.Unmarshal(raw, &args)
+	if ordered[0].Name == "$query" {
+		// Commands may be wrapped with options too, e.g. for reading from secondaries
+		wrapper := struct {
+			Query bson.Raw `bson:"$query"`
+		}{}
+		if err := bson.Unmarshal(raw, &wrapper); err != nil {
+			return failed(err)
+		}
+		return s.command(db, wrapper.Query.Data, last)
+	}
+
+	name := ordered[0].Name
+	coll, _ := ordered[0].Value.(string)
+	ns := db + "." + coll
+	switch strings.ToLower(name) {
+	case "ismaster":
+		return bson.M{"ismaster": true, "maxBsonObjectSize": 16 << 20, "maxWriteBatchSize": maxWriteBatch, "ok": 1}
+	case "ping", "logout":
+		return bson.M{"ok": 1}
+	case "getnonce":
+		return bson.M{"nonce": "2375531c32080ae8", "ok": 1}
+	case "buildinfo":
+		return bson.M{"version": "2.6.0", "versionArray": []int{2, 6, 0, 0}, "ok": 1}
+	case "getlasterror":
+		return last.doc()
+	case "count":
+		return s.count(ns, args)
+	case "aggregate":
+		return s.aggregate(ns, args)
+	case "drop":
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.collection(ns, false) == nil {
+			return failed(errorf(26, "ns not found"))
+		}
+		delete(s.collections, ns)
+		return bson.M{"ns": ns, "ok": 1}
+	case "dropdatabase":
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for name := range s.collections {
+			if strings.HasPrefix(name, db+".") {
+				delete(s.collections, name)
+			}
+		}
+		return bson.M{"dropped": db, "ok": 1}
+	case "dropindexes", "deleteindexes":
+		return s.dropIndex(ns, args["index"])
+	case "findandmodify":
+		return s.findAndModify(ns, ordered, args)
+	case "insert", "update", "delete":
+		return s.write(strings.ToLower(name), ns, args)
+	}
+	return bson.M{"ok": 0, "errmsg": "no such cmd: " + name, "code": 59}
+}
+
+func failed(err error) bson.M {
+	return bson.M{"ok": 0, "errmsg": err.Error(), "code": codeOf(err)}
+}
+
+// Returns the argument as a document, or an empty one if it is missing or null.
+func docArg(args bson.M, name string) bson.M {
+	doc, _ := args[name].(bson.M)
+	if doc == nil {
+		doc = bson.M{}
+	}
+	return doc
+}
+
+func (s *Server) count(ns string, args bson.M) bson.M {
+	found, err := s.find(ns, docArg(args, "query"), nil)
+	if err != nil {
+		return failed(err)
+	}
+	n := len(found)
+	if skip, _ := number(args["skip"]); int(skip) < n {
+		n -= int(skip)
+	} else {
+		n = 0
+	}
+	if limit, _ := number(args["limit"]); limit > 0 && int(limit) < n {
+		n = int(limit)
+	}
+	return bson.M{"n": n, "ok": 1}
+}
+
+func (s *Server) dropIndex(ns string, index interface{}) bson.M {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := s.collection(ns, false)
+	if c == nil {
+		return failed(errorf(26, "ns not found"))
+	}
+	kept := c.indexes[:1:1] // the _id index is never dropped
+	for _, spec := range c.indexes[1:] {
+		if index != "*" && index != spec["name"] {
+			kept = append(kept, spec)
+		}
+	}
+	if len(kept) == len(c.indexes) && index != "*" {
+		return failed(errorf(27, "index not found with name [%v]", index))
+	}
+	c.indexes = kept
+	return bson.M{"ok": 1}
+}
+
+// Updates, upserts or removes the first document matching the query in the sort order, and
+// returns the old or new version of it.
+func (s *Server) findAndModify(ns string, ordered bson.D, args bson.M) bson.M {
+	var sortBy bson.D
+	for _, e := range ordered {
+		if e.Name == "sort" {
+			sortBy, _ = e.Value.(bson.D)
+			if m, ok := e.Value.(bson.M); ok {
+				for field, order := range m {
+					sortBy = append(sortBy, bson.DocElem{Name: field, Value: order})
+				}
+			}
+		}
+	}
+	query, update := docArg(args, "query"), docArg(args, "update")
+	remove, upsert, returnNew := truthy(args["remove"]), truthy(args["upsert"]), truthy(args["new"])
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	found, err := s.findLocked(ns, query, sortBy)
+	if err != nil {
+		return failed(err)
+	}
+	status := bson.M{"n": 0, "updatedExisting": false}
+	var value interface{}
+	switch {
+	case len(found) > 0 && remove:
+		if _, err = s.removeLocked(ns, bson.M{"_id": found[0]["_id"]}, true); err != nil {
+			return failed(err)
+		}
+		status["n"], value = 1, found[0]
+	case len(found) > 0:
+		if _, _, err = s.updateLocked(ns, bson.M{"_id": found[0]["_id"]}, update, false, false); err != nil {
+			return failed(err)
+		}
+		status["n"], status["updatedExisting"], value = 1, true, found[0]
+		if returnNew {
+			updated, _ := s.findLocked(ns, bson.M{"_id": found[0]["_id"]}, nil)
+			value = updated[0]
+		}
+	case upsert && !remove:
+		_, id, err := s.updateLocked(ns, query, update, true, false)
+		if err != nil {
+			return failed(err)
+		}
+		status["n"], status["upserted"] = 1, id
+		if returnNew {
+			inserted, _ := s.findLocked(ns, bson.M{"_id": id}, nil)
+			value = inserted[0]
+		}
+	}
+	if doc, ok := value.(bson.M); ok {
+		value = project(doc, docArg(args, "fields"))
+	}
+	return bson.M{"value": value, "lastErrorObject": status, "ok": 1}
+}
+
+// Most documents of a write command
+const maxWriteBatch = 1000
+
+// Runs a write command of mongod 2.6 on each of its documents.  Errors are reported per
+// document, and stop the rest unless the command is unordered.  Commands of more than
+// maxWriteBatch documents fail as a whole.
+func (s *Server) write(op, ns string, args bson.M) bson.M {
+	var list []interface{}
+	switch op {
+	case "insert":
+		list, _ = args["documents"].([]interface{})
+	case "update":
+		list, _ = args["updates"].([]interface{})
+	case "delete":
+		list, _ = args["deletes"].([]interface{})
+	}
+	if len(list) > maxWriteBatch {
+		return failed(errorf(16, "Write batch sizes must be between 1 and %d. Got %d operations.", maxWriteBatch, len(list)))
+	}
+	ordered := true
+	if v, exists := args["ordered"]; exists {
+		ordered = truthy(v)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n, modified := 0, 0
+	writeErrors, upserted := []bson.M{}, []bson.M{}
+	for i, item := range list {
+		doc, _ := item.(bson.M)
+		var err error
+		switch op {
+		case "insert":
+			if err = s.insertLocked(ns, doc); err == nil {
+				n++
+			}
+		case "update":
+			var count int
+			var id interface{}
+			count, id, err = s.updateLocked(ns, docArg(doc, "q"), docArg(doc, "u"), truthy(doc["upsert"]), truthy(doc["multi"]))
+			n += count
+			if id != nil {
+				upserted = append(upserted, bson.M{"index": i, "_id": id})
+			} else {
+				modified += count
+			}
+		case "delete":
+			limit, _ := number(doc["limit"])
+			var count int
+			count, err = s.removeLocked(ns, docArg(doc, "q"), limit == 1)
+			n += count
+		}
+		if err != nil {
+			writeErrors = append(writeErrors, bson.M{"index": i, "code": codeOf(err), "errmsg": err.Error()})
+			if ordered {
+				break
+			}
+		}
+	}
+
+	result := bson.M{"n": n, "ok": 1}
+	if op == "update" {
+		result["nModified"] = modified
+	}
+	if len(upserted) > 0 {
+		result["upserted"] = upserted
+	}
+	if len(writeErrors) > 0 {
+		result["writeErrors"] = writeErrors
+	}
+	return result
+}
@@ -0,0 +1,87 @@
+package mgotest
+
+import (
+	"github.com/gyokuro/tally/geo"
+	"labix.org/v2/mgo/bson"
+	"math"
+)
+
+// Returns true if the point in the field of the document is within the shape of a $geoWithin or
+// $geoIntersects condition: a GeoJSON Polygon or MultiPolygon $geometry, or a $centerSphere.
+// Polygon edges are straight in latitude and longitude rather than geodesics as in mongod, which
+// makes no difference to the tests.
+func geoWithin(doc bson.M, field, op string, arg interface{}) (bool, error) {
+	m, ok := arg.(bson.M)
+	if !ok {
+		return false, errorf(2, "%s needs a shape", op)
+	}
+	p, isPoint := point(lookup(doc, field))
+	if c, ok := m["$centerSphere"].([]interface{}); ok && op == "$geoWithin" {
+		center, ok1 := point(c[0])
+		radians, ok2 := number(c[1])
+		if len(c) != 2 || !ok1 || !ok2 {
+			return false, errorf(2, "$centerSphere needs a point and a radius")
+		}
+		return isPoint && sphereAngle(center, p) <= radians, nil
+	}
+	g, ok := m["$geometry"].(bson.M)
+	if !ok {
+		return false, errorf(2, "%s supports $geometry and $centerSphere only", op)
+	}
+	polygons, err := multiPolygon(g)
+	if err != nil {
+		return false, err
+	}
+	return isPoint && polygons.Contains(p[1], p[0]), nil
+}
+
+// Returns the angle in radians between the points.
+func sphereAngle(a, b [2]float64) float64 {
+	return geo.Haversine(a[1], a[0], b[1], b[0]) / geo.EarthRadius
+}
+
+// Converts a GeoJSON Polygon or MultiPolygon.
+func multiPolygon(g bson.M) (geo.MultiPolygon, error) {
+	coordinates, _ := g["coordinates"].([]interface{})
+	switch g["type"] {
+	case "Polygon":
+		p, err := polygon(coordinates)
+		return geo.MultiPolygon{p}, err
+	case "MultiPolygon":
+		m := make(geo.MultiPolygon, len(coordinates))
+		for i, c := range coordinates {
+			list, _ := c.([]interface{})
+			var err error
+			if m[i], err = polygon(list); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, errorf(2, "unsupported $geometry type: %v", g["type"])
+}
+
+func polygon(rings []interface{}) (geo.Polygon, error) {
+	if len(rings) == 0 {
+		return nil, errorf(2, "polygon needs a ring")
+	}
+	p := make(geo.Polygon, len(rings))
+	for i, r := range rings {
+		positions, _ := r.([]interface{})
+		if len(positions) < 4 {
+			return nil, errorf(2, "ring needs at least 4 positions")
+		}
+		p[i] = make(geo.Ring, len(positions))
+		for j, position := range positions {
+			pt, ok := point(position)
+			if !ok || math.Abs(pt[1]) > 90 || math.Abs(pt[0]) > 180 {
+				return nil, errorf(2, "bad position in ring: %v", position)
+			}
+			p[i][j] = pt
+		}
+		if p[i][0] != p[i][len(positions)-1] {
+			return nil, errorf(2, "ring must be closed")
+		}
+	}
+	return p, nil
+}
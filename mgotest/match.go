@@ -0,0 +1,542 @@
+package mgotest
+
+import (
+	"labix.org/v2/mgo/bson"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Radius of the earth used by mongod for spherical distances
+const earthRadiusMeters = 6378.1 * 1000.
+
+// Returns the value at the dotted path in the document, or nil.  Numeric fields index arrays.
+func lookup(doc bson.M, path string) interface{} {
+	var value interface{} = doc
+	for _, field := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case bson.M:
+			value = v[field]
+		case []interface{}:
+			i, err := strconv.Atoi(field)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// Sets the value at the dotted path, creating the embedded documents on the way.
+func setPath(doc bson.M, path string, value interface{}) {
+	fields := strings.Split(path, ".")
+	for _, field := range fields[:len(fields)-1] {
+		next, ok := doc[field].(bson.M)
+		if !ok {
+			next = bson.M{}
+			doc[field] = next
+		}
+		doc = next
+	}
+	doc[fields[len(fields)-1]] = value
+}
+
+func unsetPath(doc bson.M, path string) {
+	fields := strings.Split(path, ".")
+	for _, field := range fields[:len(fields)-1] {
+		next, ok := doc[field].(bson.M)
+		if !ok {
+			return
+		}
+		doc = next
+	}
+	delete(doc, fields[len(fields)-1])
+}
+
+// Returns the value as a float64 if it is a number.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func truthy(v interface{}) bool {
+	if n, ok := number(v); ok {
+		return n != 0
+	}
+	b, _ := v.(bool)
+	return b
+}
+
+func equal(a, b interface{}) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	if t, ok := a.(time.Time); ok {
+		u, ok := b.(time.Time)
+		return ok && t.Equal(u)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Compares values of the same kind: numbers, strings, times or booleans.
+func compare(a, b interface{}) (int, bool) {
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			return sign(x - y), true
+		}
+		return 0, false
+	}
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return sign(float64(x.Sub(y))), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok && x != y {
+			if x {
+				return 1, true
+			}
+			return -1, true
+		} else if ok {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// Compares for sorting, where missing values come first and values of different kinds
+// are ordered by kind.
+func compareOrder(a, b interface{}) int {
+	if c, ok := compare(a, b); ok {
+		return c
+	}
+	return sign(float64(kindOrder(a) - kindOrder(b)))
+}
+
+func kindOrder(v interface{}) int {
+	if _, ok := number(v); ok {
+		return 1
+	}
+	switch v.(type) {
+	case nil:
+		return 0
+	case string:
+		return 2
+	case bson.M:
+		return 3
+	case []interface{}:
+		return 4
+	case bson.ObjectId:
+		return 5
+	case bool:
+		return 6
+	case time.Time:
+		return 7
+	}
+	return 8
+}
+
+func sign(f float64) int {
+	switch {
+	case f < 0:
+		return -1
+	case f > 0:
+		return 1
+	}
+	return 0
+}
+
+// Returns true if the document matches all the conditions of the query.
+func matches(doc bson.M, query bson.M) (bool, error) {
+	for key, cond := range query {
+		var ok bool
+		var err error
+		switch key {
+		case "$and", "$or", "$nor":
+			ok, err = matchesLogical(doc, key, cond)
+		default:
+			ok, err = matchesField(doc, key, cond)
+		}
+		if !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchesLogical(doc bson.M, op string, cond interface{}) (bool, error) {
+	list, ok := cond.([]interface{})
+	if !ok || len(list) == 0 {
+		return false, errorf(2, "%s must be a nonempty array", op)
+	}
+	for _, c := range list {
+		q, ok := c.(bson.M)
+		if !ok {
+			return false, errorf(2, "%s entries must be objects", op)
+		}
+		found, err := matches(doc, q)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op == "$and" && !found:
+			return false, nil
+		case op == "$or" && found:
+			return true, nil
+		case op == "$nor" && found:
+			return false, nil
+		}
+	}
+	return op != "$or", nil
+}
+
+// Returns true if the operator document, e.g. {$gt: 1}, has operators only.
+func isOperators(cond interface{}) (bson.M, bool) {
+	m, ok := cond.(bson.M)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+	for key := range m {
+		if !strings.HasPrefix(key, "$") {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+// Returns true if the value equals the condition, or if the value is an array, any element does.
+func equalOrContains(value, cond interface{}) bool {
+	if equal(value, cond) {
+		return true
+	}
+	if list, ok := value.([]interface{}); ok {
+		for _, v := range list {
+			if equal(v, cond) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchesField(doc bson.M, field string, cond interface{}) (bool, error) {
+	value := lookup(doc, field)
+	ops, ok := isOperators(cond)
+	if !ok {
+		return equalOrContains(value, cond), nil
+	}
+	for op, arg := range ops {
+		ok := false
+		switch op {
+		case "$eq":
+			ok = equalOrContains(value, arg)
+		case "$ne":
+			ok = !equalOrContains(value, arg)
+		case "$gt", "$gte", "$lt", "$lte":
+			c, comparable := compare(value, arg)
+			ok = comparable && (op == "$gt" && c > 0 || op == "$gte" && c >= 0 ||
+				op == "$lt" && c < 0 || op == "$lte" && c <= 0)
+		case "$in", "$nin":
+			list, isList := arg.([]interface{})
+			if !isList {
+				return false, errorf(2, "%s needs an array", op)
+			}
+			for _, v := range list {
+				if equalOrContains(value, v) {
+					ok = true
+					break
+				}
+			}
+			ok = ok == (op == "$in")
+		case "$all":
+			list, isList := arg.([]interface{})
+			if !isList {
+				return false, errorf(2, "%s needs an array", op)
+			}
+			ok = true
+			for _, v := range list {
+				if !equalOrContains(value, v) {
+					ok = false
+					break
+				}
+			}
+		case "$exists":
+			_, exists := parentOf(doc, field)[field[strings.LastIndex(field, ".")+1:]]
+			ok = exists == truthy(arg)
+		case "$near", "$nearSphere":
+			near, err := parseNear(field, ops)
+			if err != nil {
+				return false, err
+			}
+			ok = near.within(doc)
+		case "$geoWithin", "$geoIntersects":
+			within, err := geoWithin(doc, field, op, arg)
+			if err != nil {
+				return false, err
+			}
+			ok = within
+		case "$maxDistance", "$minDistance":
+			ok = true // part of $near
+		default:
+			return false, errorf(2, "unknown operator: %s", op)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Returns the embedded document holding the last field of the path.
+func parentOf(doc bson.M, path string) bson.M {
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		parent, _ := lookup(doc, path[:i]).(bson.M)
+		return parent
+	}
+	return doc
+}
+
+// A $near condition on a field: a GeoJSON point and the distances in meters
+type near struct {
+	field          string
+	center         [2]float64 // longitude, latitude
+	min, max       float64
+	hasMin, hasMax bool
+}
+
+// Returns the $near condition of the query, or nil if none.
+func nearOf(query bson.M) (*near, error) {
+	for field, cond := range query {
+		if ops, ok := isOperators(cond); ok {
+			if _, isNear := ops["$near"]; isNear {
+				return parseNear(field, ops)
+			}
+			if _, isNear := ops["$nearSphere"]; isNear {
+				return parseNear(field, ops)
+			}
+		}
+	}
+	return nil, nil
+}
+
+func parseNear(field string, ops bson.M) (*near, error) {
+	arg := ops["$near"]
+	if arg == nil {
+		arg = ops["$nearSphere"]
+	}
+	n := &near{field: field}
+	m, ok := arg.(bson.M)
+	if !ok {
+		return nil, errorf(2, "$near supports GeoJSON points only")
+	}
+	point, ok := point(m["$geometry"])
+	if !ok {
+		return nil, errorf(2, "$near needs a $geometry point")
+	}
+	n.center = point
+	if v, ok := number(m["$maxDistance"]); ok {
+		n.max, n.hasMax = v, true
+	} else if v, ok := number(ops["$maxDistance"]); ok {
+		n.max, n.hasMax = v, true
+	}
+	if v, ok := number(m["$minDistance"]); ok {
+		n.min, n.hasMin = v, true
+	} else if v, ok := number(ops["$minDistance"]); ok {
+		n.min, n.hasMin = v, true
+	}
+	return n, nil
+}
+
+// Returns the longitude and latitude of a GeoJSON point or a legacy coordinate pair.
+func point(v interface{}) (p [2]float64, ok bool) {
+	if m, isDoc := v.(bson.M); isDoc {
+		if m["type"] != "Point" {
+			return
+		}
+		v = m["coordinates"]
+	}
+	list, isList := v.([]interface{})
+	if !isList || len(list) != 2 {
+		return
+	}
+	lon, ok1 := number(list[0])
+	lat, ok2 := number(list[1])
+	return [2]float64{lon, lat}, ok1 && ok2
+}
+
+// Returns the spherical distance in meters from the center to the field of the document, or
+// infinity if the field is not a point.
+func (n *near) distance(doc bson.M) float64 {
+	p, ok := point(lookup(doc, n.field))
+	if !ok {
+		return math.Inf(1)
+	}
+	rad := math.Pi / 180.
+	lat1, lat2 := n.center[1]*rad, p[1]*rad
+	dlat, dlon := lat2-lat1, (p[0]-n.center[0])*rad
+	h := math.Pow(math.Sin(dlat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dlon/2), 2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1., math.Sqrt(h)))
+}
+
+func (n *near) within(doc bson.M) bool {
+	d := n.distance(doc)
+	return !math.IsInf(d, 1) && (!n.hasMax || d <= n.max) && (!n.hasMin || d >= n.min)
+}
+
+// Returns a deep copy of the document, so updates do not change the stored one.
+func copyDoc(doc bson.M) bson.M {
+	result := bson.M{}
+	for k, v := range doc {
+		result[k] = copyValue(v)
+	}
+	return result
+}
+
+func copyValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case bson.M:
+		return copyDoc(x)
+	case []interface{}:
+		list := make([]interface{}, len(x))
+		for i, e := range x {
+			list[i] = copyValue(e)
+		}
+		return list
+	}
+	return v
+}
+
+// Returns the document with the update applied: either a replacement document, keeping the _id,
+// or update operators.  $setOnInsert only applies when inserting.
+func applyUpdate(doc bson.M, update bson.M, inserting bool) (bson.M, error) {
+	if _, ok := isOperators(update); !ok {
+		for key := range update {
+			if strings.HasPrefix(key, "$") {
+				return nil, errorf(9, "cannot mix operators and fields in an update")
+			}
+		}
+		result := copyDoc(update)
+		if id, exists := doc["_id"]; exists {
+			result["_id"] = id
+		}
+		return result, nil
+	}
+
+	result := copyDoc(doc)
+	for op, arg := range update {
+		fields, ok := arg.(bson.M)
+		if !ok {
+			return nil, errorf(9, "%s needs a document", op)
+		}
+		for path, v := range fields {
+			if path == "_id" && op != "$setOnInsert" && !(op == "$set" && equal(v, doc["_id"])) {
+				return nil, errorf(66, "mod on _id not allowed")
+			}
+			switch op {
+			case "$set":
+				setPath(result, path, copyValue(v))
+			case "$setOnInsert":
+				if inserting {
+					setPath(result, path, copyValue(v))
+				}
+			case "$unset":
+				unsetPath(result, path)
+			case "$inc":
+				by, ok := number(v)
+				old := lookup(result, path)
+				current, isNumber := number(old)
+				if !ok || old != nil && !isNumber {
+					return nil, errorf(14, "cannot $inc a non-number")
+				}
+				setPath(result, path, increment(old, v, current+by))
+			case "$push", "$addToSet":
+				list, _ := lookup(result, path).([]interface{})
+				if lookup(result, path) != nil && list == nil {
+					return nil, errorf(2, "%s needs an array", op)
+				}
+				if op == "$addToSet" && equalOrContains(list, v) {
+					continue
+				}
+				setPath(result, path, append(append([]interface{}{}, list...), copyValue(v)))
+			case "$pull":
+				list, _ := lookup(result, path).([]interface{})
+				kept := make([]interface{}, 0, len(list))
+				for _, e := range list {
+					if !equal(e, v) {
+						kept = append(kept, e)
+					}
+				}
+				setPath(result, path, kept)
+			default:
+				return nil, errorf(9, "unknown modifier: %s", op)
+			}
+		}
+	}
+	return result, nil
+}
+
+// Keeps integer counters integers, as mongod does.
+func increment(old, by interface{}, sum float64) interface{} {
+	_, oldFloat := old.(float64)
+	_, byFloat := by.(float64)
+	if oldFloat || byFloat {
+		return sum
+	}
+	switch old.(type) {
+	case int64:
+		return int64(sum)
+	}
+	if _, ok := by.(int64); ok {
+		return int64(sum)
+	}
+	return int(sum)
+}
+
+// Returns the document inserted by an upsert: the equality conditions of the selector with the
+// update applied.
+func upsertDoc(selector, update bson.M) (bson.M, error) {
+	doc := bson.M{}
+	for key, cond := range selector {
+		if strings.HasPrefix(key, "$") {
+			continue
+		}
+		if ops, ok := isOperators(cond); ok {
+			if eq, exists := ops["$eq"]; exists {
+				setPath(doc, key, copyValue(eq))
+			}
+			continue
+		}
+		setPath(doc, key, copyValue(cond))
+	}
+	result, err := applyUpdate(doc, update, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := result["_id"]; !exists {
+		if id, exists := doc["_id"]; exists {
+			result["_id"] = id
+		}
+	}
+	return result, nil
+}
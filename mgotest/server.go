@@ -0,0 +1,352 @@
+// Package mgotest provides an in-process stand-in for mongod, for testing the mongodb backends
+// without a database server.  It speaks enough of the legacy wire protocol used by the vendored
+// mgo driver: queries, inserts, updates with upserts, removes, the common commands, indexes, and
+// $near queries on GeoJSON points.  Everything is kept in memory and lost on Close.
+//
+//	server := mgotest.NewServer()
+//	defer server.Close()
+//	session, err := mgo.Dial(server.URL())
+package mgotest
+
+import (
+	"encoding/binary"
+	"io"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operation codes of the wire protocol
+const (
+	opReply       = 1
+	opUpdate      = 2001
+	opInsert      = 2002
+	opQuery       = 2004
+	opGetMore     = 2005
+	opDelete      = 2006
+	opKillCursors = 2007
+)
+
+// Flags of the replies
+const (
+	replyCursorNotFound = 1 << 0
+	replyQueryFailure   = 1 << 1
+)
+
+// The fake server.  All data is held in memory behind a single lock.
+type Server struct {
+	listener net.Listener
+
+	lock        sync.Mutex
+	collections map[string]*collection // by full name, "db.collection"
+	conns       map[net.Conn]bool
+	closed      bool
+	requestId   int32
+
+	// Clock for expiring documents by TTL indexes; time.Now unless replaced in tests.
+	Now func() time.Time
+}
+
+// Starts a server listening on a local port.  Panics if it cannot listen, as there is no
+// point in running the tests without it.
+func NewServer() *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &Server{
+		listener:    listener,
+		collections: make(map[string]*collection),
+		conns:       make(map[net.Conn]bool),
+		Now:         time.Now,
+	}
+	go s.serve()
+	return s
+}
+
+// Returns the address to dial with mgo, e.g. 127.0.0.1:40123
+func (s *Server) URL() string {
+	return s.listener.Addr().String()
+}
+
+// Stops the server and closes all connections.
+func (s *Server) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.lock.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Error of the last write on a connection, as returned by getLastError
+type lastError struct {
+	err             string
+	code            int
+	n               int
+	updatedExisting bool
+	upserted        interface{}
+}
+
+func (e *lastError) doc() bson.M {
+	doc := bson.M{"n": e.n, "updatedExisting": e.updatedExisting, "ok": 1}
+	if e.err != "" {
+		doc["err"], doc["code"] = e.err, e.code
+	} else {
+		doc["err"] = nil
+	}
+	if e.upserted != nil {
+		doc["upserted"] = e.upserted
+	}
+	return doc
+}
+
+// Reads the messages of a connection until it is closed.  Each query gets a reply; writes
+// only record their result for the getLastError command that follows in safe mode.
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	last := &lastError{}
+	header := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := int32(binary.LittleEndian.Uint32(header[0:]))
+		requestId := int32(binary.LittleEndian.Uint32(header[4:]))
+		opCode := int32(binary.LittleEndian.Uint32(header[12:]))
+		if length < 16 || length > 48<<20 {
+			return
+		}
+		body := make([]byte, length-16)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		m := &message{body: body}
+		var flags int32
+		var docs []interface{}
+		switch opCode {
+		case opQuery:
+			flags, docs = s.query(m, last)
+		case opGetMore:
+			// All results are returned in the first batch, so there are no cursors.
+			flags = replyCursorNotFound
+		case opInsert:
+			m.int32()
+			coll := m.cstring()
+			inserts := []bson.M{}
+			for !m.done() {
+				inserts = append(inserts, m.doc())
+			}
+			*last = s.insert(coll, inserts)
+			continue
+		case opUpdate:
+			m.int32()
+			coll := m.cstring()
+			updateFlags := m.int32()
+			selector, update := m.doc(), m.doc()
+			*last = s.update(coll, selector, update, updateFlags&1 != 0, updateFlags&2 != 0)
+			continue
+		case opDelete:
+			m.int32()
+			coll := m.cstring()
+			deleteFlags := m.int32()
+			*last = s.remove(coll, m.doc(), deleteFlags&1 != 0)
+			continue
+		case opKillCursors:
+			continue
+		default:
+			log.Println("Warning: mgotest got unsupported op code", opCode)
+			return
+		}
+		if m.err != nil {
+			flags, docs = replyQueryFailure, []interface{}{queryError(m.err.Error(), 2)}
+		}
+		if err := s.reply(conn, requestId, flags, docs); err != nil {
+			return
+		}
+	}
+}
+
+// Writes an OP_REPLY with the documents, without a cursor.
+func (s *Server) reply(conn net.Conn, responseTo, flags int32, docs []interface{}) error {
+	s.lock.Lock()
+	s.requestId++
+	requestId := s.requestId
+	s.lock.Unlock()
+
+	buff := make([]byte, 36)
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		buff = append(buff, data...)
+	}
+	binary.LittleEndian.PutUint32(buff[0:], uint32(len(buff)))
+	binary.LittleEndian.PutUint32(buff[4:], uint32(requestId))
+	binary.LittleEndian.PutUint32(buff[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(buff[12:], opReply)
+	binary.LittleEndian.PutUint32(buff[16:], uint32(flags))
+	binary.LittleEndian.PutUint64(buff[20:], 0) // cursor id
+	binary.LittleEndian.PutUint32(buff[28:], 0) // starting from
+	binary.LittleEndian.PutUint32(buff[32:], uint32(len(docs)))
+	_, err := conn.Write(buff)
+	return err
+}
+
+// Handles an OP_QUERY, either a command on the $cmd collection or a find.
+func (s *Server) query(m *message, last *lastError) (flags int32, docs []interface{}) {
+	m.int32()
+	coll := m.cstring()
+	skip, limit := int(m.int32()), int(m.int32())
+	raw := m.raw()
+	var selector bson.M
+	if !m.done() {
+		selector = m.doc()
+	}
+	if m.err != nil {
+		return
+	}
+
+	if strings.HasSuffix(coll, ".$cmd") {
+		return 0, []interface{}{s.command(strings.TrimSuffix(coll, ".$cmd"), raw, last)}
+	}
+
+	// Queries with options are wrapped in $query
+	query, orderBy := bson.M{}, bson.D{}
+	if err := bson.Unmarshal(raw, &query); err != nil {
+		return replyQueryFailure, []interface{}{queryError(err.Error(), 2)}
+	}
+	if _, wrapped := query["$query"]; wrapped {
+		wrapper := struct {
+			Query   bson.M `bson:"$query"`
+			OrderBy bson.D `bson:"$orderby"`
+		}{}
+		if err := bson.Unmarshal(raw, &wrapper); err != nil {
+			return replyQueryFailure, []interface{}{queryError(err.Error(), 2)}
+		}
+		query, orderBy = wrapper.Query, wrapper.OrderBy
+	}
+
+	found, err := s.find(coll, query, orderBy)
+	if err != nil {
+		return replyQueryFailure, []interface{}{queryError(err.Error(), codeOf(err))}
+	}
+	if skip > len(found) {
+		skip = len(found)
+	}
+	found = found[skip:]
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < len(found) {
+		found = found[:limit]
+	}
+	docs = make([]interface{}, len(found))
+	for i, doc := range found {
+		docs[i] = project(doc, selector)
+	}
+	return
+}
+
+// Reader of the fields of a message body.  The first error is kept and later reads return
+// zero values.
+type message struct {
+	body []byte
+	err  error
+}
+
+func (m *message) done() bool {
+	return m.err != nil || len(m.body) == 0
+}
+
+func (m *message) fail() {
+	if m.err == nil {
+		m.err = io.ErrUnexpectedEOF
+	}
+	m.body = nil
+}
+
+func (m *message) int32() int32 {
+	if len(m.body) < 4 {
+		m.fail()
+		return 0
+	}
+	v := int32(binary.LittleEndian.Uint32(m.body))
+	m.body = m.body[4:]
+	return v
+}
+
+func (m *message) cstring() string {
+	for i, b := range m.body {
+		if b == 0 {
+			s := string(m.body[:i])
+			m.body = m.body[i+1:]
+			return s
+		}
+	}
+	m.fail()
+	return ""
+}
+
+// Returns the raw bytes of the next bson document.
+func (m *message) raw() []byte {
+	if len(m.body) < 4 {
+		m.fail()
+		return nil
+	}
+	size := int(binary.LittleEndian.Uint32(m.body))
+	if size < 5 || size > len(m.body) {
+		m.fail()
+		return nil
+	}
+	raw := m.body[:size]
+	m.body = m.body[size:]
+	return raw
+}
+
+func (m *message) doc() bson.M {
+	doc := bson.M{}
+	if raw := m.raw(); raw != nil {
+		if err := bson.Unmarshal(raw, &doc); err != nil && m.err == nil {
+			m.err = err
+		}
+	}
+	return doc
+}
+
+// Returns the document of a failed query.  The driver only takes $err as the first element for
+// an error, so the document is ordered.
+func queryError(message string, code int) bson.D {
+	return bson.D{{Name: "$err", Value: message}, {Name: "code", Value: code}}
+}
@@ -0,0 +1,180 @@
+package mgotest
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"math"
+	"testing"
+	"time"
+)
+
+func dial(test *testing.T) (*Server, *mgo.Collection) {
+	server := NewServer()
+	session, err := mgo.Dial(server.URL())
+	if err != nil {
+		test.Fatal(err)
+	}
+	return server, session.DB("test").C("places")
+}
+
+func geoPoint(lon, lat float64) bson.M {
+	return bson.M{"type": "Point", "coordinates": []float64{lon, lat}}
+}
+
+func TestCrud(test *testing.T) {
+	server, c := dial(test)
+	defer server.Close()
+	defer c.Database.Session.Close()
+
+	if err := c.Insert(bson.M{"_id": 1, "name": "a"}, bson.M{"_id": 2, "name": "b"}); err != nil {
+		test.Fatal(err)
+	}
+	if err := c.Insert(bson.M{"_id": 1}); !mgo.IsDup(err) {
+		test.Error("Expecting duplicate key error", err)
+	}
+	if _, err := c.UpsertId(3, bson.M{"$set": bson.M{"name": "c"}}); err != nil {
+		test.Fatal(err)
+	}
+	if err := c.UpdateId(2, bson.M{"$inc": bson.M{"visits": 2}}); err != nil {
+		test.Fatal(err)
+	}
+	result := bson.M{}
+	if err := c.FindId(2).One(&result); err != nil || result["visits"] != 2 {
+		test.Error("Expecting 2 visits", result, err)
+	}
+	if n, err := c.Find(bson.M{"_id": bson.M{"$gte": 2}}).Count(); err != nil || n != 2 {
+		test.Error("Expecting 2", n, err)
+	}
+	if _, err := c.UpsertId(1, bson.M{"$set": bson.M{"tags": []string{"x", "y"}}}); err != nil {
+		test.Fatal(err)
+	}
+	if n, err := c.Find(bson.M{"tags": bson.M{"$all": []string{"y", "x"}}}).Count(); err != nil || n != 1 {
+		test.Error("Expecting 1 with all the tags", n, err)
+	}
+	if n, err := c.Find(bson.M{"tags": bson.M{"$all": []string{"x", "z"}}}).Count(); err != nil || n != 0 {
+		test.Error("Expecting none with all the tags", n, err)
+	}
+	names := []bson.M{}
+	if err := c.Find(nil).Sort("-name").Select(bson.M{"name": 1, "_id": 0}).All(&names); err != nil ||
+		len(names) != 3 || names[0]["name"] != "c" || len(names[0]) != 1 {
+		test.Error("Expecting names in descending order", names, err)
+	}
+	id := bson.M{}
+	if err := c.Find(bson.M{"name": "c"}).Select(bson.M{"_id": 1}).One(&id); err != nil || len(id) != 1 || id["_id"] == nil {
+		test.Error("Expecting only the id", id, err)
+	}
+	if err := c.RemoveId(4); err != mgo.ErrNotFound {
+		test.Error("Expecting not found", err)
+	}
+	if info, err := c.RemoveAll(nil); err != nil || info.Removed != 3 {
+		test.Error("Expecting 3 removed", info, err)
+	}
+}
+
+func TestNear(test *testing.T) {
+	server, c := dial(test)
+	defer server.Close()
+	defer c.Database.Session.Close()
+
+	c.Insert(bson.M{"_id": 1, "loc": geoPoint(-122.4194, 37.7749)}, bson.M{"_id": 2, "loc": geoPoint(-122.2711, 37.8044)})
+	query := bson.M{"loc": bson.M{"$near": bson.M{"$geometry": geoPoint(-122.4313, 37.7739)}, "$maxDistance": 5000}}
+	if err := c.Find(query).One(nil); err == nil {
+		test.Error("Expecting error without a geo index")
+	}
+
+	if err := c.EnsureIndexKey("$2dsphere:loc"); err != nil {
+		test.Fatal(err)
+	}
+	found := []bson.M{}
+	if err := c.Find(query).All(&found); err != nil || len(found) != 1 || found[0]["_id"] != 1 {
+		test.Error("Expecting cab 1 only", found, err)
+	}
+	delete(query["loc"].(bson.M), "$maxDistance")
+	if err := c.Find(query).All(&found); err != nil || len(found) != 2 || found[1]["_id"] != 2 {
+		test.Error("Expecting both, nearest first", found, err)
+	}
+}
+
+func TestGeoWithin(test *testing.T) {
+	server, c := dial(test)
+	defer server.Close()
+	defer c.Database.Session.Close()
+
+	c.Insert(bson.M{"_id": 1, "loc": []float64{0.75, 0}}, bson.M{"_id": 2, "loc": geoPoint(0, 0)})
+	square := []interface{}{[]float64{-1, -1}, []float64{1, -1}, []float64{1, 1}, []float64{-1, 1}, []float64{-1, -1}}
+	hole := []interface{}{[]float64{-.5, -.5}, []float64{.5, -.5}, []float64{.5, .5}, []float64{-.5, .5}, []float64{-.5, -.5}}
+	for _, q := range []bson.M{
+		{"$geoWithin": bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": []interface{}{square, hole}}}},
+		{"$geoWithin": bson.M{"$centerSphere": []interface{}{[]float64{1, 0}, 0.5 * math.Pi / 180}}},
+	} {
+		found := []bson.M{}
+		if err := c.Find(bson.M{"loc": q}).All(&found); err != nil || len(found) != 1 || found[0]["_id"] != 1 {
+			test.Error("Expecting cab 1 only", q, found, err)
+		}
+	}
+	open := bson.M{"type": "Polygon", "coordinates": []interface{}{square[:4]}}
+	if err := c.Find(bson.M{"loc": bson.M{"$geoWithin": bson.M{"$geometry": open}}}).One(nil); err == nil {
+		test.Error("Expecting error for an open ring")
+	}
+}
+
+func TestExpiry(test *testing.T) {
+	server, c := dial(test)
+	defer server.Close()
+	defer c.Database.Session.Close()
+
+	now := time.Now()
+	server.Now = func() time.Time { return now }
+	c.EnsureIndex(mgo.Index{Key: []string{"seen"}, ExpireAfter: time.Minute})
+	c.Insert(bson.M{"_id": 1, "seen": now.Add(-2 * time.Minute)}, bson.M{"_id": 2, "seen": now})
+	if n, err := c.Count(); err != nil || n != 1 {
+		test.Error("Expecting the expired document removed", n, err)
+	}
+}
+
+func TestFindAndModify(test *testing.T) {
+	server, c := dial(test)
+	defer server.Close()
+	defer c.Database.Session.Close()
+
+	counter := struct{ N int }{}
+	for i := 1; i <= 2; i++ {
+		_, err := c.FindId("rides").Apply(mgo.Change{
+			Update:    bson.M{"$inc": bson.M{"n": 1}},
+			Upsert:    true,
+			ReturnNew: true,
+		}, &counter)
+		if err != nil || counter.N != i {
+			test.Error("Expecting", i, counter, err)
+		}
+	}
+	if _, err := c.FindId("other").Apply(mgo.Change{Remove: true}, nil); err != mgo.ErrNotFound {
+		test.Error("Expecting not found", err)
+	}
+}
+
+func TestAggregate(test *testing.T) {
+	server, c := dial(test)
+	defer server.Close()
+	defer c.Database.Session.Close()
+
+	c.Insert(bson.M{"_id": 1, "loc": []float64{1.5, 2}}, bson.M{"_id": 2, "loc": []float64{1.9, 2.5}},
+		bson.M{"_id": 3, "loc": []float64{-1, 0}}, bson.M{"_id": 4})
+	results := []struct {
+		Id    float64 `bson:"_id"`
+		Count int
+		Lat   float64
+	}{}
+	err := c.Pipe([]bson.M{
+		{"$match": bson.M{"loc.0": bson.M{"$gte": 0}}},
+		{"$project": bson.M{"lon": bson.M{"$arrayElemAt": []interface{}{"$loc", 0}}, "lat": bson.M{
+			"$arrayElemAt": []interface{}{"$loc", 1}}}},
+		{"$group": bson.M{"_id": bson.M{"$floor": "$lon"}, "count": bson.M{"$sum": 1}, "lat": bson.M{"$avg": "$lat"}}},
+	}).All(&results)
+	if err != nil || len(results) != 1 || results[0].Id != 1 || results[0].Count != 2 || results[0].Lat != 2.25 {
+		test.Error("Expecting the two documents east of the meridian grouped", results, err)
+	}
+	if err := c.Pipe([]bson.M{{"$out": "elsewhere"}}).All(&results); err == nil {
+		test.Error("Expecting error for an unknown stage")
+	}
+}
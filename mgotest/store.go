@@ -0,0 +1,354 @@
+package mgotest
+
+import (
+	"fmt"
+	"labix.org/v2/mgo/bson"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Error with the code mongod would return
+type mongoError struct {
+	code int
+	msg  string
+}
+
+func (e *mongoError) Error() string {
+	return e.msg
+}
+
+func codeOf(err error) int {
+	if e, ok := err.(*mongoError); ok {
+		return e.code
+	}
+	return 2 // BadValue
+}
+
+func errorf(code int, format string, args ...interface{}) error {
+	return &mongoError{code, fmt.Sprintf(format, args...)}
+}
+
+// Documents of a collection in insertion order, and its index specs.  Stored documents are
+// never modified in place; updates replace them, so found documents can be read without the lock.
+type collection struct {
+	name    string
+	docs    []bson.M
+	indexes []bson.M
+}
+
+// Returns the collection by full name, creating it if asked to.
+func (s *Server) collection(name string, create bool) *collection {
+	c := s.collections[name]
+	if c == nil && create {
+		c = &collection{
+			name:    name,
+			indexes: []bson.M{bson.M{"name": "_id_", "ns": name, "key": bson.M{"_id": 1}}},
+		}
+		s.collections[name] = c
+	}
+	return c
+}
+
+// Removes the documents expired by the TTL indexes.  Mongod does this in the background once a
+// minute; here it is done whenever the collection is used.
+func (s *Server) expire(c *collection) {
+	now := s.Now()
+	for _, index := range c.indexes {
+		seconds, ok := number(index["expireAfterSeconds"])
+		key, _ := index["key"].(bson.M)
+		if !ok || len(key) != 1 {
+			continue
+		}
+		for field := range key {
+			kept := c.docs[:0:0]
+			for _, doc := range c.docs {
+				if t, ok := lookup(doc, field).(time.Time); ok && !now.Before(t.Add(time.Duration(seconds*float64(time.Second)))) {
+					continue
+				}
+				kept = append(kept, doc)
+			}
+			c.docs = kept
+		}
+	}
+}
+
+// Returns the name of the unique index the document would violate, or empty.  The document at
+// position except, the one being updated, is not compared.
+func (c *collection) duplicate(doc bson.M, except int) string {
+	for _, index := range c.indexes {
+		key, _ := index["key"].(bson.M)
+		unique, _ := index["unique"].(bool)
+		if _, isId := key["_id"]; !(unique || isId && len(key) == 1) {
+			continue
+		}
+		for i, other := range c.docs {
+			if i == except {
+				continue
+			}
+			same := true
+			for field := range key {
+				if !equal(lookup(doc, field), lookup(other, field)) {
+					same = false
+					break
+				}
+			}
+			if same {
+				name, _ := index["name"].(string)
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func duplicateError(c *collection, index string) error {
+	return errorf(11000, "E11000 duplicate key error index: %s.$%s", c.name, index)
+}
+
+// Returns true if the collection has a geo index on the field.
+func (c *collection) geoIndexed(field string) bool {
+	for _, index := range c.indexes {
+		key, _ := index["key"].(bson.M)
+		if kind, _ := key[field].(string); kind == "2dsphere" || kind == "2d" {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the documents matching the query, nearest first for $near queries, or else in the order.
+func (s *Server) find(name string, query bson.M, orderBy bson.D) ([]bson.M, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.findLocked(name, query, orderBy)
+}
+
+func (s *Server) findLocked(name string, query bson.M, orderBy bson.D) (found []bson.M, err error) {
+	var docs []bson.M
+	if strings.HasSuffix(name, ".system.indexes") {
+		docs = s.indexSpecs(strings.TrimSuffix(name, "system.indexes"))
+	} else if c := s.collection(name, false); c != nil {
+		s.expire(c)
+		docs = c.docs
+	}
+
+	near, err := nearOf(query)
+	if err != nil {
+		return
+	}
+	if near != nil {
+		if c := s.collection(name, false); c == nil || !c.geoIndexed(near.field) {
+			return nil, errorf(17007, "unable to find index for $geoNear query")
+		}
+	}
+
+	found = make([]bson.M, 0)
+	for _, doc := range docs {
+		ok, err := matches(doc, query)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, doc)
+		}
+	}
+	if near != nil {
+		sort.SliceStable(found, func(i, j int) bool {
+			return near.distance(found[i]) < near.distance(found[j])
+		})
+	} else if len(orderBy) > 0 {
+		sort.SliceStable(found, func(i, j int) bool {
+			for _, e := range orderBy {
+				c := compareOrder(lookup(found[i], e.Name), lookup(found[j], e.Name))
+				if n, _ := number(e.Value); n < 0 {
+					c = -c
+				}
+				if c != 0 {
+					return c < 0
+				}
+			}
+			return false
+		})
+	}
+	return
+}
+
+// Returns the index specs of the collections in the database, as in system.indexes.
+func (s *Server) indexSpecs(db string) []bson.M {
+	names := make([]string, 0)
+	for name := range s.collections {
+		if strings.HasPrefix(name, db) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	specs := make([]bson.M, 0)
+	for _, name := range names {
+		specs = append(specs, s.collections[name].indexes...)
+	}
+	return specs
+}
+
+// Creates the index, or replaces the one with the same name.
+func (s *Server) ensureIndex(spec bson.M) error {
+	ns, _ := spec["ns"].(string)
+	name, _ := spec["name"].(string)
+	if _, ok := spec["key"].(bson.M); !ok || ns == "" || name == "" {
+		return errorf(67, "index spec needs ns, name and key")
+	}
+	c := s.collection(ns, true)
+	for i, index := range c.indexes {
+		if index["name"] == name {
+			c.indexes[i] = spec
+			return nil
+		}
+	}
+	c.indexes = append(c.indexes, spec)
+	return nil
+}
+
+// Inserts the documents, or index specs into system.indexes.  Stops at the first error.
+func (s *Server) insert(name string, docs []bson.M) lastError {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, doc := range docs {
+		if err := s.insertLocked(name, doc); err != nil {
+			return lastError{err: err.Error(), code: codeOf(err)}
+		}
+	}
+	return lastError{}
+}
+
+func (s *Server) insertLocked(name string, doc bson.M) error {
+	if strings.HasSuffix(name, ".system.indexes") {
+		return s.ensureIndex(doc)
+	}
+	c := s.collection(name, true)
+	s.expire(c)
+	if _, exists := doc["_id"]; !exists {
+		doc["_id"] = bson.NewObjectId()
+	}
+	if index := c.duplicate(doc, -1); index != "" {
+		return duplicateError(c, index)
+	}
+	c.docs = append(c.docs, doc)
+	return nil
+}
+
+// Updates the first or all documents matching the selector, or inserts one if none matches
+// and upsert is set.
+func (s *Server) update(name string, selector, update bson.M, upsert, multi bool) lastError {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n, upserted, err := s.updateLocked(name, selector, update, upsert, multi)
+	if err != nil {
+		return lastError{err: err.Error(), code: codeOf(err)}
+	}
+	return lastError{n: n, updatedExisting: n > 0 && upserted == nil, upserted: upserted}
+}
+
+func (s *Server) updateLocked(name string, selector, update bson.M, upsert, multi bool) (n int, upserted interface{}, err error) {
+	c := s.collection(name, true)
+	s.expire(c)
+	for i, doc := range c.docs {
+		ok, err := matches(doc, selector)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !ok {
+			continue
+		}
+		updated, err := applyUpdate(doc, update, false)
+		if err != nil {
+			return n, nil, err
+		}
+		if index := c.duplicate(updated, i); index != "" {
+			return n, nil, duplicateError(c, index)
+		}
+		c.docs[i] = updated
+		if n++; !multi {
+			break
+		}
+	}
+	if n > 0 || !upsert {
+		return
+	}
+
+	doc, err := upsertDoc(selector, update)
+	if err != nil {
+		return
+	}
+	if err = s.insertLocked(name, doc); err != nil {
+		return
+	}
+	return 1, doc["_id"], nil
+}
+
+// Removes the first or all documents matching the selector.
+func (s *Server) remove(name string, selector bson.M, single bool) lastError {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n, err := s.removeLocked(name, selector, single)
+	if err != nil {
+		return lastError{err: err.Error(), code: codeOf(err)}
+	}
+	return lastError{n: n}
+}
+
+func (s *Server) removeLocked(name string, selector bson.M, single bool) (n int, err error) {
+	c := s.collection(name, false)
+	if c == nil {
+		return
+	}
+	s.expire(c)
+	kept := make([]bson.M, 0, len(c.docs))
+	for _, doc := range c.docs {
+		ok, err := matches(doc, selector)
+		if err != nil {
+			return 0, err
+		}
+		if ok && !(single && n > 0) {
+			n++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	c.docs = kept
+	return
+}
+
+// Returns the document with only the fields selected, or without the fields excluded.  Selecting
+// only the _id includes it alone.
+func project(doc bson.M, selector bson.M) bson.M {
+	if len(selector) == 0 {
+		return doc
+	}
+	include := false
+	for field, v := range selector {
+		if (field != "_id" || len(selector) == 1) && truthy(v) {
+			include = true
+		}
+	}
+	result := bson.M{}
+	if include {
+		for field := range selector {
+			if v, exists := doc[field]; exists && field != "_id" {
+				result[field] = v
+			}
+		}
+		if v, exists := selector["_id"]; !exists || truthy(v) {
+			result["_id"] = doc["_id"]
+		}
+		return result
+	}
+	for field, v := range doc {
+		if _, excluded := selector[field]; !excluded {
+			result[field] = v
+		}
+	}
+	return result
+}
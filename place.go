@@ -0,0 +1,107 @@
+package tally
+
+import (
+	"time"
+)
+
+// Time spent by a source within a small radius, detected from its location events.  The location
+// is the mean of the fixes during the stay.  Stays that are visits of a place have its id.
+type Stay struct {
+	Source   string    `json:"source"`
+	Location Location  `json:"location"`
+	Arrived  time.Time `json:"arrived"`
+	Departed time.Time `json:"departed"`
+	Place    Id        `json:"place,omitempty"`
+}
+
+// Returns how long the stay lasted.
+func (s Stay) Duration() time.Duration {
+	return s.Departed.Sub(s.Arrived)
+}
+
+// Place where a source stays repeatedly, e.g. home or work, found by clustering its stays.  The
+// location is the mean of the stays, and the radius in meters reaches the farthest.  Places keep
+// their ids and names when detected again.
+type Place struct {
+	Id        Id            `json:"id"`
+	Source    string        `json:"source"`
+	Name      string        `json:"name,omitempty"`
+	Location  Location      `json:"location"`
+	Radius    float64       `json:"radius"`
+	Visits    int           `json:"visits"`
+	Duration  time.Duration `json:"duration"` // of all the visits
+	LastVisit time.Time     `json:"lastVisit"`
+}
+
+// Parameters of the detection of stays and places
+type PlaceConfig struct {
+	// Type of the location events; all the events with a location if empty.
+	EventType string
+
+	// Fixes less accurate than MaxAccuracy meters are discarded, e.g. indoors, and the others
+	// weighted by their accuracy.
+	MaxAccuracy float64
+
+	// A stay is at least MinStay long with all fixes within StayRadius meters of the first, give
+	// or take their accuracy.  Gaps between fixes longer than MaxGap end a stay, as the source
+	// may have left unseen.
+	StayRadius float64
+	MinStay    time.Duration
+	MaxGap     time.Duration
+
+	// Stays are clustered into places by DBSCAN: a place has at least MinVisits stays, each
+	// within ClusterRadius meters of another.
+	ClusterRadius float64
+	MinVisits     int
+}
+
+// Sanitizes the place config, filling in defaults for values not set.
+func SanitizePlaces(c *PlaceConfig) *PlaceConfig {
+	if c.MaxAccuracy == 0 {
+		c.MaxAccuracy = 200.
+	}
+	if c.StayRadius == 0 {
+		c.StayRadius = 100.
+	}
+	if c.MinStay == 0 {
+		c.MinStay = 10 * time.Minute
+	}
+	if c.MaxGap == 0 {
+		c.MaxGap = time.Hour
+	}
+	if c.ClusterRadius == 0 {
+		c.ClusterRadius = 150.
+	}
+	if c.MinVisits == 0 {
+		c.MinVisits = 2
+	}
+	return c
+}
+
+// Service interface for the places of the sources of location events.
+type PlaceService interface {
+
+	// Detects the stays of the source from all its location events and clusters them into
+	// places, replacing the places detected before.  Places found again keep their ids and
+	// names; named places no longer found are kept without visits.  Returns the places.
+	Detect(source string) ([]Place, error)
+
+	// Returns the places of the source, the most visited first.
+	Places(source string) ([]Place, error)
+
+	// Loads a place by id.  If not found, ErrorNotFound is returned.
+	Read(id Id) (Place, error)
+
+	// Names the place.  An empty name removes it.
+	Name(id Id, name string) (Place, error)
+
+	// Returns the visits of the place in time order.
+	Visits(id Id) ([]Stay, error)
+
+	// Returns the stays of the source overlapping the time range in time order, whether at a
+	// place or not, as of the last detection.
+	Stays(source string, from, to time.Time) ([]Stay, error)
+
+	// Performs any necessary clean up
+	Close()
+}
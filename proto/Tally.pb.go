@@ -13,6 +13,13 @@ It has these top-level messages:
 	Location
 	Attribute
 	Event
+	EventList
+	Cab
+	CabList
+	GeoWithin
+	QueryResult
+	BatchItem
+	BatchResult
 */
 package Tally
 
@@ -25,10 +32,21 @@ var _ = proto.Marshal
 var _ = &json.SyntaxError{}
 var _ = math.Inf
 
+// Content inline, or stored out of line by the hash of its data, e.g. photos and audio notes,
+// for the event to keep only the reference.
 type Content struct {
-	Mime             *string `protobuf:"bytes,1,req,name=mime" json:"mime,omitempty"`
-	Data             []byte  `protobuf:"bytes,2,req,name=data" json:"data,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	Mime *string `protobuf:"bytes,1,req,name=mime" json:"mime,omitempty"`
+	// Empty when stored out of line.  Required still, for readers from before contents were.
+	Data []byte `protobuf:"bytes,2,req,name=data" json:"data,omitempty"`
+	// Hex SHA-256 of the data, served at /v1/content/{hash}, and the size of the data in bytes,
+	// when stored out of line.
+	Hash *string `protobuf:"bytes,3,opt,name=hash" json:"hash,omitempty"`
+	Size *int64  `protobuf:"varint,4,opt,name=size" json:"size,omitempty"`
+	// Pixel dimensions of images, as displayed, and their thumbnails from the smallest.
+	Width            *int32     `protobuf:"varint,5,opt,name=width" json:"width,omitempty"`
+	Height           *int32     `protobuf:"varint,6,opt,name=height" json:"height,omitempty"`
+	Thumbnails       []*Content `protobuf:"bytes,7,rep,name=thumbnails" json:"thumbnails,omitempty"`
+	XXX_unrecognized []byte     `json:"-"`
 }
 
 func (m *Content) Reset()         { *m = Content{} }
@@ -49,11 +67,54 @@ func (m *Content) GetData() []byte {
 	return nil
 }
 
+func (m *Content) GetHash() string {
+	if m != nil && m.Hash != nil {
+		return *m.Hash
+	}
+	return ""
+}
+
+func (m *Content) GetSize() int64 {
+	if m != nil && m.Size != nil {
+		return *m.Size
+	}
+	return 0
+}
+
+func (m *Content) GetWidth() int32 {
+	if m != nil && m.Width != nil {
+		return *m.Width
+	}
+	return 0
+}
+
+func (m *Content) GetHeight() int32 {
+	if m != nil && m.Height != nil {
+		return *m.Height
+	}
+	return 0
+}
+
+func (m *Content) GetThumbnails() []*Content {
+	if m != nil {
+		return m.Thumbnails
+	}
+	return nil
+}
+
 // To be transformed to GeoJson - ex)  {"location" : [-71.34, 41.12]}
 // See http://www.elasticsearch.org/guide/en/elasticsearch/reference/current/mapping-geo-point-type.html
 type Location struct {
-	Lon              *float64 `protobuf:"fixed64,1,req,name=lon" json:"lon,omitempty"`
-	Lat              *float64 `protobuf:"fixed64,2,req,name=lat" json:"lat,omitempty"`
+	Lon *float64 `protobuf:"fixed64,1,req,name=lon" json:"lon,omitempty"`
+	Lat *float64 `protobuf:"fixed64,2,req,name=lat" json:"lat,omitempty"`
+	// Radius in meters of the 68% confidence circle of the fix, e.g. 5 outdoors and 100 or
+	// more indoors.  Fixes without are taken as accurate.
+	Accuracy *float64 `protobuf:"fixed64,3,opt,name=accuracy" json:"accuracy,omitempty"`
+	// Meters above the WGS 84 ellipsoid
+	Altitude *float64 `protobuf:"fixed64,4,opt,name=altitude" json:"altitude,omitempty"`
+	// Meters per second, and degrees clockwise from true north, as reported by the device
+	Speed            *float64 `protobuf:"fixed64,5,opt,name=speed" json:"speed,omitempty"`
+	Heading          *float64 `protobuf:"fixed64,6,opt,name=heading" json:"heading,omitempty"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -75,14 +136,46 @@ func (m *Location) GetLat() float64 {
 	return 0
 }
 
+func (m *Location) GetAccuracy() float64 {
+	if m != nil && m.Accuracy != nil {
+		return *m.Accuracy
+	}
+	return 0
+}
+
+func (m *Location) GetAltitude() float64 {
+	if m != nil && m.Altitude != nil {
+		return *m.Altitude
+	}
+	return 0
+}
+
+func (m *Location) GetSpeed() float64 {
+	if m != nil && m.Speed != nil {
+		return *m.Speed
+	}
+	return 0
+}
+
+func (m *Location) GetHeading() float64 {
+	if m != nil && m.Heading != nil {
+		return *m.Heading
+	}
+	return 0
+}
+
 type Attribute struct {
-	Key              *string  `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
-	StringValue      *string  `protobuf:"bytes,2,opt,name=string_value" json:"string_value,omitempty"`
-	IntValue         *int64   `protobuf:"varint,3,opt,name=int_value" json:"int_value,omitempty"`
-	DoubleValue      *float64 `protobuf:"fixed64,4,opt,name=double_value" json:"double_value,omitempty"`
-	BoolValue        *bool    `protobuf:"varint,5,opt,name=bool_value" json:"bool_value,omitempty"`
-	ContentValue     *Content `protobuf:"bytes,6,opt,name=content_value" json:"content_value,omitempty"`
-	XXX_unrecognized []byte   `json:"-"`
+	Key          *string  `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
+	StringValue  *string  `protobuf:"bytes,2,opt,name=string_value" json:"string_value,omitempty"`
+	IntValue     *int64   `protobuf:"varint,3,opt,name=int_value" json:"int_value,omitempty"`
+	DoubleValue  *float64 `protobuf:"fixed64,4,opt,name=double_value" json:"double_value,omitempty"`
+	BoolValue    *bool    `protobuf:"varint,5,opt,name=bool_value" json:"bool_value,omitempty"`
+	ContentValue *Content `protobuf:"bytes,6,opt,name=content_value" json:"content_value,omitempty"`
+	// Elements of a list value, whose keys are empty, e.g. the people at a meeting.
+	ListValue []*Attribute `protobuf:"bytes,7,rep,name=list_value" json:"list_value,omitempty"`
+	// Entries of a map value, by their keys, e.g. the scores of a game.
+	MapValue         []*Attribute `protobuf:"bytes,8,rep,name=map_value" json:"map_value,omitempty"`
+	XXX_unrecognized []byte       `json:"-"`
 }
 
 func (m *Attribute) Reset()         { *m = Attribute{} }
@@ -131,14 +224,39 @@ func (m *Attribute) GetContentValue() *Content {
 	return nil
 }
 
+func (m *Attribute) GetListValue() []*Attribute {
+	if m != nil {
+		return m.ListValue
+	}
+	return nil
+}
+
+func (m *Attribute) GetMapValue() []*Attribute {
+	if m != nil {
+		return m.MapValue
+	}
+	return nil
+}
+
 type Event struct {
-	Timestamp        *float64     `protobuf:"fixed64,1,req,name=timestamp" json:"timestamp,omitempty"`
-	Type             *string      `protobuf:"bytes,2,req,name=type" json:"type,omitempty"`
-	Source           *string      `protobuf:"bytes,3,req,name=source" json:"source,omitempty"`
-	Context          *string      `protobuf:"bytes,4,opt,name=context" json:"context,omitempty"`
-	Location         *Location    `protobuf:"bytes,5,opt,name=location" json:"location,omitempty"`
-	Attributes       []*Attribute `protobuf:"bytes,6,rep,name=attributes" json:"attributes,omitempty"`
-	XXX_unrecognized []byte       `json:"-"`
+	Timestamp  *float64     `protobuf:"fixed64,1,req,name=timestamp" json:"timestamp,omitempty"`
+	Type       *string      `protobuf:"bytes,2,req,name=type" json:"type,omitempty"`
+	Source     *string      `protobuf:"bytes,3,req,name=source" json:"source,omitempty"`
+	Context    *string      `protobuf:"bytes,4,opt,name=context" json:"context,omitempty"`
+	Location   *Location    `protobuf:"bytes,5,opt,name=location" json:"location,omitempty"`
+	Attributes []*Attribute `protobuf:"bytes,6,rep,name=attributes" json:"attributes,omitempty"`
+	// Nanoseconds since the epoch, exact where the seconds are not.  Read instead of the
+	// timestamp when set; writers set both for older readers.
+	TimeNanos *int64 `protobuf:"varint,7,opt,name=time_nanos" json:"time_nanos,omitempty"`
+	// IANA time zone of the event, e.g. America/New_York, for its local time.
+	TimeZone *string `protobuf:"bytes,8,opt,name=time_zone" json:"time_zone,omitempty"`
+	// Id given by the source.  Events put with the source and id of a stored event replace it.
+	Id   *string  `protobuf:"bytes,9,opt,name=id" json:"id,omitempty"`
+	Tags []string `protobuf:"bytes,10,rep,name=tags" json:"tags,omitempty"`
+	// Length of an interval event, e.g. sleep or a meeting, which ends that long after its
+	// time.  Events without are instants.
+	DurationNanos    *int64 `protobuf:"varint,11,opt,name=duration_nanos" json:"duration_nanos,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
 }
 
 func (m *Event) Reset()         { *m = Event{} }
@@ -187,5 +305,287 @@ func (m *Event) GetAttributes() []*Attribute {
 	return nil
 }
 
+func (m *Event) GetTimeNanos() int64 {
+	if m != nil && m.TimeNanos != nil {
+		return *m.TimeNanos
+	}
+	return 0
+}
+
+func (m *Event) GetTimeZone() string {
+	if m != nil && m.TimeZone != nil {
+		return *m.TimeZone
+	}
+	return ""
+}
+
+func (m *Event) GetId() string {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return ""
+}
+
+func (m *Event) GetTags() []string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *Event) GetDurationNanos() int64 {
+	if m != nil && m.DurationNanos != nil {
+		return *m.DurationNanos
+	}
+	return 0
+}
+
+// Batch of events, for the compact binary encoding of the event endpoints.
+type EventList struct {
+	Events           []*Event `protobuf:"bytes,1,rep,name=events" json:"events,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *EventList) Reset()         { *m = EventList{} }
+func (m *EventList) String() string { return proto.CompactTextString(m) }
+func (*EventList) ProtoMessage()    {}
+
+func (m *EventList) GetEvents() []*Event {
+	if m != nil {
+		return m.Events
+	}
+	return nil
+}
+
+// Position of a cab, for the compact binary encoding of the cab endpoints.
+type Cab struct {
+	Id               *uint64  `protobuf:"varint,1,req,name=id" json:"id,omitempty"`
+	Latitude         *float64 `protobuf:"fixed64,2,req,name=latitude" json:"latitude,omitempty"`
+	Longitude        *float64 `protobuf:"fixed64,3,req,name=longitude" json:"longitude,omitempty"`
+	Status           *string  `protobuf:"bytes,4,opt,name=status" json:"status,omitempty"`
+	Accuracy         *float64 `protobuf:"fixed64,5,opt,name=accuracy" json:"accuracy,omitempty"`
+	Altitude         *float64 `protobuf:"fixed64,6,opt,name=altitude" json:"altitude,omitempty"`
+	Speed            *float64 `protobuf:"fixed64,7,opt,name=speed" json:"speed,omitempty"`
+	Heading          *float64 `protobuf:"fixed64,8,opt,name=heading" json:"heading,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Cab) Reset()         { *m = Cab{} }
+func (m *Cab) String() string { return proto.CompactTextString(m) }
+func (*Cab) ProtoMessage()    {}
+
+func (m *Cab) GetId() uint64 {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return 0
+}
+
+func (m *Cab) GetLatitude() float64 {
+	if m != nil && m.Latitude != nil {
+		return *m.Latitude
+	}
+	return 0
+}
+
+func (m *Cab) GetLongitude() float64 {
+	if m != nil && m.Longitude != nil {
+		return *m.Longitude
+	}
+	return 0
+}
+
+func (m *Cab) GetStatus() string {
+	if m != nil && m.Status != nil {
+		return *m.Status
+	}
+	return ""
+}
+
+func (m *Cab) GetAccuracy() float64 {
+	if m != nil && m.Accuracy != nil {
+		return *m.Accuracy
+	}
+	return 0
+}
+
+func (m *Cab) GetAltitude() float64 {
+	if m != nil && m.Altitude != nil {
+		return *m.Altitude
+	}
+	return 0
+}
+
+func (m *Cab) GetSpeed() float64 {
+	if m != nil && m.Speed != nil {
+		return *m.Speed
+	}
+	return 0
+}
+
+func (m *Cab) GetHeading() float64 {
+	if m != nil && m.Heading != nil {
+		return *m.Heading
+	}
+	return 0
+}
+
+type CabList struct {
+	Cabs             []*Cab `protobuf:"bytes,1,rep,name=cabs" json:"cabs,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *CabList) Reset()         { *m = CabList{} }
+func (m *CabList) String() string { return proto.CompactTextString(m) }
+func (*CabList) ProtoMessage()    {}
+
+func (m *CabList) GetCabs() []*Cab {
+	if m != nil {
+		return m.Cabs
+	}
+	return nil
+}
+
+// Query for the cabs within the radius, in meters, of a location.
+type GeoWithin struct {
+	Latitude         *float64 `protobuf:"fixed64,1,req,name=latitude" json:"latitude,omitempty"`
+	Longitude        *float64 `protobuf:"fixed64,2,req,name=longitude" json:"longitude,omitempty"`
+	Radius           *float64 `protobuf:"fixed64,3,req,name=radius" json:"radius,omitempty"`
+	Limit            *uint32  `protobuf:"varint,4,opt,name=limit,def=8" json:"limit,omitempty"`
+	Model            *string  `protobuf:"bytes,5,opt,name=model" json:"model,omitempty"`
+	MaxAccuracy      *float64 `protobuf:"fixed64,6,opt,name=max_accuracy" json:"max_accuracy,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *GeoWithin) Reset()         { *m = GeoWithin{} }
+func (m *GeoWithin) String() string { return proto.CompactTextString(m) }
+func (*GeoWithin) ProtoMessage()    {}
+
+const Default_GeoWithin_Limit uint32 = 8
+
+func (m *GeoWithin) GetLatitude() float64 {
+	if m != nil && m.Latitude != nil {
+		return *m.Latitude
+	}
+	return 0
+}
+
+func (m *GeoWithin) GetLongitude() float64 {
+	if m != nil && m.Longitude != nil {
+		return *m.Longitude
+	}
+	return 0
+}
+
+func (m *GeoWithin) GetRadius() float64 {
+	if m != nil && m.Radius != nil {
+		return *m.Radius
+	}
+	return 0
+}
+
+func (m *GeoWithin) GetLimit() uint32 {
+	if m != nil && m.Limit != nil {
+		return *m.Limit
+	}
+	return Default_GeoWithin_Limit
+}
+
+func (m *GeoWithin) GetModel() string {
+	if m != nil && m.Model != nil {
+		return *m.Model
+	}
+	return ""
+}
+
+func (m *GeoWithin) GetMaxAccuracy() float64 {
+	if m != nil && m.MaxAccuracy != nil {
+		return *m.MaxAccuracy
+	}
+	return 0
+}
+
+// Cabs found by a query, nearest first.
+type QueryResult struct {
+	Query            *GeoWithin `protobuf:"bytes,1,opt,name=query" json:"query,omitempty"`
+	Cabs             []*Cab     `protobuf:"bytes,2,rep,name=cabs" json:"cabs,omitempty"`
+	XXX_unrecognized []byte     `json:"-"`
+}
+
+func (m *QueryResult) Reset()         { *m = QueryResult{} }
+func (m *QueryResult) String() string { return proto.CompactTextString(m) }
+func (*QueryResult) ProtoMessage()    {}
+
+func (m *QueryResult) GetQuery() *GeoWithin {
+	if m != nil {
+		return m.Query
+	}
+	return nil
+}
+
+func (m *QueryResult) GetCabs() []*Cab {
+	if m != nil {
+		return m.Cabs
+	}
+	return nil
+}
+
+// Status of one cab of a bulk update or batch read.  The status is a http status code.
+type BatchItem struct {
+	Id               *uint64 `protobuf:"varint,1,req,name=id" json:"id,omitempty"`
+	Status           *int32  `protobuf:"varint,2,req,name=status" json:"status,omitempty"`
+	Error            *string `protobuf:"bytes,3,opt,name=error" json:"error,omitempty"`
+	Cab              *Cab    `protobuf:"bytes,4,opt,name=cab" json:"cab,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *BatchItem) Reset()         { *m = BatchItem{} }
+func (m *BatchItem) String() string { return proto.CompactTextString(m) }
+func (*BatchItem) ProtoMessage()    {}
+
+func (m *BatchItem) GetId() uint64 {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return 0
+}
+
+func (m *BatchItem) GetStatus() int32 {
+	if m != nil && m.Status != nil {
+		return *m.Status
+	}
+	return 0
+}
+
+func (m *BatchItem) GetError() string {
+	if m != nil && m.Error != nil {
+		return *m.Error
+	}
+	return ""
+}
+
+func (m *BatchItem) GetCab() *Cab {
+	if m != nil {
+		return m.Cab
+	}
+	return nil
+}
+
+type BatchResult struct {
+	Items            []*BatchItem `protobuf:"bytes,1,rep,name=items" json:"items,omitempty"`
+	XXX_unrecognized []byte       `json:"-"`
+}
+
+func (m *BatchResult) Reset()         { *m = BatchResult{} }
+func (m *BatchResult) String() string { return proto.CompactTextString(m) }
+func (*BatchResult) ProtoMessage()    {}
+
+func (m *BatchResult) GetItems() []*BatchItem {
+	if m != nil {
+		return m.Items
+	}
+	return nil
+}
+
 func init() {
 }
@@ -0,0 +1,159 @@
+package tally
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gyokuro/tally/geo"
+	"time"
+)
+
+// Query for what is within polygons, or within a distance of a route, i.e. a corridor.  Either
+// Polygons or Route is set.  Results within polygons are ordered by id, and within a corridor
+// nearest the route first.  Over http it is a GeoJSON geometry, e.g.
+//
+//	{"geometry": {"type": "LineString", "coordinates": [[-122.42, 37.77], [-122.40, 37.79]]},
+//	 "distance": 300, "unit": "m", "limit": 20, "maxAccuracy": 50}
+//
+// where the geometry is a Polygon or MultiPolygon, with holes, or else a LineString or Point
+// with the distance from it.
+type GeoRegion struct {
+	Polygons geo.MultiPolygon
+	Route    geo.LineString
+	Distance float64 // from the route, in Unit
+	Unit     DistanceUnit
+	Limit    int // zero for no limit
+
+	// Leaves out the cabs whose fix is less accurate than this, in meters; all if zero.
+	MaxAccuracy float64
+}
+
+// Returns ErrorBadParam unless exactly one of the polygons and the route is set, and they have
+// enough positions.
+func (r GeoRegion) Validate() error {
+	if (len(r.Polygons) == 0) == (len(r.Route) == 0) || r.Distance < 0 || r.Limit < 0 || r.MaxAccuracy < 0 {
+		return ErrorBadParam
+	}
+	for _, p := range r.Polygons {
+		if len(p) == 0 {
+			return ErrorBadParam
+		}
+		for _, ring := range p {
+			if len(ring) < 3 {
+				return ErrorBadParam
+			}
+		}
+	}
+	return nil
+}
+
+// Returns true if the location is within the region, and the distance in meters from the route
+// if it is a corridor.
+func (r GeoRegion) Contains(loc Location) (bool, float64) {
+	if len(r.Route) > 0 {
+		d := r.Route.Distance(loc.Latitude, loc.Longitude)
+		return d <= r.Unit.Meters(r.Distance), d
+	}
+	return r.Polygons.Contains(loc.Latitude, loc.Longitude), 0.
+}
+
+// Returns boxes that together enclose the region.
+func (r GeoRegion) Bounds() []geo.Box {
+	if len(r.Route) > 0 {
+		return r.Route.Bounds(r.Unit.Meters(r.Distance))
+	}
+	return r.Polygons.Bounds()
+}
+
+// Geometry and options of a region in json
+type geoRegionJson struct {
+	Geometry struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+	Distance    float64      `json:"distance,omitempty"`
+	Unit        DistanceUnit `json:"unit"`
+	Limit       int          `json:"limit,omitempty"`
+	MaxAccuracy float64      `json:"maxAccuracy,omitempty"`
+}
+
+var errGeometry = errors.New("Geometry must be a Polygon, MultiPolygon, LineString or Point")
+
+// Implements json.Unmarshaler, from a GeoJSON geometry.
+func (r *GeoRegion) UnmarshalJSON(buff []byte) (err error) {
+	j := geoRegionJson{}
+	if err = json.Unmarshal(buff, &j); err != nil {
+		return
+	}
+	region := GeoRegion{Distance: j.Distance, Unit: j.Unit, Limit: j.Limit, MaxAccuracy: j.MaxAccuracy}
+	coordinates := j.Geometry.Coordinates
+	switch j.Geometry.Type {
+	case "MultiPolygon":
+		err = json.Unmarshal(coordinates, &region.Polygons)
+	case "Polygon":
+		p := geo.Polygon{}
+		err = json.Unmarshal(coordinates, &p)
+		region.Polygons = geo.MultiPolygon{p}
+	case "LineString":
+		err = json.Unmarshal(coordinates, &region.Route)
+	case "Point":
+		p := geo.Position{}
+		err = json.Unmarshal(coordinates, &p)
+		region.Route = geo.LineString{p}
+	default:
+		err = errGeometry
+	}
+	if err == nil {
+		err = region.Validate()
+	}
+	if err == nil {
+		*r = region
+	}
+	return
+}
+
+// Implements json.Marshaler, as a GeoJSON MultiPolygon or LineString.
+func (r GeoRegion) MarshalJSON() ([]byte, error) {
+	j := geoRegionJson{Distance: r.Distance, Unit: r.Unit, Limit: r.Limit, MaxAccuracy: r.MaxAccuracy}
+	var coordinates interface{} = r.Polygons
+	j.Geometry.Type = "MultiPolygon"
+	if len(r.Route) > 0 {
+		coordinates, j.Geometry.Type = r.Route, "LineString"
+	}
+	buff, err := json.Marshal(coordinates)
+	if err != nil {
+		return nil, err
+	}
+	j.Geometry.Coordinates = buff
+	return json.Marshal(j)
+}
+
+// Query for stored events.  The fields left empty match all events, and at most one of Within and
+// Region may be set.  Events without a location never match a spatial query.  Interval events
+// match the time range if they overlap it, i.e. start before To and end after From.
+type EventQuery struct {
+	Id     string
+	Type   string
+	Source string
+	Tags   []string  // all of them
+	From   time.Time // inclusive
+	To     time.Time // exclusive
+	Within *GeoWithin
+	Region *GeoRegion
+	Limit  int // zero for no limit
+
+	// Leaves out the events whose location is less accurate than this, in meters; all if zero.
+	// Events without a location or accuracy are kept.
+	MaxAccuracy float64
+}
+
+// Returns ErrorBadParam if both Within and Region are set, the region is invalid, or the limit
+// or accuracy negative.
+func (q EventQuery) Validate() error {
+	if q.Within != nil && q.Region != nil || q.Limit < 0 || q.MaxAccuracy < 0 {
+		return ErrorBadParam
+	}
+	if q.Region != nil {
+		return q.Region.Validate()
+	}
+	return nil
+}
@@ -0,0 +1,614 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/impl"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Limits of the coordinates accepted by redis, which encodes positions as web mercator geohashes.
+const (
+	minLatitude  = -85.05112878
+	maxLatitude  = 85.05112878
+	minLongitude = -180.
+	maxLongitude = 180.
+)
+
+var (
+	errSyntax      = errors.New("ERR syntax error")
+	errNotInteger  = errors.New("ERR value is not an integer or out of range")
+	errNotFloat    = errors.New("ERR value is not a valid float")
+	errCoordinates = errors.New("ERR invalid longitude,latitude pair")
+	errUnit        = errors.New("ERR unsupported unit provided. please use M, KM, FT, MI")
+	errMember      = errors.New("ERR could not decode requested zset member")
+	errReadOnly    = errors.New("ERR only the geo set of the cabs can be written")
+	errStore       = errors.New("ERR STORE and STOREDIST are not supported")
+	errExclusive   = errors.New("ERR XX and NX options at the same time are not compatible")
+)
+
+func errArity(command string) error {
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))
+}
+
+// A command and its minimum number of arguments, including the command name.  The arguments
+// passed to run exclude the command name.
+type command struct {
+	arity int
+	run   func(s *Server, w writer, args []string) error
+}
+
+var commands = map[string]command{
+	"GEOADD":               command{5, geoAdd},
+	"GEOPOS":               command{2, geoPos},
+	"GEODIST":              command{4, geoDist},
+	"GEOHASH":              command{2, geoHash},
+	"GEORADIUS":            command{6, geoRadius},
+	"GEORADIUS_RO":         command{6, geoRadius},
+	"GEORADIUSBYMEMBER":    command{5, geoRadiusByMember},
+	"GEORADIUSBYMEMBER_RO": command{5, geoRadiusByMember},
+	"GEOSEARCH":            command{7, geoSearch},
+	"ZREM":                 command{3, zRem},
+	"DEL":                  command{2, del},
+}
+
+// Parses a member name as a cab id.
+func parseId(member string) (tally.Id, bool) {
+	id, err := strconv.ParseUint(member, 10, 64)
+	return tally.Id(id), err == nil
+}
+
+func parseFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+// Parses a longitude and latitude pair, in the order used by redis.
+func parseLonLat(lon, lat string) (loc tally.Location, err error) {
+	if loc.Longitude, err = parseFloat(lon); err != nil {
+		return
+	}
+	if loc.Latitude, err = parseFloat(lat); err != nil {
+		return
+	}
+	if loc.Longitude < minLongitude || loc.Longitude > maxLongitude ||
+		loc.Latitude < minLatitude || loc.Latitude > maxLatitude {
+		err = errCoordinates
+	}
+	return
+}
+
+func parseUnit(s string) (tally.DistanceUnit, error) {
+	unit, err := tally.ParseDistanceUnit(s)
+	if err != nil || len(s) > 2 {
+		return 0, errUnit // only the symbols, as in redis
+	}
+	return unit, nil
+}
+
+func formatCoordinate(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatDistance(f float64) string {
+	return strconv.FormatFloat(f, 'f', 4, 64)
+}
+
+// Reads the cabs named by the members.  Members that are not cab ids, or not found, are
+// returned as not found, and so are all members of keys other than the server's.
+func (s *Server) members(key string, members []string) (cabs []tally.Cab, found []bool, err error) {
+	cabs = make([]tally.Cab, len(members))
+	found = make([]bool, len(members))
+	if key != s.Key {
+		return
+	}
+	ids := make([]tally.Id, 0, len(members))
+	index := make([]int, 0, len(members))
+	for i, member := range members {
+		if id, ok := parseId(member); ok {
+			ids = append(ids, id)
+			index = append(index, i)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	read, errs, err := s.Service.ReadBatch(ids)
+	if err != nil {
+		return
+	}
+	for j, i := range index {
+		if errs[j] == nil {
+			cabs[i], found[i] = read[j], true
+		} else if errs[j] != tally.ErrorNotFound {
+			return nil, nil, errs[j]
+		}
+	}
+	return
+}
+
+// GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+// Replies the number of cabs added, or also changed with CH.
+func geoAdd(s *Server, w writer, args []string) error {
+	key, args := args[0], args[1:]
+	nx, xx, ch := false, false, false
+options:
+	for len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		default:
+			break options
+		}
+		args = args[1:]
+	}
+	if nx && xx {
+		return errExclusive
+	}
+	if len(args) == 0 || len(args)%3 != 0 {
+		return errSyntax
+	}
+	if key != s.Key {
+		return errReadOnly
+	}
+
+	members := make([]string, 0, len(args)/3)
+	updates := make([]tally.Cab, 0, len(args)/3)
+	for i := 0; i < len(args); i += 3 {
+		loc, err := parseLonLat(args[i], args[i+1])
+		if err != nil {
+			return err
+		}
+		id, ok := parseId(args[i+2])
+		if !ok {
+			return errMember
+		}
+		members = append(members, args[i+2])
+		updates = append(updates, tally.Cab{Id: id, Latitude: loc.Latitude, Longitude: loc.Longitude})
+	}
+	existing, found, err := s.members(key, members)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	cabs := make([]tally.Cab, 0, len(updates))
+	for i, cab := range updates {
+		if (nx && found[i]) || (xx && !found[i]) {
+			continue
+		}
+		if !found[i] || (ch && (existing[i].Latitude != cab.Latitude || existing[i].Longitude != cab.Longitude)) {
+			count++
+		}
+		cabs = append(cabs, cab)
+	}
+	if len(cabs) > 0 {
+		errs, err := s.Service.UpsertBatch(cabs)
+		if err != nil {
+			return err
+		}
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+	}
+	w.integer(count)
+	return nil
+}
+
+// GEOPOS key member [member ...]
+// Replies the longitude and latitude of each member, or nil if not found.
+func geoPos(s *Server, w writer, args []string) error {
+	cabs, found, err := s.members(args[0], args[1:])
+	if err != nil {
+		return err
+	}
+	w.array(len(cabs))
+	for i, cab := range cabs {
+		if !found[i] {
+			w.nilArray()
+			continue
+		}
+		w.array(2)
+		w.bulk(formatCoordinate(cab.Longitude))
+		w.bulk(formatCoordinate(cab.Latitude))
+	}
+	return nil
+}
+
+// GEODIST key member1 member2 [M|KM|FT|MI]
+// Replies the distance between the members, or nil if either is not found.
+func geoDist(s *Server, w writer, args []string) error {
+	unit := tally.Meters
+	switch len(args) {
+	case 3:
+	case 4:
+		var err error
+		if unit, err = parseUnit(args[3]); err != nil {
+			return err
+		}
+	default:
+		return errSyntax
+	}
+	cabs, found, err := s.members(args[0], args[1:3])
+	if err != nil {
+		return err
+	}
+	if !found[0] || !found[1] {
+		w.nilBulk()
+		return nil
+	}
+	w.bulk(formatDistance(impl.Haversine(location(cabs[0]), location(cabs[1]), unit)))
+	return nil
+}
+
+// GEOHASH key member [member ...]
+// Replies the standard 11 character geohash of each member, or nil if not found.  Unlike redis,
+// which pads its 52 bits with a zero, the last character holds the position too.
+func geoHash(s *Server, w writer, args []string) error {
+	cabs, found, err := s.members(args[0], args[1:])
+	if err != nil {
+		return err
+	}
+	w.array(len(cabs))
+	for i, cab := range cabs {
+		if found[i] {
+			w.bulk(geo.Geohash(cab.Latitude, cab.Longitude, 11))
+		} else {
+			w.nilBulk()
+		}
+	}
+	return nil
+}
+
+// ZREM key member [member ...]
+// Replies the number of cabs removed.
+func zRem(s *Server, w writer, args []string) error {
+	cabs, found, err := s.members(args[0], args[1:])
+	if err != nil {
+		return err
+	}
+	count := 0
+	for i, cab := range cabs {
+		if !found[i] {
+			continue
+		}
+		if err = s.Service.Delete(cab.Id); err == nil {
+			count++
+		} else if err != tally.ErrorNotFound {
+			return err
+		}
+	}
+	w.integer(count)
+	return nil
+}
+
+// DEL key [key ...]
+// Removes all cabs if the key of the cabs is given.  Replies the number of keys removed, which
+// does not count the key of the cabs if there were none, as redis does not count missing keys.
+func del(s *Server, w writer, args []string) error {
+	count := 0
+	for _, key := range args {
+		if key == s.Key && count == 0 {
+			// Any cab where redis keeps them, the poles left out for mongo to take the polygons
+			world := tally.HeatmapQuery{Bounds: geo.Box{
+				South: minLatitude, West: minLongitude, North: maxLatitude, East: maxLongitude,
+			}}.Region()
+			world.Limit = 1
+			cabs, err := s.Service.QueryRegion(world)
+			if err != nil {
+				return err
+			}
+			if len(cabs) == 0 {
+				break
+			}
+			if err := s.Service.DeleteAll(); err != nil {
+				return err
+			}
+			count++
+		}
+	}
+	w.integer(count)
+	return nil
+}
+
+// Parameters of a search by radius or box
+type search struct {
+	center        tally.Location
+	radius        float64 // radius of the circle, or zero for a box
+	width, height float64 // size of the box
+	unit          tally.DistanceUnit
+	count         int // zero for all
+	desc          bool
+	withCoord     bool
+	withDist      bool
+	withHash      bool
+}
+
+// A cab found by a search, with its distance from the center
+type result struct {
+	cab      tally.Cab
+	distance float64
+}
+
+type byDistance []result
+
+func (s byDistance) Len() int           { return len(s) }
+func (s byDistance) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDistance) Less(i, j int) bool { return s[i].distance < s[j].distance }
+
+// Parses the options common to the search commands.  GEOSEARCH does not accept STORE.
+func (q *search) parseOptions(args []string, store bool) error {
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WITHCOORD":
+			q.withCoord = true
+		case "WITHDIST":
+			q.withDist = true
+		case "WITHHASH":
+			q.withHash = true
+		case "ASC":
+			q.desc = false
+		case "DESC":
+			q.desc = true
+		case "ANY":
+			if q.count == 0 {
+				return errors.New("ERR the ANY argument requires COUNT argument")
+			}
+		case "COUNT":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil {
+				return errNotInteger
+			}
+			if n <= 0 {
+				return errors.New("ERR COUNT must be > 0")
+			}
+			q.count = n
+		case "STORE", "STOREDIST":
+			if store {
+				return errStore
+			}
+			return errSyntax
+		default:
+			return errSyntax
+		}
+	}
+	return nil
+}
+
+// Parses a positive distance and its unit.
+func parseDistance(d, unit string) (float64, tally.DistanceUnit, error) {
+	f, err := parseFloat(d)
+	if err != nil {
+		return 0, 0, err
+	}
+	if f < 0 {
+		return 0, 0, errors.New("ERR radius cannot be negative")
+	}
+	u, err := parseUnit(unit)
+	return f, u, err
+}
+
+// Returns the location of the member, for the searches from a member.
+func (s *Server) memberLocation(key, member string) (loc tally.Location, err error) {
+	cabs, found, err := s.members(key, []string{member})
+	if err != nil {
+		return
+	}
+	if !found[0] {
+		return loc, errMember
+	}
+	return location(cabs[0]), nil
+}
+
+// GEORADIUS key longitude latitude radius M|KM|FT|MI [WITHCOORD] [WITHDIST] [WITHHASH]
+// [COUNT count [ANY]] [ASC|DESC]
+func geoRadius(s *Server, w writer, args []string) (err error) {
+	q := search{}
+	if q.center, err = parseLonLat(args[1], args[2]); err != nil {
+		return
+	}
+	if q.radius, q.unit, err = parseDistance(args[3], args[4]); err != nil {
+		return
+	}
+	if err = q.parseOptions(args[5:], true); err != nil {
+		return
+	}
+	return s.search(w, args[0], q)
+}
+
+// GEORADIUSBYMEMBER key member radius M|KM|FT|MI [WITHCOORD] [WITHDIST] [WITHHASH]
+// [COUNT count [ANY]] [ASC|DESC]
+func geoRadiusByMember(s *Server, w writer, args []string) (err error) {
+	q := search{}
+	if q.radius, q.unit, err = parseDistance(args[2], args[3]); err != nil {
+		return
+	}
+	if err = q.parseOptions(args[4:], true); err != nil {
+		return
+	}
+	if args[0] != s.Key {
+		w.array(0)
+		return
+	}
+	if q.center, err = s.memberLocation(args[0], args[1]); err != nil {
+		return
+	}
+	return s.search(w, args[0], q)
+}
+
+// GEOSEARCH key FROMMEMBER member|FROMLONLAT longitude latitude
+// BYRADIUS radius M|KM|FT|MI|BYBOX width height M|KM|FT|MI
+// [ASC|DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func geoSearch(s *Server, w writer, args []string) (err error) {
+	q := search{}
+	key, args := args[0], args[1:]
+	fromMember := ""
+	from, by := false, false
+	options := []string{}
+	for len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "FROMMEMBER":
+			if from || len(args) < 2 {
+				return errSyntax
+			}
+			fromMember, from, args = args[1], true, args[2:]
+		case "FROMLONLAT":
+			if from || len(args) < 3 {
+				return errSyntax
+			}
+			if q.center, err = parseLonLat(args[1], args[2]); err != nil {
+				return
+			}
+			from, args = true, args[3:]
+		case "BYRADIUS":
+			if by || len(args) < 3 {
+				return errSyntax
+			}
+			if q.radius, q.unit, err = parseDistance(args[1], args[2]); err != nil {
+				return
+			}
+			by, args = true, args[3:]
+		case "BYBOX":
+			if by || len(args) < 4 {
+				return errSyntax
+			}
+			if q.width, q.unit, err = parseDistance(args[1], args[3]); err != nil {
+				return
+			}
+			if q.height, _, err = parseDistance(args[2], args[3]); err != nil {
+				return
+			}
+			by, args = true, args[4:]
+		default:
+			options, args = append(options, args[0]), args[1:]
+		}
+	}
+	if !from {
+		return errors.New("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH")
+	}
+	if !by {
+		return errors.New("ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH")
+	}
+	if err = q.parseOptions(options, false); err != nil {
+		return
+	}
+	if key != s.Key {
+		w.array(0)
+		return
+	}
+	if fromMember != "" {
+		if q.center, err = s.memberLocation(key, fromMember); err != nil {
+			return
+		}
+	}
+	return s.search(w, key, q)
+}
+
+// Queries the cabs within the circle enclosing the search area, filters those outside a box,
+// and replies the members sorted by distance.
+func (s *Server) search(w writer, key string, q search) error {
+	if key != s.Key {
+		w.array(0)
+		return nil
+	}
+	box := q.radius == 0 && (q.width > 0 || q.height > 0)
+	query := tally.GeoWithin{Center: q.center, Radius: q.radius, Unit: q.unit, Limit: math.MaxInt32}
+	if box {
+		query.Radius = math.Sqrt(q.width*q.width+q.height*q.height) / 2.
+	} else if q.count > 0 && !q.desc {
+		query.Limit = q.count
+	}
+	cabs, err := s.Service.Query(query)
+	if err != nil {
+		return err
+	}
+
+	results := make([]result, 0, len(cabs))
+	for _, cab := range cabs {
+		loc := location(cab)
+		if box {
+			// Distances along the meridian and the parallel of the cab
+			corner := tally.Location{Latitude: loc.Latitude, Longitude: q.center.Longitude}
+			if impl.Haversine(q.center, corner, q.unit) > q.height/2. ||
+				impl.Haversine(corner, loc, q.unit) > q.width/2. {
+				continue
+			}
+		}
+		results = append(results, result{cab, impl.Haversine(q.center, loc, q.unit)})
+	}
+	if q.desc {
+		sort.Sort(sort.Reverse(byDistance(results)))
+	} else {
+		sort.Sort(byDistance(results))
+	}
+	if q.count > 0 && len(results) > q.count {
+		results = results[:q.count]
+	}
+
+	w.array(len(results))
+	for _, r := range results {
+		member := strconv.FormatUint(uint64(r.cab.Id), 10)
+		n := 1
+		for _, with := range []bool{q.withDist, q.withHash, q.withCoord} {
+			if with {
+				n++
+			}
+		}
+		if n == 1 {
+			w.bulk(member)
+			continue
+		}
+		w.array(n)
+		w.bulk(member)
+		if q.withDist {
+			w.bulk(formatDistance(r.distance))
+		}
+		if q.withHash {
+			w.integer(int(geohash(location(r.cab))))
+		}
+		if q.withCoord {
+			w.array(2)
+			w.bulk(formatCoordinate(r.cab.Longitude))
+			w.bulk(formatCoordinate(r.cab.Latitude))
+		}
+	}
+	return nil
+}
+
+func location(cab tally.Cab) tally.Location {
+	return tally.Location{Latitude: cab.Latitude, Longitude: cab.Longitude}
+}
+
+// Returns the 52 bit geohash used by redis as the score of a member: 26 bits each of the
+// latitude, within the web mercator limits, and the longitude, interleaved.
+func geohash(loc tally.Location) uint64 {
+	lat := uint64((loc.Latitude - minLatitude) / (maxLatitude - minLatitude) * (1 << 26))
+	lon := uint64((loc.Longitude - minLongitude) / (maxLongitude - minLongitude) * (1 << 26))
+	return interleave(lat, lon)
+}
+
+// Interleaves the low 26 bits of x into the even bits and of y into the odd bits.
+func interleave(x, y uint64) (bits uint64) {
+	for i := uint(0); i < 26; i++ {
+		bits |= (x>>i&1)<<(2*i) | (y>>i&1)<<(2*i+1)
+	}
+	return
+}
@@ -0,0 +1,111 @@
+// Package resp implements a subset of the Redis protocol (RESP) for the geo commands, so that
+// redis clients and tools can query and update the cabs of any tally.CabService.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	errProtocol = errors.New("Protocol error")
+)
+
+// Maximum size of a bulk string or an array in a request
+const maxBulk = 1 << 20
+
+// Arguments of a command allocated up front
+const maxPrealloc = 64
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Reads a command, either a RESP array of bulk strings as sent by clients, or an inline
+// command line as typed in a telnet session.
+func readCommand(r *bufio.Reader) (args []string, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxBulk {
+		return nil, errProtocol
+	}
+	// Allocated as the arguments come, not by the length claimed
+	args = make([]string, 0, minInt(n, maxPrealloc))
+	for i := 0; i < n; i++ {
+		if line, err = readLine(r); err != nil {
+			return
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		size, e := strconv.Atoi(line[1:])
+		if e != nil || size < 0 || size > maxBulk {
+			return nil, errProtocol
+		}
+		buff := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buff); err != nil {
+			return
+		}
+		if buff[size] != '\r' || buff[size+1] != '\n' {
+			return nil, errProtocol
+		}
+		args = append(args, string(buff[:size]))
+	}
+	return
+}
+
+// Reads a line terminated by CRLF, or by LF alone for inline commands.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Writes the replies of the RESP protocol.  Errors are kept by the underlying bufio.Writer
+// and returned on Flush.
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w writer) error(s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func (w writer) integer(n int) {
+	w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w writer) bulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w writer) nilBulk() {
+	w.WriteString("$-1\r\n")
+}
+
+// Starts an array reply of n elements, which must be written next.
+func (w writer) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w writer) nilArray() {
+	w.WriteString("*-1\r\n")
+}
@@ -0,0 +1,35 @@
+package resp
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(test *testing.T) {
+	read := func(s string) ([]string, error) {
+		return readCommand(bufio.NewReader(strings.NewReader(s)))
+	}
+	args, err := read("*2\r\n$4\r\nPING\r\n$2\r\nhi\r\n")
+	if err != nil || !reflect.DeepEqual(args, []string{"PING", "hi"}) {
+		test.Error("Expecting the arguments", args, err)
+	}
+	args, err = read("GEOPOS cabs 1\r\n")
+	if err != nil || !reflect.DeepEqual(args, []string{"GEOPOS", "cabs", "1"}) {
+		test.Error("Expecting the inline arguments", args, err)
+	}
+
+	// Negative and oversized lengths of arrays and bulk strings are protocol errors, not panics
+	for _, bad := range []string{"*-1\r\n", "*-5\r\n", "*2097152\r\n", "*1\r\n$-1\r\n", "*1\r\n$-7\r\n",
+		"*1\r\n$2097152\r\n", "*1\r\n$3\r\nabcde\r\n", "*x\r\n"} {
+		if args, err := read(bad); err != errProtocol {
+			test.Errorf("Expecting a protocol error for %q, got %v %v", bad, args, err)
+		}
+	}
+
+	// A large array claimed is not allocated up front
+	if _, err := read("*1000000\r\n$4\r\nPING\r\n"); err == nil {
+		test.Error("Expecting the missing arguments to fail")
+	}
+}
@@ -0,0 +1,173 @@
+package resp
+
+import (
+	"bufio"
+	"github.com/gyokuro/tally"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Server speaking the Redis protocol on top of a CabService.  The cabs are the members of a
+// single geo set named by Key; member names are the cab ids in decimal.  Reads of other keys
+// return empty replies, as redis does for keys that do not exist, while writes are rejected.
+type Server struct {
+	Service tally.CabService
+	Key     string
+
+	lock     sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+// Constructor method.  Returns a server for the cabs of the service as the geo set key.
+func NewServer(service tally.CabService, key string) *Server {
+	return &Server{
+		Service: service,
+		Key:     key,
+		conns:   make(map[net.Conn]bool),
+	}
+}
+
+// Listens on the tcp address and serves connections until closed.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serves connections from the listener until closed.  Returns nil if stopped by Close.
+func (s *Server) Serve(listener net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.lock.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Implements io.Closer.  Stops the listener and closes all connections.  The service is
+// not closed.
+func (s *Server) Close() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return
+}
+
+// Reads and executes the commands of a connection.  Replies to pipelined commands are
+// flushed together once all commands read so far are executed.
+func (s *Server) serveConn(conn net.Conn) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = true
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := writer{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if err == errProtocol {
+			w.error("ERR " + err.Error())
+			w.Flush()
+			return
+		} else if err != nil {
+			if err != io.EOF {
+				log.Println("Warning: resp connection failed", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.execute(w, args)
+		if r.Buffered() == 0 || quit {
+			if err = w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// Executes the command and writes its reply.  Returns true if the connection should be closed.
+func (s *Server) execute(w writer, args []string) (quit bool) {
+	name := strings.ToUpper(args[0])
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			w.bulk(args[1])
+		} else {
+			w.simple("PONG")
+		}
+		return
+	case "ECHO":
+		if len(args) != 2 {
+			w.error(errArity(args[0]).Error())
+		} else {
+			w.bulk(args[1])
+		}
+		return
+	case "QUIT":
+		w.simple("OK")
+		return true
+	case "SELECT":
+		w.simple("OK")
+		return
+	case "COMMAND":
+		w.array(0)
+		return
+	}
+
+	command, exists := commands[name]
+	if !exists {
+		w.error("ERR unknown command '" + args[0] + "'")
+		return
+	}
+	if len(args) < command.arity {
+		w.error(errArity(args[0]).Error())
+		return
+	}
+	if err := command.run(s, w, args[1:]); err != nil {
+		w.error(err.Error())
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/impl"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// Minimal client sending commands and reading replies as strings, ints, nils and slices.
+type testClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *testClient) do(test *testing.T, args ...string) interface{} {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		test.Fatal("Write failed", err)
+	}
+	reply, err := c.reply()
+	if err != nil {
+		test.Fatal("Read failed", err)
+	}
+	return reply
+}
+
+func (c *testClient) reply() (interface{}, error) {
+	line, err := readLine(c.r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return errors.New(line[1:]), nil
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '$':
+		if line == "$-1" {
+			return nil, nil
+		}
+		s, err := readLine(c.r)
+		return s, err
+	case '*':
+		if line == "*-1" {
+			return nil, nil
+		}
+		n, _ := strconv.Atoi(line[1:])
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = c.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	return nil, errProtocol
+}
+
+func startServer(test *testing.T) (*Server, *testClient) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	server := NewServer(impl.NewSimpleCabService(), "cabs")
+	go server.Serve(listener)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		test.Fatal(err)
+	}
+	return server, &testClient{conn, bufio.NewReader(conn)}
+}
+
+func lonLat(lon, lat float64) tally.Location {
+	return tally.Location{Latitude: lat, Longitude: lon}
+}
+
+func expect(test *testing.T, got, expected interface{}) {
+	if !reflect.DeepEqual(got, expected) {
+		test.Errorf("Expecting %#v, got %#v", expected, got)
+	}
+}
+
+func TestGeoCommands(test *testing.T) {
+	server, c := startServer(test)
+	defer server.Close()
+
+	expect(test, c.do(test, "PING"), "PONG")
+	expect(test, c.do(test, "GEOADD", "cabs", "-122.4194", "37.7749", "1", "-122.4313", "37.7739", "2"), 2)
+	expect(test, c.do(test, "GEOADD", "cabs", "NX", "-122.0", "37.0", "1", "-122.2711", "37.8044", "3"), 1)
+	expect(test, c.do(test, "GEOADD", "cabs", "XX", "CH", "-122.4194", "37.7749", "1", "0", "0", "4"), 0)
+	expect(test, c.do(test, "GEOADD", "other", "0", "0", "5"), errors.New(errReadOnly.Error()))
+	expect(test, c.do(test, "GEOADD", "cabs", "0", "89", "5"), errors.New(errCoordinates.Error()))
+
+	expect(test, c.do(test, "GEOPOS", "cabs", "1", "4", "x"),
+		[]interface{}{[]interface{}{"-122.4194", "37.7749"}, nil, nil})
+	expect(test, c.do(test, "GEODIST", "cabs", "1", "4"), nil)
+	if d, err := strconv.ParseFloat(c.do(test, "GEODIST", "cabs", "1", "2", "km").(string), 64); err != nil || d < 1.0 || d > 1.1 {
+		test.Error("Expecting about 1.05 km", d, err)
+	}
+	expect(test, c.do(test, "GEOHASH", "cabs", "1"), []interface{}{"9q8yyk8ytpx"})
+
+	expect(test, c.do(test, "GEORADIUS", "cabs", "-122.4194", "37.7749", "5", "km"), []interface{}{"1", "2"})
+	expect(test, c.do(test, "GEORADIUS", "cabs", "-122.4194", "37.7749", "20", "km", "DESC", "COUNT", "2"),
+		[]interface{}{"3", "2"})
+	expect(test, c.do(test, "GEORADIUSBYMEMBER", "cabs", "2", "5", "km", "WITHCOORD", "COUNT", "1"),
+		[]interface{}{[]interface{}{"2", []interface{}{"-122.4313", "37.7739"}}})
+	expect(test, c.do(test, "GEOSEARCH", "cabs", "FROMLONLAT", "-122.4194", "37.7749", "BYRADIUS", "20", "km",
+		"ASC", "WITHDIST", "COUNT", "1"), []interface{}{[]interface{}{"1", "0.0000"}})
+	// The box is too narrow for cabs 2 and 3, which lie to the west and east
+	expect(test, c.do(test, "GEOSEARCH", "cabs", "FROMMEMBER", "1", "BYBOX", "1", "100", "km"), []interface{}{"1"})
+	expect(test, c.do(test, "GEORADIUS", "other", "-122.4194", "37.7749", "5", "km"), []interface{}{})
+
+	expect(test, c.do(test, "ZREM", "cabs", "2", "4"), 1)
+	expect(test, c.do(test, "GEOPOS", "cabs", "2"), []interface{}{nil})
+	expect(test, c.do(test, "DEL", "cabs"), 1)
+	expect(test, c.do(test, "DEL", "cabs", "other"), 0)
+	expect(test, c.do(test, "GEORADIUS", "cabs", "-122.4194", "37.7749", "20", "km"), []interface{}{})
+	expect(test, c.do(test, "QUIT"), "OK")
+}
+
+func TestGeohash(test *testing.T) {
+	// Score of Palermo in the redis documentation of GEOADD
+	if h := geohash(lonLat(13.361389, 38.115556)); h != 3479099956230698 {
+		test.Error("Expecting redis score", h)
+	}
+}
@@ -0,0 +1,112 @@
+package tally
+
+import (
+	"time"
+)
+
+// States of a ride.  A ride is requested, assigned to a cab, picked up, and then completed.
+// It can be cancelled any time before it is picked up.
+type RideState string
+
+const (
+	RideRequested RideState = "requested"
+	RideAssigned  RideState = "assigned"
+	RidePickedUp  RideState = "pickedup"
+	RideCompleted RideState = "completed"
+	RideCancelled RideState = "cancelled"
+)
+
+// Valid transitions from each state
+var rideTransitions = map[RideState][]RideState{
+	RideRequested: []RideState{RideAssigned, RideCancelled},
+	RideAssigned:  []RideState{RidePickedUp, RideCancelled},
+	RidePickedUp:  []RideState{RideCompleted},
+}
+
+// Returns true if a ride in this state can change to the given state.
+func (s RideState) CanTransition(to RideState) bool {
+	for _, next := range rideTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Status a cab should have while its ride is in this state.
+func (s RideState) CabStatus() CabStatus {
+	switch s {
+	case RideAssigned:
+		return CabDispatched
+	case RidePickedUp:
+		return CabOccupied
+	default:
+		return CabAvailable
+	}
+}
+
+// Position of a cab at a point in time, recorded while a ride is in progress.  The accuracy is of
+// the fix, and zero if the cab did not report it.
+type TrackPoint struct {
+	Location
+	Time     time.Time `json:"time"`
+	Accuracy float64   `json:"accuracy,omitempty"` // in meters
+}
+
+// A ride from the request until the rider is dropped off.  Timestamps are set when the ride
+// enters each state; the pickup and dropoff locations are where the cab was at the time.
+// The track holds the positions from pick up to drop off, for computing the fare.
+type Ride struct {
+	Id        Id           `json:"id"`
+	Rider     string       `json:"rider"`
+	Cab       Id           `json:"cab,omitempty"`
+	State     RideState    `json:"state"`
+	Origin    Location     `json:"origin"` // requested pickup location
+	Pickup    *Location    `json:"pickup,omitempty"`
+	Dropoff   *Location    `json:"dropoff,omitempty"`
+	Requested time.Time    `json:"requested"`
+	Assigned  *time.Time   `json:"assigned,omitempty"`
+	PickedUp  *time.Time   `json:"pickedUp,omitempty"`
+	Completed *time.Time   `json:"completed,omitempty"`
+	Cancelled *time.Time   `json:"cancelled,omitempty"`
+	Track     []TrackPoint `json:"track,omitempty"`
+}
+
+// Request to change the state of a ride.  The cab is required when assigning; the location
+// is optional and defaults to the cab's current position for pick up and drop off.
+type RideTransition struct {
+	State    RideState `json:"state"`
+	Cab      Id        `json:"cab,omitempty"`
+	Location *Location `json:"location,omitempty"`
+}
+
+// Service interface for storing rides and changing their states.  Changing the state of a
+// ride also updates the status of its cab in the CabService.
+type RideService interface {
+
+	// Creates a ride in the requested state.  Returns the ride with the id assigned.
+	Create(ride Ride) (Ride, error)
+
+	// Loads a ride by id.  If not found, ErrorNotFound is returned.
+	Read(id Id) (Ride, error)
+
+	// Updates the rider and origin of a ride.  Only a ride not yet assigned can be updated;
+	// otherwise ErrorInvalidState is returned.
+	Update(ride Ride) (Ride, error)
+
+	// Deletes the ride by id.
+	Delete(id Id) error
+
+	// Changes the state of the ride.  Invalid transitions return ErrorInvalidState, as does
+	// assigning a cab that is on another ride, occupied or off duty; assigning a cab not found
+	// returns ErrorBadParam.  A cab whose status cannot be updated once the ride changed, e.g. as
+	// it expired, is logged and does not fail the transition.
+	Transition(id Id, transition RideTransition) (Ride, error)
+
+	// Appends the positions to the track of a ride in progress.  If the ride is not picked up,
+	// ErrorInvalidState is returned.
+	Track(id Id, points []TrackPoint) (Ride, error)
+
+	// Performs any necessary clean up
+	Close()
+}
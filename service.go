@@ -2,24 +2,50 @@ package tally
 
 import (
 	"errors"
+	"github.com/gyokuro/tally/geo"
 	"github.com/gyokuro/tally/proto"
+	"time"
 )
 
 var (
-	ErrorNotFound = errors.New("Not found")
-	ErrorBadParam = errors.New("Bad parameter")
+	ErrorNotFound     = errors.New("Not found")
+	ErrorBadParam     = errors.New("Bad parameter")
+	ErrorInvalidState = errors.New("Invalid state")
 )
 
 // Location by lat, lng
 type Location struct {
-	Latitude  float64
-	Longitude float64
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
 }
 
 type EventService interface {
 	Put(events []Tally.Event) error
 }
 
+// Event service that keeps the events for querying.  Events put with the source and id of a
+// stored event replace it, e.g. for a calendar to correct a meeting that moved.
+type EventStore interface {
+	EventService
+
+	// Finds the events matching the query, in the order of their timestamps.  If none, returns
+	// an empty list.
+	Find(query EventQuery) ([]Tally.Event, error)
+
+	// Counts the events matching the query in the box per cell of the grid, so that densities
+	// are found without loading the events.  Events without a location are left out, and the
+	// limit is ignored.  Cells are ordered by row and column.
+	Count(query EventQuery, box geo.Box, grid Grid) ([]GridCell, error)
+
+	// Removes the events matching the query by id, type, source, tags and time range, e.g.
+	// derived events before they are derived again.  Returns the number removed.  Spatial
+	// filters and limits are not supported and return ErrorBadParam.
+	Remove(query EventQuery) (int, error)
+
+	// Performs any necessary clean up
+	Close()
+}
+
 // Typedef of Id, using 64 bit unsigned int.
 type Id uint64
 
@@ -34,11 +60,39 @@ const (
 	Miles
 )
 
+// Availability of a cab for dispatch.  An empty status is the same as available.
+type CabStatus string
+
+const (
+	CabAvailable  CabStatus = "available"
+	CabDispatched CabStatus = "dispatched" // on the way to pick up a rider
+	CabOccupied   CabStatus = "occupied"
+	CabOffDuty    CabStatus = "offduty"
+)
+
 // Cab strcture for minimum of id and location
+// An update without a status keeps the status the cab already has.  The accuracy, altitude, speed
+// and heading are of the last fix, and zero if the cab did not report them.
 type Cab struct {
-	Id        Id      `json:"id"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+	Id        Id        `json:"id"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Status    CabStatus `json:"status,omitempty"`
+	Accuracy  float64   `json:"accuracy,omitempty"` // in meters
+	Altitude  float64   `json:"altitude,omitempty"` // in meters
+	Speed     float64   `json:"speed,omitempty"`    // in meters per second
+	Heading   float64   `json:"heading,omitempty"`  // in degrees from north
+}
+
+// Returns true unless the maximum accuracy is set and the cab is less accurate.  Cabs without an
+// accuracy are taken as accurate.
+func (c Cab) AccurateTo(maxAccuracy float64) bool {
+	return maxAccuracy <= 0 || c.Accuracy <= maxAccuracy
+}
+
+// Returns true if the cab can be dispatched to a rider.
+func (c Cab) Available() bool {
+	return c.Status == "" || c.Status == CabAvailable
 }
 
 // Structure for capturing the query parameters for within or proximity computation
@@ -47,6 +101,43 @@ type GeoWithin struct {
 	Radius float64
 	Unit   DistanceUnit
 	Limit  int
+	Model  geo.Model // of the distances to the center; that of the service by default
+
+	// Leaves out the fixes less accurate than this, in meters, e.g. of cabs in garages; all if
+	// zero.
+	MaxAccuracy float64
+}
+
+// Notification emitted when a cab has not reported within the expiry TTL and has been removed.
+type CabOffline struct {
+	Id       Id        `json:"id"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// Settings for the automatic expiry of cabs that stop reporting their positions.
+// Every Upsert records the time the cab was last seen.  Cabs not seen within TTL are
+// excluded from queries and removed by a background reaper.
+type Expiry struct {
+	// Time to live since the last update.  Zero disables expiry.
+	TTL time.Duration
+
+	// How often the reaper runs.  Defaults to a tenth of the TTL.
+	Reap time.Duration
+
+	// Optional channel for offline notifications.  The reaper blocks on send until the
+	// service is closed, so the channel must be drained by the consumer.
+	Offline chan<- CabOffline
+}
+
+// Returns the reaper interval, applying the default if not set.
+func (e Expiry) ReapInterval() time.Duration {
+	if e.Reap > 0 {
+		return e.Reap
+	}
+	if e.TTL >= 10*time.Millisecond {
+		return e.TTL / 10
+	}
+	return time.Millisecond
 }
 
 // Service interface implemented by various backend datastores.
@@ -59,12 +150,28 @@ type CabService interface {
 	// Insert or update a cab
 	Upsert(cab Cab) error
 
+	// Sets the status of a cab, keeping its position, the rest of its last fix and the time it was
+	// last seen, e.g. as it is dispatched.  If not found, a ErrorNotFound must be returned.
+	SetStatus(id Id, status CabStatus) error
+
+	// Inserts or updates a batch of cabs.  The returned errors correspond to the cabs by position,
+	// with nil for each cab stored.  The error is non-nil only if the batch as a whole failed.
+	UpsertBatch(cabs []Cab) ([]error, error)
+
+	// Loads a batch of cabs by id.  The returned cabs and errors correspond to the ids by position,
+	// with ErrorNotFound for each id not found.  The error is non-nil only if the batch as a whole failed.
+	ReadBatch(ids []Id) ([]Cab, []error, error)
+
 	// Deletes the cab by Id
 	Delete(id Id) error
 
 	// Queries for list of cabs by location and radius.  If none, return empty list.
 	Query(query GeoWithin) ([]Cab, error)
 
+	// Queries for list of cabs within polygons or a corridor.  If none, return empty list.
+	// Returns ErrorBadParam if the region is not valid.
+	QueryRegion(query GeoRegion) ([]Cab, error)
+
 	// Delete all cabs
 	DeleteAll() error
 
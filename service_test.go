@@ -0,0 +1,193 @@
+package tally
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/json"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/proto"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDistanceUnits(test *testing.T) {
+	for s, expected := range map[string]DistanceUnit{
+		"m": Meters, "KM": Kilometers, "kilometres": Kilometers, "ft": Feet, "feet": Feet, " mi ": Miles, "miles": Miles,
+	} {
+		if u, err := ParseDistanceUnit(s); err != nil || u != expected {
+			test.Error("Expecting", expected, "for", s, "got", u, err)
+		}
+	}
+	if _, err := ParseDistanceUnit("yd"); err != ErrorUnknownUnit {
+		test.Error("Expecting error", err)
+	}
+	if s := Kilometers.String(); s != "km" {
+		test.Error("Expecting km", s)
+	}
+	if m := Miles.Meters(1.); m != 1609.344 {
+		test.Error("Expecting a mile in meters", m)
+	}
+	if ft := Feet.FromMeters(0.3048 * 5280.); ft != 5280. {
+		test.Error("Expecting a mile in feet", ft)
+	}
+
+	// Tariffs have the numbers of their units, and may name them
+	tariff := Tariff{}
+	if err := json.Unmarshal([]byte(`{"unit": 3}`), &tariff); err != nil || tariff.Unit != Miles {
+		test.Error("Expecting miles", tariff.Unit, err)
+	}
+	if err := json.Unmarshal([]byte(`{"unit": "km"}`), &tariff); err != nil || tariff.Unit != Kilometers {
+		test.Error("Expecting km", tariff.Unit, err)
+	}
+	if err := json.Unmarshal([]byte(`{"unit": 7}`), &tariff); err == nil {
+		test.Error("Expecting error")
+	}
+	if buff, _ := json.Marshal(tariff); !strings.Contains(string(buff), `"unit":1`) {
+		test.Error("Expecting the number of the unit", string(buff))
+	}
+}
+
+func TestBounds(test *testing.T) {
+	q := GeoWithin{Center: Location{Latitude: -16.5, Longitude: 179.9}, Radius: 50, Unit: Kilometers}
+	b := q.Bounds()
+	if !b.CrossesAntimeridian() || !b.Contains(-16.5, -179.8) || !b.Contains(-16.9, 179.9) || b.Contains(-16.5, 179) {
+		test.Error("Expecting the box around the circle", b)
+	}
+}
+
+func TestHeatmapQuery(test *testing.T) {
+	box := geo.Box{South: 37.7, West: -122.5, North: 37.8, East: -122.4}
+	grid := HeatmapQuery{Bounds: box, CellSize: 0.01}
+	key, cell := grid.Cell(Location{Latitude: 37.7749, Longitude: -122.4194})
+	if key != "12777/5758" || math.Abs(cell.South-37.77) > 1e-9 || math.Abs(cell.East+122.41) > 1e-9 {
+		test.Error("Expecting the cell of 0.01 degree", key, cell)
+	}
+	if key, _ := grid.Cell(Location{Latitude: 90., Longitude: 180.}); key != "17999/35999" {
+		test.Error("Expecting the last cell at the pole", key)
+	}
+	if key, cell := (HeatmapQuery{Bounds: box, Precision: 5}).Cell(Location{Latitude: 37.7749, Longitude: -122.4194}); key != "9q8yy" || !cell.Contains(37.7749, -122.4194) {
+		test.Error("Expecting the geohash cell", key, cell)
+	}
+
+	for _, q := range []HeatmapQuery{
+		HeatmapQuery{Bounds: box},
+		HeatmapQuery{Bounds: box, CellSize: 0.01, Precision: 5},
+		HeatmapQuery{Bounds: geo.Box{South: 10, North: -10}, CellSize: 1},
+		HeatmapQuery{Bounds: geo.World, CellSize: 0.01},
+		HeatmapQuery{Bounds: box, Precision: 13},
+		HeatmapQuery{Bounds: geo.Box{South: 10, West: math.NaN(), North: 20, East: 10}, CellSize: 1},
+		HeatmapQuery{Bounds: geo.Box{South: 10, West: 0, North: 20, East: math.Inf(1)}, CellSize: 1},
+		HeatmapQuery{Bounds: box, CellSize: math.NaN()},
+	} {
+		if q.Validate() != ErrorBadParam {
+			test.Error("Expecting ErrorBadParam for", q)
+		}
+	}
+	if err := (HeatmapQuery{Bounds: geo.World, Precision: 3}).Validate(); err != nil {
+		test.Error("Expecting the world in 32768 cells", err)
+	}
+
+	// Polygons at most 90 degrees wide, on either side of the antimeridian
+	region := HeatmapQuery{Bounds: geo.Box{South: -10, West: 10, North: 10, East: -170}}.Region()
+	if len(region.Polygons) != 3 || !region.Polygons.Contains(0, 179) || !region.Polygons.Contains(0, -175) ||
+		region.Polygons.Contains(0, -160) || region.Validate() != nil {
+		test.Error("Expecting the box split in 3", region.Polygons)
+	}
+	if region := (HeatmapQuery{Bounds: geo.Box{West: math.NaN(), East: 10}}).Region(); len(region.Polygons) > 4 {
+		test.Error("Expecting the polygons bounded in number", len(region.Polygons))
+	}
+
+	// The geodesics between the vertices of the edges, as mongo takes them, hold the whole box
+	for _, box := range []geo.Box{{South: 60, West: 0, North: 70, East: 90}, {South: -70, West: 0, North: -60, East: 90}} {
+		ring := HeatmapQuery{Bounds: box}.Region().Polygons[0][0]
+		for i := range ring {
+			a, b := ring[i], ring[(i+1)%len(ring)]
+			if a[1] != b[1] {
+				continue
+			}
+			if mid := geodesicMiddle(a, b); mid > box.South+1e-9 && mid < box.North-1e-9 ||
+				math.Abs(b[0]-a[0]) > regionStep+1e-9 {
+				test.Error("Expecting the edge out of the box", a, b, mid)
+			}
+		}
+		if len(ring) != 38 || ring[0][0] != 0 || ring[18][0] != 90 {
+			test.Error("Expecting vertices every 5 degrees", ring)
+		}
+	}
+}
+
+// Returns the latitude of the middle of the geodesic between the positions.
+func geodesicMiddle(a, b geo.Position) float64 {
+	var x, y, z float64
+	for _, p := range []geo.Position{a, b} {
+		lat, lon := p[1]*math.Pi/180., p[0]*math.Pi/180.
+		x, y, z = x+math.Cos(lat)*math.Cos(lon), y+math.Cos(lat)*math.Sin(lon), z+math.Sin(lat)
+	}
+	return math.Atan2(z, math.Hypot(x, y)) * 180. / math.Pi
+}
+
+func TestPeriods(test *testing.T) {
+	la, err := LoadZone("America/Los_Angeles")
+	if err != nil {
+		test.Fatal(err)
+	}
+	// Daylight saving time ends at 2:00 on Sunday, November 2nd 2014
+	at := time.Date(2014, 11, 2, 18, 30, 0, 0, la)
+	for _, c := range []struct {
+		period Period
+		start  string
+		hours  float64
+	}{
+		{PeriodDay, "2014-11-02T00:00:00-07:00", 25},
+		{PeriodWeek, "2014-10-27T00:00:00-07:00", 7*24 + 1},
+		{PeriodMonth, "2014-11-01T00:00:00-07:00", 30*24 + 1},
+	} {
+		start := c.period.Start(at)
+		if start.Format(time.RFC3339) != c.start || c.period.Next(start).Sub(start).Hours() != c.hours {
+			test.Error("Expecting", c.start, c.hours, "got", start, c.period.Next(start).Sub(start))
+		}
+	}
+	if err := Period("fortnight").Validate(); err != ErrorBadParam {
+		test.Error("Expecting ErrorBadParam", err)
+	}
+
+	starts := Buckets(time.Date(2014, 11, 1, 12, 0, 0, 0, la), time.Date(2014, 11, 4, 0, 0, 0, 0, la), PeriodDay)
+	if len(starts) != 3 || starts[0].Day() != 1 || starts[2].Day() != 3 || starts[2].Hour() != 0 {
+		test.Error("Expecting 3 days from local midnight", starts)
+	}
+	for t, expected := range map[time.Time]int{
+		starts[0].Add(-time.Second): -1, starts[0]: 0, at: 1, starts[2].Add(-time.Second): 1, starts[2]: 2,
+	} {
+		if b := BucketOf(starts, t); b != expected {
+			test.Error("Expecting bucket", expected, "of", t, "got", b)
+		}
+	}
+}
+
+func TestEventTime(test *testing.T) {
+	at := time.Date(2014, 6, 2, 12, 0, 0, 123456789, time.UTC)
+	event := Tally.Event{Type: proto.String("coffee"), Source: proto.String("alice")}
+	SetEventTime(&event, at)
+	if !EventTime(&event).Equal(at) || event.GetTimestamp() != 1401710400.123456789 {
+		test.Error("Expecting the time exactly", EventTime(&event), event.GetTimestamp())
+	}
+
+	// Events without nanoseconds are read from their seconds
+	event.TimeNanos = nil
+	if d := EventTime(&event).Sub(at); d < -time.Microsecond || d > time.Microsecond {
+		test.Error("Expecting the time from the seconds", EventTime(&event))
+	}
+
+	zones := Zones{"alice": "Europe/Paris"}
+	if local := zones.LocalTime(&event); local.Hour() != 14 || local.Location().String() != "Europe/Paris" {
+		test.Error("Expecting the time in the zone of the source", local)
+	}
+	event.TimeZone = proto.String("Asia/Tokyo")
+	if local := zones.LocalTime(&event); local.Hour() != 21 {
+		test.Error("Expecting the time in the zone of the event", local)
+	}
+	if err := (Zones{"bob": "Mars/Olympus"}).Validate(); err == nil {
+		test.Error("Expecting an unknown zone")
+	}
+}
@@ -0,0 +1,214 @@
+package tallytest
+
+import (
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"testing"
+)
+
+func CheckUpsert(service tally.CabService, test *testing.T) {
+	for _, c := range Cabs {
+		err := service.Upsert(c)
+		if err != nil {
+			test.Error("Got error", err)
+		}
+	}
+}
+
+// Checks the cab read by id, or ErrorNotFound if expected is nil.
+func CheckGet(service tally.CabService, test *testing.T, id tally.Id, expected *tally.Cab) {
+	found, err := service.Read(id)
+	if expected != nil && err != nil {
+		test.Error("Expecting", *expected, "but got error", err)
+	}
+	if expected != nil && *expected != found {
+		test.Error("Expecting", *expected, "but found", found)
+	}
+	if expected == nil && err != tally.ErrorNotFound {
+		test.Error("Nothing found should always return ErrorNotFound")
+	}
+}
+
+// Checks the cabs found within the radius in meters, in order.
+func CheckQuery(service tally.CabService, test *testing.T,
+	loc tally.Location, radius float64, expected []tally.Cab) {
+	q := tally.GeoWithin{
+		Center: loc,
+		Radius: radius,
+		Unit:   tally.Meters,
+	}
+
+	cabs, err := service.Query(q)
+	if err != nil {
+		test.Error("Got error", err)
+	}
+
+	if cabs == nil || len(cabs) != len(expected) {
+		test.Error("Expect vs actual", expected, cabs)
+		return
+	}
+
+	for i, c := range cabs {
+		if expected[i] != c {
+			test.Error("Expecting", expected[i], "got", c)
+		}
+	}
+}
+
+func CheckDelete(service tally.CabService, test *testing.T, id tally.Id) {
+	err := service.Delete(id)
+	if err != nil {
+		test.Error("Got error", err)
+	}
+}
+
+func CheckDeleteAll(service tally.CabService, test *testing.T) {
+	err := service.DeleteAll()
+	if err != nil {
+		test.Error("Got error", err)
+	}
+}
+
+// Checks the fixed cases of upsert, read, query and delete.
+func CheckBasic(service tally.CabService, test *testing.T) {
+	CheckUpsert(service, test)
+	CheckGet(service, test, Cabs[0].Id, &Cabs[0])
+	CheckGet(service, test, Cabs[1].Id, &Cabs[1])
+	CheckQuery(service, test, Locations[0], 1000., []tally.Cab{Cabs[0]})
+	CheckQuery(service, test, Locations[0], 500., []tally.Cab{})
+
+	// Updates replace the position
+	moved := Cabs[1]
+	moved.Latitude = Cabs[0].Latitude
+	if err := service.Upsert(moved); err != nil {
+		test.Error("Got error", err)
+	}
+	CheckGet(service, test, moved.Id, &moved)
+	CheckQuery(service, test, LocationOf(Cabs[1]), 1000., []tally.Cab{})
+
+	CheckDelete(service, test, moved.Id)
+	CheckGet(service, test, moved.Id, nil)
+	CheckQuery(service, test, LocationOf(Cabs[0]), 1000., []tally.Cab{Cabs[0]})
+
+	CheckDeleteAll(service, test)
+	CheckGet(service, test, Cabs[0].Id, nil)
+	CheckQuery(service, test, LocationOf(Cabs[0]), 1000., []tally.Cab{})
+}
+
+// Checks the batch upsert and read, including ids not found.
+func CheckBatch(service tally.CabService, test *testing.T) {
+	errs, err := service.UpsertBatch(Cabs)
+	if err != nil || len(errs) != len(Cabs) {
+		test.Error("Got error", err, errs)
+	}
+	for _, e := range errs {
+		if e != nil {
+			test.Error("Got error", e)
+		}
+	}
+
+	missing := tally.Id(999)
+	found, errs, err := service.ReadBatch([]tally.Id{Cabs[1].Id, missing, Cabs[0].Id})
+	if err != nil || len(found) != 3 || len(errs) != 3 {
+		test.Error("Got error", err, found, errs)
+		return
+	}
+	if errs[0] != nil || found[0] != Cabs[1] {
+		test.Error("Expecting", Cabs[1], "got", found[0], errs[0])
+	}
+	if errs[1] != tally.ErrorNotFound {
+		test.Error("Nothing found should always return ErrorNotFound", errs[1])
+	}
+	if errs[2] != nil || found[2] != Cabs[0] {
+		test.Error("Expecting", Cabs[0], "got", found[2], errs[2])
+	}
+}
+
+// Checks that the accuracy, altitude, speed and heading of cabs are kept, replaced by each update,
+// and that queries, also by region, leave out the cabs less accurate than their maximum.
+func CheckAccuracy(service tally.CabService, test *testing.T) {
+	outside, inside := Cabs[0], Cabs[0]
+	outside.Accuracy, outside.Altitude, outside.Speed, outside.Heading = 5, 20, 8.5, 270
+	inside.Id, inside.Latitude, inside.Accuracy = 3, inside.Latitude+0.001, 300
+	for _, cab := range []tally.Cab{outside, inside} {
+		if err := service.Upsert(cab); err != nil {
+			test.Error("Got error", err)
+		}
+	}
+	CheckGet(service, test, outside.Id, &outside)
+	cabs, err := service.Query(tally.GeoWithin{Center: Locations[0], Radius: 1000., MaxAccuracy: 50})
+	if err != nil || len(cabs) != 1 || cabs[0] != outside {
+		test.Error("Expecting", outside, "got", cabs, err)
+	}
+	CheckQuery(service, test, Locations[0], 1000., []tally.Cab{outside, inside})
+	corridor := tally.GeoRegion{Route: geo.LineString{{Locations[0].Longitude, Locations[0].Latitude}},
+		Distance: 1000., MaxAccuracy: 50}
+	around := tally.GeoRegion{Polygons: geo.MultiPolygon{{{
+		{outside.Longitude - 0.01, outside.Latitude - 0.01}, {outside.Longitude + 0.01, outside.Latitude - 0.01},
+		{outside.Longitude + 0.01, outside.Latitude + 0.01}, {outside.Longitude - 0.01, outside.Latitude + 0.01},
+	}}}, MaxAccuracy: 50}
+	for _, region := range []tally.GeoRegion{corridor, around} {
+		if cabs, err = service.QueryRegion(region); err != nil || len(cabs) != 1 || cabs[0] != outside {
+			test.Error("Expecting", outside, "in", region, "got", cabs, err)
+		}
+	}
+	if _, err = service.QueryRegion(tally.GeoRegion{Polygons: around.Polygons, MaxAccuracy: -1}); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam for a negative accuracy", err)
+	}
+
+	// Fixes without an accuracy are taken as accurate
+	CheckUpsert(service, test)
+	cabs, err = service.Query(tally.GeoWithin{Center: Locations[0], Radius: 1000., MaxAccuracy: 50})
+	if err != nil || len(cabs) != 1 || cabs[0] != Cabs[0] {
+		test.Error("Expecting", Cabs[0], "got", cabs, err)
+	}
+}
+
+// Checks that updates without a status keep the status of the cab, also when it moves far, e.g.
+// across the boundary of a shard at the prime meridian, that updates with one replace it, and
+// that setting the status alone keeps the rest.
+func CheckStatus(service tally.CabService, test *testing.T) {
+	occupied := tally.Cab{Id: 4, Latitude: 51.4779, Longitude: -0.001, Status: tally.CabOccupied}
+	if err := service.Upsert(occupied); err != nil {
+		test.Error("Got error", err)
+	}
+	moved := occupied
+	moved.Longitude, moved.Status = 0.001, ""
+	if err := service.Upsert(moved); err != nil {
+		test.Error("Got error", err)
+	}
+	moved.Status = tally.CabOccupied
+	CheckGet(service, test, moved.Id, &moved)
+
+	// Back across in a batch
+	back := moved
+	back.Longitude, back.Status = -0.001, ""
+	if errs, err := service.UpsertBatch([]tally.Cab{back}); err != nil || errs[0] != nil {
+		test.Error("Got error", err, errs)
+	}
+	back.Status = tally.CabOccupied
+	CheckGet(service, test, back.Id, &back)
+
+	available := back
+	available.Status = tally.CabAvailable
+	if err := service.Upsert(available); err != nil {
+		test.Error("Got error", err)
+	}
+	CheckGet(service, test, available.Id, &available)
+
+	// Setting the status keeps the position and the rest of the fix
+	dispatched := available
+	dispatched.Accuracy, dispatched.Status = 8, tally.CabDispatched
+	if err := service.Upsert(tally.Cab{Id: dispatched.Id, Latitude: dispatched.Latitude,
+		Longitude: dispatched.Longitude, Accuracy: 8}); err != nil {
+		test.Error("Got error", err)
+	}
+	if err := service.SetStatus(dispatched.Id, tally.CabDispatched); err != nil {
+		test.Error("Got error", err)
+	}
+	CheckGet(service, test, dispatched.Id, &dispatched)
+	if err := service.SetStatus(999, tally.CabDispatched); err != tally.ErrorNotFound {
+		test.Error("Nothing found should always return ErrorNotFound", err)
+	}
+	CheckGet(service, test, 999, nil)
+}
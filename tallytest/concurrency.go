@@ -0,0 +1,91 @@
+package tallytest
+
+import (
+	"fmt"
+	"github.com/gyokuro/tally"
+	"sync"
+	"testing"
+)
+
+// Checks the service under concurrent use.  Each worker owns its own cabs, which it upserts,
+// moves, reads back and deletes, while all workers query the area shared by the cabs.  Reads
+// must always see the latest position written by the owner, and queries must only return cabs
+// as some worker wrote them.  Run with -race to also detect data races.
+func CheckConcurrency(service tally.CabService, test *testing.T, workers, ops int) {
+	center := Locations[0]
+	failures := make(chan string, workers) // one failure at most per worker, which then stops
+	wg := sync.WaitGroup{}
+
+	// Every position written, for checking the query results
+	lock := sync.Mutex{}
+	written := make(map[tally.Cab]bool)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			fail := func(format string, args ...interface{}) {
+				failures <- fmt.Sprintf("Worker %d: ", w) + fmt.Sprintf(format, args...)
+			}
+			for i := 0; i < ops; i++ {
+				cab := tally.Cab{
+					Id:        tally.Id(w*ops + i%10 + 1),
+					Latitude:  center.Latitude + float64(w)*0.0001,
+					Longitude: center.Longitude + float64(i)*0.00001,
+				}
+				lock.Lock()
+				written[cab] = true
+				lock.Unlock()
+
+				var err error
+				switch i % 4 {
+				case 0, 1:
+					err = service.Upsert(cab)
+				case 2:
+					_, err = service.UpsertBatch([]tally.Cab{cab})
+				case 3:
+					if err = service.Upsert(cab); err == nil && i%8 == 7 {
+						if err = service.Delete(cab.Id); err == nil {
+							if _, err = service.Read(cab.Id); err == tally.ErrorNotFound {
+								continue
+							}
+							fail("deleted cab %d still found, %v", cab.Id, err)
+							return
+						}
+					}
+				}
+				if err != nil {
+					fail("got error %v", err)
+					return
+				}
+				if found, err := service.Read(cab.Id); err != nil || found != cab {
+					fail("expecting %v, read %v %v", cab, found, err)
+					return
+				}
+
+				result, err := service.Query(tally.GeoWithin{Center: center, Radius: 1000., Limit: 50})
+				if err != nil {
+					fail("got error %v", err)
+					return
+				}
+				stray := make([]tally.Cab, 0)
+				lock.Lock()
+				for _, c := range result {
+					if !written[c] {
+						stray = append(stray, c)
+					}
+				}
+				lock.Unlock()
+				if len(stray) > 0 {
+					fail("query returned %v, which were never written", stray)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(failures)
+	for f := range failures {
+		test.Error(f)
+	}
+}
@@ -0,0 +1,93 @@
+package tallytest
+
+import (
+	"github.com/gyokuro/tally"
+	"testing"
+)
+
+// Upserts the cabs, failing the test on error.
+func upsertAll(service tally.CabService, test *testing.T, cabs []tally.Cab) map[tally.Id]tally.Cab {
+	stored := make(map[tally.Id]tally.Cab)
+	for _, cab := range cabs {
+		if err := service.Upsert(cab); err != nil {
+			test.Fatal("Got error", err)
+		}
+		stored[cab.Id] = cab
+	}
+	return stored
+}
+
+// Runs the query and checks the result against the oracle, and that the expected cabs are found.
+func checkFound(service tally.CabService, test *testing.T, stored map[tally.Id]tally.Cab,
+	q tally.GeoWithin, expected ...tally.Id) {
+	result, err := service.Query(q)
+	if err != nil {
+		test.Error("Got error", err)
+		return
+	}
+	if violation := verify(stored, q, result); violation != "" {
+		test.Errorf("%s for %+v: %v", violation, q, result)
+	}
+	ids := make(map[tally.Id]bool)
+	for _, cab := range result {
+		ids[cab.Id] = true
+	}
+	for _, id := range expected {
+		if !ids[id] {
+			test.Errorf("Expecting cab %d for %+v: %v", id, q, result)
+		}
+	}
+}
+
+// Checks queries around the poles, where all longitudes meet.
+func CheckPoles(service tally.CabService, test *testing.T) {
+	stored := upsertAll(service, test, []tally.Cab{
+		tally.Cab{Id: 1, Latitude: 89.995, Longitude: 0.},
+		tally.Cab{Id: 2, Latitude: 89.995, Longitude: 90.},
+		tally.Cab{Id: 3, Latitude: 89.995, Longitude: -179.},
+		tally.Cab{Id: 4, Latitude: -89.995, Longitude: 45.},
+		tally.Cab{Id: 5, Latitude: -89.995, Longitude: -135.},
+		tally.Cab{Id: 6, Latitude: 89.9, Longitude: 0.},
+	})
+
+	// About 560 meters from the north pole, and 1.1 km between cabs on opposite longitudes
+	checkFound(service, test, stored, tally.GeoWithin{Center: tally.Location{Latitude: 90.}, Radius: 1000.},
+		1, 2, 3)
+	checkFound(service, test, stored, tally.GeoWithin{Center: tally.Location{Latitude: -90.}, Radius: 1000.},
+		4, 5)
+	checkFound(service, test, stored,
+		tally.GeoWithin{Center: tally.Location{Latitude: 89.995, Longitude: 180.}, Radius: 1200.}, 1, 2, 3)
+	checkFound(service, test, stored,
+		tally.GeoWithin{Center: tally.Location{Latitude: 89.95, Longitude: 0.}, Radius: 10., Unit: tally.Kilometers},
+		1, 2, 3, 6)
+}
+
+// Checks queries across the antimeridian, where the longitude wraps from 180 to -180.
+func CheckAntimeridian(service tally.CabService, test *testing.T) {
+	stored := upsertAll(service, test, []tally.Cab{
+		tally.Cab{Id: 1, Latitude: 0., Longitude: 179.999},
+		tally.Cab{Id: 2, Latitude: 0., Longitude: -179.999},
+		tally.Cab{Id: 3, Latitude: -16.5, Longitude: 179.99},
+		tally.Cab{Id: 4, Latitude: -16.5, Longitude: -179.99},
+		tally.Cab{Id: 5, Latitude: 0., Longitude: 179.9},
+	})
+
+	// About 111 meters either side of the antimeridian at the equator
+	checkFound(service, test, stored, tally.GeoWithin{Center: tally.Location{Longitude: 180.}, Radius: 200.}, 1, 2)
+	checkFound(service, test, stored, tally.GeoWithin{Center: tally.Location{Longitude: -180.}, Radius: 200.}, 1, 2)
+	checkFound(service, test, stored, tally.GeoWithin{Center: tally.Location{Longitude: 179.9995}, Radius: 250.},
+		1, 2)
+	// About 2.1 km apart in Fiji
+	checkFound(service, test, stored,
+		tally.GeoWithin{Center: tally.Location{Latitude: -16.5, Longitude: -179.995}, Radius: 2., Unit: tally.Kilometers},
+		3, 4)
+	checkFound(service, test, stored,
+		tally.GeoWithin{Center: tally.Location{Longitude: -179.95}, Radius: 20., Unit: tally.Kilometers}, 1, 2, 5)
+}
+
+// Checks that a query of zero radius finds only the cabs at the center.
+func CheckZeroRadius(service tally.CabService, test *testing.T) {
+	stored := upsertAll(service, test, Cabs)
+	checkFound(service, test, stored, tally.GeoWithin{Center: LocationOf(Cabs[0])}, Cabs[0].Id)
+	checkFound(service, test, stored, tally.GeoWithin{Center: Locations[0]})
+}
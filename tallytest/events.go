@@ -0,0 +1,57 @@
+package tallytest
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/proto"
+	"sync"
+	"testing"
+)
+
+// Returns n events of the type, with locations and attributes.
+func Events(n int, eventType string) []Tally.Event {
+	events := make([]Tally.Event, n)
+	for i := range events {
+		events[i] = Tally.Event{
+			Timestamp: proto.Float64(1.4e9 + float64(i)),
+			Type:      proto.String(eventType),
+			Source:    proto.String("tallytest"),
+			Location: &Tally.Location{
+				Lon: proto.Float64(Cabs[0].Longitude),
+				Lat: proto.Float64(Cabs[0].Latitude),
+			},
+			Attributes: []*Tally.Attribute{
+				&Tally.Attribute{Key: proto.String("index"), IntValue: proto.Int64(int64(i))},
+			},
+		}
+	}
+	return events
+}
+
+// Checks that the event service accepts empty and non-empty batches, including from
+// concurrent callers.
+func RunEventServiceSuite(test *testing.T, service tally.EventService) {
+	if err := service.Put(nil); err != nil {
+		test.Error("Empty batch got error", err)
+	}
+	if err := service.Put(Events(10, "test")); err != nil {
+		test.Error("Got error", err)
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- service.Put(Events(100, "concurrent"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			test.Error("Got error", err)
+		}
+	}
+}
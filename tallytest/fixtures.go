@@ -0,0 +1,79 @@
+// Package tallytest is a conformance test kit for implementations of tally.CabService,
+// tally.EventService and tally.EventStore.  Backends run the suites from their own tests, e.g.
+//
+//	func TestMyBackend(test *testing.T) {
+//		tallytest.RunCabServiceSuite(test, func() tally.CabService { return NewMyBackend() })
+//	}
+//
+// Query results are checked against a brute force Haversine oracle, with a small tolerance at
+// the edge of the circle for backends that model the earth with a different radius.
+package tallytest
+
+import (
+	"github.com/gyokuro/tally"
+	"testing"
+)
+
+var (
+	// Fixed cabs for the basic checks, a degree of latitude apart.
+	Cabs = []tally.Cab{
+		tally.Cab{
+			Id:        1,
+			Longitude: -77.037852,
+			Latitude:  38.898556,
+		},
+		tally.Cab{
+			Id:        2,
+			Longitude: -77.037852,
+			Latitude:  39.898557,
+		},
+	}
+
+	// Location about 550 meters from the first cab.
+	Locations = []tally.Location{
+		tally.Location{
+			Longitude: -77.043934,
+			Latitude:  38.897147,
+		}}
+)
+
+func LocationOf(cab tally.Cab) tally.Location {
+	return tally.Location{
+		Latitude:  cab.Latitude,
+		Longitude: cab.Longitude}
+}
+
+// Runs all checks of a CabService, each on a new service from the factory.  The service is
+// cleared with DeleteAll before and closed after each check.
+func RunCabServiceSuite(test *testing.T, factory func() tally.CabService) {
+	suite := []struct {
+		name  string
+		check func(service tally.CabService, test *testing.T)
+	}{
+		{"Basic", CheckBasic},
+		{"Batch", CheckBatch},
+		{"Properties", func(service tally.CabService, test *testing.T) {
+			CheckProperties(service, test, 1, 50)
+		}},
+		{"Concurrency", func(service tally.CabService, test *testing.T) {
+			CheckConcurrency(service, test, 8, 100)
+		}},
+		{"Poles", CheckPoles},
+		{"Antimeridian", CheckAntimeridian},
+		{"ZeroRadius", CheckZeroRadius},
+		{"Region", CheckRegion},
+		{"Accuracy", CheckAccuracy},
+		{"Status", CheckStatus},
+	}
+	for _, s := range suite {
+		check := s.check
+		test.Run(s.name, func(test *testing.T) {
+			service := factory()
+			defer service.Close()
+			if err := service.DeleteAll(); err != nil {
+				test.Fatal("Got error", err)
+			}
+			check(service, test)
+		})
+	}
+}
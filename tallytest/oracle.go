@@ -0,0 +1,108 @@
+package tallytest
+
+import (
+	"github.com/gyokuro/tally"
+	"math"
+	"sort"
+)
+
+const (
+	// Mean radius of the earth used by the oracle
+	earthRadiusMeters = 6371008.8
+
+	// Relative tolerance at the edge of a query circle.  Backends may use other radii of the
+	// earth or an ellipsoid; cabs within the tolerance of the edge may or may not be found.
+	Tolerance = 0.005
+)
+
+// Returns the great circle distance in meters by the Haversine formula.  This is the oracle
+// the query results are checked against, independent of the backends' own implementations.
+func Haversine(a, b tally.Location) float64 {
+	lat1, lat2 := a.Latitude*math.Pi/180., b.Latitude*math.Pi/180.
+	dlat := lat2 - lat1
+	dlon := (b.Longitude - a.Longitude) * math.Pi / 180.
+	h := math.Pow(math.Sin(dlat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dlon/2), 2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1., math.Sqrt(h)))
+}
+
+// Returns the distance in meters.
+func meters(d float64, unit tally.DistanceUnit) float64 {
+	switch unit {
+	case tally.Kilometers:
+		return d * 1000.
+	case tally.Miles:
+		return d * 1609.344
+	case tally.Feet:
+		return d * 0.3048
+	}
+	return d
+}
+
+// A cab and its distance from the center of a query
+type cabDistance struct {
+	cab      tally.Cab
+	distance float64
+}
+
+type byDistance []cabDistance
+
+func (s byDistance) Len() int           { return len(s) }
+func (s byDistance) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDistance) Less(i, j int) bool { return s[i].distance < s[j].distance }
+
+// Returns the cabs within the distance in meters of the center, nearest first, by brute force.
+func within(cabs map[tally.Id]tally.Cab, center tally.Location, radius float64) []cabDistance {
+	found := make([]cabDistance, 0)
+	for _, cab := range cabs {
+		if d := Haversine(center, LocationOf(cab)); d <= radius {
+			found = append(found, cabDistance{cab, d})
+		}
+	}
+	sort.Sort(byDistance(found))
+	return found
+}
+
+// Checks the result of the query against the oracle over all the cabs stored.  Returns a
+// description of the first violation, or empty if the result is correct:
+//
+//   - at most limit cabs are returned, each as stored, without duplicates
+//   - each cab is within the radius, up to the tolerance
+//   - the cabs missing are either near the edge, or beyond the limit and no nearer than the
+//     farthest cab returned
+func verify(stored map[tally.Id]tally.Cab, q tally.GeoWithin, result []tally.Cab) string {
+	tally.Sanitize(&q)
+	radius := meters(q.Radius, q.Unit)
+	slack := math.Max(radius*Tolerance, 0.01)
+
+	if len(result) > q.Limit {
+		return "more cabs than the limit"
+	}
+	seen := make(map[tally.Id]bool)
+	farthest := 0.
+	for _, cab := range result {
+		if seen[cab.Id] {
+			return "duplicate cab"
+		}
+		seen[cab.Id] = true
+		if stored[cab.Id] != cab {
+			return "cab not as stored"
+		}
+		d := Haversine(q.Center, LocationOf(cab))
+		if d > radius+slack {
+			return "cab outside the radius"
+		}
+		farthest = math.Max(farthest, d)
+	}
+	for _, c := range within(stored, q.Center, radius-slack) {
+		if seen[c.cab.Id] {
+			continue
+		}
+		if len(result) < q.Limit {
+			return "cab within the radius not found"
+		}
+		if c.distance < farthest-slack {
+			return "cab nearer than those found is missing"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package tallytest
+
+import (
+	"github.com/gyokuro/tally"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Checks randomized queries against the oracle.  Each round stores a cluster of random cabs
+// around a random center, moves and deletes some of them, and runs queries of random radius,
+// unit and limit.  The seed makes failures reproducible.
+func CheckProperties(service tally.CabService, test *testing.T, seed int64, rounds int) {
+	r := rand.New(rand.NewSource(seed))
+	units := []tally.DistanceUnit{tally.Meters, tally.Kilometers, tally.Feet, tally.Miles}
+
+	for round := 0; round < rounds; round++ {
+		if err := service.DeleteAll(); err != nil {
+			test.Fatal("Got error", err)
+		}
+		// Clusters away from the poles and the antimeridian, which have their own checks
+		center := tally.Location{Latitude: r.Float64()*140. - 70., Longitude: r.Float64()*340. - 170.}
+		spread := 5000. * math.Pow(10., r.Float64()*2.-1.) // 500 m to 50 km
+
+		stored := make(map[tally.Id]tally.Cab)
+		cabs := make([]tally.Cab, 20+r.Intn(80))
+		for i := range cabs {
+			cabs[i] = randomCab(r, tally.Id(round*1000+i+1), center, spread)
+			stored[cabs[i].Id] = cabs[i]
+		}
+		errs, err := service.UpsertBatch(cabs)
+		if err != nil {
+			test.Fatal("Got error", err)
+		}
+		for _, e := range errs {
+			if e != nil {
+				test.Fatal("Got error", e)
+			}
+		}
+		for i := 0; i < len(cabs)/5; i++ {
+			cab := cabs[r.Intn(len(cabs))]
+			if r.Intn(2) == 0 {
+				cab = randomCab(r, cab.Id, center, spread)
+				err = service.Upsert(cab)
+				stored[cab.Id] = cab
+			} else {
+				err = service.Delete(cab.Id)
+				delete(stored, cab.Id)
+			}
+			if err != nil {
+				test.Fatal("Got error", err)
+			}
+		}
+
+		for i := 0; i < 10; i++ {
+			unit := units[r.Intn(len(units))]
+			q := tally.GeoWithin{
+				Center: randomLocation(r, center, spread),
+				Radius: spread * r.Float64() * 2. / meters(1., unit),
+				Unit:   unit,
+				Limit:  1 + r.Intn(30),
+			}
+			result, err := service.Query(q)
+			if err != nil {
+				test.Fatal("Got error", err)
+			}
+			if violation := verify(stored, q, result); violation != "" {
+				test.Errorf("Seed %d round %d: %s for %+v: %v", seed, round, violation, q, result)
+			}
+		}
+	}
+}
+
+// Returns a location at a uniformly random bearing and distance within spread meters.
+func randomLocation(r *rand.Rand, center tally.Location, spread float64) tally.Location {
+	d := spread * r.Float64() / earthRadiusMeters
+	bearing := r.Float64() * 2 * math.Pi
+	lat1, lon1 := center.Latitude*math.Pi/180., center.Longitude*math.Pi/180.
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(d) + math.Cos(lat1)*math.Sin(d)*math.Cos(bearing))
+	lon2 := lon1 + math.Atan2(math.Sin(bearing)*math.Sin(d)*math.Cos(lat1), math.Cos(d)-math.Sin(lat1)*math.Sin(lat2))
+	return tally.Location{Latitude: lat2 * 180. / math.Pi, Longitude: lon2 * 180. / math.Pi}
+}
+
+func randomCab(r *rand.Rand, id tally.Id, center tally.Location, spread float64) tally.Cab {
+	loc := randomLocation(r, center, spread)
+	return tally.Cab{Id: id, Latitude: loc.Latitude, Longitude: loc.Longitude}
+}
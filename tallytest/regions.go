@@ -0,0 +1,352 @@
+package tallytest
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/proto"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	// Square in San Francisco with a hole in the middle, and islands on either side of the
+	// antimeridian.
+	Polygons = geo.MultiPolygon{
+		geo.Polygon{
+			geo.Ring{{-122.45, 37.75}, {-122.39, 37.75}, {-122.39, 37.80}, {-122.45, 37.80}},
+			geo.Ring{{-122.43, 37.77}, {-122.41, 37.77}, {-122.41, 37.78}, {-122.43, 37.78}},
+		},
+		geo.Polygon{geo.Ring{{179, -17}, {180, -17}, {180, -16}, {179, -16}}},
+		geo.Polygon{geo.Ring{{-180, -17}, {-179, -17}, {-179, -16}, {-180, -16}}},
+	}
+
+	// Route along the parallel across the square
+	Route = geo.LineString{{-122.45, 37.77}, {-122.39, 37.77}}
+
+	// Places in and around the polygons and the corridor along the route
+	RegionCabs = []tally.Cab{
+		tally.Cab{Id: 1, Latitude: 37.76, Longitude: -122.44},    // in the square, 1.1 km off the route
+		tally.Cab{Id: 2, Latitude: 37.775, Longitude: -122.42},   // in the hole, 560 m off the route
+		tally.Cab{Id: 3, Latitude: 37.79, Longitude: -122.40},    // in the square
+		tally.Cab{Id: 4, Latitude: 37.85, Longitude: -122.42},    // north of the square
+		tally.Cab{Id: 5, Latitude: -16.5, Longitude: -179.5},     // on the island east of the antimeridian
+		tally.Cab{Id: 6, Latitude: 37.772, Longitude: -122.435},  // 220 m off the route
+		tally.Cab{Id: 7, Latitude: 37.773, Longitude: -122.445},  // 330 m off the route
+		tally.Cab{Id: 8, Latitude: 37.7705, Longitude: -122.395}, // 55 m off the route
+		tally.Cab{Id: 9, Latitude: 37.77, Longitude: -122.46},    // 880 m past the end of the route
+	}
+)
+
+// Returns the ids of the cabs.
+func ids(cabs []tally.Cab) []tally.Id {
+	result := make([]tally.Id, len(cabs))
+	for i, cab := range cabs {
+		result[i] = cab.Id
+	}
+	return result
+}
+
+// Checks queries of polygons, with holes and across the antimeridian, and of corridors.  Cabs
+// within polygons are ordered by id, and within corridors nearest the route first.
+func CheckRegion(service tally.CabService, test *testing.T) {
+	upsertAll(service, test, RegionCabs)
+	for _, c := range []struct {
+		region   tally.GeoRegion
+		expected []tally.Id
+	}{
+		{tally.GeoRegion{Polygons: Polygons}, []tally.Id{1, 3, 5, 6, 7, 8}},
+		{tally.GeoRegion{Polygons: Polygons[:1], Limit: 1}, []tally.Id{1}},
+		{tally.GeoRegion{Route: Route, Distance: 300.}, []tally.Id{8, 6}},
+		{tally.GeoRegion{Route: Route, Distance: 0.3, Unit: tally.Kilometers, Limit: 1}, []tally.Id{8}},
+		{tally.GeoRegion{Route: Route, Distance: 600.}, []tally.Id{8, 6, 7, 2}},
+		{tally.GeoRegion{Route: geo.LineString{{179.9, -16.5}}, Distance: 70., Unit: tally.Kilometers},
+			[]tally.Id{5}},
+	} {
+		result, err := service.QueryRegion(c.region)
+		if err != nil {
+			test.Error("Got error", err)
+			continue
+		}
+		if found := ids(result); !reflect.DeepEqual(found, c.expected) {
+			test.Errorf("Expecting %v for %+v, got %v", c.expected, c.region, found)
+		}
+	}
+
+	for _, region := range []tally.GeoRegion{
+		tally.GeoRegion{},
+		tally.GeoRegion{Polygons: Polygons, Route: Route},
+		tally.GeoRegion{Polygons: geo.MultiPolygon{geo.Polygon{geo.Ring{{0, 0}, {1, 1}}}}},
+	} {
+		if _, err := service.QueryRegion(region); err != tally.ErrorBadParam {
+			test.Errorf("Expecting ErrorBadParam for %+v, got %v", region, err)
+		}
+	}
+}
+
+// Returns an event at each of the region's cabs, out of order in time, alternating between
+// pickups and dropoffs, and one without a location.
+func regionEvents() []Tally.Event {
+	events := make([]Tally.Event, 0, len(RegionCabs)+1)
+	for i, cab := range RegionCabs {
+		eventType := "pickup"
+		if cab.Id%2 == 0 {
+			eventType = "dropoff"
+		}
+		events = append(events, Tally.Event{
+			Timestamp: proto.Float64(1.4e9 + float64(cab.Id)),
+			Type:      proto.String(eventType),
+			Source:    proto.String("tallytest"),
+			Location: &Tally.Location{
+				Lon: proto.Float64(cab.Longitude),
+				Lat: proto.Float64(cab.Latitude),
+			},
+			Attributes: []*Tally.Attribute{
+				&Tally.Attribute{Key: proto.String("index"), IntValue: proto.Int64(int64(i))},
+			},
+		})
+	}
+	events[0], events[len(events)-1] = events[len(events)-1], events[0]
+	return append(events, Tally.Event{
+		Timestamp: proto.Float64(1.4e9 + 10),
+		Type:      proto.String("pickup"),
+		Source:    proto.String("elsewhere"),
+	})
+}
+
+// Returns the ids of the cabs where the events happened, from their timestamps, or 0 for events
+// without a location.
+func eventIds(events []Tally.Event) []tally.Id {
+	result := make([]tally.Id, len(events))
+	for i, event := range events {
+		if event.Location != nil {
+			result[i] = tally.Id(event.GetTimestamp() - 1.4e9)
+		}
+	}
+	return result
+}
+
+// Runs the checks of an EventStore, each on a new empty store from the factory, closing it after.
+// Events are found by id, type, source, tags, time range, accuracy, circle, polygons and corridor,
+// in time order, and counted per cell of a grid.
+func RunEventStoreSuite(test *testing.T, factory func() tally.EventStore) {
+	first := factory()
+	RunEventServiceSuite(test, first)
+	first.Close()
+
+	store := factory()
+	defer store.Close()
+	if err := store.Put(regionEvents()); err != nil {
+		test.Fatal("Got error", err)
+	}
+	at := func(id int) time.Time { return time.Unix(1.4e9+int64(id), 0) }
+	center := tally.Location{Latitude: 37.77, Longitude: -122.42}
+	for _, c := range []struct {
+		query    tally.EventQuery
+		expected []tally.Id
+	}{
+		{tally.EventQuery{}, []tally.Id{1, 2, 3, 4, 5, 6, 7, 8, 9, 0}},
+		{tally.EventQuery{Type: "dropoff"}, []tally.Id{2, 4, 6, 8}},
+		{tally.EventQuery{Type: "pickup", Source: "elsewhere"}, []tally.Id{0}},
+		{tally.EventQuery{From: at(3), To: at(6)}, []tally.Id{3, 4, 5}},
+		{tally.EventQuery{From: at(3), Limit: 2}, []tally.Id{3, 4}},
+		{tally.EventQuery{Within: &tally.GeoWithin{Center: center, Radius: 2.5, Unit: tally.Kilometers}},
+			[]tally.Id{1, 2, 6, 7, 8}},
+		{tally.EventQuery{Region: &tally.GeoRegion{Polygons: Polygons}}, []tally.Id{1, 3, 5, 6, 7, 8}},
+		{tally.EventQuery{Type: "pickup", Region: &tally.GeoRegion{Route: Route, Distance: 600.}},
+			[]tally.Id{7}},
+		{tally.EventQuery{Region: &tally.GeoRegion{Route: Route, Distance: 600.}, Limit: 2},
+			[]tally.Id{2, 6}},
+	} {
+		events, err := store.Find(c.query)
+		if err != nil {
+			test.Error("Got error", err)
+			continue
+		}
+		if found := eventIds(events); !reflect.DeepEqual(found, c.expected) {
+			test.Errorf("Expecting %v for %+v, got %v", c.expected, c.query, found)
+		}
+	}
+
+	events, err := store.Find(tally.EventQuery{From: at(1), To: at(2)})
+	if err != nil || len(events) != 1 || !proto.Equal(&events[0], &regionEvents()[len(RegionCabs)-1]) {
+		test.Error("Expecting the event as put", events, err)
+	}
+	both := tally.EventQuery{Within: &tally.GeoWithin{Center: center, Radius: 1.}, Region: &tally.GeoRegion{Route: Route}}
+	if _, err := store.Find(both); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam for a circle and a region, got", err)
+	}
+
+	checkCount(test, store)
+
+	// Removed by type and time range only
+	if _, err := store.Remove(tally.EventQuery{Region: &tally.GeoRegion{Polygons: Polygons}}); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam removing by region, got", err)
+	}
+	if removed, err := store.Remove(tally.EventQuery{Type: "dropoff", From: at(4)}); err != nil || removed != 3 {
+		test.Error("Expecting 3 removed", removed, err)
+	}
+	events, err = store.Find(tally.EventQuery{})
+	if found := eventIds(events); err != nil || !reflect.DeepEqual(found, []tally.Id{1, 2, 3, 5, 7, 9, 0}) {
+		test.Error("Expecting the dropoffs from 4 removed", found, err)
+	}
+
+	checkMeetings(test, store)
+	checkAccuracy(test, store)
+}
+
+// Checks the counts of the region events per cell, in the box and its cells across the
+// antimeridian, by type and within a circle, at the mean locations of the events counted.
+func checkCount(test *testing.T, store tally.EventStore) {
+	box := geo.Box{South: 37.75, West: -122.45, North: 37.80, East: -122.39}
+	grid := tally.Grid{South: 37.7, West: -122.51, Height: .05, Width: .05}
+	island := geo.Box{South: -17, West: 179, North: -16, East: -179}
+	for _, c := range []struct {
+		query    tally.EventQuery
+		box      geo.Box
+		grid     tally.Grid
+		expected []tally.GridCell
+	}{
+		{tally.EventQuery{}, box, grid, []tally.GridCell{
+			{Row: 1, Column: 1, Count: 4, Latitude: 37.77, Longitude: -122.435},
+			{Row: 1, Column: 2, Count: 2, Latitude: 37.78025, Longitude: -122.3975},
+		}},
+		{tally.EventQuery{Type: "dropoff"}, box, grid, []tally.GridCell{
+			{Row: 1, Column: 1, Count: 2, Latitude: 37.7735, Longitude: -122.4275},
+			{Row: 1, Column: 2, Count: 1, Latitude: 37.7705, Longitude: -122.395},
+		}},
+		{tally.EventQuery{Within: &tally.GeoWithin{
+			Center: tally.Location{Latitude: 37.77, Longitude: -122.42}, Radius: 2.5, Unit: tally.Kilometers,
+		}}, box, grid, []tally.GridCell{
+			{Row: 1, Column: 1, Count: 4, Latitude: 37.77, Longitude: -122.435},
+			{Row: 1, Column: 2, Count: 1, Latitude: 37.7705, Longitude: -122.395},
+		}},
+		{tally.EventQuery{}, island, tally.Grid{South: -17, West: 179, Height: 1, Width: 1}, []tally.GridCell{
+			{Row: 0, Column: 1, Count: 1, Latitude: -16.5, Longitude: -179.5},
+		}},
+	} {
+		cells, err := store.Count(c.query, c.box, c.grid)
+		if err != nil || len(cells) != len(c.expected) {
+			test.Errorf("Expecting %v for %+v, got %v %v", c.expected, c.query, cells, err)
+			continue
+		}
+		for i, cell := range cells {
+			e := c.expected[i]
+			if cell.Row != e.Row || cell.Column != e.Column || cell.Count != e.Count ||
+				math.Abs(cell.Latitude-e.Latitude) > 1e-9 || math.Abs(cell.Longitude-e.Longitude) > 1e-9 {
+				test.Errorf("Expecting %v for %+v, got %v", c.expected, c.query, cells)
+				break
+			}
+		}
+	}
+	if _, err := store.Count(tally.EventQuery{}, box, tally.Grid{Height: 1}); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam for cells without a width, got", err)
+	}
+}
+
+// Checks that events less accurate than the query's maximum are left out, and those without an
+// accuracy kept.
+func checkAccuracy(test *testing.T, store tally.EventStore) {
+	fixes := make([]Tally.Event, 0)
+	for i, accuracy := range []float64{5, 0, 500, 50} {
+		fix := Tally.Event{
+			Timestamp: proto.Float64(1.5e9 + float64(i)),
+			Type:      proto.String("fix"),
+			Source:    proto.String("phone"),
+			Location:  &Tally.Location{Lon: proto.Float64(-122.42), Lat: proto.Float64(37.77), Altitude: proto.Float64(12)},
+		}
+		if accuracy > 0 {
+			fix.Location.Accuracy = proto.Float64(accuracy)
+		}
+		fixes = append(fixes, fix)
+	}
+	if err := store.Put(fixes); err != nil {
+		test.Fatal("Got error", err)
+	}
+	events, err := store.Find(tally.EventQuery{Source: "phone", MaxAccuracy: 50})
+	if err != nil || len(events) != 3 || events[2].Location.GetAccuracy() != 50 || events[1].Location.Accuracy != nil ||
+		events[0].Location.GetAltitude() != 12 {
+		test.Error("Expecting the fixes accurate to 50 meters", events, err)
+	}
+	if _, err := store.Find(tally.EventQuery{MaxAccuracy: -1}); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam for a negative accuracy, got", err)
+	}
+}
+
+// Returns a meeting of the calendar source, with an id and tags, lasting the minutes.
+func meeting(id string, start time.Time, minutes int, tags ...string) Tally.Event {
+	event := Tally.Event{
+		Id:            proto.String(id),
+		Type:          proto.String("meeting"),
+		Source:        proto.String("calendar"),
+		Tags:          tags,
+		DurationNanos: proto.Int64(int64(time.Duration(minutes) * time.Minute)),
+	}
+	tally.SetEventTime(&event, start)
+	return event
+}
+
+// Returns the ids of the events.
+func idsOf(events []Tally.Event) []string {
+	result := make([]string, len(events))
+	for i := range events {
+		result[i] = events[i].GetId()
+	}
+	return result
+}
+
+// Checks that events put with the id of another of the same source replace it, and that interval
+// events are found by tags and by overlapping the time range.
+func checkMeetings(test *testing.T, store tally.EventStore) {
+	nine := time.Date(2014, 6, 2, 9, 0, 0, 0, time.UTC)
+	other := meeting("standup", nine, 15)
+	other.Source = proto.String("elsewhere")
+	if err := store.Put([]Tally.Event{
+		meeting("standup", nine, 15, "work", "daily"),
+		meeting("review", nine.Add(time.Hour), 60, "work"),
+		meeting("lunch", nine.Add(3*time.Hour), 60),
+		other,
+	}); err != nil {
+		test.Fatal("Got error", err)
+	}
+	// The standup moved after the review
+	if err := store.Put([]Tally.Event{meeting("standup", nine.Add(2*time.Hour), 15, "work", "daily")}); err != nil {
+		test.Fatal("Got error", err)
+	}
+	for _, c := range []struct {
+		query    tally.EventQuery
+		expected []string
+	}{
+		{tally.EventQuery{Source: "calendar"}, []string{"review", "standup", "lunch"}},
+		{tally.EventQuery{Id: "standup"}, []string{"standup", "standup"}},
+		{tally.EventQuery{Tags: []string{"work"}}, []string{"review", "standup"}},
+		{tally.EventQuery{Tags: []string{"daily", "work"}}, []string{"standup"}},
+		{tally.EventQuery{Tags: []string{"daily", "home"}}, []string{}},
+		{tally.EventQuery{Source: "calendar", From: nine.Add(90 * time.Minute), To: nine.Add(3 * time.Hour)},
+			[]string{"review", "standup"}},
+		{tally.EventQuery{Source: "calendar", From: nine.Add(2 * time.Hour), To: nine.Add(2 * time.Hour)},
+			[]string{}},
+	} {
+		events, err := store.Find(c.query)
+		if found := idsOf(events); err != nil || !reflect.DeepEqual(found, c.expected) {
+			test.Errorf("Expecting %v for %+v, got %v %v", c.expected, c.query, found, err)
+		}
+	}
+	events, err := store.Find(tally.EventQuery{Source: "calendar", Id: "standup"})
+	if err != nil || len(events) != 1 || !tally.EventEnd(&events[0]).Equal(nine.Add(135*time.Minute)) {
+		test.Error("Expecting the standup moved", events, err)
+	}
+
+	if removed, err := store.Remove(tally.EventQuery{Tags: []string{"work"}, From: nine.Add(90 * time.Minute)}); err != nil || removed != 2 {
+		test.Error("Expecting the review and the standup removed", removed, err)
+	}
+	if err := store.Put([]Tally.Event{meeting("review", nine.Add(4*time.Hour), 30)}); err != nil {
+		test.Fatal("Got error", err)
+	}
+	events, err = store.Find(tally.EventQuery{Source: "calendar"})
+	if found := idsOf(events); err != nil || !reflect.DeepEqual(found, []string{"lunch", "review"}) {
+		test.Error("Expecting the lunch and the review put again", found, err)
+	}
+}
@@ -0,0 +1,133 @@
+package tiles
+
+import (
+	"errors"
+	"github.com/gyokuro/tally"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var errRamp = errors.New("Color ramp must be two or more comma separated colors, in hex as rrggbb or rrggbbaa")
+
+// Colors of a heat map from low to high, evenly spaced
+type Ramp []color.NRGBA
+
+// Transparent blue through cyan, green and yellow to red
+var DefaultRamp = Ramp{
+	{0, 0, 255, 0}, {0, 255, 255, 160}, {0, 255, 0, 192}, {255, 255, 0, 224}, {255, 0, 0, 255},
+}
+
+// Parses a ramp of comma separated hex colors, e.g. "0000ff00,ffff00,ff0000".  Colors without
+// an alpha are opaque.
+func ParseRamp(s string) (Ramp, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) < 2 {
+		return nil, errRamp
+	}
+	ramp := make(Ramp, len(parts))
+	for i, part := range parts {
+		part = strings.TrimPrefix(strings.TrimSpace(part), "#")
+		if len(part) == 6 {
+			part += "ff"
+		}
+		n, err := strconv.ParseUint(part, 16, 32)
+		if err != nil || len(part) != 8 {
+			return nil, errRamp
+		}
+		ramp[i] = color.NRGBA{uint8(n >> 24), uint8(n >> 16), uint8(n >> 8), uint8(n)}
+	}
+	return ramp, nil
+}
+
+// Returns the color at the value from 0 to 1, interpolated between the nearest stops.  NaN is 0.
+func (r Ramp) At(v float64) color.NRGBA {
+	if math.IsNaN(v) {
+		v = 0
+	}
+	v = math.Max(0., math.Min(1., v)) * float64(len(r)-1)
+	i := int(math.Min(v, float64(len(r)-2)))
+	f := v - float64(i)
+	mix := func(a, b uint8) uint8 { return uint8(float64(a)*(1-f) + float64(b)*f + .5) }
+	a, b := r[i], r[i+1]
+	return color.NRGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), mix(a.A, b.A)}
+}
+
+// Colors of the tracks, assigned to sources by hash
+var trackPalette = []color.NRGBA{
+	{31, 119, 180, 255}, {255, 127, 14, 255}, {44, 160, 44, 255}, {214, 39, 40, 255},
+	{148, 103, 189, 255}, {140, 86, 75, 255}, {227, 119, 194, 255}, {23, 190, 207, 255},
+}
+
+// Returns the color of the source's track, the same in every tile.
+func trackColor(source string) color.NRGBA {
+	h := fnv.New32a()
+	h.Write([]byte(source))
+	return trackPalette[h.Sum32()%uint32(len(trackPalette))]
+}
+
+// Colors of the cabs by status, gray for off duty and any other
+var (
+	cabColors = map[tally.CabStatus]color.NRGBA{
+		"":                  {44, 160, 44, 255},
+		tally.CabAvailable:  {44, 160, 44, 255},
+		tally.CabDispatched: {255, 127, 14, 255},
+		tally.CabOccupied:   {214, 39, 40, 255},
+	}
+	cabOtherColor   = color.NRGBA{127, 127, 127, 255}
+	cabOutlineColor = color.NRGBA{255, 255, 255, 255}
+)
+
+// Paints the color over the pixel, blending by its alpha.
+func blend(img *image.RGBA, x, y int, c color.NRGBA) {
+	if !(image.Point{x, y}.In(img.Rect)) || c.A == 0 {
+		return
+	}
+	i := img.PixOffset(x, y)
+	a := uint32(c.A)
+	for j, v := range []uint8{c.R, c.G, c.B} {
+		// Premultiplied, as image.RGBA is
+		img.Pix[i+j] = uint8((uint32(v)*a + uint32(img.Pix[i+j])*(255-a)) / 255)
+	}
+	img.Pix[i+3] = uint8(a + uint32(img.Pix[i+3])*(255-a)/255)
+}
+
+// Paints a disc centered at the point.
+func disc(img *image.RGBA, cx, cy, radius float64, c color.NRGBA) {
+	for y := int(math.Floor(cy - radius)); y <= int(math.Ceil(cy+radius)); y++ {
+		for x := int(math.Floor(cx - radius)); x <= int(math.Ceil(cx+radius)); x++ {
+			dx, dy := float64(x)+.5-cx, float64(y)+.5-cy
+			if dx*dx+dy*dy <= radius*radius {
+				blend(img, x, y, c)
+			}
+		}
+	}
+}
+
+// Paints a line of the width between the points, clipped to the image.
+func line(img *image.RGBA, x0, y0, x1, y1, width float64, c color.NRGBA) {
+	length := math.Hypot(x1-x0, y1-y0)
+	if length > 4*float64(img.Rect.Dx()+img.Rect.Dy()) {
+		return // across the antimeridian, or too far off the tile to matter
+	}
+	half := width / 2
+	minX, maxX := math.Min(x0, x1)-half, math.Max(x0, x1)+half
+	minY, maxY := math.Min(y0, y1)-half, math.Max(y0, y1)+half
+	b := img.Rect
+	for y := int(math.Max(math.Floor(minY), float64(b.Min.Y))); y <= int(math.Min(maxY, float64(b.Max.Y-1))); y++ {
+		for x := int(math.Max(math.Floor(minX), float64(b.Min.X))); x <= int(math.Min(maxX, float64(b.Max.X-1))); x++ {
+			px, py := float64(x)+.5, float64(y)+.5
+			// Distance from the pixel to the segment
+			t := 0.
+			if length > 0 {
+				t = math.Max(0, math.Min(1, ((px-x0)*(x1-x0)+(py-y0)*(y1-y0))/(length*length)))
+			}
+			if math.Hypot(px-(x0+t*(x1-x0)), py-(y0+t*(y1-y0))) <= half {
+				blend(img, x, y, c)
+			}
+		}
+	}
+}
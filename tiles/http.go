@@ -0,0 +1,76 @@
+package tiles
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Returns the url routes of the tiles of the source, as vector tiles or images, e.g.
+//
+//	/tiles/13/1310/3166.mvt?status=available&type=pickup&from=2014-05-01T00:00:00Z
+//	/tiles/13/1310/3166.png?layers=heat,cabs&ramp=0000ff00,ff0000&max=4
+//
+// where the cabs are filtered by status, and the events as by tally.EventFilter within at most
+// MaxSpan, by default up to now.  Below ClusterZoom, the events are counted by the store in the
+// cells the cabs are clustered in, each cell a cluster even of one event.  Images have the layers
+// heat, tracks and cabs, drawn in the order given; the heat is colored by the ramp, from nothing
+// to the density of max events at the same place.
+func Routes(source Source) tally.Routes {
+	return func(router *mux.Router) {
+		router.Methods("GET").Path("/tiles/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.mvt").HandlerFunc(handleMvt(source))
+		router.Methods("GET").Path("/tiles/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png").HandlerFunc(handlePng(source))
+	}
+}
+
+// Parses the tile of the url.
+func tileOf(r *http.Request) (t geo.Tile, err error) {
+	vars := mux.Vars(r)
+	coordinates := []*int{&t.Z, &t.X, &t.Y}
+	for i, name := range []string{"z", "x", "y"} {
+		if *coordinates[i], err = strconv.Atoi(vars[name]); err != nil {
+			return
+		}
+	}
+	return t, t.Validate()
+}
+
+func handleMvt(source Source) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+
+		t, err := tileOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter, err := eventFilter(r, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		layers := make(map[string][]point)
+		if layers["cabs"], err = source.cabs(t, tally.CabStatus(r.FormValue("status")), Buffer); err == nil {
+			if t.Z < ClusterZoom {
+				layers["cabs"] = cluster(layers["cabs"])
+				layers["events"], err = source.counts(t, filter, Buffer, Extent/clusterCell)
+			} else {
+				layers["events"], err = source.events(t, filter, Buffer)
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		buff, err := encode(layers, "cabs", "events")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ContentTypeMvt)
+		w.Write(buff)
+	}
+}
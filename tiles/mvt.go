@@ -0,0 +1,112 @@
+package tiles
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/gyokuro/tally/proto/vector_tile"
+	"math"
+)
+
+// Media type of Mapbox vector tiles
+const ContentTypeMvt = "application/vnd.mapbox-vector-tile"
+
+// Geometry commands, with their count in the upper bits
+const (
+	commandMoveTo = 1
+)
+
+// Builder of a layer of a vector tile, sharing the keys and values among its features
+type layer struct {
+	pb     *vector_tile.Tile_Layer
+	keys   map[string]uint32
+	values map[interface{}]uint32
+}
+
+func newLayer(name string) *layer {
+	return &layer{
+		pb: &vector_tile.Tile_Layer{
+			Version: proto.Uint32(2),
+			Name:    proto.String(name),
+			Extent:  proto.Uint32(Extent),
+		},
+		keys:   make(map[string]uint32),
+		values: make(map[interface{}]uint32),
+	}
+}
+
+// Returns the index of the key in the layer, adding it if new.
+func (l *layer) key(k string) uint32 {
+	i, exists := l.keys[k]
+	if !exists {
+		i = uint32(len(l.pb.Keys))
+		l.keys[k] = i
+		l.pb.Keys = append(l.pb.Keys, k)
+	}
+	return i
+}
+
+// Returns the index of the value in the layer, adding it if new.
+func (l *layer) value(v interface{}) uint32 {
+	i, exists := l.values[v]
+	if exists {
+		return i
+	}
+	pb := &vector_tile.Tile_Value{}
+	switch x := v.(type) {
+	case string:
+		pb.StringValue = proto.String(x)
+	case int64:
+		pb.SintValue = proto.Int64(x)
+	case uint64:
+		pb.UintValue = proto.Uint64(x)
+	case float64:
+		pb.DoubleValue = proto.Float64(x)
+	case bool:
+		pb.BoolValue = proto.Bool(x)
+	}
+	i = uint32(len(l.pb.Values))
+	l.values[v] = i
+	l.pb.Values = append(l.pb.Values, pb)
+	return i
+}
+
+// Adds the point as a feature.  Properties with a key already set are left out.
+func (l *layer) add(p point) {
+	f := &vector_tile.Tile_Feature{
+		Type:     vector_tile.Tile_POINT.Enum(),
+		Geometry: []uint32{commandMoveTo | 1<<3, zigzag(p.x), zigzag(p.y)},
+	}
+	if p.id != 0 {
+		f.Id = proto.Uint64(p.id)
+	}
+	set := make(map[string]bool)
+	for _, prop := range p.props {
+		if !set[prop.key] {
+			set[prop.key] = true
+			f.Tags = append(f.Tags, l.key(prop.key), l.value(prop.value))
+		}
+	}
+	l.pb.Features = append(l.pb.Features, f)
+}
+
+// Returns the parameter of a geometry command: the coordinate rounded, zigzag encoded so that small
+// negative numbers are small too.
+func zigzag(coordinate float64) uint32 {
+	n := int32(math.Floor(coordinate + 0.5))
+	return uint32((n << 1) ^ (n >> 31))
+}
+
+// Encodes the layers of points as a vector tile.  Layers without points are left out.
+func encode(layers map[string][]point, order ...string) ([]byte, error) {
+	tile := &vector_tile.Tile{}
+	for _, name := range order {
+		if len(layers[name]) == 0 {
+			continue
+		}
+		l := newLayer(name)
+		for _, p := range layers[name] {
+			l.add(p)
+		}
+		tile.Layers = append(tile.Layers, l.pb)
+	}
+	return proto.Marshal(tile)
+}
@@ -0,0 +1,185 @@
+package tiles
+
+import (
+	"bytes"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"image"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Size of the image tiles in pixels
+const TileSize = 256
+
+// Radius in pixels of the heat of each event
+const heatRadius = 16.
+
+// Density at which the heat reaches the top of the ramp, by default: about that many events at
+// the same place
+const defaultHeatMax = 8.
+
+// Layers drawn by default, bottom up
+const defaultImageLayers = "heat,tracks,cabs"
+
+// Options of an image tile
+type imageOptions struct {
+	layers  []string
+	ramp    Ramp
+	heatMax float64
+	status  tally.CabStatus
+	filter  tally.EventQuery
+}
+
+// Parses the options of an image tile from the url parameters: layers, ramp, max (the density
+// at the top of the ramp, finite and positive), and the filters of cabs and events as by
+// eventFilter.
+func parseImageOptions(r *http.Request) (o imageOptions, err error) {
+	o.layers = strings.Split(defaultImageLayers, ",")
+	if s := r.FormValue("layers"); s != "" {
+		o.layers = strings.Split(s, ",")
+	}
+	o.ramp = DefaultRamp
+	if s := r.FormValue("ramp"); s != "" {
+		if o.ramp, err = ParseRamp(s); err != nil {
+			return
+		}
+	}
+	o.heatMax = defaultHeatMax
+	if s := r.FormValue("max"); s != "" {
+		o.heatMax, err = strconv.ParseFloat(s, 64)
+		if err == nil && !(o.heatMax > 0 && !math.IsInf(o.heatMax, 1)) {
+			err = tally.ErrorBadParam
+		}
+		if err != nil {
+			return
+		}
+	}
+	o.status = tally.CabStatus(r.FormValue("status"))
+	o.filter, err = eventFilter(r, time.Now())
+	return
+}
+
+// Renders the layers of the tile: the density of the events as heat, the tracks of the events of
+// each source in time order, and the cabs colored by status.
+func (s Source) render(t geo.Tile, o imageOptions) (*image.RGBA, error) {
+	img := image.NewRGBA(image.Rect(0, 0, TileSize, TileSize))
+	for _, name := range o.layers {
+		var err error
+		switch name {
+		case "heat":
+			err = s.renderHeat(img, t, o)
+		case "tracks":
+			err = s.renderTracks(img, t, o)
+		case "cabs":
+			err = s.renderCabs(img, t, o)
+		default:
+			err = tally.ErrorBadParam
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+func (s Source) renderHeat(img *image.RGBA, t geo.Tile, o imageOptions) error {
+	// Counted per pixel by the store, the events of each at their mean location
+	points, err := s.counts(t, o.filter, heatRadius/TileSize, TileSize)
+	if err != nil {
+		return err
+	}
+	// Gaussian kernel, of which the radius is three standard deviations
+	density := make([]float64, TileSize*TileSize)
+	sigma2 := 2 * (heatRadius / 3) * (heatRadius / 3)
+	for _, p := range points {
+		count, _ := p.prop("point_count").(int64)
+		x0, y0 := p.x*TileSize/Extent, p.y*TileSize/Extent
+		for y := int(math.Max(0, y0-heatRadius)); y < int(math.Min(TileSize, y0+heatRadius+1)); y++ {
+			for x := int(math.Max(0, x0-heatRadius)); x < int(math.Min(TileSize, x0+heatRadius+1)); x++ {
+				dx, dy := float64(x)+.5-x0, float64(y)+.5-y0
+				density[y*TileSize+x] += float64(count) * math.Exp(-(dx*dx+dy*dy)/sigma2)
+			}
+		}
+	}
+	for i, d := range density {
+		if d > 0.01 {
+			blend(img, i%TileSize, i/TileSize, o.ramp.At(d/o.heatMax))
+		}
+	}
+	return nil
+}
+
+func (s Source) renderTracks(img *image.RGBA, t geo.Tile, o imageOptions) error {
+	// Half a tile around, for the segments to the events just outside
+	points, err := s.events(t, o.filter, .5)
+	if err != nil {
+		return err
+	}
+	last := make(map[string]point)
+	for _, p := range points {
+		source, _ := p.prop("source").(string)
+		x, y := p.x*TileSize/Extent, p.y*TileSize/Extent
+		c := trackColor(source)
+		if previous, exists := last[source]; exists {
+			line(img, previous.x, previous.y, x, y, 2., c)
+		}
+		disc(img, x, y, 2., c)
+		last[source] = point{x: x, y: y}
+	}
+	return nil
+}
+
+func (s Source) renderCabs(img *image.RGBA, t geo.Tile, o imageOptions) error {
+	points, err := s.cabs(t, o.status, 6./TileSize)
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		status, _ := p.prop("status").(string)
+		c, exists := cabColors[tally.CabStatus(status)]
+		if !exists {
+			c = cabOtherColor
+		}
+		x, y := p.x*TileSize/Extent, p.y*TileSize/Extent
+		disc(img, x, y, 5., cabOutlineColor)
+		disc(img, x, y, 4., c)
+	}
+	return nil
+}
+
+func handlePng(source Source) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+
+		t, err := tileOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		o, err := parseImageOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		img, err := source.render(t, o)
+		if err == tally.ErrorBadParam {
+			http.Error(w, "Layers must be heat, tracks or cabs", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		buff := &bytes.Buffer{}
+		if err := png.Encode(buff, img); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buff.Bytes())
+	}
+}
@@ -0,0 +1,110 @@
+package tiles
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/impl"
+	"github.com/gyokuro/tally/proto"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"testing"
+)
+
+func TestRamp(test *testing.T) {
+	ramp, err := ParseRamp("0000ff00, #ff0000")
+	if err != nil || len(ramp) != 2 || ramp[1] != (color.NRGBA{255, 0, 0, 255}) {
+		test.Fatal("Expecting transparent blue to red", ramp, err)
+	}
+	if c := ramp.At(.5); c != (color.NRGBA{128, 0, 128, 128}) {
+		test.Error("Expecting half way", c)
+	}
+	if ramp.At(-1) != ramp[0] || ramp.At(2) != ramp[1] || ramp.At(math.NaN()) != ramp[0] {
+		test.Error("Expecting the ends beyond the range")
+	}
+	for _, s := range []string{"ff0000", "ff0000,blue", "ff00,00ff00"} {
+		if _, err := ParseRamp(s); err != errRamp {
+			test.Error("Expecting errRamp for", s, err)
+		}
+	}
+}
+
+// Returns an event of the source at the place.
+func walk(source string, seconds, lat, lon float64) Tally.Event {
+	return Tally.Event{
+		Timestamp: proto.Float64(seconds),
+		Type:      proto.String("location"),
+		Source:    proto.String(source),
+		Location:  &Tally.Location{Lat: proto.Float64(lat), Lon: proto.Float64(lon)},
+	}
+}
+
+func TestRender(test *testing.T) {
+	cabs, events := impl.NewSimpleCabService(), impl.NewSimpleEventStore()
+	source := Source{Cabs: cabs, Events: events}
+	t := geo.Tile{Z: 16, X: 10484, Y: 25332}
+	b := t.Bounds(0)
+	lat, lon := (b.North+b.South)/2, (b.West+b.East)/2
+	cabs.Upsert(tally.Cab{Id: 1, Latitude: lat, Longitude: lon, Status: tally.CabDispatched})
+
+	// A walk across the tile, out of order, and 3 events at its north west quarter
+	events.Put([]Tally.Event{
+		walk("walker", 2, lat, b.East+.001), walk("walker", 1, lat, b.West-.001),
+		walk("sitter", 1, (lat+b.North)/2, (lon+b.West)/2),
+		walk("sitter", 2, (lat+b.North)/2, (lon+b.West)/2),
+		walk("sitter", 3, (lat+b.North)/2, (lon+b.West)/2),
+	})
+
+	img, err := source.render(t, imageOptions{layers: []string{"heat", "tracks", "cabs"}, ramp: DefaultRamp, heatMax: 8})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if c := img.At(128, 128).(color.RGBA); c != (color.RGBA{255, 127, 14, 255}) {
+		test.Error("Expecting the dispatched cab in the middle", c)
+	}
+	walker := trackColor("walker")
+	if c := img.At(20, 128).(color.RGBA); c != (color.RGBA{walker.R, walker.G, walker.B, 255}) {
+		test.Error("Expecting the track across the tile", c, walker)
+	}
+	if c := img.At(72, 64).(color.RGBA); c.A == 0 || c.R != 0 {
+		test.Error("Expecting the heat of 3 events", c)
+	}
+	if c := img.At(250, 5).(color.RGBA); c.A != 0 {
+		test.Error("Expecting nothing in the corner", c)
+	}
+	if _, err := source.render(t, imageOptions{layers: []string{"roads"}}); err != tally.ErrorBadParam {
+		test.Error("Expecting ErrorBadParam for an unknown layer", err)
+	}
+}
+
+func TestPng(test *testing.T) {
+	server := testServer(test)
+	defer server.Close()
+
+	x, y := geo.Mercator(37.7705, -122.395, 16)
+	resp, err := http.Get(fmt.Sprintf("%s/tiles/16/%d/%d.png?layers=cabs", server.URL, int(x), int(y)))
+	if err != nil {
+		test.Fatal(err)
+	}
+	img, err := png.Decode(resp.Body)
+	if err != nil || resp.Header.Get("Content-Type") != "image/png" || img.Bounds().Dx() != TileSize {
+		test.Fatal("Expecting a png tile", resp.Header, err)
+	}
+	px, py := int((x-float64(int(x)))*TileSize), int((y-float64(int(y)))*TileSize)
+	if _, _, _, a := img.At(px, py).RGBA(); a == 0 {
+		test.Error("Expecting cab 8 drawn", px, py)
+	}
+
+	for _, query := range []string{"layers=roads", "ramp=red", "max=0", "max=NaN", "max=-Inf", "max=Inf", "from=today"} {
+		resp, err := http.Get(fmt.Sprintf("%s/tiles/16/%d/%d.png?%s", server.URL, int(x), int(y), query))
+		if err != nil {
+			test.Fatal(err)
+		}
+		if resp.StatusCode != 400 {
+			test.Error("Expecting 400 for", query, resp.StatusCode)
+		}
+	}
+}
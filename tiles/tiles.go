@@ -0,0 +1,226 @@
+// Package tiles serves the cabs and events as map tiles, in slippy map tile coordinates, so that
+// web maps draw them without loading every point as json.
+package tiles
+
+import (
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/proto"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Size of the square within which points of a tile are positioned, as is usual for vector tiles
+const Extent = 4096
+
+// Points within this fraction of the tile's size around it are included in vector tiles, so that
+// symbols on the edges are not cut off
+const Buffer = 1. / 64.
+
+// Zoom from which points are not clustered
+const ClusterZoom = 14
+
+// Size of the cells points are clustered in, in units of the extent
+const clusterCell = Extent / 64
+
+// Longest time range of the events of a tile, and the range up to now of those of tiles without
+// one
+const MaxSpan = 7 * 24 * time.Hour
+
+// Most events loaded for a tile, the earliest of the time range
+const MaxPoints = 10000
+
+// Sources of the points of the tiles.  Events is nil if no events are kept.
+type Source struct {
+	Cabs   tally.CabService
+	Events tally.EventStore
+}
+
+// Property of a feature: a string, int64, uint64, float64 or bool
+type property struct {
+	key   string
+	value interface{}
+}
+
+// Point of a layer, at its position in the tile
+type point struct {
+	x, y  float64
+	id    uint64
+	props []property
+}
+
+// Returns the cabs in the tile and the buffer around it, a fraction of the tile's size, of the
+// status unless it is empty.
+func (s Source) cabs(t geo.Tile, status tally.CabStatus, buffer float64) ([]point, error) {
+	cabs, err := s.Cabs.QueryRegion(region(t, buffer))
+	if err != nil {
+		return nil, err
+	}
+	points := make([]point, 0, len(cabs))
+	for _, cab := range cabs {
+		if status != "" && cab.Status != status {
+			continue
+		}
+		p := point{id: uint64(cab.Id), props: []property{{"id", uint64(cab.Id)}}}
+		if cab.Status != "" {
+			p.props = append(p.props, property{"status", string(cab.Status)})
+		}
+		p.x, p.y = t.Point(cab.Latitude, cab.Longitude, Extent)
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+// Returns the filter of events from the url parameters, as by tally.EventFilter, bounded in time:
+// by default the MaxSpan up to now, or from or up to the time given.  Returns ErrorBadParam for
+// longer ranges.
+func eventFilter(r *http.Request, now time.Time) (tally.EventQuery, error) {
+	filter, err := tally.EventFilter(r)
+	if err != nil {
+		return filter, err
+	}
+	switch {
+	case filter.From.IsZero() && filter.To.IsZero():
+		filter.From, filter.To = now.Add(-MaxSpan), now
+	case filter.From.IsZero():
+		filter.From = filter.To.Add(-MaxSpan)
+	case filter.To.IsZero():
+		filter.To = filter.From.Add(MaxSpan)
+	case filter.To.Sub(filter.From) > MaxSpan:
+		return filter, tally.ErrorBadParam
+	}
+	return filter, nil
+}
+
+// Returns the events matching the filter in the tile and the buffer around it, in time order, with
+// their type, source, context, timestamp in RFC 3339 and attributes as properties, at most
+// MaxPoints of them.  Content attributes are left out.
+func (s Source) events(t geo.Tile, filter tally.EventQuery, buffer float64) ([]point, error) {
+	if s.Events == nil {
+		return nil, nil
+	}
+	r := region(t, buffer)
+	filter.Within, filter.Region, filter.Limit = nil, &r, MaxPoints
+	events, err := s.Events.Find(filter)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]point, 0, len(events))
+	for _, event := range events {
+		if event.Location == nil {
+			continue
+		}
+		p := point{props: []property{
+			{"type", event.GetType()},
+			{"source", event.GetSource()},
+			{"timestamp", tally.EventTime(&event).UTC().Format(time.RFC3339Nano)},
+		}}
+		if event.Context != nil {
+			p.props = append(p.props, property{"context", event.GetContext()})
+		}
+		p.props = append(p.props, attributes(event.Attributes)...)
+		p.x, p.y = t.Point(event.Location.GetLat(), event.Location.GetLon(), Extent)
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+// Returns the events matching the filter in the tile and the buffer around it counted by the
+// store, in cells of the tile divided that many times across, as points at the mean locations of
+// the events in each with properties cluster and point_count.  Rows are even in latitude rather
+// than in the tile's projection.
+func (s Source) counts(t geo.Tile, filter tally.EventQuery, buffer float64, divisions int) ([]point, error) {
+	if s.Events == nil {
+		return nil, nil
+	}
+	b := t.Bounds(0)
+	grid := tally.Grid{
+		South:  b.South,
+		West:   b.West,
+		Height: (b.North - b.South) / float64(divisions),
+		Width:  360. / math.Exp2(float64(t.Z)) / float64(divisions),
+	}
+	filter.Within, filter.Region = nil, nil
+	cells, err := s.Events.Count(filter, t.Bounds(buffer), grid)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]point, len(cells))
+	for i, cell := range cells {
+		points[i].props = []property{{"cluster", true}, {"point_count", int64(cell.Count)}}
+		points[i].x, points[i].y = t.Point(cell.Latitude, cell.Longitude, Extent)
+	}
+	return points, nil
+}
+
+// Returns the scalar values of the attributes as properties.
+func attributes(attrs []*Tally.Attribute) []property {
+	props := make([]property, 0, len(attrs))
+	for _, a := range attrs {
+		var value interface{}
+		switch {
+		case a.StringValue != nil:
+			value = a.GetStringValue()
+		case a.IntValue != nil:
+			value = a.GetIntValue()
+		case a.DoubleValue != nil:
+			value = a.GetDoubleValue()
+		case a.BoolValue != nil:
+			value = a.GetBoolValue()
+		default:
+			continue
+		}
+		props = append(props, property{a.GetKey(), value})
+	}
+	return props
+}
+
+// Returns the region of the tile and the buffer around it.
+func region(t geo.Tile, buffer float64) tally.GeoRegion {
+	return tally.HeatmapQuery{Bounds: t.Bounds(buffer)}.Region()
+}
+
+// Returns the value of the property, or nil.
+func (p point) prop(key string) interface{} {
+	for _, prop := range p.props {
+		if prop.key == key {
+			return prop.value
+		}
+	}
+	return nil
+}
+
+// Returns the points merged by the cells of the grid they are in, each cell with more than one
+// point becoming a point at their mean position with properties cluster and point_count.
+func cluster(points []point) []point {
+	type cell struct{ x, y int }
+	cells := make(map[cell][]point)
+	order := make([]cell, 0)
+	for _, p := range points {
+		c := cell{int(math.Floor(p.x / clusterCell)), int(math.Floor(p.y / clusterCell))}
+		if _, exists := cells[c]; !exists {
+			order = append(order, c)
+		}
+		cells[c] = append(cells[c], p)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return order[i].y < order[j].y || order[i].y == order[j].y && order[i].x < order[j].x
+	})
+	clustered := make([]point, 0, len(cells))
+	for _, c := range order {
+		members := cells[c]
+		if len(members) == 1 {
+			clustered = append(clustered, members[0])
+			continue
+		}
+		merged := point{props: []property{{"cluster", true}, {"point_count", int64(len(members))}}}
+		for _, p := range members {
+			merged.x += p.x / float64(len(members))
+			merged.y += p.y / float64(len(members))
+		}
+		clustered = append(clustered, merged)
+	}
+	return clustered
+}
@@ -0,0 +1,169 @@
+package tiles
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gyokuro/tally"
+	"github.com/gyokuro/tally/geo"
+	"github.com/gyokuro/tally/impl"
+	"github.com/gyokuro/tally/proto/vector_tile"
+	"github.com/gyokuro/tally/tallytest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Returns a server of the tiles of the region fixtures, each cab with an event where it is.
+func testServer(test *testing.T) *httptest.Server {
+	cabs, events := impl.NewSimpleCabService(), impl.NewSimpleEventStore()
+	for _, cab := range tallytest.RegionCabs {
+		cab.Status = tally.CabAvailable
+		if cab.Id%2 == 0 {
+			cab.Status = tally.CabDispatched
+		}
+		if err := cabs.Upsert(cab); err != nil {
+			test.Fatal(err)
+		}
+	}
+	if err := events.Put(tallytest.Events(3, "pickup")); err != nil {
+		test.Fatal(err)
+	}
+	router := mux.NewRouter()
+	Routes(Source{Cabs: cabs, Events: events})(router)
+	return httptest.NewServer(router)
+}
+
+// Returns the tile decoded, and its layers by name.
+func getTile(test *testing.T, server *httptest.Server, path string) (int, map[string]*vector_tile.Tile_Layer) {
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		test.Fatal(err)
+	}
+	buff, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		test.Fatal(err)
+	}
+	layers := make(map[string]*vector_tile.Tile_Layer)
+	if resp.StatusCode != 200 {
+		return resp.StatusCode, layers
+	}
+	if resp.Header.Get("Content-Type") != ContentTypeMvt {
+		test.Error("Expecting the vector tile type", resp.Header)
+	}
+	tile := &vector_tile.Tile{}
+	if err := proto.Unmarshal(buff, tile); err != nil {
+		test.Fatal(err)
+	}
+	for _, l := range tile.Layers {
+		layers[l.GetName()] = l
+	}
+	return resp.StatusCode, layers
+}
+
+// Returns the properties of the feature.
+func properties(l *vector_tile.Tile_Layer, f *vector_tile.Tile_Feature) map[string]interface{} {
+	props := make(map[string]interface{})
+	for i := 0; i+1 < len(f.Tags); i += 2 {
+		v := l.Values[f.Tags[i+1]]
+		var value interface{}
+		switch {
+		case v.StringValue != nil:
+			value = v.GetStringValue()
+		case v.SintValue != nil:
+			value = v.GetSintValue()
+		case v.UintValue != nil:
+			value = v.GetUintValue()
+		case v.DoubleValue != nil:
+			value = v.GetDoubleValue()
+		case v.BoolValue != nil:
+			value = v.GetBoolValue()
+		}
+		props[l.Keys[f.Tags[i]]] = value
+	}
+	return props
+}
+
+func TestMvt(test *testing.T) {
+	server := testServer(test)
+	defer server.Close()
+
+	// Cab 8 at zoom 16
+	x, y := geo.Mercator(37.7705, -122.395, 16)
+	status, layers := getTile(test, server, fmt.Sprintf("/tiles/16/%d/%d.mvt", int(x), int(y)))
+	cabs := layers["cabs"]
+	if status != 200 || cabs == nil || len(cabs.Features) != 1 || cabs.GetExtent() != Extent || cabs.GetVersion() != 2 {
+		test.Fatal("Expecting cab 8", status, layers)
+	}
+	f := cabs.Features[0]
+	props := properties(cabs, f)
+	if f.GetId() != 8 || f.GetType() != vector_tile.Tile_POINT || props["id"] != uint64(8) || props["status"] != "dispatched" {
+		test.Error("Expecting the properties of cab 8", f, props)
+	}
+	px, py := int32(f.Geometry[1]>>1)^-int32(f.Geometry[1]&1), int32(f.Geometry[2]>>1)^-int32(f.Geometry[2]&1)
+	if len(f.Geometry) != 3 || f.Geometry[0] != 9 || px != int32((x-float64(int(x)))*Extent+.5) ||
+		py != int32((y-float64(int(y)))*Extent+.5) {
+		test.Error("Expecting a point at the cab", f.Geometry, px, py)
+	}
+	if layers["events"] != nil {
+		test.Error("Expecting no events layer", layers["events"])
+	}
+
+	// Events at the first cab of the fixtures, filtered by time
+	x, y = geo.Mercator(tallytest.Cabs[0].Latitude, tallytest.Cabs[0].Longitude, 16)
+	_, layers = getTile(test, server, fmt.Sprintf("/tiles/16/%d/%d.mvt?from=2014-05-13T16:53:21Z", int(x), int(y)))
+	events := layers["events"]
+	if events == nil || len(events.Features) != 2 {
+		test.Fatal("Expecting 2 events", layers)
+	}
+	props = properties(events, events.Features[0])
+	if props["type"] != "pickup" || props["source"] != "tallytest" || props["timestamp"] != "2014-05-13T16:53:21Z" ||
+		props["index"] != int64(1) {
+		test.Error("Expecting the properties of the event", props)
+	}
+
+	// Clusters of the cabs in San Francisco at zoom 6, filtered by status
+	x, y = geo.Mercator(37.77, -122.42, 6)
+	_, layers = getTile(test, server, fmt.Sprintf("/tiles/6/%d/%d.mvt?status=available", int(x), int(y)))
+	total := int64(0)
+	clusters := 0
+	for _, f := range layers["cabs"].Features {
+		props := properties(layers["cabs"], f)
+		if props["cluster"] == true {
+			clusters++
+			total += props["point_count"].(int64)
+		} else {
+			total++
+		}
+	}
+	if clusters == 0 || total != 4 {
+		test.Error("Expecting the available cabs 1, 3, 7 and 9 clustered", clusters, total)
+	}
+
+	// The events counted in one cluster at zoom 6, and none in the week up to now
+	x, y = geo.Mercator(tallytest.Cabs[0].Latitude, tallytest.Cabs[0].Longitude, 6)
+	_, layers = getTile(test, server, fmt.Sprintf("/tiles/6/%d/%d.mvt?from=2014-05-13T16:53:20Z", int(x), int(y)))
+	events = layers["events"]
+	if events == nil || len(events.Features) != 1 {
+		test.Fatal("Expecting a cluster of the events", layers)
+	}
+	props = properties(events, events.Features[0])
+	px, py = int32(events.Features[0].Geometry[1]>>1)^-int32(events.Features[0].Geometry[1]&1),
+		int32(events.Features[0].Geometry[2]>>1)^-int32(events.Features[0].Geometry[2]&1)
+	if props["cluster"] != true || props["point_count"] != int64(3) ||
+		px != int32((x-float64(int(x)))*Extent+.5) || py != int32((y-float64(int(y)))*Extent+.5) {
+		test.Error("Expecting the 3 events at the first cab", props, px, py)
+	}
+	_, layers = getTile(test, server, fmt.Sprintf("/tiles/6/%d/%d.mvt", int(x), int(y)))
+	if layers["events"] != nil {
+		test.Error("Expecting no events in the last week", layers["events"])
+	}
+
+	for _, path := range []string{"/tiles/2/4/0.mvt", "/tiles/25/0/0.mvt", "/tiles/3/1/1.mvt?from=today",
+		"/tiles/3/1/1.mvt?from=2014-05-01T00:00:00Z&to=2014-05-09T00:00:00Z"} {
+		if status, _ := getTile(test, server, path); status != 400 {
+			test.Error("Expecting 400 for", path, status)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package tally
+
+import (
+	"time"
+)
+
+// Kind of an entry of a timeline
+type TimelineKind string
+
+const (
+	TimelineEvent TimelineKind = "event"
+	TimelineStay  TimelineKind = "stay"
+	TimelineTrip  TimelineKind = "trip"
+)
+
+// Entry of a timeline: an event, a stay or a trip, from its start to its end in the time zone of
+// the timeline.  Instant events end when they start.  Attributes of events are summarized by
+// their values, lists and maps in full, and contents by their mime type, size and hash if stored
+// out of line.
+type TimelineEntry struct {
+	Kind       TimelineKind           `json:"kind"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Id         string                 `json:"id,omitempty"`
+	Type       string                 `json:"type,omitempty"`
+	Context    string                 `json:"context,omitempty"`
+	Tags       []string               `json:"tags,omitempty"`
+	Location   *Location              `json:"location,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Place      *Place                 `json:"place,omitempty"` // of a stay at a known place
+	Trip       *Trip                  `json:"trip,omitempty"`
+}
+
+// Day of a source: its events, stays and trips in chronological order, from midnight to midnight
+// in the time zone.  Interval events, stays and trips across midnight are included in full.  The
+// totals are of the trips departing in the day.
+type Timeline struct {
+	Source   string          `json:"source"`
+	TimeZone string          `json:"timeZone"`
+	Start    time.Time       `json:"start"`
+	End      time.Time       `json:"end"`
+	Entries  []TimelineEntry `json:"entries"`
+	Events   int             `json:"events"`
+	Trips    int             `json:"trips"`
+	Distance float64         `json:"distance"` // in meters
+	Travel   time.Duration   `json:"travel"`
+}
+
+// Service interface for the daily timelines of the sources.
+type TimelineService interface {
+
+	// Returns the timeline of the source on the day of the date, in the date's location.  Days
+	// are 23 or 25 hours long across daylight saving changes.  Stays and trips are as last
+	// detected.
+	Day(source string, date time.Time) (Timeline, error)
+}
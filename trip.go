@@ -0,0 +1,108 @@
+package tally
+
+import (
+	"time"
+)
+
+// Type of the events derived from the trips of a source.  They are located at the origin, at the
+// time of departure, with the rest of the trip in their attributes.
+const TripEventType = "trip"
+
+// Means of travel of a trip, guessed from its speeds
+type TravelMode string
+
+const (
+	ModeWalk    TravelMode = "walk"
+	ModeBike    TravelMode = "bike"
+	ModeDrive   TravelMode = "drive"
+	ModeTransit TravelMode = "transit" // bus or train, stopping regularly
+	ModeFlight  TravelMode = "flight"
+)
+
+// Travel of a source between two stays.  The distance in meters is along the fixes, and the
+// speeds are in meters per second.  Trips starting or ending at a known place have its id.
+type Trip struct {
+	Source       string     `json:"source"`
+	Origin       Location   `json:"origin"`
+	Destination  Location   `json:"destination"`
+	Departed     time.Time  `json:"departed"`
+	Arrived      time.Time  `json:"arrived"`
+	FromPlace    Id         `json:"fromPlace,omitempty"`
+	ToPlace      Id         `json:"toPlace,omitempty"`
+	Distance     float64    `json:"distance"`
+	AverageSpeed float64    `json:"averageSpeed"`
+	PeakSpeed    float64    `json:"peakSpeed"`
+	Mode         TravelMode `json:"mode"`
+}
+
+// Returns how long the trip lasted.
+func (t Trip) Duration() time.Duration {
+	return t.Arrived.Sub(t.Departed)
+}
+
+// Query for the trips of a source under way in a time range, and tallied if departing in it.
+// Empty fields match all trips.
+type TripQuery struct {
+	Source string
+	Mode   TravelMode
+	From   time.Time
+	To     time.Time
+
+	// Trips between any two of the places, e.g. home and work for the commutes.
+	Places []Id
+
+	// Calendar periods tallied in the location of From, e.g. weeks, the first holding From; the
+	// whole range if empty.
+	Period Period
+}
+
+// Validates the query.  Returns ErrorBadParam if periods are unknown or have no range.
+func (q TripQuery) Validate() error {
+	if q.Period != "" && (q.Period.Validate() != nil || q.From.IsZero() || q.To.IsZero()) {
+		return ErrorBadParam
+	}
+	if !q.To.IsZero() && q.To.Before(q.From) {
+		return ErrorBadParam
+	}
+	return nil
+}
+
+// Returns true if the trip matches the mode and places of the query.
+func (q TripQuery) Matches(t Trip) bool {
+	if q.Mode != "" && t.Mode != q.Mode {
+		return false
+	}
+	if len(q.Places) == 0 {
+		return true
+	}
+	from, to := false, false
+	for _, id := range q.Places {
+		from = from || t.FromPlace == id
+		to = to || t.ToPlace == id
+	}
+	return from && to && t.FromPlace != t.ToPlace
+}
+
+// Totals of the trips departing in a period, e.g. the time spent commuting in a week or the
+// meters walked.
+type TripTally struct {
+	Start    time.Time     `json:"start"`
+	Trips    int           `json:"trips"`
+	Distance float64       `json:"distance"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Service interface for the trips of the sources of location events.
+type TripService interface {
+
+	// Splits all the location events of the source into stays and the trips between them,
+	// guessing the mode of each trip.  The trips replace those derived before as events of the
+	// TripEventType.  Returns the trips in time order.
+	Detect(source string) ([]Trip, error)
+
+	// Returns the trips matching the query in time order.
+	Trips(query TripQuery) ([]Trip, error)
+
+	// Returns the totals of the trips matching the query for each period in the range.
+	Tally(query TripQuery) ([]TripTally, error)
+}
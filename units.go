@@ -0,0 +1,76 @@
+package tally
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gyokuro/tally/geo"
+	"strings"
+)
+
+var ErrorUnknownUnit = errors.New("Unknown distance unit")
+
+// Symbols of the distance units, by unit
+var unitSymbols = []string{"m", "km", "ft", "mi"}
+
+// Length of each unit in meters
+var unitMeters = []float64{1., 1000., 0.3048, 1609.344}
+
+// Parses the symbol or name of a unit, e.g. "km" or "kilometers", ignoring case.
+func ParseDistanceUnit(s string) (DistanceUnit, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "m", "meter", "meters", "metre", "metres":
+		return Meters, nil
+	case "km", "kilometer", "kilometers", "kilometre", "kilometres":
+		return Kilometers, nil
+	case "ft", "foot", "feet":
+		return Feet, nil
+	case "mi", "mile", "miles":
+		return Miles, nil
+	}
+	return Meters, ErrorUnknownUnit
+}
+
+// Returns the symbol of the unit, e.g. "km".
+func (u DistanceUnit) String() string {
+	if u >= 0 && int(u) < len(unitSymbols) {
+		return unitSymbols[u]
+	}
+	return "unknown"
+}
+
+// Converts the distance in the unit to meters.
+func (u DistanceUnit) Meters(d float64) float64 {
+	if u >= 0 && int(u) < len(unitMeters) {
+		return d * unitMeters[u]
+	}
+	return d
+}
+
+// Converts the distance in meters to the unit.
+func (u DistanceUnit) FromMeters(d float64) float64 {
+	return d / u.Meters(1.)
+}
+
+// Implements json.Unmarshaler.  Accepts the symbol or name, or the number of the unit as it is
+// written, e.g. in tariffs.
+func (u *DistanceUnit) UnmarshalJSON(buff []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(buff, &s); err == nil {
+		*u, err = ParseDistanceUnit(s)
+		return
+	}
+	var n int
+	if err = json.Unmarshal(buff, &n); err != nil {
+		return
+	}
+	if n < 0 || n >= len(unitSymbols) {
+		return ErrorUnknownUnit
+	}
+	*u = DistanceUnit(n)
+	return
+}
+
+// Returns the bounding box of the query's circle.
+func (q GeoWithin) Bounds() geo.Box {
+	return geo.BoundingBox(q.Center.Latitude, q.Center.Longitude, q.Unit.Meters(q.Radius))
+}
@@ -0,0 +1,144 @@
+package tally
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/gyokuro/tally/proto"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Calendar period of the buckets of tallies, in local time
+type Period string
+
+const (
+	PeriodDay   Period = "day"
+	PeriodWeek  Period = "week" // from Monday
+	PeriodMonth Period = "month"
+)
+
+// Validates the period.  Returns ErrorBadParam if unknown.
+func (p Period) Validate() error {
+	switch p {
+	case PeriodDay, PeriodWeek, PeriodMonth:
+		return nil
+	}
+	return ErrorBadParam
+}
+
+// Returns the start of the period holding the time, in its location: the local midnight of the
+// day, of the Monday of the week, or of the first of the month.
+func (p Period) Start(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch p {
+	case PeriodWeek:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case PeriodMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+	return day
+}
+
+// Returns the start of the period after the one starting at start.  Periods are of calendar
+// days, so those across daylight saving changes are an hour shorter or longer.
+func (p Period) Next(start time.Time) time.Time {
+	switch p {
+	case PeriodWeek:
+		return start.AddDate(0, 0, 7)
+	case PeriodMonth:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// Returns the starts of the periods from the one holding from up to to, in the location of from.
+func Buckets(from, to time.Time, p Period) []time.Time {
+	starts := make([]time.Time, 0)
+	for start := p.Start(from); start.Before(to); start = p.Next(start) {
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// Returns the index of the bucket holding the time, given the starts of the buckets, or -1 if
+// before the first.
+func BucketOf(starts []time.Time, t time.Time) int {
+	return sort.Search(len(starts), func(i int) bool { return starts[i].After(t) }) - 1
+}
+
+// IANA time zones of the sources, e.g. {"alice": "America/Los_Angeles"}, for the local times of
+// their events and the buckets of their tallies.
+type Zones map[string]string
+
+// Validates the zones.  Returns the error of the first that is not known.
+func (z Zones) Validate() error {
+	for _, name := range z {
+		if _, err := LoadZone(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the time zone of the source, or UTC if not known.
+func (z Zones) Of(source string) *time.Location {
+	if zone, err := LoadZone(z[source]); err == nil {
+		return zone
+	}
+	return time.UTC
+}
+
+// Returns the local time of the event: in its own time zone, or else in its source's.
+func (z Zones) LocalTime(event *Tally.Event) time.Time {
+	if event.TimeZone != nil {
+		if zone, err := LoadZone(event.GetTimeZone()); err == nil {
+			return EventTime(event).In(zone)
+		}
+	}
+	return EventTime(event).In(z.Of(event.GetSource()))
+}
+
+// Time zones loaded, by name
+var zones = struct {
+	sync.RWMutex
+	byName map[string]*time.Location
+}{byName: make(map[string]*time.Location)}
+
+// Loads the IANA time zone by name, once.  The empty name is UTC.
+func LoadZone(name string) (*time.Location, error) {
+	zones.RLock()
+	zone, exists := zones.byName[name]
+	zones.RUnlock()
+	if exists {
+		return zone, nil
+	}
+	zone, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	zones.Lock()
+	zones.byName[name] = zone
+	zones.Unlock()
+	return zone, nil
+}
+
+// Returns the time of the event from its nanoseconds if set, or else its timestamp in seconds.
+func EventTime(event *Tally.Event) time.Time {
+	if event.TimeNanos != nil {
+		return time.Unix(0, event.GetTimeNanos())
+	}
+	seconds, fraction := math.Modf(event.GetTimestamp())
+	return time.Unix(int64(seconds), int64(fraction*1e9))
+}
+
+// Returns the end of the event: its time plus its duration, or its time if an instant.
+func EventEnd(event *Tally.Event) time.Time {
+	return EventTime(event).Add(time.Duration(event.GetDurationNanos()))
+}
+
+// Sets the time of the event, both in nanoseconds and in seconds for older readers.
+func SetEventTime(event *Tally.Event, t time.Time) {
+	event.TimeNanos = proto.Int64(t.UnixNano())
+	event.Timestamp = proto.Float64(float64(t.UnixNano()) / 1e9)
+}